@@ -0,0 +1,343 @@
+package clock
+
+// A Chan is a channel owned by a clock. Goroutines registered with a Virtual
+// clock (see Clock.Go) may only block in the clock's Sleep, or on its Chans,
+// which is how the clock knows which of them are blocked and which are
+// runnable. Each operation behaves like the same operation on a Go channel
+// with the same capacity, except that Select always picks the first case
+// which can proceed, rather than a random one.
+//
+// Chan should be instantiated using NewChan.
+type Chan[T any] struct {
+	s      scheduler
+	size   int
+	buf    []T
+	closed bool
+
+	// Goroutines blocked on the channel, in the order they blocked
+	recvq []*recvWaiter[T]
+	sendq []*sendWaiter[T]
+}
+
+// NewChan creates a Chan owned by clk, which buffers up to size values.
+func NewChan[T any](clk Clock, size int) *Chan[T] {
+	return &Chan[T]{
+		s:    clk.scheduler(),
+		size: size,
+	}
+}
+
+// Send sends v on c, blocking until there is room in the buffer or a receiver.
+func (c *Chan[T]) Send(v T) {
+	Select(c.SendCase(v))
+}
+
+// TrySend sends v on c if it can do so without blocking, and reports whether
+// it did.
+func (c *Chan[T]) TrySend(v T) bool {
+	return TrySelect(c.SendCase(v)) == 0
+}
+
+// Recv receives a value from c, blocking until one is available. Once c is
+// closed and empty, it returns the zero value.
+func (c *Chan[T]) Recv() T {
+	v, _ := c.RecvOk()
+	return v
+}
+
+// RecvOk receives a value from c, like Recv, and reports whether it was sent
+// rather than the zero value of a closed channel.
+func (c *Chan[T]) RecvOk() (T, bool) {
+	var v T
+	var ok bool
+	Select(c.RecvCase(&v, &ok))
+	return v, ok
+}
+
+// TryRecv receives a value from c if it can do so without blocking, and
+// reports whether it did.
+func (c *Chan[T]) TryRecv() (T, bool) {
+	var v T
+	var ok bool
+	TrySelect(c.RecvCase(&v, &ok))
+	return v, ok
+}
+
+// Len returns the number of values buffered in c.
+func (c *Chan[T]) Len() int {
+	c.s.acquire()
+	defer c.s.release()
+
+	return len(c.buf)
+}
+
+// Close closes c. Receivers get the values still buffered, and then the zero
+// value, and sending on c panics.
+func (c *Chan[T]) Close() {
+	c.s.acquire()
+	defer c.s.release()
+
+	if c.closed {
+		panic("clock: close of closed Chan")
+	}
+	c.closed = true
+
+	for _, r := range c.recvq {
+		if r.w.index < 0 {
+			var zero T
+			if r.dst != nil {
+				*r.dst = zero
+			}
+			if r.ok != nil {
+				*r.ok = false
+			}
+			r.w.complete(c.s, r.index)
+		}
+	}
+	for _, s := range c.sendq {
+		if s.w.index < 0 {
+			s.w.closed = true
+			s.w.complete(c.s, s.index)
+		}
+	}
+}
+
+// SendCase returns a Case which sends v on c.
+func (c *Chan[T]) SendCase(v T) Case {
+	return &sendCase[T]{c: c, v: v}
+}
+
+// RecvCase returns a Case which receives a value from c into *dst, and
+// reports whether it was sent in *ok. Either pointer may be nil.
+func (c *Chan[T]) RecvCase(dst *T, ok *bool) Case {
+	return &recvCase[T]{c: c, dst: dst, ok: ok}
+}
+
+// A Case is a single operation of a Select.
+type Case interface {
+	scheduler() scheduler
+	// ready reports whether the operation can proceed without blocking.
+	ready() bool
+	// do performs the operation, which must be ready.
+	do()
+	// enqueue queues w as waiting for the operation, as case i.
+	enqueue(w *waiter, i int)
+	// dequeue removes w from the queue.
+	dequeue(w *waiter)
+}
+
+// Select blocks until one of cases can proceed, performs it, and returns its
+// index. If several can proceed, it performs the first. Every case must use
+// Chans owned by the same clock.
+func Select(cases ...Case) int {
+	s := cases[0].scheduler()
+	s.acquire()
+
+	for i, c := range cases {
+		if c.ready() {
+			c.do()
+			s.release()
+			return i
+		}
+	}
+
+	w := newWaiter()
+	for i, c := range cases {
+		c.enqueue(w, i)
+	}
+
+	s.park(w)
+
+	s.acquire()
+	for _, c := range cases {
+		c.dequeue(w)
+	}
+	s.release()
+
+	if w.closed {
+		panic("clock: send on closed Chan")
+	}
+
+	return w.index
+}
+
+// TrySelect performs the first of cases which can proceed without blocking and
+// returns its index, or returns -1 if none can.
+func TrySelect(cases ...Case) int {
+	s := cases[0].scheduler()
+	s.acquire()
+	defer s.release()
+
+	for i, c := range cases {
+		if c.ready() {
+			c.do()
+			return i
+		}
+	}
+
+	return -1
+}
+
+// A waiter is a goroutine blocked in a Select.
+type waiter struct {
+	wake chan bool
+	// The case which completed, or -1 while blocked
+	index int
+	// Whether the Chan it was sending on was closed instead
+	closed bool
+}
+
+func newWaiter() *waiter {
+	return &waiter{
+		wake:  make(chan bool, 1),
+		index: -1,
+	}
+}
+
+// complete records that case i of w's Select has been performed, and makes w
+// runnable. The scheduler's lock must be held.
+func (w *waiter) complete(s scheduler, i int) {
+	w.index = i
+	s.ready(w)
+}
+
+type recvWaiter[T any] struct {
+	w     *waiter
+	index int
+	dst   *T
+	ok    *bool
+}
+
+type sendWaiter[T any] struct {
+	w     *waiter
+	index int
+	v     T
+}
+
+// sender returns the first goroutine blocked sending on c, if any, skipping
+// those whose Select has already completed.
+func (c *Chan[T]) sender() *sendWaiter[T] {
+	for _, s := range c.sendq {
+		if s.w.index < 0 {
+			return s
+		}
+	}
+	return nil
+}
+
+// receiver returns the first goroutine blocked receiving from c, if any,
+// skipping those whose Select has already completed.
+func (c *Chan[T]) receiver() *recvWaiter[T] {
+	for _, r := range c.recvq {
+		if r.w.index < 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+type sendCase[T any] struct {
+	c *Chan[T]
+	v T
+}
+
+func (sc *sendCase[T]) scheduler() scheduler {
+	return sc.c.s
+}
+
+func (sc *sendCase[T]) ready() bool {
+	c := sc.c
+	return c.closed || len(c.buf) < c.size || c.receiver() != nil
+}
+
+func (sc *sendCase[T]) do() {
+	c := sc.c
+	if c.closed {
+		panic("clock: send on closed Chan")
+	}
+
+	if r := c.receiver(); r != nil {
+		if r.dst != nil {
+			*r.dst = sc.v
+		}
+		if r.ok != nil {
+			*r.ok = true
+		}
+		r.w.complete(c.s, r.index)
+		return
+	}
+
+	c.buf = append(c.buf, sc.v)
+}
+
+func (sc *sendCase[T]) enqueue(w *waiter, i int) {
+	sc.c.sendq = append(sc.c.sendq, &sendWaiter[T]{w: w, index: i, v: sc.v})
+}
+
+func (sc *sendCase[T]) dequeue(w *waiter) {
+	c := sc.c
+	for i, s := range c.sendq {
+		if s.w == w {
+			c.sendq = append(c.sendq[:i], c.sendq[i+1:]...)
+			return
+		}
+	}
+}
+
+type recvCase[T any] struct {
+	c   *Chan[T]
+	dst *T
+	ok  *bool
+}
+
+func (rc *recvCase[T]) scheduler() scheduler {
+	return rc.c.s
+}
+
+func (rc *recvCase[T]) ready() bool {
+	c := rc.c
+	return len(c.buf) > 0 || c.closed || c.sender() != nil
+}
+
+func (rc *recvCase[T]) do() {
+	c := rc.c
+
+	var v T
+	ok := true
+	if len(c.buf) > 0 {
+		v = c.buf[0]
+		c.buf = c.buf[1:]
+
+		// Make room for the first blocked sender
+		if s := c.sender(); s != nil {
+			c.buf = append(c.buf, s.v)
+			s.w.complete(c.s, s.index)
+		}
+	} else if s := c.sender(); s != nil {
+		v = s.v
+		s.w.complete(c.s, s.index)
+	} else {
+		ok = false
+	}
+
+	if rc.dst != nil {
+		*rc.dst = v
+	}
+	if rc.ok != nil {
+		*rc.ok = ok
+	}
+}
+
+func (rc *recvCase[T]) enqueue(w *waiter, i int) {
+	rc.c.recvq = append(rc.c.recvq, &recvWaiter[T]{w: w, index: i, dst: rc.dst, ok: rc.ok})
+}
+
+func (rc *recvCase[T]) dequeue(w *waiter) {
+	c := rc.c
+	for i, r := range c.recvq {
+		if r.w == w {
+			c.recvq = append(c.recvq[:i], c.recvq[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChan(t *testing.T) {
+	c := NewReal()
+
+	buffered := NewChan[int](c, 2)
+	if !buffered.TrySend(1) || !buffered.TrySend(2) || buffered.TrySend(3) {
+		t.Error("A Chan should buffer exactly as many values as its size.")
+	}
+	if buffered.Len() != 2 {
+		t.Error("Incorrect length.", buffered.Len())
+	}
+
+	unbuffered := NewChan[int](c, 0)
+	if unbuffered.TrySend(1) {
+		t.Error("An unbuffered Chan should not accept a value without a receiver.")
+	}
+
+	// Select picks the first case which can proceed
+	var v int
+	if i := Select(unbuffered.RecvCase(&v, nil), buffered.RecvCase(&v, nil)); i != 1 || v != 1 {
+		t.Error("Select picked the wrong case.", i, v)
+	}
+
+	received := NewChan[int](c, 0)
+	go func() {
+		received.Send(unbuffered.Recv())
+	}()
+	unbuffered.Send(3)
+	if v := received.Recv(); v != 3 {
+		t.Error("Value not passed to a blocked receiver.", v)
+	}
+
+	// A blocked sender's value is buffered once there is room
+	buffered.TrySend(4)
+	go buffered.Send(5)
+	time.Sleep(10 * time.Millisecond)
+	for _, expected := range []int{2, 4, 5} {
+		if v := buffered.Recv(); v != expected {
+			t.Error("Values received out of order.", v, expected)
+		}
+	}
+
+	buffered.TrySend(6)
+	buffered.Close()
+	if v, ok := buffered.RecvOk(); v != 6 || !ok {
+		t.Error("Buffered values should be received after a Chan is closed.", v, ok)
+	}
+	if v, ok := buffered.RecvOk(); v != 0 || ok {
+		t.Error("A closed Chan should receive the zero value.", v, ok)
+	}
+}
@@ -0,0 +1,114 @@
+// Package clock provides the source of time used throughout the simulation.
+// Every delay in the system (network latency, timeouts, heartbeats and
+// simulated disk latency) must go through a Clock, so that a simulation can be
+// run either against the wall clock or against a virtual clock.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock measures and waits for time. There are two implementations: Real,
+// which uses the wall clock, and Virtual, a discrete-event clock which skips
+// straight to the next scheduled wakeup whenever the system is idle.
+//
+// Goroutines which wait for each other, or for the clock, must be started with
+// Go, and must only block in Sleep or on Chans owned by the clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// Sleep blocks the calling goroutine for at least d.
+	Sleep(d time.Duration)
+	// After returns a channel which receives the current time once d has
+	// elapsed.
+	After(d time.Duration) *Chan[time.Time]
+	// Go starts f in a new goroutine registered with the clock.
+	Go(f func())
+
+	scheduler() scheduler
+}
+
+// A scheduler blocks and wakes goroutines for the Chans of a clock.
+type scheduler interface {
+	// acquire and release the lock which guards every Chan owned by the
+	// clock.
+	acquire()
+	release()
+	// park releases the lock, and blocks until w has been made ready.
+	park(w *waiter)
+	// ready makes the goroutine blocked on w runnable. The lock must be
+	// held.
+	ready(w *waiter)
+}
+
+// Run runs f in a goroutine registered with clk, and waits for it to return.
+// It lets goroutines which are not registered with clk, such as HTTP handlers,
+// use Chans owned by it.
+func Run(clk Clock, f func()) {
+	done := make(chan bool)
+	clk.Go(func() {
+		f()
+		close(done)
+	})
+	<-done
+}
+
+// realClock is a Clock backed by the time package.
+type realClock struct{}
+
+// Every Chan owned by a real clock is guarded by the same lock, so that any
+// of them may be used together in a Select.
+var realLock sync.Mutex
+
+// NewReal creates a Clock which uses the wall clock.
+func NewReal() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (r realClock) After(d time.Duration) *Chan[time.Time] {
+	c := NewChan[time.Time](r, 1)
+	time.AfterFunc(d, func() {
+		c.TrySend(time.Now())
+	})
+	return c
+}
+
+func (realClock) Go(f func()) {
+	go f()
+}
+
+func (r realClock) scheduler() scheduler {
+	return r
+}
+
+func (realClock) acquire() {
+	realLock.Lock()
+}
+
+func (realClock) release() {
+	realLock.Unlock()
+}
+
+func (realClock) park(w *waiter) {
+	realLock.Unlock()
+	<-w.wake
+}
+
+func (realClock) ready(w *waiter) {
+	w.wake <- true
+}
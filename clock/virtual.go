@@ -0,0 +1,210 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// A Virtual is a discrete-event Clock. It runs the goroutines registered with
+// it one at a time: a goroutine runs until it blocks in Sleep or on a Chan
+// owned by the clock (or returns), and then the first runnable goroutine, in
+// the order they became runnable, runs next. Only once every registered
+// goroutine is blocked does time move forward: the clock jumps to the earliest
+// pending wakeup and releases exactly that one sleeper. Wakeups scheduled for
+// the same instant are released in the order they were scheduled.
+//
+// The goroutine which creates the clock is registered with it, along with
+// every goroutine started by Go. Registered goroutines must not block on
+// anything else (an ordinary channel, a lock held by another registered
+// goroutine, or the network), since nothing else can run until they do.
+//
+// Because goroutines run in a deterministic order, whatever GOMAXPROCS is, and
+// each wakeup runs to completion before the next is released, a simulation
+// driven by a Virtual clock and pseudorandom sources with fixed seeds replays
+// the same schedule on every run, and runs as fast as the CPU can process
+// events rather than in real time.
+//
+// Virtual should be instantiated using NewVirtual.
+type Virtual struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerQueue
+
+	// Registered goroutines which are runnable, in the order they became
+	// runnable, and whether one of them is running
+	runnable []*waiter
+	running  bool
+
+	stopped bool
+}
+
+// NewVirtual creates a Virtual clock starting at the Unix epoch, and registers
+// the calling goroutine with it.
+func NewVirtual() *Virtual {
+	return &Virtual{
+		now:     time.Unix(0, 0),
+		running: true,
+	}
+}
+
+// Now returns the current virtual time.
+func (v *Virtual) Now() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.now
+}
+
+// Since returns the virtual time elapsed since t.
+func (v *Virtual) Since(t time.Time) time.Duration {
+	return v.Now().Sub(t)
+}
+
+// Sleep blocks the calling goroutine until the virtual clock has advanced by d.
+func (v *Virtual) Sleep(d time.Duration) {
+	v.After(d).Recv()
+}
+
+// After returns a channel which receives the virtual time once the clock has
+// advanced by d. Non-positive durations are scheduled for the current instant,
+// behind any other wakeups already scheduled for that instant, so they fire
+// once every registered goroutine is blocked.
+func (v *Virtual) After(d time.Duration) *Chan[time.Time] {
+	if d < 0 {
+		d = 0
+	}
+
+	c := NewChan[time.Time](v, 1)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.seq++
+	heap.Push(&v.timers, &timer{
+		when: v.now.Add(d),
+		seq:  v.seq,
+		c:    c,
+	})
+
+	return c
+}
+
+// Go starts f in a new goroutine registered with the clock. It runs once every
+// goroutine which became runnable before it has blocked.
+func (v *Virtual) Go(f func()) {
+	w := newWaiter()
+
+	go func() {
+		<-w.wake
+		f()
+
+		v.lock.Lock()
+		v.dispatch()
+		v.lock.Unlock()
+	}()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.runnable = append(v.runnable, w)
+	if !v.running {
+		// Started by a goroutine which is not registered, while every
+		// registered goroutine is blocked
+		v.dispatch()
+	}
+}
+
+// Stop stops the clock, so that every goroutine sleeping on it (such as the
+// nodes of a finished simulation) blocks forever, rather than using the CPU
+// as time races ahead.
+func (v *Virtual) Stop() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.stopped = true
+}
+
+func (v *Virtual) scheduler() scheduler {
+	return v
+}
+
+func (v *Virtual) acquire() {
+	v.lock.Lock()
+}
+
+func (v *Virtual) release() {
+	v.lock.Unlock()
+}
+
+func (v *Virtual) park(w *waiter) {
+	v.dispatch()
+	v.lock.Unlock()
+	<-w.wake
+}
+
+func (v *Virtual) ready(w *waiter) {
+	v.runnable = append(v.runnable, w)
+}
+
+// dispatch is called, with the lock held, by the running goroutine as it
+// blocks or returns. It wakes the next runnable goroutine, firing the earliest
+// pending wakeups until one is runnable. If none is left (or the clock has
+// been stopped), nothing is running until a goroutine is started.
+func (v *Virtual) dispatch() {
+	for len(v.runnable) == 0 {
+		if v.stopped || v.timers.Len() == 0 {
+			v.running = false
+			return
+		}
+
+		t := heap.Pop(&v.timers).(*timer)
+		if t.when.After(v.now) {
+			v.now = t.when
+		}
+		t.c.SendCase(v.now).do()
+	}
+
+	w := v.runnable[0]
+	v.runnable = v.runnable[1:]
+	v.running = true
+	w.wake <- true
+}
+
+// A timer is a single pending wakeup.
+type timer struct {
+	when time.Time
+	seq  uint64
+	c    *Chan[time.Time]
+}
+
+// timerQueue is a min-heap of timers ordered by (when, seq). It implements
+// heap.Interface.
+type timerQueue []*timer
+
+func (q timerQueue) Len() int {
+	return len(q)
+}
+
+func (q timerQueue) Less(i, j int) bool {
+	if q[i].when.Equal(q[j].when) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].when.Before(q[j].when)
+}
+
+func (q timerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *timerQueue) Push(x interface{}) {
+	*q = append(*q, x.(*timer))
+}
+
+func (q *timerQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
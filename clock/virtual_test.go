@@ -0,0 +1,138 @@
+package clock
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	c := NewVirtual()
+	defer c.Stop()
+
+	start := c.Now()
+	realStart := time.Now()
+
+	results := NewChan[int](c, 3)
+
+	for i, d := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		id, delay := i, c.After(d)
+		c.Go(func() {
+			delay.Recv()
+			results.Send(id)
+		})
+	}
+
+	for _, expected := range []int{1, 2, 0} {
+		if id := results.Recv(); id != expected {
+			t.Error("Sleepers woken in the wrong order.", id, expected)
+		}
+	}
+
+	if elapsed := c.Since(start); elapsed != 3*time.Hour {
+		t.Error("Virtual clock advanced by the wrong amount.", elapsed)
+	}
+
+	if time.Since(realStart) > time.Minute {
+		t.Error("Virtual clock should not wait in real time.")
+	}
+
+	order := NewChan[int](c, 10)
+	for i := 0; i < 10; i++ {
+		id, delay := i, c.After(time.Second)
+		c.Go(func() {
+			delay.Recv()
+			order.Send(id)
+		})
+	}
+
+	for i := 0; i < 10; i++ {
+		if id := order.Recv(); id != i {
+			t.Error("Simultaneous wakeups should be released in the order they were scheduled.", id, i)
+		}
+	}
+}
+
+func TestVirtualClockWaitsForWork(t *testing.T) {
+	c := NewVirtual()
+	defer c.Stop()
+
+	start := c.Now()
+	later := c.After(2 * time.Millisecond)
+
+	done := NewChan[time.Time](c, 0)
+	c.Go(func() {
+		c.Sleep(time.Millisecond)
+
+		// Busy in real time, without using the clock
+		for realStart := time.Now(); time.Since(realStart) < 20*time.Millisecond; {
+		}
+
+		done.Send(c.Now())
+	})
+
+	if now := done.Recv(); now.Sub(start) != time.Millisecond {
+		t.Error("Virtual clock should not advance while a goroutine is busy.", now.Sub(start))
+	}
+	later.Recv()
+}
+
+// Registered goroutines run in the same order on every run, however many
+// threads run goroutines.
+func TestVirtualClockDeterministic(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	run := func() []int {
+		c := NewVirtual()
+		defer c.Stop()
+
+		results := NewChan[int](c, 0)
+		for i := 0; i < 10; i++ {
+			id := i
+			c.Go(func() {
+				for j := 0; j < 10; j++ {
+					results.Send(id)
+				}
+			})
+		}
+
+		var order []int
+		for i := 0; i < 100; i++ {
+			order = append(order, results.Recv())
+		}
+		return order
+	}
+
+	expected := run()
+	for i := 0; i < 10; i++ {
+		order := run()
+		for j := range order {
+			if order[j] != expected[j] {
+				t.Fatal("Goroutines ran in a different order.", order, expected)
+			}
+		}
+	}
+}
+
+// A goroutine which is not registered with the clock can use its Chans
+// through Run.
+func TestRun(t *testing.T) {
+	c := NewVirtual()
+	defer c.Stop()
+
+	requests := NewChan[int](c, 0)
+	c.Go(func() {
+		c.Sleep(time.Second)
+		requests.Recv()
+	})
+
+	results := NewChan[time.Time](c, 1)
+	go Run(c, func() {
+		requests.Send(1)
+		results.Send(c.Now())
+	})
+
+	if now := results.Recv(); !now.Equal(time.Unix(1, 0)) {
+		t.Error("Goroutine run from outside the clock did not block on it.", now)
+	}
+}
@@ -0,0 +1,129 @@
+// Command dbnode runs a single database node as a standalone process,
+// communicating with its peers over TCP rather than through the simulated
+// network.
+//
+// Example (a 3 node cluster on localhost):
+//
+//	dbnode -id 0 -peers localhost:7000,localhost:7001,localhost:7002 &
+//	dbnode -id 1 -peers localhost:7000,localhost:7001,localhost:7002 &
+//	dbnode -id 2 -peers localhost:7000,localhost:7001,localhost:7002 &
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/datastore"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/hashring"
+	"github.com/alexbostock/part-ii-project/net/transport"
+)
+
+func main() {
+	id := flag.Int("id", 0, "id of this node, an index into -peers")
+	peers := flag.String("peers", "localhost:7000", "comma separated TCP addresses of every node, ordered by id")
+	rqs := flag.Uint("vr", 1, "read quorum size")
+	wqs := flag.Uint("vw", 1, "write quorum size, must satisfy vw > n/2")
+	timeout := flag.Duration("timeout", 500*time.Millisecond, "time to wait before aborting a transaction")
+	var store datastore.Kind
+	flag.Var(&store, "persistent", "use a persistent data store on disk rather than an in-memory store (-persistent or -persistent=paged for a hash map, -persistent=log for a log-structured store)")
+	sloppy := flag.Bool("sloppy", false, "add background writes to provide eventually consistency in a sloppy quorum system, and let writes substitute unresponsive replicas, which are handed the writes they missed once they recover")
+	antiEntropy := flag.Duration("antientropy", 0, "mean interval between anti-entropy rounds, in which this node compares Merkle trees of its store with a random peer and repairs differing keys (0 to disable)")
+	var readRepair dbnode.ReadRepair
+	flag.Var(&readRepair, "readrepair", "whether a read repairs replicas in its quorum which returned older values (none, async or sync)")
+	replicas := flag.Uint("replicas", 0, "number of nodes storing each key, chosen by a consistent hash ring, to which vr and vw are relative (0 for every node; use the same value on every node)")
+	vnodes := flag.Uint("vnodes", 64, "number of points (virtual nodes) of each node on the consistent hash ring, with -replicas")
+	memberList := flag.String("members", "", "comma separated ids of the initial members of the cluster, to which vr and vw are relative (empty for every node; use the same value on every node); other nodes are spares, which may join later")
+	logWrites := flag.Bool("logwrites", false, "log every write commit and background write with microsecond timestamps")
+	var electorKind elector.Kind
+	flag.Var(&electorKind, "elector", "leader election algorithm (ring, bully, dummy or raft)")
+	var eventFormat eventlog.Format
+	flag.Var(&eventFormat, "eventformat", "format of the event log on stdout (text or json)")
+
+	flag.Parse()
+
+	log.SetFlags(log.Lmicroseconds)
+	log.SetOutput(os.Stdout)
+
+	addrs := strings.Split(*peers, ",")
+	numNodes := uint(len(addrs))
+
+	if *id < 0 || *id >= len(addrs) {
+		log.Fatal("Node id must be an index into the list of peers.")
+	}
+
+	var members []int
+	if *memberList != "" {
+		for _, s := range strings.Split(*memberList, ",") {
+			m, err := strconv.Atoi(s)
+			if err != nil || m < 0 || m >= len(addrs) {
+				log.Fatal("Members must be indices into the list of peers.")
+			}
+			members = append(members, m)
+		}
+		numNodes = uint(len(members))
+	}
+
+	ring := hashring.New(len(addrs), int(*replicas), int(*vnodes))
+	numReplicas := uint(ring.Factor(int(numNodes)))
+
+	if members != nil && ring != nil {
+		log.Fatal("A cluster partitioned by a ring cannot have spare nodes.")
+	}
+
+	if *rqs > numReplicas {
+		log.Fatal("Read quorum size must not be greater than the number of replicas.")
+	}
+	if *wqs > numReplicas {
+		log.Fatal("Write quorum size must not be greater than the number of replicas.")
+	}
+	if *wqs <= numReplicas/2 {
+		log.Fatal("Write quorum size must greater than half the number of replicas.")
+	}
+	if !*sloppy && *rqs+*wqs <= numReplicas {
+		log.Fatal("Strict quorum requires V_R + V_W > R.")
+	}
+
+	clk := clock.NewReal()
+	events := eventlog.New(eventlog.NewSink(eventFormat, os.Stdout), clk)
+
+	node := dbnode.New(len(addrs), *id, *timeout, *rqs, *wqs, dbnode.Options{
+		Store:        store,
+		Elector:      electorKind,
+		SloppyQuorum: *sloppy,
+		AntiEntropy:  *antiEntropy,
+		ReadRepair:   readRepair,
+		Ring:         ring,
+		Members:      members,
+		LogWrites:    *logWrites,
+		Events:       events,
+		Seed:         rand.Int63(),
+	}, clk)
+
+	endpoint, err := transport.Listen(*id, addrs, node.Incoming, node.Outgoing)
+	if err != nil {
+		log.Fatal("Failed to listen on ", addrs[*id], ": ", err)
+	}
+
+	log.Printf("Node %v listening on %v", *id, addrs[*id])
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+
+	endpoint.Close()
+
+	if err := events.Close(); err != nil {
+		log.Fatal("Failed to write events: ", err)
+	}
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"bytes"
+	"sort"
+)
+
+// An Iterator steps through the committed key, value pairs in a range of keys,
+// in ascending order of key (compared using bytes.Compare). Next must be
+// called before the first pair is available. For example:
+//
+//	it := store.Prefix(p)
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if it.Err() != nil { ... }
+type Iterator interface {
+	Next() bool    // Advances to the next pair, returning false when there are none left (or on error)
+	Key() []byte   // The key of the current pair
+	Value() []byte // The value of the current pair
+	Err() error    // Non-nil if the scan failed (in which case Next returns false)
+}
+
+// PrefixEnd returns the smallest key greater than every key which starts with
+// p, for use as the end of a Scan. It returns nil (ie. no upper bound) if there
+// is no such key, since p is empty or consists only of 0xff bytes.
+func PrefixEnd(p []byte) []byte {
+	end := make([]byte, len(p))
+	copy(end, p)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// inRange returns true iff start <= key < end. A nil end is unbounded.
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+// A sliceIterator is an Iterator over pairs which have already been read.
+type sliceIterator struct {
+	pairs []pair
+	i     int
+	err   error
+}
+
+// newSliceIterator sorts pairs by key and returns an Iterator over them.
+func newSliceIterator(pairs []pair) *sliceIterator {
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].key, pairs[j].key) < 0
+	})
+
+	return &sliceIterator{pairs: pairs, i: -1}
+}
+
+// errIterator returns an Iterator which fails immediately with err.
+func errIterator(err error) *sliceIterator {
+	return &sliceIterator{err: err}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.err != nil || it.i >= len(it.pairs)-1 {
+		return false
+	}
+
+	it.i++
+	return true
+}
+
+func (it *sliceIterator) Key() []byte {
+	return it.pairs[it.i].key
+}
+
+func (it *sliceIterator) Value() []byte {
+	return it.pairs[it.i].value
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,399 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A logstore is a persistent, log-structured data store. Every Put, Commit and
+// Rollback is appended to a single log file (using the same record format as
+// the write-ahead log in wal.go), and an in-memory index maps each key to the
+// position of its latest committed value in the log. Writes never rewrite
+// existing data, so a write costs one append (and one fsync per commit), and a
+// read costs one positioned read. Space used by overwritten values is
+// reclaimed by compacting the log once most of it is garbage.
+type logstore struct {
+	path string
+	txid int
+
+	log     *os.File
+	logSize int64
+
+	index   map[string]valuePosition // committed values
+	pending map[int]pendingPut       // uncommitted transactions
+
+	// Total length of every value in index, used to decide when to compact
+	liveBytes int64
+
+	// Non-nil if the store could not be opened or recovered, in which case
+	// every operation fails.
+	err error
+}
+
+// A valuePosition is the location of a value in the log.
+type valuePosition struct {
+	offset int64
+	length int
+}
+
+// A pendingPut is an uncommitted put or delete.
+type pendingPut struct {
+	key     []byte
+	value   valuePosition
+	deleted bool
+}
+
+const (
+	logName = "log"
+
+	// The log is compacted once it is larger than this and more than half
+	// of it is garbage
+	logCompactSize = 1 << 20
+)
+
+// newLogStore opens the store in directory path, creating it if necessary, and
+// rebuilds the index from the log.
+func newLogStore(path string) *logstore {
+	store := &logstore{
+		path:    path,
+		index:   make(map[string]valuePosition),
+		pending: make(map[int]pendingPut),
+	}
+
+	os.MkdirAll(path, 0755)
+
+	store.err = store.recover()
+
+	return store
+}
+
+// Get retrieves the latest committed value for key, or nil (and a nil error)
+// if there is no such value.
+func (store *logstore) Get(key []byte) ([]byte, error) {
+	if store.err != nil {
+		return nil, store.err
+	}
+
+	pos, ok := store.index[string(key)]
+	if !ok {
+		return nil, nil
+	}
+
+	val := make([]byte, pos.length)
+	if _, err := store.log.ReadAt(val, pos.offset); err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
+
+// Put appends an uncommitted write to the log, and returns a unique non-zero
+// transaction ID, or 0 in case of error. The write is not made durable until
+// it is committed, since recovery discards uncommitted writes anyway.
+func (store *logstore) Put(key, val []byte) int {
+	if store.err != nil {
+		return 0
+	}
+
+	store.txid++
+	if store.txid == 0 {
+		store.txid++
+	}
+
+	pos, err := store.appendRecord(walRecord{walPut, store.txid, key, val})
+	if err != nil {
+		return 0
+	}
+
+	store.pending[store.txid] = pendingPut{key, pos, false}
+
+	return store.txid
+}
+
+// Delete appends an uncommitted delete of key to the log, in the same way as
+// Put.
+func (store *logstore) Delete(key []byte) int {
+	if store.err != nil {
+		return 0
+	}
+
+	store.txid++
+	if store.txid == 0 {
+		store.txid++
+	}
+
+	if _, err := store.appendRecord(walRecord{walDelete, store.txid, key, nil}); err != nil {
+		return 0
+	}
+
+	store.pending[store.txid] = pendingPut{key, valuePosition{}, true}
+
+	return store.txid
+}
+
+// Commit durably appends a commit record to the log, then makes the value
+// written (or deletion) by transaction id visible. The given key must match
+// the id.
+func (store *logstore) Commit(key []byte, id int) bool {
+	if store.err != nil {
+		return false
+	}
+
+	tx, ok := store.pending[id]
+	if !ok || !bytes.Equal(tx.key, key) {
+		return false
+	}
+
+	if _, err := store.appendRecord(walRecord{walCommit, id, nil, nil}); err != nil {
+		return false
+	}
+	if err := store.log.Sync(); err != nil {
+		return false
+	}
+
+	delete(store.pending, id)
+	store.apply(tx)
+
+	if store.logSize > logCompactSize && store.logSize > 2*store.liveBytes {
+		if err := store.compact(); err != nil {
+			store.err = err
+		}
+	}
+
+	return true
+}
+
+// DeleteStore removes all data associated with this store from the file system
+// (deleting the directory this store uses).
+func (store *logstore) DeleteStore() {
+	if store.log != nil {
+		store.log.Close()
+	}
+	os.RemoveAll(store.path)
+}
+
+// Rollback discards an uncommitted transaction. It requires a transaction ID
+// returned by Put which has not yet been committed or rolled back.
+func (store *logstore) Rollback(id int) {
+	if store.err != nil {
+		return
+	}
+
+	if _, ok := store.pending[id]; !ok {
+		return
+	}
+
+	delete(store.pending, id)
+
+	store.appendRecord(walRecord{walAbort, id, nil, nil})
+}
+
+// Len returns the number of committed keys.
+func (store *logstore) Len() int {
+	return len(store.index)
+}
+
+// recover rebuilds the index from the log, applying every committed
+// transaction in order. A torn record at the end of the log (from a crash
+// while appending) is truncated, along with everything after it.
+func (store *logstore) recover() error {
+	path := filepath.Join(store.path, logName)
+
+	// A compaction which did not complete
+	os.Remove(path + tmpExt)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	uncommitted := make(map[int]pendingPut)
+
+	var offset int64
+	for offset < int64(len(data)) {
+		record, rest, ok := decodeRecord(data[offset:])
+		if !ok {
+			break
+		}
+
+		if record.txid > store.txid {
+			store.txid = record.txid
+		}
+
+		switch record.kind {
+		case walPut:
+			uncommitted[record.txid] = pendingPut{record.key, valueOffset(offset, record), false}
+		case walDelete:
+			uncommitted[record.txid] = pendingPut{record.key, valuePosition{}, true}
+		case walCommit:
+			if tx, ok := uncommitted[record.txid]; ok {
+				delete(uncommitted, record.txid)
+				store.apply(tx)
+			}
+		case walAbort:
+			delete(uncommitted, record.txid)
+		}
+
+		offset = int64(len(data)) - int64(len(rest))
+	}
+
+	log, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := log.Truncate(offset); err != nil {
+		log.Close()
+		return err
+	}
+	if _, err := log.Seek(offset, 0); err != nil {
+		log.Close()
+		return err
+	}
+
+	store.log = log
+	store.logSize = offset
+
+	return nil
+}
+
+// compact atomically replaces the log with one containing only the latest
+// committed value of every key, and every pending transaction.
+func (store *logstore) compact() error {
+	path := filepath.Join(store.path, logName)
+
+	var data []byte
+	index := make(map[string]valuePosition)
+	pending := make(map[int]pendingPut)
+
+	data = append(data, encodeRecord(walRecord{walCheckpoint, store.txid, nil, nil})...)
+
+	// Committed values are written as a put and a commit with txid 0,
+	// which is never used by a real transaction.
+	for key := range store.index {
+		val, err := store.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		r := walRecord{walPut, 0, []byte(key), val}
+		index[key] = valueOffset(int64(len(data)), r)
+		data = append(data, encodeRecord(r)...)
+		data = append(data, encodeRecord(walRecord{walCommit, 0, nil, nil})...)
+	}
+
+	for id, tx := range store.pending {
+		if tx.deleted {
+			pending[id] = tx
+			data = append(data, encodeRecord(walRecord{walDelete, id, tx.key, nil})...)
+			continue
+		}
+
+		val := make([]byte, tx.value.length)
+		if _, err := store.log.ReadAt(val, tx.value.offset); err != nil {
+			return err
+		}
+
+		r := walRecord{walPut, id, tx.key, val}
+		pending[id] = pendingPut{tx.key, valueOffset(int64(len(data)), r), false}
+		data = append(data, encodeRecord(r)...)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := log.Seek(0, 2); err != nil {
+		log.Close()
+		return err
+	}
+
+	store.log.Close()
+	store.log = log
+	store.logSize = int64(len(data))
+	store.index = index
+	store.pending = pending
+
+	return nil
+}
+
+// appendRecord appends a record to the log (without syncing), and returns the
+// position of the record's value.
+func (store *logstore) appendRecord(r walRecord) (valuePosition, error) {
+	encoded := encodeRecord(r)
+
+	if _, err := store.log.Write(encoded); err != nil {
+		// Remove any partial record, so that later records are readable
+		store.log.Truncate(store.logSize)
+		store.log.Seek(store.logSize, 0)
+		return valuePosition{}, err
+	}
+
+	pos := valueOffset(store.logSize, r)
+	store.logSize += int64(len(encoded))
+
+	return pos, nil
+}
+
+// apply updates the index for a newly committed put or delete.
+func (store *logstore) apply(tx pendingPut) {
+	if old, ok := store.index[string(tx.key)]; ok {
+		store.liveBytes -= int64(old.length)
+	}
+
+	if tx.deleted {
+		delete(store.index, string(tx.key))
+		return
+	}
+
+	store.index[string(tx.key)] = tx.value
+	store.liveBytes += int64(tx.value.length)
+}
+
+// valueOffset returns the position of the value of record r, given that the
+// record starts at offset in the log.
+func valueOffset(offset int64, r walRecord) valuePosition {
+	// record_length type txid key_length key val_length
+	return valuePosition{
+		offset: offset + 4 + 1 + 8 + 4 + int64(len(r.key)) + 4,
+		length: len(r.value),
+	}
+}
+
+// Scan returns an Iterator over every committed key k, start <= k < end. The
+// index is not ordered, so this checks every key, but only reads the values of
+// keys in the range.
+func (store *logstore) Scan(start, end []byte) Iterator {
+	if store.err != nil {
+		return errIterator(store.err)
+	}
+
+	var pairs []pair
+
+	for k, pos := range store.index {
+		key := []byte(k)
+		if !inRange(key, start, end) {
+			continue
+		}
+
+		val := make([]byte, pos.length)
+		if _, err := store.log.ReadAt(val, pos.offset); err != nil {
+			return errIterator(err)
+		}
+
+		pairs = append(pairs, pair{key, val})
+	}
+
+	return newSliceIterator(pairs)
+}
+
+// Prefix returns an Iterator over every committed key starting with p.
+func (store *logstore) Prefix(p []byte) Iterator {
+	return store.Scan(p, PrefixEnd(p))
+}
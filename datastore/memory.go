@@ -3,6 +3,8 @@ package datastore
 import (
 	"bytes"
 	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
 )
 
 // An in-memory datastore module
@@ -19,21 +21,23 @@ type memstore struct {
 	children    map[byte]*memstore
 	uncommitted map[int]pair
 	txid        int
+	keys        int // in the whole trie (only counted at the root)
 
 	seekTime    time.Duration
 	kbReadTime  time.Duration
 	kbWriteTime time.Duration
+
+	clock clock.Clock
 }
 
 // Get retrieves the requested value from the store. It has an err return value
 // to match the Store interface, but err is always nil.
 func (store *memstore) Get(key []byte) ([]byte, error) {
-	t := time.NewTimer(time.Duration(len(key)/1000)*store.kbReadTime + store.seekTime)
+	t := store.clock.After(time.Duration(len(key)/1000)*store.kbReadTime + store.seekTime)
 
 	if len(key) == 0 {
-		<-t.C
-		t = time.NewTimer(time.Duration(len(store.value)/1000) * store.kbReadTime)
-		<-t.C
+		t.Recv()
+		store.clock.After(time.Duration(len(store.value)/1000) * store.kbReadTime).Recv()
 
 		return store.value, nil
 	}
@@ -41,7 +45,7 @@ func (store *memstore) Get(key []byte) ([]byte, error) {
 		return store.children[key[0]].Get(key[1:])
 	}
 
-	<-t.C
+	t.Recv()
 
 	return nil, nil
 }
@@ -49,7 +53,7 @@ func (store *memstore) Get(key []byte) ([]byte, error) {
 // Put stores the requested value in the store and returns a unique, non-zero
 // transaction ID. This operation is always successful.
 func (store *memstore) Put(key, val []byte) int {
-	t := time.NewTimer(time.Duration(len(val)/1000)*store.kbWriteTime + store.seekTime)
+	t := store.clock.After(time.Duration(len(val)/1000)*store.kbWriteTime + store.seekTime)
 
 	store.txid++
 	if store.txid == 0 {
@@ -58,19 +62,44 @@ func (store *memstore) Put(key, val []byte) int {
 
 	store.uncommitted[store.txid] = pair{key, val}
 
-	<-t.C
+	t.Recv()
+
+	return store.txid
+}
+
+// Delete records an uncommitted deletion of a key, and returns a unique,
+// non-zero transaction ID. This operation is always successful.
+func (store *memstore) Delete(key []byte) int {
+	t := store.clock.After(store.seekTime)
+
+	store.txid++
+	if store.txid == 0 {
+		store.txid++
+	}
+
+	// A nil value marks a delete
+	store.uncommitted[store.txid] = pair{key, nil}
+
+	t.Recv()
 
 	return store.txid
 }
 
 // Commit commits a transaction given a key and transaction ID. The ID must be
-// the value returned by a previous call to Put.
+// the value returned by a previous call to Put or Delete.
 func (store *memstore) Commit(key []byte, id int) bool {
-	if !bytes.Equal(store.uncommitted[id].key, key) {
+	tx, ok := store.uncommitted[id]
+	if !ok || !bytes.Equal(tx.key, key) {
 		return false
 	}
 
-	store.insert(key, store.uncommitted[id].value)
+	if tx.value == nil {
+		if store.remove(key) {
+			store.keys--
+		}
+	} else if store.insert(key, tx.value) {
+		store.keys++
+	}
 	delete(store.uncommitted, id)
 	return true
 }
@@ -88,13 +117,102 @@ func (store *memstore) Rollback(id int) {
 	delete(store.uncommitted, id)
 }
 
-func (store *memstore) insert(key, value []byte) {
+// Len returns the number of committed keys.
+func (store *memstore) Len() int {
+	return store.keys
+}
+
+// remove deletes the value of key, and any nodes left without descendants. It
+// returns whether key had a value.
+func (store *memstore) remove(key []byte) bool {
 	if len(key) == 0 {
+		removed := store.value != nil
+		store.value = nil
+		return removed
+	}
+
+	child := store.children[key[0]]
+	if child == nil {
+		return false
+	}
+
+	removed := child.remove(key[1:])
+
+	if child.value == nil && len(child.children) == 0 {
+		delete(store.children, key[0])
+	}
+
+	return removed
+}
+
+// insert sets the value of key, and returns whether key is new.
+func (store *memstore) insert(key, value []byte) bool {
+	if len(key) == 0 {
+		added := store.value == nil
 		store.value = value
-	} else {
-		if store.children[key[0]] == nil {
-			store.children[key[0]] = &memstore{children: make(map[byte]*memstore)}
+		return added
+	}
+
+	if store.children[key[0]] == nil {
+		store.children[key[0]] = &memstore{
+			children: make(map[byte]*memstore),
+			clock:    store.clock,
+		}
+	}
+	return store.children[key[0]].insert(key[1:], value)
+}
+
+// Scan returns an Iterator over every committed key k, start <= k < end, by
+// traversing the trie in order. It simulates the latency of reading every
+// value in the range.
+func (store *memstore) Scan(start, end []byte) Iterator {
+	var pairs []pair
+	store.collect(nil, start, end, &pairs)
+
+	var size int
+	for _, p := range pairs {
+		size += len(p.key) + len(p.value)
+	}
+	store.clock.After(time.Duration(size/1000)*store.kbReadTime + store.seekTime).Recv()
+
+	// Pairs are collected in order, so need not be sorted
+	return &sliceIterator{pairs: pairs, i: -1}
+}
+
+// Prefix returns an Iterator over every committed key starting with p.
+func (store *memstore) Prefix(p []byte) Iterator {
+	return store.Scan(p, PrefixEnd(p))
+}
+
+// collect appends every pair in the subtree rooted at store (which holds keys
+// starting with prefix) in the range [start, end) to pairs, in order of key.
+func (store *memstore) collect(prefix, start, end []byte, pairs *[]pair) {
+	// Every key in this subtree is at least prefix, so the subtree can be
+	// skipped once prefix reaches end.
+	if end != nil && bytes.Compare(prefix, end) >= 0 {
+		return
+	}
+
+	if store.value != nil && inRange(prefix, start, end) {
+		key := make([]byte, len(prefix))
+		copy(key, prefix)
+		*pairs = append(*pairs, pair{key, store.value})
+	}
+
+	for b := 0; b < 256; b++ {
+		child := store.children[byte(b)]
+		if child == nil {
+			continue
+		}
+
+		childPrefix := append(prefix, byte(b))
+
+		// Skip subtrees which end before start: every key in the subtree
+		// starts with childPrefix.
+		if bytes.Compare(childPrefix, start) < 0 && !bytes.HasPrefix(start, childPrefix) {
+			continue
 		}
-		store.children[key[0]].insert(key[1:], value)
+
+		child.collect(childPrefix, start, end, pairs)
 	}
 }
@@ -9,36 +9,69 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
 )
 
 // A persistentstore is a persistent data store which stores data in binary
-// in a directory. It is essentially a persistent hash map.
+// in a directory. It is essentially a persistent hash map. Every Put, Commit
+// and Rollback is first recorded in a write-ahead log, so that the store can
+// recover from a crash at any point (see recover).
 type persistentstore struct {
 	path string
 	txid int
+
+	wal     *os.File
+	walSize int64
+	pending map[int]walRecord // uncommitted transactions (puts and deletes)
+	keys    int               // committed keys, counted on recovery and by writePage
+
+	// Non-nil if the store could not be opened or recovered, in which case
+	// every operation fails.
+	err error
 }
 
-// File format is (key_length key val_length val)*
+// Page file format is (key_length key val_length val)*
+
+// Files in the data directory:
+// wal: the write-ahead log
+// <md5 of key>: a page, containing every key with that hash
+// *.tmp: a page or log being written (deleted on recovery)
+
+const (
+	walName = "wal"
+	tmpExt  = ".tmp"
+
+	// The log is compacted once it grows beyond this size
+	walCompactSize = 1 << 20
+)
+
+// newPersistentStore opens the store in directory path, creating it if
+// necessary, and recovers from any previous crash.
+func newPersistentStore(path string) *persistentstore {
+	store := &persistentstore{
+		path:    path,
+		pending: make(map[int]walRecord),
+	}
+
+	os.MkdirAll(path, 0755)
+
+	store.err = store.recover()
+
+	return store
+}
 
 // Get attempts to retreive the value associated with a key. The key must not
 // contain any 0 (null) bytes. Get returns nil and an error on failure. It may
 // return nil with a nil error, indicating that the requested value is not
 // present in the store.
 func (store *persistentstore) Get(key []byte) ([]byte, error) {
-	sum := md5.Sum(key)
-	hash := hex.EncodeToString(sum[:])
-	path := filepath.Join(store.path, hash)
-
-	// If there is no file, we do not have a value for the requested key
-	// (this is not an error)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return nil, nil
+	if store.err != nil {
+		return nil, store.err
 	}
 
-	data, e := ioutil.ReadFile(path)
+	data, e := store.readPage(key)
 
-	// Any other io error is an error
+	// Any io error is an error
 	if e != nil {
 		return nil, errors.New("Failed to read from disk")
 	}
@@ -62,134 +95,416 @@ func (store *persistentstore) Get(key []byte) ([]byte, error) {
 }
 
 // Put attempts to store (but not commit) a key, value pair in the store. If
-// successful, it returns a unique non-zero transaction ID. In case of error,
-// it returns -1.
+// successful, it returns a unique non-zero transaction ID. The write is durable
+// once Put returns, but is not visible (and is discarded by recovery) until it
+// is committed. In case of error, it returns 0.
 func (store *persistentstore) Put(key, val []byte) int {
+	return store.begin(walPut, key, val)
+}
+
+// Delete attempts to delete (but not commit the deletion of) a key, in the
+// same way as Put.
+func (store *persistentstore) Delete(key []byte) int {
+	return store.begin(walDelete, key, nil)
+}
+
+// begin logs an uncommitted put or delete, and returns its transaction ID, or
+// 0 in case of error.
+func (store *persistentstore) begin(kind walRecordType, key, val []byte) int {
+	if store.err != nil {
+		return 0
+	}
+
 	store.txid++
 	if store.txid == 0 {
 		store.txid++
 	}
 
-	sum := md5.Sum(key)
-	hash := hex.EncodeToString(sum[:])
+	record := walRecord{kind, store.txid, key, val}
 
-	oldPage, e := ioutil.ReadFile(filepath.Join(store.path, hash))
-	if os.IsNotExist(e) {
-		return store.putNew(key, val)
-	} else if e != nil {
+	if store.appendRecord(record) != nil {
 		return 0
 	}
 
-	newPage, e := os.Create(filepath.Join(store.path, "tx"+strconv.Itoa(store.txid)))
-	if e != nil {
-		return 0
+	store.pending[store.txid] = record
+
+	return store.txid
+}
+
+// Commit commits an uncommitted transaction. It requires a transaction ID from
+// Put which has not yet been committed or rolled back. The given key must
+// match the id (from the call to Put). Once the commit is recorded in the log,
+// the transaction survives a crash, even if the page has not yet been updated.
+func (store *persistentstore) Commit(key []byte, id int) bool {
+	if store.err != nil {
+		return false
+	}
+
+	tx, ok := store.pending[id]
+	if !ok || !bytes.Equal(tx.key, key) {
+		return false
+	}
+
+	if store.appendRecord(walRecord{walCommit, id, nil, nil}) != nil {
+		return false
+	}
+
+	delete(store.pending, id)
+
+	// The transaction is committed even if its page cannot be written, but
+	// the page is then stale, so the store fails until it is reopened, when
+	// recovery rewrites the page from the log
+	if err := store.writePage(tx); err != nil {
+		store.err = err
+		return true
+	}
+
+	store.maybeCompact()
+
+	return true
+}
+
+// DeleteStore removes all data associated with this store from the file system
+// (deleting the directory this store uses).
+func (store *persistentstore) DeleteStore() {
+	if store.wal != nil {
+		store.wal.Close()
+	}
+	os.RemoveAll(store.path)
+}
+
+// Rollback deletes an uncommitted transaction. It requires a transaction ID
+// returned by Put which has not yet been committed or rolled back.
+func (store *persistentstore) Rollback(id int) {
+	if store.err != nil {
+		return
 	}
-	defer newPage.Sync()
-	defer newPage.Close()
 
+	if _, ok := store.pending[id]; !ok {
+		return
+	}
+
+	delete(store.pending, id)
+
+	store.appendRecord(walRecord{walAbort, id, nil, nil})
+	store.maybeCompact()
+}
+
+// Len returns the number of committed keys.
+func (store *persistentstore) Len() int {
+	return store.keys
+}
+
+// recover restores the store to a consistent state after it was last closed
+// (or crashed). It replays every transaction committed in the log, so that
+// pages reflect every commit, and discards every uncommitted transaction and
+// any torn record at the end of the log. It then removes leftover temporary
+// files, and rewrites the log so that it only records the transaction counter.
+func (store *persistentstore) recover() error {
+	files, err := ioutil.ReadDir(store.path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		// Partially written files, and transaction files written by older
+		// versions of this store, were never committed.
+		if strings.HasSuffix(f.Name(), tmpExt) || strings.HasPrefix(f.Name(), "tx") {
+			os.Remove(filepath.Join(store.path, f.Name()))
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(store.path, walName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	uncommitted := make(map[int]walRecord)
+
+	for len(data) > 0 {
+		record, rest, ok := decodeRecord(data)
+		if !ok {
+			// A torn write at the end of the log (a crash mid-Put)
+			break
+		}
+		data = rest
+
+		if record.txid > store.txid {
+			store.txid = record.txid
+		}
+
+		switch record.kind {
+		case walPut, walDelete:
+			uncommitted[record.txid] = record
+		case walCommit:
+			tx, ok := uncommitted[record.txid]
+			if !ok {
+				continue
+			}
+			delete(uncommitted, record.txid)
+
+			// Rewriting a page is idempotent, so it does not matter
+			// whether the commit had been applied before the crash.
+			if err := store.writePage(tx); err != nil {
+				return err
+			}
+		case walAbort:
+			delete(uncommitted, record.txid)
+		}
+	}
+
+	// Replayed commits may already have been applied, so writePage cannot
+	// tell whether their keys are new
+	store.keys = 0
+	it := store.Scan(nil, nil)
+	for it.Next() {
+		store.keys++
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return store.compact()
+}
+
+// maybeCompact compacts the log if it has grown too large.
+func (store *persistentstore) maybeCompact() {
+	if store.walSize > walCompactSize {
+		if err := store.compact(); err != nil {
+			store.err = err
+		}
+	}
+}
+
+// compact atomically replaces the log with one containing only the
+// transaction counter and every pending transaction.
+func (store *persistentstore) compact() error {
+	path := filepath.Join(store.path, walName)
+
+	var log []byte
+	log = append(log, encodeRecord(walRecord{walCheckpoint, store.txid, nil, nil})...)
+	for _, tx := range store.pending {
+		log = append(log, encodeRecord(tx)...)
+	}
+
+	if err := writeFileAtomic(path, log); err != nil {
+		return err
+	}
+
+	if store.wal != nil {
+		store.wal.Close()
+	}
+
+	wal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	store.wal = wal
+	store.walSize = int64(len(log))
+
+	return nil
+}
+
+// appendRecord durably appends a record to the log.
+func (store *persistentstore) appendRecord(r walRecord) error {
+	encoded := encodeRecord(r)
+
+	if _, err := store.wal.Write(encoded); err != nil {
+		return err
+	}
+	if err := store.wal.Sync(); err != nil {
+		return err
+	}
+
+	store.walSize += int64(len(encoded))
+
+	return nil
+}
+
+func (store *persistentstore) pagePath(key []byte) string {
+	sum := md5.Sum(key)
+	return filepath.Join(store.path, hex.EncodeToString(sum[:]))
+}
+
+// readPage returns the contents of the page containing key. A page which does
+// not exist is empty.
+func (store *persistentstore) readPage(key []byte) ([]byte, error) {
+	data, err := ioutil.ReadFile(store.pagePath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// writePage atomically applies a committed put or delete to the page
+// containing its key. A page left empty by a delete is removed.
+func (store *persistentstore) writePage(tx walRecord) error {
+	key, val := tx.key, tx.value
+
+	oldPage, err := store.readPage(key)
+	if err != nil {
+		return err
+	}
+
+	var newPage []byte
 	written := false
 
 	for len(oldPage) > 0 {
 		keyLen := binary.BigEndian.Uint32(oldPage[:4])
 		found := bytes.Equal(oldPage[4:keyLen+4], key)
 
-		_, e = newPage.Write(oldPage[:keyLen+4])
-		if e != nil {
-			return 0
-		}
-
+		newPage = append(newPage, oldPage[:keyLen+4]...)
 		oldPage = oldPage[keyLen+4:]
 
 		valLen := binary.BigEndian.Uint32(oldPage[:4])
-		if found {
+		if found && tx.kind == walDelete {
+			// Remove the key, which has already been copied
+			newPage = newPage[:len(newPage)-int(keyLen)-4]
+			written = true
+		} else if found {
 			// Write new valLen and val
-			record := make([]byte, len(val)+4)
-			binary.BigEndian.PutUint32(record[:4], uint32(len(val)))
-			copy(record[4:], val)
-
-			_, e = newPage.Write(record)
-			if e != nil {
-				return 0
-			}
-
+			newPage = appendField(newPage, val)
 			written = true
 		} else {
 			// Write current valLen and val
-			_, e = newPage.Write(oldPage[:valLen+4])
+			newPage = append(newPage, oldPage[:valLen+4]...)
 		}
 
 		oldPage = oldPage[valLen+4:]
 	}
 
-	// Case of hash collision, where file already exists, but does not
-	// contain the required key.
-	if !written {
-		record := make([]byte, len(key)+len(val)+8)
+	// The key is new (or there is a hash collision, where the page already
+	// exists, but does not contain the required key).
+	added := !written && tx.kind != walDelete
+	if added {
+		newPage = appendField(newPage, key)
+		newPage = appendField(newPage, val)
+	}
 
-		binary.BigEndian.PutUint32(record[:4], uint32(len(key)))
-		copy(record[4:len(key)+4], key)
+	if len(newPage) == 0 {
+		err = removeFile(store.pagePath(key))
+	} else {
+		err = writeFileAtomic(store.pagePath(key), newPage)
+	}
+	if err != nil {
+		return err
+	}
+
+	if added {
+		store.keys++
+	} else if written && tx.kind == walDelete {
+		store.keys--
+	}
 
-		binary.BigEndian.PutUint32(record[len(key)+4:len(key)+8], uint32(len(val)))
-		copy(record[len(key)+8:], val)
+	return nil
+}
+
+// appendField appends a uint32 length and then b to dst.
+func appendField(dst, b []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
 
-		_, e = newPage.Write(record)
-		if e != nil {
-			return 0
+	dst = append(dst, length[:]...)
+	return append(dst, b...)
+}
+
+// removeFile durably removes the file at path, if it exists.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
 	}
 
-	return store.txid
+	return syncDir(filepath.Dir(path))
 }
 
-// Used internally in the case Put is writing a new key, rather than overwriting
-func (store *persistentstore) putNew(key []byte, val []byte) int {
-	newPage, e := os.Create(filepath.Join(store.path, "tx"+strconv.Itoa(store.txid)))
-	if e != nil {
-		return 0
-	}
-	defer newPage.Sync()
-	defer newPage.Close()
+// writeFileAtomic replaces the file at path with data, such that after a crash
+// the file contains either its old contents or data.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + tmpExt
 
-	record := make([]byte, len(key)+len(val)+8)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
 
-	binary.BigEndian.PutUint32(record[:4], uint32(len(key)))
-	copy(record[4:len(key)+4], key)
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
 
-	binary.BigEndian.PutUint32(record[len(key)+4:len(key)+8], uint32(len(val)))
-	copy(record[len(key)+8:], val)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
 
-	_, e = newPage.Write(record)
+	// Make the rename itself durable
+	return syncDir(filepath.Dir(path))
+}
 
-	if e == nil {
-		return store.txid
-	} else {
-		return 0
+// syncDir makes changes to the entries of directory path durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer dir.Close()
+
+	return dir.Sync()
 }
 
-// Commit commits an uncommitted transaction. It requires a transaction ID from
-// Put which has not yet been committed or rolled back. The given key must
-// match the id (from the call to Put).
-func (store *persistentstore) Commit(key []byte, id int) bool {
-	oldPath := filepath.Join(store.path, "tx"+strconv.Itoa(id))
+// Scan returns an Iterator over every committed key k, start <= k < end.
+// Pages are ordered by hash rather than by key, so this reads every page.
+func (store *persistentstore) Scan(start, end []byte) Iterator {
+	if store.err != nil {
+		return errIterator(store.err)
+	}
 
-	sum := md5.Sum(key)
-	newPath := filepath.Join(store.path, hex.EncodeToString(sum[:]))
+	files, err := ioutil.ReadDir(store.path)
+	if err != nil {
+		return errIterator(err)
+	}
 
-	e := os.Rename(oldPath, newPath)
+	var pairs []pair
 
-	return e == nil
-}
+	for _, f := range files {
+		// Every page is named by an md5 hash in hex
+		if len(f.Name()) != 2*md5.Size || strings.HasSuffix(f.Name(), tmpExt) {
+			continue
+		}
 
-// DeleteStore removes all data associated with this store from the file system
-// (deleting the directory this store uses).
-func (store *persistentstore) DeleteStore() {
-	os.RemoveAll(store.path)
+		data, err := ioutil.ReadFile(filepath.Join(store.path, f.Name()))
+		if err != nil {
+			return errIterator(errors.New("Failed to read from disk"))
+		}
+
+		for len(data) > 0 {
+			keyLen := binary.BigEndian.Uint32(data[:4])
+			key := data[4 : keyLen+4]
+			data = data[keyLen+4:]
+
+			valLen := binary.BigEndian.Uint32(data[:4])
+			if inRange(key, start, end) {
+				pairs = append(pairs, pair{key, data[4 : valLen+4]})
+			}
+			data = data[valLen+4:]
+		}
+	}
+
+	return newSliceIterator(pairs)
 }
 
-// Rollback deletes an uncommitted transaction. It requires a transaction ID
-// returned by Put which has not yet been committed or rolled back.
-func (store *persistentstore) Rollback(id int) {
-	path := filepath.Join(store.path, "tx"+strconv.Itoa(id))
-	os.Remove(path)
+// Prefix returns an Iterator over every committed key starting with p.
+func (store *persistentstore) Prefix(p []byte) Iterator {
+	return store.Scan(p, PrefixEnd(p))
 }
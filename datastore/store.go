@@ -4,38 +4,99 @@
 package datastore
 
 import (
-	"os"
+	"errors"
 	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
 )
 
-// A Store is a local key-value store. There are currently two different
-// implementations, which store data on disk or in memory. Keys may not contain
-// any null bytes. Value lengths must be respresentable by a uint32.
+// A Store is a local key-value store. There are currently three different
+// implementations (see Kind), which store data on disk or in memory. Keys may
+// not contain any null bytes. Value lengths must be respresentable by a uint32.
 type Store interface {
 	Get(key []byte) ([]byte, error) // Returns a value, or nil to indicate no value
 	Put(key, val []byte) int        // Returns a unique non-zero id if write was successful (requires a commit call to complete)
+	Delete(key []byte) int          // Returns a unique non-zero id if delete was successful (requires a commit call to complete)
 	Commit(key []byte, id int) bool // Returns true iff the transaction with id id was successfully committed
 	DeleteStore()                   // Delete the store (including removing all data from disk)
 	Rollback(id int)                // Deletes all traces of an uncommitted transaction
+	Len() int                       // Returns the number of committed keys, without reading them
+
+	Scan(start, end []byte) Iterator // Iterates over committed keys k, start <= k < end (nil end is unbounded)
+	Prefix(p []byte) Iterator        // Iterates over committed keys starting with p
 }
 
-// New creates a new Store. Given the empty string, it creates an in-memory
-// store. Given any other string, it attempts to use that string as the path
-// to a data directory.
-func New(path string) Store {
-	if path == "" {
+// A Kind is an enum indicating which Store implementation to use.
+// InMemory: a trie in main memory, with simulated disk latency.
+// Paged: a persistent hash map, with a file per hash bucket.
+// Log: a persistent append-only log, with an in-memory index.
+type Kind int
+
+const (
+	InMemory Kind = iota
+	Paged
+	Log
+)
+
+// New creates a new Store of the given kind. Persistent stores use path as the
+// path to a data directory. If that directory already contains a store, the
+// store is recovered, including every transaction committed before a crash.
+// The in-memory store simulates disk latency using clk.
+func New(kind Kind, path string, clk clock.Clock) Store {
+	switch kind {
+	case Paged:
+		return newPersistentStore(path)
+	case Log:
+		return newLogStore(path)
+	default:
 		return &memstore{
 			nil,
 			make(map[byte]*memstore),
 			make(map[int]pair),
 			0,
+			0,
 
 			310 * time.Microsecond,
 			time.Second / 150000,
 			time.Second / 285000,
+
+			clk,
 		}
-	} else {
-		os.Mkdir(path, 0755)
-		return &persistentstore{path, 0}
 	}
 }
+
+// String converts a Kind to a string
+func (k Kind) String() string {
+	switch k {
+	case InMemory:
+		return "memory"
+	case Paged:
+		return "paged"
+	case Log:
+		return "log"
+	default:
+		return "UNKNOWN_STORE_KIND"
+	}
+}
+
+// Set parses a Kind, so that a Kind can be used as a command line flag. "true"
+// (ie. a bare boolean flag) means Paged, and "false" means InMemory.
+func (k *Kind) Set(s string) error {
+	switch s {
+	case "memory", "false":
+		*k = InMemory
+	case "paged", "true":
+		*k = Paged
+	case "log":
+		*k = Log
+	default:
+		return errors.New("Unknown store kind (expected memory, paged or log)")
+	}
+
+	return nil
+}
+
+// IsBoolFlag allows a Kind flag to be given without a value.
+func (k *Kind) IsBoolFlag() bool {
+	return true
+}
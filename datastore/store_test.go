@@ -2,7 +2,12 @@ package datastore
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/alexbostock/part-ii-project/clock"
 )
 
 type testpair struct {
@@ -11,12 +16,17 @@ type testpair struct {
 }
 
 func TestPersistentStore(t *testing.T) {
-	store := New("teststore")
+	store := New(Paged, "teststore", clock.NewReal())
+	testStore(store, t)
+}
+
+func TestLogStore(t *testing.T) {
+	store := New(Log, "teststore-log", clock.NewReal())
 	testStore(store, t)
 }
 
 func TestInMemStore(t *testing.T) {
-	store := New("")
+	store := New(InMemory, "", clock.NewReal())
 	testStore(store, t)
 }
 
@@ -76,6 +86,10 @@ func testStore(store Store, t *testing.T) {
 		t.Error("Overwritten value not returned by Get.")
 	}
 
+	if n := store.Len(); n != 1 {
+		t.Error("Overwriting a key should not change the number of keys.", n)
+	}
+
 	// cases must not contain duplicate keys
 	cases := []testpair{
 		{[]byte{100, 61, 23, 44}, []byte{99, 30, 102, 121, 31, 104}},
@@ -120,4 +134,354 @@ func testStore(store Store, t *testing.T) {
 			t.Error("Incorrect value returned.")
 		}
 	}
+
+	if n := store.Len(); n != len(cases)+1 {
+		t.Error("Every committed key should be counted.", n)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	stores := map[string]Store{
+		"memory": New(InMemory, "", clock.NewReal()),
+		"paged":  New(Paged, "teststore-delete", clock.NewReal()),
+		"log":    New(Log, "teststore-log-delete", clock.NewReal()),
+	}
+
+	for name, store := range stores {
+		testDelete(store, name, t)
+	}
+}
+
+func testDelete(store Store, name string, t *testing.T) {
+	defer store.DeleteStore()
+
+	k := []byte{1, 2, 3}
+	k2 := []byte{1, 2, 4}
+	v := []byte{4, 5, 6}
+
+	for _, key := range [][]byte{k, k2} {
+		id := store.Put(key, v)
+		store.Commit(key, id)
+	}
+
+	id := store.Delete(k)
+	if id == 0 {
+		t.Error(name, "Delete should return a non-zero transaction id.")
+	}
+
+	val, _ := store.Get(k)
+	if !bytes.Equal(val, v) {
+		t.Error(name, "Uncommitted delete should not be visible to Get.", val)
+	}
+
+	store.Rollback(id)
+
+	val, _ = store.Get(k)
+	if !bytes.Equal(val, v) {
+		t.Error(name, "Rolled back delete should have no effect.", val)
+	}
+
+	id = store.Delete(k)
+	if !store.Commit(k, id) {
+		t.Error(name, "Commit of a valid delete should return true.")
+	}
+
+	val, err := store.Get(k)
+	if val != nil || err != nil {
+		t.Error(name, "Deleted key should not be present.", val, err)
+	}
+
+	it := store.Prefix([]byte{1, 2})
+	if !it.Next() || !bytes.Equal(it.Key(), k2) || it.Next() {
+		t.Error(name, "Deleted key should not be scanned, but other keys should.")
+	}
+
+	val, _ = store.Get(k2)
+	if !bytes.Equal(val, v) {
+		t.Error(name, "Delete should not affect other keys, even in the same page.", val)
+	}
+
+	// Deleting a key which is not present is not an error
+	id = store.Delete([]byte{7})
+	if id == 0 || !store.Commit([]byte{7}, id) {
+		t.Error(name, "Deleting a missing key should succeed.")
+	}
+
+	if n := store.Len(); n != 1 {
+		t.Error(name, "Only keys which are present should be counted.", n)
+	}
+}
+
+func TestScan(t *testing.T) {
+	stores := map[string]Store{
+		"memory": New(InMemory, "", clock.NewReal()),
+		"paged":  New(Paged, "teststore-scan", clock.NewReal()),
+		"log":    New(Log, "teststore-log-scan", clock.NewReal()),
+	}
+
+	for name, store := range stores {
+		testScan(store, name, t)
+	}
+}
+
+func testScan(store Store, name string, t *testing.T) {
+	defer store.DeleteStore()
+
+	keys := [][]byte{
+		[]byte("a"),
+		[]byte("a/b"),
+		[]byte("a/b/c"),
+		[]byte("a/c"),
+		[]byte("b"),
+		{0xff},
+		{0xff, 0xff},
+	}
+
+	// Insert in reverse order, so that scans must sort
+	for i := len(keys) - 1; i >= 0; i-- {
+		id := store.Put(keys[i], []byte{byte(i)})
+		store.Commit(keys[i], id)
+	}
+
+	// An uncommitted write should not be visible
+	store.Put([]byte("a/a"), []byte{100})
+
+	cases := []struct {
+		it       Iterator
+		expected [][]byte
+	}{
+		{store.Scan(nil, nil), keys},
+		{store.Scan([]byte("a/"), []byte("b")), keys[1:4]},
+		{store.Scan([]byte("a/b/c"), []byte("a/c")), keys[2:3]},
+		{store.Scan([]byte("c"), []byte("b")), nil},
+		{store.Prefix([]byte("a/")), keys[1:4]},
+		{store.Prefix([]byte("a/b")), keys[1:3]},
+		{store.Prefix([]byte{0xff}), keys[5:]},
+		{store.Prefix([]byte("z")), nil},
+	}
+
+	for i, test := range cases {
+		var found [][]byte
+		for test.it.Next() {
+			found = append(found, test.it.Key())
+
+			j := 0
+			for !bytes.Equal(keys[j], test.it.Key()) {
+				j++
+			}
+			if !bytes.Equal(test.it.Value(), []byte{byte(j)}) {
+				t.Error(name, "Scan returned wrong value.", i, test.it.Value())
+			}
+		}
+
+		if test.it.Err() != nil {
+			t.Error(name, "Scan failed.", i, test.it.Err())
+		}
+
+		if len(found) != len(test.expected) {
+			t.Error(name, "Scan returned wrong keys.", i, found)
+			continue
+		}
+		for j := range found {
+			if !bytes.Equal(found[j], test.expected[j]) {
+				t.Error(name, "Scan returned wrong keys.", i, found)
+				break
+			}
+		}
+	}
+}
+
+// Simulates crashes at various points by abandoning a store (without closing
+// it) and opening a new store on the same directory.
+func TestPersistentStoreRecovery(t *testing.T) {
+	path := "teststore-recovery"
+	store := newPersistentStore(path)
+	defer store.DeleteStore()
+
+	k := []byte{1, 2, 3}
+	v := []byte{4, 5, 6}
+	v2 := []byte{7, 8, 9}
+
+	id := store.Put(k, v)
+	if !store.Commit(k, id) {
+		t.Error("Commit with a valid id should commit and return true.")
+	}
+
+	// Crash after Put, before Commit
+	uncommittedId := store.Put(k, v2)
+
+	store = newPersistentStore(path)
+
+	val, err := store.Get(k)
+	if !bytes.Equal(val, v) || err != nil {
+		t.Error("Committed value should survive a crash.", val, err)
+	}
+	if n := store.Len(); n != 1 {
+		t.Error("Recovery should count the committed keys.", n)
+	}
+	if store.Commit(k, uncommittedId) {
+		t.Error("Uncommitted transaction should be discarded by recovery.")
+	}
+
+	id = store.Put(k, v2)
+	if id <= uncommittedId {
+		t.Error("Transaction ids should not be reused after a crash.", id, uncommittedId)
+	}
+
+	// Crash mid-Commit: the commit is logged, but the page is not updated
+	if store.appendRecord(walRecord{walCommit, id, nil, nil}) != nil {
+		t.Fatal("Failed to append to log.")
+	}
+
+	store = newPersistentStore(path)
+
+	val, _ = store.Get(k)
+	if !bytes.Equal(val, v2) {
+		t.Error("Logged commit should be applied by recovery.", val)
+	}
+
+	// Crash mid-Put: a torn record at the end of the log, and a partially
+	// written page
+	torn := encodeRecord(walRecord{walPut, store.txid + 1, k, v})
+	wal, _ := os.OpenFile(filepath.Join(path, walName), os.O_WRONLY|os.O_APPEND, 0644)
+	wal.Write(torn[:len(torn)/2])
+	wal.Close()
+	ioutil.WriteFile(store.pagePath(k)+tmpExt, []byte{1, 2}, 0644)
+
+	store = newPersistentStore(path)
+
+	val, err = store.Get(k)
+	if !bytes.Equal(val, v2) || err != nil {
+		t.Error("Torn write should not affect committed values.", val, err)
+	}
+	if _, err := os.Stat(store.pagePath(k) + tmpExt); !os.IsNotExist(err) {
+		t.Error("Recovery should remove leftover temporary files.")
+	}
+
+	id = store.Put(k, v)
+	if id == 0 || !store.Commit(k, id) {
+		t.Error("Store should be usable after recovering from a torn write.")
+	}
+
+	store = newPersistentStore(path)
+
+	val, _ = store.Get(k)
+	if !bytes.Equal(val, v) {
+		t.Error("Commit after recovery should survive a crash.", val)
+	}
+
+	// Crash after a delete
+	id = store.Delete(k)
+	store.Commit(k, id)
+
+	store = newPersistentStore(path)
+
+	val, err = store.Get(k)
+	if val != nil || err != nil {
+		t.Error("Committed delete should survive a crash.", val, err)
+	}
+
+	// A page which cannot be written, since a directory is in its place
+	os.Remove(store.pagePath(k))
+	os.MkdirAll(filepath.Join(store.pagePath(k), "blocker"), 0755)
+
+	id = store.Put(k, v)
+	if !store.Commit(k, id) {
+		t.Error("A logged commit should succeed even if its page cannot be written.")
+	}
+	if _, err := store.Get(k); err == nil {
+		t.Error("A store with a stale page should fail until it is reopened.")
+	}
+
+	os.RemoveAll(store.pagePath(k))
+	store = newPersistentStore(path)
+
+	val, err = store.Get(k)
+	if !bytes.Equal(val, v) || err != nil {
+		t.Error("Recovery should write the page of a logged commit.", val, err)
+	}
+}
+
+func TestLogStoreRecovery(t *testing.T) {
+	path := "teststore-log-recovery"
+	store := newLogStore(path)
+	defer store.DeleteStore()
+
+	k := []byte{1, 2, 3}
+	k2 := []byte{4, 5}
+	v := []byte{4, 5, 6}
+
+	id := store.Put(k2, v)
+	store.Commit(k2, id)
+
+	// Overwrite the same key until the log is compacted
+	var last []byte
+	for i := 0; ; i++ {
+		last = make([]byte, 1000)
+		last[0] = byte(i)
+
+		size := store.logSize
+
+		id = store.Put(k, last)
+		if !store.Commit(k, id) {
+			t.Fatal("Commit with a valid id should commit and return true.")
+		}
+
+		if store.logSize < size {
+			break
+		}
+		if store.logSize > 2*logCompactSize {
+			t.Fatal("Log should have been compacted.", store.logSize)
+		}
+	}
+
+	// Crash with an uncommitted transaction and a torn record
+	uncommittedId := store.Put(k, v)
+	torn := encodeRecord(walRecord{walCommit, uncommittedId, nil, nil})
+	store.log.Write(torn[:len(torn)-1])
+
+	store = newLogStore(path)
+
+	val, err := store.Get(k)
+	if !bytes.Equal(val, last) || err != nil {
+		t.Error("Latest committed value should survive a crash.", err)
+	}
+	val, _ = store.Get(k2)
+	if !bytes.Equal(val, v) {
+		t.Error("Value should survive compaction and a crash.", val)
+	}
+	if store.Commit(k, uncommittedId) {
+		t.Error("Uncommitted transaction should be discarded by recovery.")
+	}
+
+	id = store.Put(k, v)
+	if id <= uncommittedId {
+		t.Error("Transaction ids should not be reused after a crash.", id, uncommittedId)
+	}
+	if !store.Commit(k, id) {
+		t.Error("Store should be usable after recovering from a torn write.")
+	}
+
+	store = newLogStore(path)
+
+	val, _ = store.Get(k)
+	if !bytes.Equal(val, v) {
+		t.Error("Commit after recovery should survive a crash.", val)
+	}
+
+	// Crash after a delete, and during another
+	id = store.Delete(k)
+	store.Commit(k, id)
+	store.Delete(k2)
+
+	store = newLogStore(path)
+
+	val, err = store.Get(k)
+	if val != nil || err != nil {
+		t.Error("Committed delete should survive a crash.", val, err)
+	}
+	val, _ = store.Get(k2)
+	if !bytes.Equal(val, v) {
+		t.Error("Uncommitted delete should be discarded by recovery.", val)
+	}
 }
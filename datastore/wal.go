@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// The write-ahead log used by persistentstore
+
+type walRecordType byte
+
+const (
+	_             walRecordType = iota
+	walPut                      // An uncommitted write
+	walCommit                   // Commit of an earlier walPut
+	walAbort                    // Rollback of an earlier walPut
+	walCheckpoint               // Written when the log is compacted, to preserve txid
+	walDelete                   // An uncommitted delete
+)
+
+// A walRecord is a single entry in the write-ahead log. key is only used by
+// walPut and walDelete records, and value is only used by walPut records.
+type walRecord struct {
+	kind  walRecordType
+	txid  int
+	key   []byte
+	value []byte
+}
+
+// Record format (all integers big endian):
+// record_length(4) type(1) txid(8) key_length(4) key val_length(4) val crc(4)
+// record_length counts every byte after itself, and crc is the CRC-32 of
+// every byte from type to the end of val. A record which is truncated or fails
+// its checksum was torn by a crash while being written.
+
+const walRecordOverhead = 4 + 1 + 8 + 4 + 4 + 4
+
+func encodeRecord(r walRecord) []byte {
+	b := make([]byte, 0, walRecordOverhead+len(r.key)+len(r.value))
+
+	var header [13]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(walRecordOverhead-4+len(r.key)+len(r.value)))
+	header[4] = byte(r.kind)
+	binary.BigEndian.PutUint64(header[5:13], uint64(r.txid))
+
+	b = append(b, header[:]...)
+	b = appendField(b, r.key)
+	b = appendField(b, r.value)
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(b[4:]))
+
+	return append(b, crc[:]...)
+}
+
+// decodeRecord decodes the first record in b, and returns the rest of b. ok is
+// false if b does not start with a complete, valid record.
+func decodeRecord(b []byte) (r walRecord, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return
+	}
+
+	length := binary.BigEndian.Uint32(b[:4])
+	if length < walRecordOverhead-4 || uint64(length) > uint64(len(b)-4) {
+		return
+	}
+
+	body := b[4 : 4+length-4]
+	crc := binary.BigEndian.Uint32(b[4+length-4 : 4+length])
+	if crc32.ChecksumIEEE(body) != crc {
+		return
+	}
+
+	r.kind = walRecordType(body[0])
+	r.txid = int(binary.BigEndian.Uint64(body[1:9]))
+
+	fields := body[9:]
+
+	keyLen := binary.BigEndian.Uint32(fields[:4])
+	if uint64(keyLen)+8 > uint64(len(fields)) {
+		return
+	}
+	r.key = fields[4 : 4+keyLen]
+	fields = fields[4+keyLen:]
+
+	valLen := binary.BigEndian.Uint32(fields[:4])
+	if uint64(valLen)+4 != uint64(len(fields)) {
+		return
+	}
+	r.value = fields[4:]
+
+	return r, b[4+length:], true
+}
@@ -0,0 +1,336 @@
+package dbnode
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// Anti-entropy repairs replicas which missed writes (eg. while failed), even
+// for keys which are never written again. Periodically, each node compares its
+// store with a random peer's by exchanging Merkle trees, and the two nodes
+// exchange the entries of the keys which differ. Each node keeps the value (or
+// tombstone) with the latest Lamport timestamp.
+//
+// Keys are hashed into the leaves of a complete binary tree of depth
+// merkleDepth. The hash of a leaf combines (by XOR) the hash of the key,
+// timestamp and tombstone flag of every entry in it, and the hash of any
+// other tree node is the hash of its children's hashes. Values are not hashed:
+// a value is identified by its key and timestamp.
+//
+// A round is a series of messages between two nodes, a and b:
+// 1. a sends the hash of its root in a NodeSyncRequest.
+// 2. For every hash in a NodeSyncRequest which differs from its own tree, the
+// receiver replies with its hashes of that node's children (in another
+// NodeSyncRequest), or, for a leaf, every entry in the leaf (in a
+// NodeSyncEntries).
+// 3. The receiver of a NodeSyncEntries stores every newer entry, and replies
+// with its own entries which the sender lacks.
+// So a round takes at most merkleDepth+2 messages, or 1 if the stores match.
+//
+// When keys are partitioned, each pair of nodes only compares the keys which
+// both replicate.
+//
+// Repairs bypass locks, like background writes, except that a key locked by a
+// transaction on the receiver is left until a later round (see repair).
+
+const (
+	merkleDepth  = 6
+	merkleLeaves = 1 << merkleDepth
+)
+
+// A merkleTree is a complete binary tree of hashes, stored as a heap: the root
+// is at index 1, and node i has children 2i and 2i+1. The leaves are at indices
+// merkleLeaves to 2*merkleLeaves-1.
+type merkleTree [2 * merkleLeaves]uint64
+
+// A treeHash is the hash of one node of a merkleTree.
+type treeHash struct {
+	index int
+	hash  uint64
+}
+
+// startAntiEntropy starts an anti-entropy round every interval (with jitter from
+// random, so that nodes' rounds are spread out). This should run asynchronously.
+func (n *Dbnode) startAntiEntropy(interval time.Duration, random *rand.Rand) {
+	for {
+		n.clock.Sleep(interval/2 + time.Duration(random.Int63n(int64(interval))))
+
+		n.Incoming.Send(packet.Message{
+			Id:       -1,
+			Src:      n.id,
+			Dest:     n.id,
+			DemuxKey: packet.InternalSync,
+		})
+	}
+}
+
+// startSync starts an anti-entropy round with a random peer, if this node is a
+// member. Only members are peers.
+func (n *Dbnode) startSync() {
+	var peers []int
+	for _, m := range n.config.members {
+		if m != n.id {
+			peers = append(peers, m)
+		}
+	}
+
+	if len(peers) == 0 || !n.config.isMember(n.id) {
+		return
+	}
+
+	peer := peers[n.random.Intn(len(peers))]
+
+	tree := n.merkleTree(peer)
+
+	n.Outgoing.Send(packet.Message{
+		Id:       -1,
+		Src:      n.id,
+		Dest:     peer,
+		DemuxKey: packet.NodeSyncRequest,
+		Value:    encodeTreeHashes([]treeHash{{1, tree[1]}}),
+		Ok:       true,
+	})
+}
+
+func (n *Dbnode) handleSyncReq(msg packet.Message) {
+	hashes, ok := decodeTreeHashes(msg.Value)
+	if !ok {
+		log.Fatal("Malformed anti-entropy request", msg)
+	}
+
+	tree := n.merkleTree(msg.Src)
+
+	var children []treeHash
+	var leaves []int
+	for _, h := range hashes {
+		if tree[h.index] == h.hash {
+			continue
+		}
+
+		if h.index < merkleLeaves {
+			children = append(children, treeHash{2 * h.index, tree[2*h.index]}, treeHash{2*h.index + 1, tree[2*h.index+1]})
+		} else {
+			leaves = append(leaves, h.index)
+		}
+	}
+
+	if len(children) > 0 {
+		n.Outgoing.Send(packet.Message{
+			Id:       -1,
+			Src:      n.id,
+			Dest:     msg.Src,
+			DemuxKey: packet.NodeSyncRequest,
+			Value:    encodeTreeHashes(children),
+			Ok:       true,
+		})
+	}
+
+	if len(leaves) > 0 {
+		n.Outgoing.Send(packet.Message{
+			Id:       -1,
+			Src:      n.id,
+			Dest:     msg.Src,
+			DemuxKey: packet.NodeSyncEntries,
+			Key:      encodeLeaves(leaves),
+			Value:    packet.EncodeEntries(n.leafEntries(leaves, msg.Src)),
+			Ok:       true,
+		})
+	}
+}
+
+func (n *Dbnode) handleSyncEntries(msg packet.Message) {
+	leaves, ok := decodeLeaves(msg.Key)
+	theirs, err := packet.DecodeEntries(msg.Value)
+	if !ok || err != nil {
+		log.Fatal("Malformed anti-entropy entries", msg)
+	}
+
+	mine := make(map[string]packet.Entry)
+	for _, e := range n.leafEntries(leaves, msg.Src) {
+		mine[string(e.Key)] = e
+	}
+
+	for _, e := range theirs {
+		current, ok := mine[string(e.Key)]
+		if ok && e.Timestamp < current.Timestamp {
+			// Ours is newer, so is sent back
+			continue
+		}
+		delete(mine, string(e.Key))
+
+		if ok && e.Timestamp == current.Timestamp {
+			// An equal timestamp means the same value, except after
+			// a write committed on some nodes and then aborted, in
+			// which case neither value is preferred
+			continue
+		}
+
+		if n.locked(keyLocks(e.Key)) {
+			continue
+		}
+
+		n.repair(e)
+	}
+
+	if !msg.Ok || len(mine) == 0 {
+		return
+	}
+
+	// Every entry left in mine is newer than the sender's (or the sender
+	// lacks its key)
+	newer := make([]packet.Entry, 0, len(mine))
+	for _, e := range mine {
+		newer = append(newer, e)
+	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:       -1,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.NodeSyncEntries,
+		Key:      msg.Key,
+		Value:    packet.EncodeEntries(mergeEntries(newer)),
+		Ok:       false,
+	})
+}
+
+// merkleTree computes the Merkle tree of every committed key in the store which
+// peer also replicates.
+func (n *Dbnode) merkleTree(peer int) *merkleTree {
+	entries := n.sharedEntries(peer)
+
+	var tree merkleTree
+	for _, e := range entries {
+		tree[merkleLeaves+leafOf(e.Key)] ^= entryHash(e)
+	}
+
+	var buf [16]byte
+	for i := merkleLeaves - 1; i > 0; i-- {
+		binary.BigEndian.PutUint64(buf[:8], tree[2*i])
+		binary.BigEndian.PutUint64(buf[8:], tree[2*i+1])
+
+		h := fnv.New64a()
+		h.Write(buf[:])
+		tree[i] = h.Sum64()
+	}
+
+	return &tree
+}
+
+// leafEntries returns every committed entry in the given leaves of the Merkle
+// tree (given by their indices in the tree) shared with peer.
+func (n *Dbnode) leafEntries(leaves []int, peer int) []packet.Entry {
+	entries := n.sharedEntries(peer)
+
+	inLeaves := make(map[int]bool)
+	for _, l := range leaves {
+		inLeaves[l] = true
+	}
+
+	var selected []packet.Entry
+	for _, e := range entries {
+		if inLeaves[merkleLeaves+leafOf(e.Key)] {
+			selected = append(selected, e)
+		}
+	}
+
+	return selected
+}
+
+// sharedEntries returns every committed entry in the store whose key peer also
+// replicates (every entry, unless keys are partitioned).
+func (n *Dbnode) sharedEntries(peer int) []packet.Entry {
+	entries, err := n.scanLocal(nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shared := entries[:0]
+	for _, e := range entries {
+		if n.ring.Contains(e.Key, peer) {
+			shared = append(shared, e)
+		}
+	}
+
+	return shared
+}
+
+// leafOf returns the leaf of the Merkle tree containing key (0 <= leaf <
+// merkleLeaves).
+func leafOf(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % merkleLeaves)
+}
+
+func entryHash(e packet.Entry) uint64 {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:8], e.Timestamp)
+	if e.Tombstone {
+		buf[8] = 1
+	}
+
+	// Keys never contain null bytes, so a null byte separates the key
+	h := fnv.New64a()
+	h.Write(e.Key)
+	h.Write([]byte{0})
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// Tree hashes are encoded as index(4) hash(8) (big endian), repeated.
+func encodeTreeHashes(hashes []treeHash) []byte {
+	b := make([]byte, 12*len(hashes))
+	for i, h := range hashes {
+		binary.BigEndian.PutUint32(b[12*i:], uint32(h.index))
+		binary.BigEndian.PutUint64(b[12*i+4:], h.hash)
+	}
+	return b
+}
+
+func decodeTreeHashes(b []byte) ([]treeHash, bool) {
+	if len(b)%12 != 0 {
+		return nil, false
+	}
+
+	hashes := make([]treeHash, len(b)/12)
+	for i := range hashes {
+		hashes[i].index = int(binary.BigEndian.Uint32(b[12*i:]))
+		hashes[i].hash = binary.BigEndian.Uint64(b[12*i+4:])
+
+		if hashes[i].index < 1 || hashes[i].index >= 2*merkleLeaves {
+			return nil, false
+		}
+	}
+	return hashes, true
+}
+
+// Leaves are encoded as index(4) (big endian), repeated.
+func encodeLeaves(leaves []int) []byte {
+	b := make([]byte, 4*len(leaves))
+	for i, l := range leaves {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(l))
+	}
+	return b
+}
+
+func decodeLeaves(b []byte) ([]int, bool) {
+	if len(b)%4 != 0 {
+		return nil, false
+	}
+
+	leaves := make([]int, len(b)/4)
+	for i := range leaves {
+		leaves[i] = int(binary.BigEndian.Uint32(b[4*i:]))
+
+		if leaves[i] < merkleLeaves || leaves[i] >= 2*merkleLeaves {
+			return nil, false
+		}
+	}
+	return leaves, true
+}
@@ -2,27 +2,41 @@ package dbnode
 
 import (
 	"log"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/hashring"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
 // A propagater quietly streams write requests to other nodes and tracks
-// responses to ensure that at least n - V_R + 1 nodes eventually receive every
-// value.
+// responses to ensure that at least R - V_R + 1 replicas eventually receive
+// every value (where R is the number of replicas of each key, n unless keys are
+// partitioned).
 type propagater struct {
 	id           int
-	n            int
+	members      []int
 	criticalSize int
-	outgoing     chan packet.Message
-	transactions map[int]*transaction
+	ring         *hashring.Ring
+	outgoing     *clock.Chan[packet.Message]
+	transactions map[propagation]*transaction
 
 	// Channel used to signal for the main loop to send requests
-	timer chan bool
+	timer *clock.Chan[bool]
 	// (triggered when a new transaction is added, add every second)
 
 	lock sync.Mutex
+
+	clock clock.Clock
+}
+
+// A propagation identifies a transaction being propagated. A multi-key
+// transaction is propagated as one transaction per key, sharing an id.
+type propagation struct {
+	id  int
+	key string
 }
 
 // A transaction represents a single put transaction, including the data written,
@@ -32,25 +46,36 @@ type transaction struct {
 	key               []byte
 	value             []byte
 	timestamp         uint64
+	tombstone         bool
 	numConfirmedNodes int
 	nodes             map[int]bool
 }
 
 // newPropagater instantiates propagator, including starting its clock and main
 // loop. Its arguments are this node's id, the total number of nodes, the read
-// quorum size V_R, and the outgoing network link for this node.
-func newPropagater(id, numNodes, rqs int, outgoing chan packet.Message) *propagater {
+// quorum size V_R, the ring partitioning keys (nil if every node replicates
+// every key), the outgoing network link for this node, and the clock. Every
+// node is a member until reconfigure is called.
+func newPropagater(id, numNodes, rqs int, ring *hashring.Ring, outgoing *clock.Chan[packet.Message], clk clock.Clock) *propagater {
+	var members []int
+	for i := 0; i < numNodes; i++ {
+		members = append(members, i)
+	}
+
 	p := &propagater{
 		id:           id,
-		n:            numNodes,
-		criticalSize: numNodes - rqs + 1,
+		members:      members,
+		criticalSize: ring.Factor(numNodes) - rqs + 1,
+		ring:         ring,
 		outgoing:     outgoing,
-		transactions: make(map[int]*transaction),
+		transactions: make(map[propagation]*transaction),
+
+		timer: clock.NewChan[bool](clk, 0),
 
-		timer: make(chan bool),
+		clock: clk,
 	}
 
-	go p.streamWrites()
+	clk.Go(p.streamWrites)
 
 	return p
 }
@@ -59,27 +84,34 @@ func newPropagater(id, numNodes, rqs int, outgoing chan packet.Message) *propaga
 // asynchronously.
 func (p *propagater) startClock() {
 	for {
-		time.Sleep(time.Second)
-		p.timer <- true
+		p.clock.Sleep(time.Second)
+		p.timer.Send(true)
 	}
 }
 
 // streamWrites is the main loop. It iterates every time there is a signal on
 // p.timer.
 func (p *propagater) streamWrites() {
-	for _ = range p.timer {
+	for {
+		p.timer.Recv()
+
+		// The requests are sent after unlocking, since sending may
+		// block
+		var requests []packet.Message
+
 		p.lock.Lock()
 
-		for id, t := range p.transactions {
+		for _, prop := range p.propagations() {
+			t := p.transactions[prop]
 			if t.numConfirmedNodes >= p.criticalSize {
-				delete(p.transactions, id)
+				delete(p.transactions, prop)
 				continue
 			}
 
-			for node := 0; node < p.n; node++ {
+			for _, node := range p.members {
 				if !t.nodes[node] {
-					p.outgoing <- packet.Message{
-						Id:        id,
+					requests = append(requests, packet.Message{
+						Id:        prop.id,
 						Src:       p.id,
 						Dest:      node,
 						DemuxKey:  packet.NodeBackgroundWriteRequest,
@@ -87,37 +119,83 @@ func (p *propagater) streamWrites() {
 						Value:     t.value,
 						Timestamp: t.timestamp,
 						Ok:        true,
-					}
+						Tombstone: t.tombstone,
+					})
 				}
 			}
 		}
 
 		p.lock.Unlock()
+
+		for _, req := range requests {
+			p.outgoing.Send(req)
+		}
+	}
+}
+
+// propagations returns the transactions being propagated, ordered by id and
+// then key, so that requests are sent in the same order on every run.
+func (p *propagater) propagations() []propagation {
+	props := make([]propagation, 0, len(p.transactions))
+	for prop := range p.transactions {
+		props = append(props, prop)
 	}
+	sort.Slice(props, func(i, j int) bool {
+		if props[i].id != props[j].id {
+			return props[i].id < props[j].id
+		}
+		return props[i].key < props[j].key
+	})
+
+	return props
 }
 
 // propagateTransaction adds a transaction to the propagater so that the main
-// loop will begin propagating it. Its arguments are the transaction id, the
-// set of nodes involved in the atomic write transaction (including this node,
-// the coordinator), and the values stored.
-func (p *propagater) propagateTransaction(id int, quorumMembers map[int]packet.Message, key, value []byte, timestamp uint64) {
+// loop will begin propagating it (to the replicas of key). Its arguments are
+// the transaction id, the set of nodes involved in the atomic write transaction
+// (including this node, the coordinator), and the values stored (where
+// tombstone indicates a delete).
+func (p *propagater) propagateTransaction(id int, quorumMembers map[int]packet.Message, key, value []byte, timestamp uint64, tombstone bool) {
 	p.lock.Lock()
-	defer p.lock.Unlock()
 
 	t := &transaction{
-		key:               key,
-		value:             value,
-		timestamp:         timestamp,
-		numConfirmedNodes: len(quorumMembers),
-		nodes:             make(map[int]bool),
+		key:       key,
+		value:     value,
+		timestamp: timestamp,
+		tombstone: tombstone,
+		nodes:     make(map[int]bool),
 	}
 
-	for node, _ := range quorumMembers {
-		t.nodes[node] = true
+	for _, node := range p.members {
+		if !p.ring.Contains(key, node) {
+			// Never sent the value, so never counted
+			t.nodes[node] = true
+		} else if _, ok := quorumMembers[node]; ok {
+			t.nodes[node] = true
+			t.numConfirmedNodes++
+		}
+	}
+
+	p.transactions[propagation{id, string(key)}] = t
+	p.lock.Unlock()
+
+	p.timer.Send(true)
+}
+
+// reconfigure changes the nodes to which writes are propagated to the members
+// of a new configuration, with read quorum size rqs (see membership.go).
+// Writes already propagated to enough of the old members are not propagated to
+// new ones, which are caught up separately.
+func (p *propagater) reconfigure(members []int, rqs int) {
+	if p == nil {
+		return
 	}
 
-	p.transactions[id] = t
-	p.timer <- true
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.members = members
+	p.criticalSize = p.ring.Factor(len(members)) - rqs + 1
 }
 
 // response should be called whenever the dbnode receives a
@@ -132,7 +210,9 @@ func (p *propagater) response(msg packet.Message) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	t := p.transactions[msg.Id]
+	prop := propagation{msg.Id, string(msg.Key)}
+
+	t := p.transactions[prop]
 	if t == nil {
 		return
 	}
@@ -143,7 +223,7 @@ func (p *propagater) response(msg packet.Message) {
 		t.numConfirmedNodes++
 
 		if t.numConfirmedNodes >= p.criticalSize {
-			delete(p.transactions, msg.Id)
+			delete(p.transactions, prop)
 		}
 	}
 
@@ -155,6 +235,6 @@ func (p *propagater) response(msg packet.Message) {
 			log.Fatal("Conflicting timestamps", msg, t)
 		}
 
-		delete(p.transactions, msg.Id)
+		delete(p.transactions, prop)
 	}
 }
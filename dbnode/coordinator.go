@@ -1,13 +1,30 @@
 package dbnode
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"log"
+	"sort"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
+// Values are stored as a 64 bit Lamport timestamp followed by the value. A
+// tombstone, recording that a key was deleted, is stored as just a timestamp,
+// with tombstoneBit set. (Timestamps never grow large enough to set this bit.)
+const tombstoneBit = 1 << 63
+
 func decodeTimestampVal(encoded []byte) (timestamp uint64, value []byte) {
+	timestamp, value, _ = decodeStoredVal(encoded)
+	return
+}
+
+// decodeStoredVal decodes a stored value. If the value is a tombstone, value is
+// nil and tombstone is true.
+func decodeStoredVal(encoded []byte) (timestamp uint64, value []byte, tombstone bool) {
 	if len(encoded) == 0 {
-		return 0, nil
+		return 0, nil, false
 	}
 
 	// First 8 bytes are a Lamport timestamp.
@@ -17,15 +34,117 @@ func decodeTimestampVal(encoded []byte) (timestamp uint64, value []byte) {
 
 	timestamp = binary.BigEndian.Uint64(encoded[:8])
 
+	if timestamp&tombstoneBit != 0 {
+		return timestamp &^ tombstoneBit, nil, true
+	}
+
 	value = encoded[8:]
 
 	return
 }
 
 func encodeTimestampVal(timestamp uint64, value []byte) []byte {
+	return encodeStoredVal(timestamp, value, false)
+}
+
+// encodeStoredVal encodes a value, or a tombstone if tombstone is true (in
+// which case value is ignored).
+func encodeStoredVal(timestamp uint64, value []byte, tombstone bool) []byte {
+	if tombstone {
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, timestamp|tombstoneBit)
+		return encoded
+	}
+
 	encoded := make([]byte, len(value)+8)
 	binary.BigEndian.PutUint64(encoded[:8], timestamp)
 	copy(encoded[8:], value)
 
 	return encoded
 }
+
+// mergeEntries merges the results of scanning several nodes, keeping the
+// value (or tombstone) with the latest timestamp for each key, and returns
+// them sorted by key.
+func mergeEntries(results ...[]packet.Entry) []packet.Entry {
+	latest := make(map[string]packet.Entry)
+
+	for _, entries := range results {
+		for _, e := range entries {
+			if current, ok := latest[string(e.Key)]; !ok || e.Timestamp > current.Timestamp {
+				latest[string(e.Key)] = e
+			}
+		}
+	}
+
+	merged := make([]packet.Entry, 0, len(latest))
+	for _, e := range latest {
+		merged = append(merged, e)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return bytes.Compare(merged[i].Key, merged[j].Key) < 0
+	})
+
+	return merged
+}
+
+// removeTombstones removes every tombstone from a list of scan results.
+func removeTombstones(entries []packet.Entry) []packet.Entry {
+	live := entries[:0]
+	for _, e := range entries {
+		if !e.Tombstone {
+			live = append(live, e)
+		}
+	}
+
+	return live
+}
+
+// decodeTxn decodes the writes in a ClientTxnRequest. Each key may only be
+// written once.
+func decodeTxn(encoded []byte) ([]packet.Entry, error) {
+	writes, err := packet.DecodeEntries(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, w := range writes {
+		if seen[string(w.Key)] {
+			return nil, errors.New("Duplicate key in transaction")
+		}
+		seen[string(w.Key)] = true
+	}
+
+	return writes, nil
+}
+
+// assignTxnTimestamps gives each write in a transaction the timestamp after
+// the latest timestamp of its key. A write with a non-zero timestamp is
+// conditional (like a strong write): it requires exactly that timestamp.
+// assignTxnTimestamps returns false if any condition does not hold, in which
+// case writes still holds the required timestamps.
+func assignTxnTimestamps(writes, latest []packet.Entry) bool {
+	next := make(map[string]uint64)
+	for _, e := range latest {
+		if e.Timestamp+1 > next[string(e.Key)] {
+			next[string(e.Key)] = e.Timestamp + 1
+		}
+	}
+
+	ok := true
+	for i := range writes {
+		timestamp, found := next[string(writes[i].Key)]
+		if !found {
+			timestamp = 1
+		}
+
+		if writes[i].Timestamp != 0 && writes[i].Timestamp != timestamp {
+			ok = false
+		}
+		writes[i].Timestamp = timestamp
+	}
+
+	return ok
+}
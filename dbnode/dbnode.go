@@ -4,16 +4,19 @@ package dbnode
 
 import (
 	"bytes"
-	"fmt"
 	"log"
 	"math/rand"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/datastore"
 	"github.com/alexbostock/part-ii-project/dbnode/elector"
 	"github.com/alexbostock/part-ii-project/dbnode/repeater"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/hashring"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
@@ -27,10 +30,40 @@ const (
 	processingRead
 	processingWrite
 	coordinatingFastRead
+	coordinatingScan
 )
 
+// String converts a mode to a string
+func (m mode) String() string {
+	switch m {
+	case idle:
+		return "idle"
+	case assemblingQuorum:
+		return "assemblingQuorum"
+	case coordinatingRead:
+		return "coordinatingRead"
+	case coordinatingWrite:
+		return "coordinatingWrite"
+	case processingRead:
+		return "processingRead"
+	case processingWrite:
+		return "processingWrite"
+	case coordinatingFastRead:
+		return "coordinatingFastRead"
+	case coordinatingScan:
+		return "coordinatingScan"
+	default:
+		return "UNKNOWN_MODE"
+	}
+}
+
 const fastReads = true
 
+// The time to wait after a delete before garbage collecting its tombstone, as
+// a multiple of the lock timeout. This allows time for any older writes still
+// in flight to arrive, so that they cannot overwrite the collected tombstone.
+const tombstoneGracePeriod = 20
+
 // A Dbnode is a single database node. In order to behave like a node, it
 // should be instantiated with New. Public fields are Incoming and Outgoing
 // simulated network links and Store, the underlying local datastore.
@@ -39,41 +72,180 @@ type Dbnode struct {
 	numPeers        int
 	readQuorumSize  int
 	writeQuorumSize int
-	Incoming        chan packet.Message
-	Outgoing        chan packet.Message
+	Incoming        *clock.Chan[packet.Message]
+	Outgoing        *clock.Chan[packet.Message]
 	lockTimeout     time.Duration
 
-	currentMode  mode
 	Store        datastore.Store
-	currentTxid  int
 	lockRequests queue
-
-	// State relevent in modes coordinatingRead and coordinatingWrite:
-
-	clientRequest packet.Message
-	quorumMembers map[int]packet.Message
-	// The number of nodes we are waiting for before we can continue
-	numWaitingNodes int
+	// The time at which each queued lock request was queued, and the time
+	// for which each request granted since the last stats query waited
+	lockQueuedAt map[*packet.Message]time.Time
+	lockWaits    []time.Duration
+
+	// Transactions in progress on this node (as coordinator or
+	// participant), by transaction ID. Each holds the locks on its keys
+	// until it is released.
+	txns map[int]*txnState
+	// The number of transactions started by this node
+	numTxns int
 
 	requestRepeater       *repeater.Repeater
 	backgroundWriteDaemon *propagater
 
-	uncommitedTxid int
-	uncommitedKey  []byte
-
 	// IDs from previous unlock transactions to guard against case of
 	// unlock received before corresponding lock.
 	unlockTxids map[int]bool
 
-	internalTimer chan int
+	// The highest fencing token of any write request received (see
+	// checkToken)
+	fencingToken uint64
+
+	internalTimer *clock.Chan[bool]
 	elector       elector.Elector
 
 	disabled bool
 
-	stateQueryReq chan bool
-	stateQueryRes chan int
+	stateQueryReq *clock.Chan[bool]
+	stateQueryRes *clock.Chan[Stats]
+
+	statusQueryReq *clock.Chan[bool]
+	statusQueryRes *clock.Chan[Status]
+
+	readRepair ReadRepair
+
+	// The replicas of each key (nil if every node stores every key)
+	ring *hashring.Ring
+
+	// The cluster's members (see membership.go): this node's configuration,
+	// and the configuration of version 0
+	config        config
+	initialConfig config
+	// As leader, the configuration being proposed (or nil), and the
+	// number of ballots used
+	proposal   *configProposal
+	numBallots int
+	// The highest ballot promised, and the configuration accepted (with
+	// its ballot). acceptedStale is true if the configuration accepted has
+	// not been committed since the last internal timer signal.
+	promised       uint64
+	accepted       config
+	acceptedBallot uint64
+	acceptedStale  bool
+	// As a new member, the state of catching up (or nil)
+	catchUp *catchUp
+
+	// Writes held for other nodes, by owner, in a sloppy quorum system (see
+	// substitute), and when each owner was last sent its hints
+	hints       map[int][]packet.Entry
+	handoffSent map[int]time.Time
 
 	logWrites bool
+	events    *eventlog.Log
+
+	// The number of garbage collection transactions started by this node
+	numGarbageCollections int
+
+	// The source of the main loop's random choices (see Options)
+	random *rand.Rand
+
+	clock clock.Clock
+}
+
+// A txnState is the state of one transaction in progress on this node.
+type txnState struct {
+	mode  mode
+	locks lockSet
+
+	// The order in which transactions were started
+	seq int
+
+	// The request which started the transaction: a client request (for a
+	// coordinator) or a lock request (for a participant)
+	clientRequest packet.Message
+
+	// The fencing token of the leader's lease, sent with every write request
+	// (as coordinator of a write; 0 if coordinated by a replica, see
+	// partitioning.go)
+	token uint64
+
+	// The version of the coordinator's configuration
+	version uint64
+
+	// State relevent in modes coordinatingRead and coordinatingWrite:
+
+	quorumMembers map[int]packet.Message
+	// The size of the quorum, including this node
+	quorumSize int
+	// The number of nodes we are waiting for before we can continue
+	numWaitingNodes int
+
+	// Writes made in Store for this transaction, which are committed (or
+	// rolled back) together
+	uncommitted []stagedWrite
+
+	// State relevant to a write with a sloppy quorum: the owner of the write
+	// sent to each substitute, and every replica replaced (see substitute)
+	hints    map[int]int
+	replaced map[int]bool
+
+	// False if no message for this transaction has been received since the
+	// last internal timer signal
+	active bool
+}
+
+// members returns the IDs of the nodes in t.quorumMembers in ascending order,
+// so that requests are sent (and responses compared) in the same order on
+// every run.
+func (t *txnState) members() []int {
+	ids := make([]int, 0, len(t.quorumMembers))
+	for id := range t.quorumMembers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// A stagedWrite is a write (or delete) made with Store.Put (or Store.Delete)
+// which has not yet been committed.
+type stagedWrite struct {
+	key  []byte
+	txid int
+}
+
+// Options are the optional features of a Dbnode. The zero value is a node
+// with an in-memory store and the ring elector, in a strict quorum system in
+// which every node stores every key, with every other feature disabled.
+// Fields:
+// Store: the type of the underlying store (on disk or in main memory).
+// Elector: the leader election algorithm.
+// SloppyQuorum: true enables background writes to achieve eventual
+// consistency, and lets writes substitute unresponsive replicas (see
+// substitute).
+// AntiEntropy: the mean interval between anti-entropy rounds started by this
+// node, to repair replicas which missed writes (0 disables anti-entropy).
+// ReadRepair: whether (and how) reads repair stale replicas in their quorum.
+// Ring: the nodes which store each key (nil if every node stores every key),
+// to which quorum sizes are relative.
+// Members: the nodes initially in the cluster, to which quorum sizes are
+// relative (nil for every node). Others may join later (see membership.go).
+// LogWrites: true logs every write commit and background write.
+// Events: the log of failures, elections and (if LogWrites) writes (or nil).
+// Seed: the seed of every random choice made by the node (of quorum members,
+// substitutes, anti-entropy peers and intervals, and election timeouts). Nodes
+// with the same seed still make different choices from each other.
+type Options struct {
+	Store        datastore.Kind
+	Elector      elector.Kind
+	SloppyQuorum bool
+	AntiEntropy  time.Duration
+	ReadRepair   ReadRepair
+	Ring         *hashring.Ring
+	Members      []int
+	LogWrites    bool
+	Events       *eventlog.Log
+	Seed         int64
 }
 
 // New creates a new database node and starts the main loop to handle requests
@@ -81,27 +253,33 @@ type Dbnode struct {
 // without delay.
 //
 // Parameters:
-// n: the number of database nodes in the system.
+// n: the number of database nodes in the system, including any which are not
+// members.
 // id: the id of this node (0 <= id < n).
 // lockTimeout: the time to wait before aborting a transaction (where applicable).
-// persistentStore: indicates whether the underlying store should use disk or
-// main memory.
 // rqs: the minimum size of a read quorum.
 // wqs: the minimum size of a write quorum.
-// sloppyQuorum: true enables background writes to achieve eventual consistency.
-func New(n int, id int, lockTimeout time.Duration, persistentStore bool, rqs uint, wqs uint, sloppyQuorum bool, logWrites bool) *Dbnode {
-	outgoing := make(chan packet.Message, 1000)
+// o: the optional features of the node (see Options).
+// clk: the source of time for all timeouts and delays.
+func New(n int, id int, lockTimeout time.Duration, rqs uint, wqs uint, o Options, clk clock.Clock) *Dbnode {
+	outgoing := clock.NewChan[packet.Message](clk, 1000)
 
-	var store datastore.Store
-	if persistentStore {
-		store = datastore.New(filepath.Join("data", strconv.Itoa(id)))
-	} else {
-		store = datastore.New("")
+	store := datastore.New(o.Store, filepath.Join("data", strconv.Itoa(id)), clk)
+
+	members := o.Members
+	if members == nil {
+		for i := 0; i < n; i++ {
+			members = append(members, i)
+		}
 	}
+	initial := initialConfig(members, int(rqs), int(wqs))
+
+	random := rand.New(rand.NewSource(o.Seed + int64(id)))
 
 	var p *propagater
-	if sloppyQuorum {
-		p = newPropagater(id, n, int(rqs), outgoing)
+	if o.SloppyQuorum {
+		p = newPropagater(id, n, int(rqs), o.Ring, outgoing, clk)
+		p.reconfigure(initial.members, initial.rqs)
 	}
 
 	state := &Dbnode{
@@ -109,26 +287,51 @@ func New(n int, id int, lockTimeout time.Duration, persistentStore bool, rqs uin
 		numPeers:        n - 1,
 		readQuorumSize:  int(rqs),
 		writeQuorumSize: int(wqs),
-		Incoming:        make(chan packet.Message, 1000),
+		Incoming:        clock.NewChan[packet.Message](clk, 1000),
 		Outgoing:        outgoing,
 		lockTimeout:     lockTimeout,
 		Store:           store,
-		currentTxid:     -1,
+		txns:            make(map[int]*txnState),
+		lockQueuedAt:    make(map[*packet.Message]time.Time),
 
-		requestRepeater:       repeater.New(n, outgoing, lockTimeout, 3),
+		requestRepeater:       repeater.New(n, outgoing, lockTimeout, 3, clk),
 		backgroundWriteDaemon: p,
 		unlockTxids:           make(map[int]bool),
 
-		stateQueryReq: make(chan bool),
-		stateQueryRes: make(chan int),
+		stateQueryReq: clock.NewChan[bool](clk, 0),
+		stateQueryRes: clock.NewChan[Stats](clk, 0),
+
+		statusQueryReq: clock.NewChan[bool](clk, 0),
+		statusQueryRes: clock.NewChan[Status](clk, 0),
 
-		internalTimer: make(chan int),
-		elector:       elector.New(id, n, outgoing),
+		internalTimer: clock.NewChan[bool](clk, 0),
+		elector:       elector.New(o.Elector, id, initial.members, outgoing, random.Int63(), o.Events, clk),
 
-		logWrites: logWrites,
+		readRepair: o.ReadRepair,
+		ring:       o.Ring,
+
+		config:        initial,
+		initialConfig: initial,
+
+		hints:       make(map[int][]packet.Entry),
+		handoffSent: make(map[int]time.Time),
+
+		logWrites: o.LogWrites,
+		events:    o.Events,
+
+		random: random,
+
+		clock: clk,
 	}
 
-	go state.handleRequests()
+	clk.Go(state.handleRequests)
+
+	if o.AntiEntropy > 0 {
+		antiEntropyRandom := rand.New(rand.NewSource(random.Int63()))
+		clk.Go(func() {
+			state.startAntiEntropy(o.AntiEntropy, antiEntropyRandom)
+		})
+	}
 
 	return state
 }
@@ -137,28 +340,36 @@ func New(n int, id int, lockTimeout time.Duration, persistentStore bool, rqs uin
 // must not block; all blocking operations should be in separate goroutines,
 // which communicate with the main loop by sending messages.
 func (n *Dbnode) handleRequests() {
-	go n.setInternalTimer()
+	n.clock.Go(n.setInternalTimer)
 
-	timeoutCounter := 0
-	n.internalTimer <- timeoutCounter
+	n.internalTimer.Send(true)
 
-	timedOutLockRequests := make(chan *packet.Message, 10)
+	timedOutLockRequests := clock.NewChan[*packet.Message](n.clock, 10)
 
+	var incoming packet.Message
+	var timedOut *packet.Message
 	for {
-		select {
-		case msg := <-n.Incoming:
+		switch clock.Select(
+			n.Incoming.RecvCase(&incoming, nil),
+			timedOutLockRequests.RecvCase(&timedOut, nil),
+			n.stateQueryReq.RecvCase(nil, nil),
+			n.statusQueryReq.RecvCase(nil, nil),
+		) {
+		case 0:
+			// A new variable, since pointers to queued lock requests
+			// identify them
+			msg := incoming
 			if n.disabled || msg.DemuxKey == packet.ControlRecover {
 				if n.disabled && msg.DemuxKey == packet.ControlRecover {
 					n.disabled = false
-					timeoutCounter = 0
-					n.internalTimer <- timeoutCounter
+					n.internalTimer.Send(true)
 
 					n.requestRepeater.Recover()
 					n.elector.ProcessMsg(packet.Message{
 						DemuxKey: packet.ControlRecover,
 					})
 
-					fmt.Printf("Node %v recovered\n", n.id)
+					n.events.Emit(eventlog.NodeRecovered(n.id))
 				}
 
 				continue
@@ -173,13 +384,13 @@ func (n *Dbnode) handleRequests() {
 						DemuxKey: packet.ControlFail,
 					})
 
-					fmt.Printf("Node %v failed while in mode %v\n", n.id, n.currentMode)
+					n.events.Emit(eventlog.NodeFailed(n.id, len(n.txns)))
 
-					if n.currentMode != coordinatingWrite && n.currentMode != assemblingQuorum {
-						n.currentMode = idle
-						n.currentTxid = -1
-						n.clientRequest = packet.Message{}
-						n.quorumMembers = nil
+					for _, t := range n.txnsInOrder() {
+						if t.mode != coordinatingWrite && t.mode != assemblingQuorum {
+							n.rollbackStaged(t)
+							n.release(t)
+						}
 					}
 				}
 
@@ -190,22 +401,32 @@ func (n *Dbnode) handleRequests() {
 				log.Fatal("Midelivered message", msg)
 			}
 
-			if msg.DemuxKey == packet.InternalTimerSignal {
-				if msg.Id == timeoutCounter {
-					switch n.currentMode {
-					case coordinatingRead:
-						n.abortProcessing()
-					case coordinatingWrite:
-						n.abortProcessing()
-					case assemblingQuorum:
-						n.abortProcessing()
-					case processingRead:
-						n.abortProcessing()
+			// Any message from a node shows that it can receive its hints
+			if n.hints[msg.Src] != nil {
+				n.handOff(msg.Src)
+			}
+
+			switch msg.DemuxKey {
+			case packet.InternalTimerSignal:
+				// Abort every transaction which has not progressed
+				// since the last signal
+				for _, t := range n.txnsInOrder() {
+					switch t.mode {
+					case coordinatingRead, coordinatingWrite, assemblingQuorum, processingRead, coordinatingScan:
+						if !t.active {
+							n.abortProcessing(t)
+						}
+						t.active = false
 					}
 				}
-				n.internalTimer <- timeoutCounter
-			} else {
-				timeoutCounter++
+				n.configTimerSignal()
+				n.internalTimer.Send(true)
+			case packet.ElectionElect, packet.ElectionCoordinator, packet.ElectionAck, packet.ElectionLeaseRequest, packet.ElectionLeaseResponse, packet.NodeBackgroundWriteRequest, packet.NodeBackgroundWriteResponse, packet.InternalSync, packet.NodeSyncRequest, packet.NodeSyncEntries, packet.NodeRepairRequest, packet.NodeHintRequest, packet.NodeHandoffRequest, packet.NodeHandoffResponse, packet.ClientMembershipRequest, packet.NodeConfigPrepare, packet.NodeConfigPromise, packet.NodeConfigAccept, packet.NodeConfigAccepted, packet.NodeConfigCommit, packet.NodeConfigRecover, packet.NodeCatchUpRequest, packet.NodeCatchUpResponse, packet.NodeCaughtUp:
+				// Not part of any transaction
+			default:
+				if t := n.txns[msg.Id]; t != nil {
+					t.active = true
+				}
 			}
 
 			// Occasionally delete stale unlockTxids
@@ -214,27 +435,43 @@ func (n *Dbnode) handleRequests() {
 			}
 
 			switch msg.DemuxKey {
-			case packet.ClientWriteRequest, packet.ClientStrongWriteRequest:
-				if n.writeQuorumSize == 1 {
+			case packet.ClientReadRequest, packet.ClientScanRequest, packet.ClientWriteRequest, packet.ClientStrongWriteRequest, packet.ClientDeleteRequest, packet.ClientTxnRequest, packet.InternalGarbageCollect:
+				// A node which is not a member cannot coordinate
+				if !n.config.isMember(n.id) {
+					continue
+				}
+			}
+
+			switch msg.DemuxKey {
+			case packet.ClientWriteRequest, packet.ClientStrongWriteRequest, packet.ClientDeleteRequest, packet.ClientTxnRequest, packet.InternalGarbageCollect:
+				// Garbage collection locks every node, so always uses the
+				// leader, even when writes do not.
+				if n.writeQuorumSize == 1 && n.ring == nil && msg.DemuxKey == packet.ClientTxnRequest {
+					n.processLocalTxn(msg)
+				} else if n.writeQuorumSize == 1 && msg.DemuxKey != packet.InternalGarbageCollect {
 					n.processLocalWrite(msg)
-				} else if n.elector.Leader() == n.id {
-					n.lockRequests.enqueue(&msg)
-					go func() {
-						time.Sleep(10 * n.lockTimeout)
-						timedOutLockRequests <- &msg
-					}()
+				} else if n.replicaCoordinates(msg) && !n.replicates(msg.Key) {
+					n.forwardToReplica(msg)
+				} else if n.replicaCoordinates(msg) || n.elector.Leader() == n.id {
+					n.queueLockRequest(&msg)
+					n.clock.Go(func() {
+						n.clock.Sleep(10 * n.lockTimeout)
+						timedOutLockRequests.Send(&msg)
+					})
 				} else {
 					n.elector.ForwardToLeader(msg)
 				}
-			case packet.ClientReadRequest, packet.NodeLockRequest, packet.NodeLockRequestNoTimeout:
+			case packet.ClientReadRequest, packet.ClientScanRequest, packet.NodeLockRequest, packet.NodeLockRequestNoTimeout:
 				if msg.DemuxKey == packet.ClientReadRequest && n.readQuorumSize == 1 {
 					n.processLocalRead(msg)
+				} else if msg.DemuxKey == packet.ClientScanRequest && n.readQuorumSize == 1 && n.ring == nil {
+					n.processLocalScan(msg)
 				} else {
-					n.lockRequests.enqueue(&msg)
-					go func() {
-						time.Sleep(n.lockTimeout)
-						timedOutLockRequests <- &msg
-					}()
+					n.queueLockRequest(&msg)
+					n.clock.Go(func() {
+						n.clock.Sleep(n.lockTimeout)
+						timedOutLockRequests.Send(&msg)
+					})
 				}
 			case packet.NodeLockResponse:
 				n.handleLockRes(msg)
@@ -250,83 +487,100 @@ func (n *Dbnode) handleRequests() {
 				n.handlePutReq(msg)
 			case packet.NodePutResponse:
 				n.handlePutRes(msg)
+			case packet.NodeGarbageCollectRequest:
+				n.handleGarbageCollectReq(msg)
 			case packet.NodeTimestampRequest:
 				n.handleTimestampReq(msg)
+			case packet.NodeTxnTimestampRequest:
+				n.handleTxnTimestampReq(msg)
+			case packet.NodeTxnPutRequest:
+				n.handleTxnPutReq(msg)
+			case packet.NodeScanRequest:
+				n.handleScanReq(msg)
+			case packet.NodeScanResponse:
+				n.handleScanRes(msg)
 			case packet.NodeBackgroundWriteRequest:
 				n.handleBackgroundWriteReq(msg)
 			case packet.NodeBackgroundWriteResponse:
 				n.handleBackgroundWriteRes(msg)
+			case packet.InternalSync:
+				n.startSync()
+			case packet.NodeSyncRequest:
+				n.handleSyncReq(msg)
+			case packet.NodeSyncEntries:
+				n.handleSyncEntries(msg)
+			case packet.NodeRepairRequest:
+				n.handleRepairReq(msg)
+			case packet.NodeRepairResponse:
+				n.handleRepairRes(msg)
+			case packet.InternalSubstitute:
+				n.substitute(msg)
+			case packet.NodeHintRequest:
+				n.handleHintReq(msg)
+			case packet.NodeHandoffRequest:
+				n.handleHandoffReq(msg)
+			case packet.NodeHandoffResponse:
+				n.handleHandoffRes(msg)
+			case packet.ClientMembershipRequest, packet.NodeConfigRecover, packet.NodeCaughtUp:
+				if n.elector.Leader() != n.id {
+					n.elector.ForwardToLeader(msg)
+				} else if msg.DemuxKey == packet.ClientMembershipRequest {
+					n.handleMembershipReq(msg)
+				} else if msg.DemuxKey == packet.NodeConfigRecover {
+					n.handleConfigRecover(msg)
+				} else {
+					n.handleCaughtUp(msg)
+				}
+			case packet.NodeConfigPrepare:
+				n.handleConfigPrepare(msg)
+			case packet.NodeConfigPromise:
+				n.handleConfigPromise(msg)
+			case packet.NodeConfigAccept:
+				n.handleConfigAccept(msg)
+			case packet.NodeConfigAccepted:
+				n.handleConfigAccepted(msg)
+			case packet.NodeConfigCommit:
+				n.handleConfigCommit(msg)
+			case packet.NodeCatchUpRequest:
+				n.handleCatchUpReq(msg)
+			case packet.NodeCatchUpResponse:
+				n.handleCatchUpRes(msg)
 			case packet.InternalTimerSignal:
 				// Do nothing (already dealt with above)
-			case packet.ElectionElect, packet.ElectionCoordinator, packet.ElectionAck:
-				timeoutCounter--
+			case packet.ElectionElect, packet.ElectionCoordinator, packet.ElectionAck, packet.ElectionLeaseRequest, packet.ElectionLeaseResponse:
 				n.elector.ProcessMsg(msg)
 			default:
 				log.Fatal("Unexpected message type", msg)
 			}
 
-			if n.currentMode == idle && !n.lockRequests.empty() {
-				msg = *n.lockRequests.dequeue()
-
-				// Don't lock for a transaction for which we have
-				// previously received an unlock request.
-				if n.unlockTxids[msg.Id] {
-					continue
-				}
-
-				n.currentTxid = msg.Id
-				n.clientRequest = msg
-
-				switch msg.DemuxKey {
-				case packet.ClientReadRequest:
-					if fastReads {
-						n.currentMode = coordinatingFastRead
-					} else {
-						n.currentMode = coordinatingRead
-					}
-					n.continueProcessing()
-				case packet.ClientWriteRequest, packet.ClientStrongWriteRequest:
-					n.currentMode = assemblingQuorum
-					n.continueProcessing()
-				case packet.NodeLockRequest:
-					n.currentMode = processingRead
-					n.Outgoing <- packet.Message{
-						Id:       msg.Id,
-						Src:      n.id,
-						Dest:     msg.Src,
-						DemuxKey: packet.NodeLockResponse,
-						Ok:       true,
-					}
-				case packet.NodeLockRequestNoTimeout:
-					n.currentMode = processingWrite
-					n.Outgoing <- packet.Message{
-						Id:       msg.Id,
-						Src:      n.id,
-						Dest:     msg.Src,
-						DemuxKey: packet.NodeLockResponse,
-						Ok:       true,
-					}
-				default:
-					log.Fatal("Unexpected message type", msg)
-				}
-			}
-		case msg := <-timedOutLockRequests:
+			n.grantLockRequests()
+		case 1:
+			msg := timedOut
 			if n.disabled {
 				continue
 			}
 
 			if n.lockRequests.remove(msg) {
+				delete(n.lockQueuedAt, msg)
+
+				if msg.DemuxKey == packet.InternalGarbageCollect {
+					n.scheduleGarbageCollection(msg.Key, msg.Timestamp)
+					continue
+				}
+
 				var resType packet.Messagetype
 				switch msg.DemuxKey {
 				case packet.ClientReadRequest:
 					resType = packet.ClientReadResponse
-				case packet.ClientWriteRequest, packet.ClientStrongWriteRequest:
+				case packet.ClientScanRequest:
+					resType = packet.ClientScanResponse
+				case packet.ClientWriteRequest, packet.ClientStrongWriteRequest, packet.ClientDeleteRequest, packet.ClientTxnRequest:
 					resType = packet.ClientWriteResponse
 				default:
 					resType = packet.NodeLockResponse
 				}
 
-				n.Outgoing <- packet.Message{
+				n.Outgoing.Send(packet.Message{
 					Id:       msg.Id,
 					Src:      n.id,
 					Dest:     msg.Src,
@@ -334,26 +588,156 @@ func (n *Dbnode) handleRequests() {
 					Key:      msg.Key,
 					Value:    msg.Value,
 					Ok:       false,
-				}
-			} else if msg.Id == n.currentTxid && (msg.DemuxKey == packet.ClientReadRequest || msg.DemuxKey == packet.ClientWriteRequest || msg.DemuxKey == packet.ClientStrongWriteRequest) {
-				n.abortProcessing()
+				})
+			} else if t := n.txns[msg.Id]; t != nil && msg.DemuxKey != packet.NodeLockRequest && msg.DemuxKey != packet.NodeLockRequestNoTimeout {
+				n.abortProcessing(t)
+				n.grantLockRequests()
 			}
-		case <-n.stateQueryReq:
-			n.stateQueryRes <- n.currentTxid
+		case 2:
+			n.stateQueryRes.Send(Stats{
+				OldestTxid:   n.oldestTxid(),
+				Transactions: len(n.txns),
+				LockQueue:    n.lockRequests.length(),
+				LockWaits:    n.lockWaits,
+			})
+			n.lockWaits = nil
+		case 3:
+			n.statusQueryRes.Send(n.status())
 		}
 	}
 }
 
+// startTxn starts a transaction for a lock request, once every key it needs
+// has been locked. A write coordinated by this node is sent with the given
+// fencing token.
+func (n *Dbnode) startTxn(msg packet.Message, locks lockSet, token uint64) {
+	participant := msg.DemuxKey == packet.NodeLockRequest || msg.DemuxKey == packet.NodeLockRequestNoTimeout
+	if participant && n.fenced(msg) || msg.DemuxKey == packet.NodeLockRequestNoTimeout && !n.checkToken(msg.Token) {
+		n.Outgoing.Send(packet.Message{
+			Id:       msg.Id,
+			Src:      n.id,
+			Dest:     msg.Src,
+			DemuxKey: packet.NodeLockResponse,
+			Ok:       false,
+		})
+		return
+	}
+
+	n.numTxns++
+
+	t := &txnState{
+		locks:         locks,
+		seq:           n.numTxns,
+		clientRequest: msg,
+		token:         token,
+		version:       n.config.version,
+		active:        true,
+	}
+	if participant {
+		t.version = msg.Timestamp
+	}
+	n.txns[msg.Id] = t
+
+	switch msg.DemuxKey {
+	case packet.ClientReadRequest:
+		if fastReads {
+			t.mode = coordinatingFastRead
+		} else {
+			t.mode = coordinatingRead
+		}
+		n.continueProcessing(t)
+	case packet.ClientScanRequest:
+		t.mode = coordinatingScan
+		n.continueProcessing(t)
+	case packet.ClientWriteRequest, packet.ClientStrongWriteRequest, packet.ClientDeleteRequest, packet.ClientTxnRequest, packet.InternalGarbageCollect:
+		t.mode = assemblingQuorum
+		n.continueProcessing(t)
+	case packet.NodeLockRequest:
+		t.mode = processingRead
+		n.Outgoing.Send(packet.Message{
+			Id:       msg.Id,
+			Src:      n.id,
+			Dest:     msg.Src,
+			DemuxKey: packet.NodeLockResponse,
+			Ok:       true,
+		})
+	case packet.NodeLockRequestNoTimeout:
+		t.mode = processingWrite
+		n.Outgoing.Send(packet.Message{
+			Id:       msg.Id,
+			Src:      n.id,
+			Dest:     msg.Src,
+			DemuxKey: packet.NodeLockResponse,
+			Ok:       true,
+		})
+	default:
+		log.Fatal("Unexpected message type", msg)
+	}
+}
+
+// checkToken returns false if token is less than the fencing token of a write
+// request already received, since the leader which sent it no longer holds its
+// lease (and may not know). Otherwise, it records token. If keys are
+// partitioned, a write coordinated by a replica rather than the leader (see
+// partitioning.go) has token 0, and is never refused.
+func (n *Dbnode) checkToken(token uint64) bool {
+	if token == 0 && n.ring != nil {
+		return true
+	}
+	if token < n.fencingToken {
+		return false
+	}
+
+	n.fencingToken = token
+	return true
+}
+
+// release ends transaction t, releasing its locks.
+func (n *Dbnode) release(t *txnState) {
+	delete(n.txns, t.clientRequest.Id)
+}
+
+// oldestTxid returns the ID of the transaction in progress which was started
+// first, or -1 if there is none.
+func (n *Dbnode) oldestTxid() int {
+	txid := -1
+	seq := 0
+
+	for id, t := range n.txns {
+		if seq == 0 || t.seq < seq {
+			txid = id
+			seq = t.seq
+		}
+	}
+
+	return txid
+}
+
+// txnsInOrder returns the transactions in progress in the order they were
+// started, so that they are aborted (and their messages sent) in the same order
+// on every run.
+func (n *Dbnode) txnsInOrder() []*txnState {
+	txns := make([]*txnState, 0, len(n.txns))
+	for _, t := range n.txns {
+		txns = append(txns, t)
+	}
+	sort.Slice(txns, func(i, j int) bool {
+		return txns[i].seq < txns[j].seq
+	})
+
+	return txns
+}
+
 func (n *Dbnode) setInternalTimer() {
 	for {
-		c := <-n.internalTimer
-		time.Sleep(n.lockTimeout)
-		n.Incoming <- packet.Message{
-			Id:       c,
+		n.internalTimer.Recv()
+		n.clock.Sleep(n.lockTimeout)
+		n.Incoming.Send(packet.Message{
+			Id:       -1,
 			Src:      n.id,
 			Dest:     n.id,
 			DemuxKey: packet.InternalTimerSignal,
-		}
+		})
 	}
 }
 
@@ -374,28 +758,65 @@ func (n *Dbnode) cleanUnlockTxids() {
 	}
 }
 
+// stage records a write made with Store.Put or Store.Delete, which returned
+// txid, to be committed with the rest of transaction t. It returns false if the
+// write failed.
+func (n *Dbnode) stage(t *txnState, key []byte, txid int) bool {
+	if txid == 0 {
+		return false
+	}
+
+	t.uncommitted = append(t.uncommitted, stagedWrite{key, txid})
+
+	return true
+}
+
+// commitStaged commits every write staged by t, and returns false if any
+// commit failed.
+func (n *Dbnode) commitStaged(t *txnState) bool {
+	ok := true
+	for _, w := range t.uncommitted {
+		ok = n.Store.Commit(w.key, w.txid) && ok
+	}
+
+	t.uncommitted = nil
+
+	return ok
+}
+
+// rollbackStaged rolls back every write staged by t. Requests to stage writes
+// may be repeated, so any writes already staged must be rolled back before
+// staging them again, so that they are not committed twice.
+func (n *Dbnode) rollbackStaged(t *txnState) {
+	for _, w := range t.uncommitted {
+		n.Store.Rollback(w.txid)
+	}
+
+	t.uncommitted = nil
+}
+
 func (n *Dbnode) processLocalRead(msg packet.Message) {
 	// If busy, just try again after a short wait
-	if len(n.uncommitedKey) > 0 {
-		n.Outgoing <- msg
+	if n.hasStagedWrites(keyLocks(msg.Key)) {
+		n.Outgoing.Send(msg)
 		return
 	}
 
 	val, err := n.Store.Get(msg.Key)
 
 	if err != nil {
-		n.Outgoing <- packet.Message{
+		n.Outgoing.Send(packet.Message{
 			Id:       msg.Id,
 			Src:      n.id,
 			Dest:     msg.Src,
 			DemuxKey: packet.ClientReadResponse,
 			Key:      msg.Key,
 			Ok:       false,
-		}
+		})
 	} else {
 		timestamp, val := decodeTimestampVal(val)
 
-		n.Outgoing <- packet.Message{
+		n.Outgoing.Send(packet.Message{
 			Id:        msg.Id,
 			Src:       n.id,
 			Dest:      msg.Src,
@@ -404,20 +825,20 @@ func (n *Dbnode) processLocalRead(msg packet.Message) {
 			Value:     val,
 			Timestamp: timestamp,
 			Ok:        true,
-		}
+		})
 	}
 }
 
 func (n *Dbnode) processLocalWrite(msg packet.Message) {
 	// If busy, just try again after a short wait
-	if len(n.uncommitedKey) > 0 {
-		n.Outgoing <- msg
+	if n.hasStagedWrites(keyLocks(msg.Key)) {
+		n.Outgoing.Send(msg)
 		return
 	}
 
 	oldVal, err := n.Store.Get(msg.Key)
 	if err != nil {
-		n.Outgoing <- packet.Message{
+		n.Outgoing.Send(packet.Message{
 			Id:       msg.Id,
 			Src:      n.id,
 			Dest:     msg.Src,
@@ -425,7 +846,7 @@ func (n *Dbnode) processLocalWrite(msg packet.Message) {
 			Key:      msg.Key,
 			Value:    msg.Value,
 			Ok:       false,
-		}
+		})
 		return
 	}
 
@@ -433,7 +854,7 @@ func (n *Dbnode) processLocalWrite(msg packet.Message) {
 	timestamp++
 
 	if timestamp != msg.Timestamp && msg.DemuxKey == packet.ClientStrongWriteRequest {
-		n.Outgoing <- packet.Message{
+		n.Outgoing.Send(packet.Message{
 			Id:        msg.Id,
 			Src:       n.id,
 			Dest:      msg.Src,
@@ -442,17 +863,22 @@ func (n *Dbnode) processLocalWrite(msg packet.Message) {
 			Value:     oldVal,
 			Timestamp: timestamp,
 			Ok:        false,
-		}
+		})
 
 		return
 	}
 
-	newVal := encodeTimestampVal(timestamp, msg.Value)
+	tombstone := msg.DemuxKey == packet.ClientDeleteRequest
+	newVal := encodeStoredVal(timestamp, msg.Value, tombstone)
 
 	txid := n.Store.Put(msg.Key, newVal)
 	ok := n.Store.Commit(msg.Key, txid)
 
-	n.Outgoing <- packet.Message{
+	if ok && tombstone {
+		n.scheduleGarbageCollection(msg.Key, timestamp)
+	}
+
+	n.Outgoing.Send(packet.Message{
 		Id:        msg.Id,
 		Src:       n.id,
 		Dest:      msg.Src,
@@ -461,24 +887,150 @@ func (n *Dbnode) processLocalWrite(msg packet.Message) {
 		Value:     msg.Value,
 		Timestamp: timestamp,
 		Ok:        ok,
+		Tombstone: tombstone,
+	})
+}
+
+// processLocalTxn writes every key in a transaction, when the write quorum is
+// just this node.
+func (n *Dbnode) processLocalTxn(msg packet.Message) {
+	// If busy, just try again after a short wait
+	if n.hasStagedWrites(lockSetOf(msg)) {
+		n.Outgoing.Send(msg)
+		return
+	}
+
+	res := packet.Message{
+		Id:       msg.Id,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.ClientWriteResponse,
+		Key:      msg.Key,
+		Value:    msg.Value,
+		Ok:       false,
+	}
+
+	writes, err := decodeTxn(msg.Value)
+	if err != nil {
+		n.Outgoing.Send(res)
+		return
+	}
+
+	latest, err := n.txnTimestamps(writes)
+	if err != nil {
+		n.Outgoing.Send(res)
+		return
+	}
+
+	if !assignTxnTimestamps(writes, latest) {
+		res.Value = packet.EncodeEntries(writes)
+		n.Outgoing.Send(res)
+		return
+	}
+
+	// Nothing else runs until the writes are committed, so there is no need
+	// to lock them, but they are staged to commit them together.
+	t := &txnState{}
+	for _, w := range writes {
+		if !n.stage(t, w.Key, n.Store.Put(w.Key, encodeStoredVal(w.Timestamp, w.Value, w.Tombstone))) {
+			n.rollbackStaged(t)
+			n.Outgoing.Send(res)
+			return
+		}
+	}
+
+	res.Ok = n.commitStaged(t)
+	res.Value = packet.EncodeEntries(writes)
+
+	if res.Ok {
+		for _, w := range writes {
+			if w.Tombstone {
+				n.scheduleGarbageCollection(w.Key, w.Timestamp)
+			}
+		}
+	}
+
+	n.Outgoing.Send(res)
+}
+
+// txnTimestamps returns the latest timestamp stored for every key written by a
+// transaction (and whether that is the timestamp of a tombstone).
+func (n *Dbnode) txnTimestamps(writes []packet.Entry) ([]packet.Entry, error) {
+	latest := make([]packet.Entry, len(writes))
+
+	for i, w := range writes {
+		val, err := n.Store.Get(w.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		latest[i].Key = w.Key
+		latest[i].Timestamp, _, latest[i].Tombstone = decodeStoredVal(val)
 	}
+
+	return latest, nil
+}
+
+func (n *Dbnode) processLocalScan(msg packet.Message) {
+	// If busy, just try again after a short wait
+	if n.hasStagedWrites(lockSetOf(msg)) {
+		n.Outgoing.Send(msg)
+		return
+	}
+
+	entries, err := n.scanLocal(msg.Key, msg.Value)
+
+	n.Outgoing.Send(packet.Message{
+		Id:       msg.Id,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.ClientScanResponse,
+		Key:      msg.Key,
+		Value:    packet.EncodeEntries(removeTombstones(entries)),
+		Ok:       err == nil,
+	})
+}
+
+// scanLocal reads every committed key k, start <= k < end, from the local
+// store, including tombstones. An empty end is unbounded.
+func (n *Dbnode) scanLocal(start, end []byte) ([]packet.Entry, error) {
+	if len(end) == 0 {
+		end = nil
+	}
+
+	var entries []packet.Entry
+
+	it := n.Store.Scan(start, end)
+	for it.Next() {
+		timestamp, val, tombstone := decodeStoredVal(it.Value())
+		entries = append(entries, packet.Entry{
+			Key:       it.Key(),
+			Value:     val,
+			Timestamp: timestamp,
+			Tombstone: tombstone,
+		})
+	}
+
+	return entries, it.Err()
 }
 
 func (n *Dbnode) handleLockRes(msg packet.Message) {
 	n.requestRepeater.Ack(msg)
 
-	if n.currentTxid == msg.Id && (n.currentMode == coordinatingRead || n.currentMode == assemblingQuorum) {
+	// A replica replaced by a substitute is no longer in the quorum (see
+	// substitute)
+	if t := n.txns[msg.Id]; t != nil && (t.mode == coordinatingRead || t.mode == assemblingQuorum) && !t.replaced[msg.Src] {
 		if !msg.Ok {
-			n.abortProcessing()
+			n.abortProcessing(t)
 			return
 		}
 
 		// Make sure we don't count multiple responses from the same node
-		if n.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
-			n.quorumMembers[msg.Src] = msg
-			n.numWaitingNodes--
-			if n.numWaitingNodes == 0 {
-				n.continueProcessing()
+		if t.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
+			t.quorumMembers[msg.Src] = msg
+			t.numWaitingNodes--
+			if t.numWaitingNodes == 0 {
+				n.continueProcessing(t)
 			}
 		}
 	} else if msg.Ok {
@@ -493,26 +1045,25 @@ func (n *Dbnode) handleLockRes(msg packet.Message) {
 }
 
 func (n *Dbnode) handleUnlockReq(msg packet.Message) {
-	if n.currentTxid == msg.Id && n.uncommitedTxid > 0 && msg.Ok {
-		n.Store.Commit(n.uncommitedKey, n.uncommitedTxid)
-		n.uncommitedKey = nil
-		n.uncommitedTxid = 0
-	}
+	if t := n.txns[msg.Id]; t != nil && (t.mode == processingRead || t.mode == processingWrite) {
+		if msg.Ok {
+			n.commitStaged(t)
+		} else {
+			n.rollbackStaged(t)
+		}
 
-	if n.currentTxid == msg.Id {
-		n.currentMode = idle
-		n.currentTxid = -1
+		n.release(t)
 	}
 
 	n.unlockTxids[msg.Id] = true
 
-	n.Outgoing <- packet.Message{
+	n.Outgoing.Send(packet.Message{
 		Id:       msg.Id,
 		Src:      n.id,
 		Dest:     msg.Src,
 		DemuxKey: packet.NodeUnlockAck,
 		Ok:       true,
-	}
+	})
 }
 
 func (n *Dbnode) handleUnlockAck(msg packet.Message) {
@@ -522,18 +1073,19 @@ func (n *Dbnode) handleUnlockAck(msg packet.Message) {
 func (n *Dbnode) handleGetReq(msg packet.Message) {
 	var val []byte
 	var timestamp uint64
-	var ok bool
+	var ok, tombstone bool
 
-	if n.currentMode == processingRead && n.currentTxid == msg.Id || fastReads &&
-		n.uncommitedKey == nil {
+	t := n.txns[msg.Id]
+	if t != nil && t.mode == processingRead || fastReads &&
+		(t != nil || !n.fenced(msg)) && !n.hasStagedWrites(keyLocks(msg.Key)) {
 		var err error
 		val, err = n.Store.Get(msg.Key)
 		ok = err == nil
 		if ok {
-			timestamp, val = decodeTimestampVal(val)
+			timestamp, val, tombstone = decodeStoredVal(val)
 		}
 	}
-	n.Outgoing <- packet.Message{
+	n.Outgoing.Send(packet.Message{
 		Id:        msg.Id,
 		Src:       n.id,
 		Dest:      msg.Src,
@@ -542,25 +1094,85 @@ func (n *Dbnode) handleGetReq(msg packet.Message) {
 		Value:     val,
 		Timestamp: timestamp,
 		Ok:        ok,
-	}
+		Tombstone: tombstone,
+	})
 }
 
 func (n *Dbnode) handleGetRes(msg packet.Message) {
 	n.requestRepeater.Ack(msg)
 
-	if n.currentTxid == msg.Id && (n.currentMode == coordinatingRead ||
-		n.currentMode == coordinatingWrite ||
-		n.currentMode == coordinatingFastRead) {
+	if t := n.txns[msg.Id]; t != nil && (t.mode == coordinatingRead ||
+		t.mode == coordinatingWrite ||
+		t.mode == coordinatingFastRead) && !n.awaitingRepair(t) {
+		if !msg.Ok && t.mode == coordinatingFastRead {
+			// The replica has staged a write to the key, which is likely
+			// about to commit, so ask it again (see retryFastRead)
+			n.retryFastRead(t.quorumMembers[msg.Src])
+			return
+		}
+		if !msg.Ok {
+			n.abortProcessing(t)
+			return
+		}
+
+		if t.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
+			t.quorumMembers[msg.Src] = msg
+			t.numWaitingNodes--
+			if t.numWaitingNodes == 0 {
+				n.continueProcessing(t)
+			}
+		}
+	}
+}
+
+// retryFastRead resends a fast read's get request to a replica which refused it
+// because a write to the key was in progress, after a tenth of the lock
+// timeout. The read aborts as usual if the write is still in progress when its
+// lock times out.
+func (n *Dbnode) retryFastRead(req packet.Message) {
+	n.clock.Go(func() {
+		n.clock.Sleep(n.lockTimeout / 10)
+		n.requestRepeater.Send(req, false)
+	})
+}
+
+func (n *Dbnode) handleScanReq(msg packet.Message) {
+	var entries []packet.Entry
+	var ok bool
+
+	// Like a fast read, a scan does not lock, but fails if a write to any
+	// key in the range is in progress.
+	if !n.fenced(msg) && !n.hasStagedWrites(lockSetOf(msg)) {
+		var err error
+		entries, err = n.scanLocal(msg.Key, msg.Value)
+		ok = err == nil
+	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:       msg.Id,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.NodeScanResponse,
+		Key:      msg.Key,
+		Value:    packet.EncodeEntries(entries),
+		Ok:       ok,
+	})
+}
+
+func (n *Dbnode) handleScanRes(msg packet.Message) {
+	n.requestRepeater.Ack(msg)
+
+	if t := n.txns[msg.Id]; t != nil && t.mode == coordinatingScan {
 		if !msg.Ok {
-			n.abortProcessing()
+			n.abortProcessing(t)
 			return
 		}
 
-		if n.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
-			n.quorumMembers[msg.Src] = msg
-			n.numWaitingNodes--
-			if n.numWaitingNodes == 0 {
-				n.continueProcessing()
+		if t.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
+			t.quorumMembers[msg.Src] = msg
+			t.numWaitingNodes--
+			if t.numWaitingNodes == 0 {
+				n.continueProcessing(t)
 			}
 		}
 	}
@@ -569,17 +1181,14 @@ func (n *Dbnode) handleGetRes(msg packet.Message) {
 func (n *Dbnode) handlePutReq(msg packet.Message) {
 	var ok bool
 
-	if n.currentMode == processingWrite && n.currentTxid == msg.Id {
-		val := encodeTimestampVal(msg.Timestamp, msg.Value)
+	if t := n.txns[msg.Id]; t != nil && t.mode == processingWrite && n.checkToken(msg.Token) {
+		val := encodeStoredVal(msg.Timestamp, msg.Value, msg.Tombstone)
 
-		n.uncommitedTxid = n.Store.Put(msg.Key, val)
-		if n.uncommitedTxid > 0 {
-			n.uncommitedKey = msg.Key
-			ok = true
-		}
+		n.rollbackStaged(t)
+		ok = n.stage(t, msg.Key, n.Store.Put(msg.Key, val))
 	}
 
-	n.Outgoing <- packet.Message{
+	n.Outgoing.Send(packet.Message{
 		Id:        msg.Id,
 		Src:       n.id,
 		Dest:      msg.Src,
@@ -588,23 +1197,78 @@ func (n *Dbnode) handlePutReq(msg packet.Message) {
 		Value:     msg.Value,
 		Timestamp: msg.Timestamp,
 		Ok:        ok,
+	})
+}
+
+// handleTxnPutReq stages every write in a transaction, which the coordinator
+// has already given timestamps. Either every write is staged, or none are.
+func (n *Dbnode) handleTxnPutReq(msg packet.Message) {
+	var ok bool
+
+	if t := n.txns[msg.Id]; t != nil && t.mode == processingWrite && n.checkToken(msg.Token) {
+		writes, err := packet.DecodeEntries(msg.Value)
+		ok = err == nil
+
+		n.rollbackStaged(t)
+		for i := 0; ok && i < len(writes); i++ {
+			if !n.replicates(writes[i].Key) {
+				continue
+			}
+			val := encodeStoredVal(writes[i].Timestamp, writes[i].Value, writes[i].Tombstone)
+			ok = n.stage(t, writes[i].Key, n.Store.Put(writes[i].Key, val))
+		}
+
+		if !ok {
+			n.rollbackStaged(t)
+		}
 	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:       msg.Id,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.NodePutResponse,
+		Key:      msg.Key,
+		Ok:       ok,
+	})
+}
+
+// handleGarbageCollectReq removes a tombstone, as the final stage of a garbage
+// collection transaction. The coordinator has already checked that no node has
+// a newer value.
+func (n *Dbnode) handleGarbageCollectReq(msg packet.Message) {
+	var ok bool
+
+	if t := n.txns[msg.Id]; t != nil && t.mode == processingWrite && n.checkToken(msg.Token) {
+		n.rollbackStaged(t)
+		ok = n.stage(t, msg.Key, n.Store.Delete(msg.Key))
+	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:        msg.Id,
+		Src:       n.id,
+		Dest:      msg.Src,
+		DemuxKey:  packet.NodePutResponse,
+		Key:       msg.Key,
+		Timestamp: msg.Timestamp,
+		Ok:        ok,
+	})
 }
 
 func (n *Dbnode) handlePutRes(msg packet.Message) {
 	n.requestRepeater.Ack(msg)
 
-	if n.currentTxid == msg.Id && n.currentMode == coordinatingWrite {
+	if t := n.txns[msg.Id]; t != nil && t.mode == coordinatingWrite {
 		if !msg.Ok {
-			n.abortProcessing()
+			n.abortProcessing(t)
 			return
 		}
 
-		if n.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
-			n.quorumMembers[msg.Src] = msg
-			n.numWaitingNodes--
-			if n.numWaitingNodes == 0 {
-				n.continueProcessing()
+		if t.quorumMembers[msg.Src].DemuxKey != msg.DemuxKey {
+			t.quorumMembers[msg.Src] = msg
+			t.numWaitingNodes--
+			if t.numWaitingNodes == 0 {
+				n.continueProcessing(t)
 			}
 		}
 	}
@@ -615,13 +1279,14 @@ func (n *Dbnode) handleTimestampReq(msg packet.Message) {
 
 	var val []byte
 	var timestamp uint64
+	var tombstone bool
 
-	if n.currentMode == processingWrite && n.currentTxid == msg.Id {
+	if t := n.txns[msg.Id]; t != nil && t.mode == processingWrite {
 		val, _ = n.Store.Get(msg.Key)
-		timestamp, _ = decodeTimestampVal(val)
+		timestamp, _, tombstone = decodeStoredVal(val)
 	}
 
-	n.Outgoing <- packet.Message{
+	n.Outgoing.Send(packet.Message{
 		Id:        msg.Id,
 		Src:       n.id,
 		Dest:      msg.Src,
@@ -629,23 +1294,48 @@ func (n *Dbnode) handleTimestampReq(msg packet.Message) {
 		Key:       msg.Key,
 		Timestamp: timestamp,
 		Ok:        true,
+		Tombstone: tombstone,
+	})
+}
+
+// handleTxnTimestampReq is the equivalent of handleTimestampReq for every key
+// in a transaction. The response's Value lists the timestamp of each key.
+func (n *Dbnode) handleTxnTimestampReq(msg packet.Message) {
+	// Must always respond with nodeGetResponse, ok: true
+
+	var latest []packet.Entry
+
+	if t := n.txns[msg.Id]; t != nil && t.mode == processingWrite {
+		if writes, err := packet.DecodeEntries(msg.Value); err == nil {
+			latest, _ = n.txnTimestamps(writes)
+		}
 	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:       msg.Id,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.NodeGetResponse,
+		Key:      msg.Key,
+		Value:    packet.EncodeEntries(latest),
+		Ok:       true,
+	})
 }
 
 func (n *Dbnode) handleBackgroundWriteReq(msg packet.Message) {
 	currentVal, _ := n.Store.Get(msg.Key)
-	currentTimestamp, currentVal := decodeTimestampVal(currentVal)
+	currentTimestamp, currentVal, currentTombstone := decodeStoredVal(currentVal)
 
-	if msg.Timestamp == currentTimestamp && !bytes.Equal(currentVal, msg.Value) {
+	if msg.Timestamp == currentTimestamp && (!bytes.Equal(currentVal, msg.Value) || currentTombstone != msg.Tombstone) {
 		log.Fatal("Inconsistent values with same timestamp", currentVal, msg.Value)
 	}
 	if msg.Timestamp > currentTimestamp {
-		value := encodeTimestampVal(msg.Timestamp, msg.Value)
+		value := encodeStoredVal(msg.Timestamp, msg.Value, msg.Tombstone)
 		txid := n.Store.Put(msg.Key, value)
 		n.Store.Commit(msg.Key, txid)
 	}
 	if msg.Timestamp >= currentTimestamp {
-		n.Outgoing <- packet.Message{
+		n.Outgoing.Send(packet.Message{
 			Id:        msg.Id,
 			Src:       n.id,
 			Dest:      msg.Src,
@@ -654,13 +1344,14 @@ func (n *Dbnode) handleBackgroundWriteReq(msg packet.Message) {
 			Value:     msg.Value,
 			Timestamp: msg.Timestamp,
 			Ok:        true,
-		}
+			Tombstone: msg.Tombstone,
+		})
 
 		if n.logWrites {
-			log.Println(n.id, "background write", msg.Key, msg.Timestamp)
+			n.events.Emit(eventlog.BackgroundWritten(n.id, msg.Key, msg.Timestamp))
 		}
 	} else {
-		n.Outgoing <- packet.Message{
+		n.Outgoing.Send(packet.Message{
 			Id:        msg.Id,
 			Src:       n.id,
 			Dest:      msg.Src,
@@ -669,7 +1360,8 @@ func (n *Dbnode) handleBackgroundWriteReq(msg packet.Message) {
 			Value:     currentVal,
 			Timestamp: currentTimestamp,
 			Ok:        false,
-		}
+			Tombstone: currentTombstone,
+		})
 	}
 }
 
@@ -678,107 +1370,140 @@ func (n *Dbnode) handleBackgroundWriteRes(msg packet.Message) {
 
 	if !msg.Ok {
 		currentVal, _ := n.Store.Get(msg.Key)
-		currentTimestamp, currentVal := decodeTimestampVal(currentVal)
+		currentTimestamp, currentVal, currentTombstone := decodeStoredVal(currentVal)
 
-		if msg.Timestamp == currentTimestamp && !bytes.Equal(currentVal, msg.Value) {
+		if msg.Timestamp == currentTimestamp && (!bytes.Equal(currentVal, msg.Value) || currentTombstone != msg.Tombstone) {
 			log.Fatal("Inconsistent values with same timestamp", currentVal, msg.Value)
 		}
 		if msg.Timestamp > currentTimestamp {
-			value := encodeTimestampVal(msg.Timestamp, msg.Value)
+			value := encodeStoredVal(msg.Timestamp, msg.Value, msg.Tombstone)
 			txid := n.Store.Put(msg.Key, value)
 			n.Store.Commit(msg.Key, txid)
 		}
 	}
 }
 
-func (n *Dbnode) continueProcessing() {
-	switch n.currentMode {
+func (n *Dbnode) continueProcessing(t *txnState) {
+	switch t.mode {
 	case coordinatingFastRead:
-		if n.quorumMembers == nil {
-			n.assembleQuorum(n.readQuorumSize, packet.NodeGetRequest)
+		if t.quorumMembers == nil {
+			n.assembleQuorum(t, n.readQuorum(t), packet.NodeGetRequest)
 
 			return
 		}
+		if n.awaitingRepair(t) {
+			// Every stale replica has been repaired
+			n.answerRead(t, t.quorumMembers[n.id])
+			return
+		}
 
-		localVal, err := n.Store.Get(n.clientRequest.Key)
+		localVal, err := n.Store.Get(t.clientRequest.Key)
 		if err != nil {
-			n.abortProcessing()
+			n.abortProcessing(t)
 			return
 		}
 
-		timestamp, value := decodeTimestampVal(localVal)
+		latest := packet.Message{Key: t.clientRequest.Key}
+		latest.Timestamp, latest.Value, latest.Tombstone = decodeStoredVal(localVal)
+		localTimestamp := latest.Timestamp
 
-		for _, node := range n.quorumMembers {
-			if node.Timestamp > timestamp {
-				timestamp = node.Timestamp
-				value = node.Value
+		for _, id := range t.members() {
+			node := t.quorumMembers[id]
+			if node.Timestamp > latest.Timestamp {
+				latest.Timestamp = node.Timestamp
+				latest.Value = node.Value
+				latest.Tombstone = node.Tombstone
 			}
 		}
 
-		n.Outgoing <- packet.Message{
-			Id:        n.clientRequest.Id,
-			Src:       n.id,
-			Dest:      n.clientRequest.Src,
-			DemuxKey:  packet.ClientReadResponse,
-			Key:       n.clientRequest.Key,
-			Value:     value,
-			Timestamp: timestamp,
-			Ok:        true,
+		n.repairRead(t, latest, localTimestamp)
+	case coordinatingScan:
+		if t.quorumMembers == nil {
+			n.assembleQuorum(t, n.readQuorum(t), packet.NodeScanRequest)
+
+			return
+		}
+
+		local, err := n.scanLocal(t.clientRequest.Key, t.clientRequest.Value)
+		if err != nil {
+			n.abortProcessing(t)
+			return
+		}
+
+		results := [][]packet.Entry{local}
+		for _, id := range t.members() {
+			node := t.quorumMembers[id]
+			entries, err := packet.DecodeEntries(node.Value)
+			if err != nil {
+				n.abortProcessing(t)
+				return
+			}
+			results = append(results, entries)
 		}
 
-		n.currentMode = idle
-		n.currentTxid = -1
-		n.quorumMembers = nil
-		n.numWaitingNodes = 0
+		n.Outgoing.Send(packet.Message{
+			Id:       t.clientRequest.Id,
+			Src:      n.id,
+			Dest:     t.clientRequest.Src,
+			DemuxKey: packet.ClientScanResponse,
+			Key:      t.clientRequest.Key,
+			Value:    packet.EncodeEntries(removeTombstones(mergeEntries(results...))),
+			Ok:       true,
+		})
+
+		n.release(t)
 	case coordinatingRead:
-		if n.quorumMembers == nil {
-			n.assembleQuorum(n.readQuorumSize, packet.NodeLockRequest)
+		if t.quorumMembers == nil {
+			n.assembleQuorum(t, n.readQuorum(t), packet.NodeLockRequest)
 
 			return
 		}
-		switch n.quorumMembers[n.id].DemuxKey {
+		switch t.quorumMembers[n.id].DemuxKey {
 		case packet.NodeGetRequest:
-			for node := range n.quorumMembers {
+			for _, node := range t.members() {
 				if node == n.id {
 					continue
 				}
 
 				n.requestRepeater.Send(packet.Message{
-					Id:       n.currentTxid,
+					Id:       t.clientRequest.Id,
 					Src:      n.id,
 					Dest:     node,
 					DemuxKey: packet.NodeGetRequest,
-					Key:      n.clientRequest.Key,
+					Key:      t.clientRequest.Key,
 					Ok:       true,
 				}, false)
 			}
 
-			n.quorumMembers[n.id] = packet.Message{
+			t.quorumMembers[n.id] = packet.Message{
 				DemuxKey: packet.NodeUnlockRequest,
 			}
 
-			n.numWaitingNodes = n.readQuorumSize - 1
+			t.numWaitingNodes = t.quorumSize - 1
 		case packet.NodeUnlockRequest:
 			// Read local value
-			localVal, err := n.Store.Get(n.clientRequest.Key)
+			localVal, err := n.Store.Get(t.clientRequest.Key)
 			if err != nil {
-				n.abortProcessing()
+				n.abortProcessing(t)
 				return
 			}
 
-			timestamp, value := decodeTimestampVal(localVal)
+			latest := packet.Message{Key: t.clientRequest.Key}
+			latest.Timestamp, latest.Value, latest.Tombstone = decodeStoredVal(localVal)
+			localTimestamp := latest.Timestamp
 
 			// Find the most recent value
 
-			for id, res := range n.quorumMembers {
+			for _, id := range t.members() {
+				res := t.quorumMembers[id]
 				if id == n.id {
 					continue
 				}
 
-				t, v := decodeTimestampVal(res.Value)
-				if t > timestamp {
-					timestamp = t
-					value = v
+				if res.Timestamp > latest.Timestamp {
+					latest.Timestamp = res.Timestamp
+					latest.Value = res.Value
+					latest.Tombstone = res.Tombstone
 				}
 
 				// Unlock each node
@@ -791,121 +1516,179 @@ func (n *Dbnode) continueProcessing() {
 				}, true)
 			}
 
-			// Return to client
-			n.Outgoing <- packet.Message{
-				Id:        n.clientRequest.Id,
-				Src:       n.id,
-				Dest:      n.clientRequest.Src,
-				DemuxKey:  packet.ClientReadResponse,
-				Key:       n.clientRequest.Key,
-				Value:     value,
-				Timestamp: timestamp,
-				Ok:        true,
-			}
-
-			// Return to idle state
-			n.currentMode = idle
-			n.currentTxid = -1
-			n.quorumMembers = nil
-			n.numWaitingNodes = 0
+			// Return to client (and idle state), after any repairs
+			n.repairRead(t, latest, localTimestamp)
+		case packet.NodeRepairRequest:
+			// Every stale replica has been repaired
+			n.answerRead(t, t.quorumMembers[n.id])
 		default:
-			log.Fatal("Read coordinator has reached an invalid state", n.quorumMembers[n.id])
+			log.Fatal("Read coordinator has reached an invalid state", t.quorumMembers[n.id])
 		}
 	case coordinatingWrite:
-		switch n.quorumMembers[n.id].DemuxKey {
+		switch t.quorumMembers[n.id].DemuxKey {
 		case packet.NodeTimestampRequest:
-			for node := range n.quorumMembers {
+			requestType := packet.NodeTimestampRequest
+			if t.clientRequest.DemuxKey == packet.ClientTxnRequest {
+				requestType = packet.NodeTxnTimestampRequest
+			}
+
+			for _, node := range t.members() {
 				if node == n.id {
 					continue
 				}
 
+				// A NodeTxnTimestampRequest only uses the keys in
+				// Value
 				n.requestRepeater.Send(packet.Message{
-					Id:       n.clientRequest.Id,
+					Id:       t.clientRequest.Id,
 					Src:      n.id,
 					Dest:     node,
-					DemuxKey: packet.NodeTimestampRequest,
-					Key:      n.clientRequest.Key,
+					DemuxKey: requestType,
+					Key:      t.clientRequest.Key,
+					Value:    t.clientRequest.Value,
 					Ok:       true,
 				}, true)
 			}
 
-			n.quorumMembers[n.id] = packet.Message{
+			t.quorumMembers[n.id] = packet.Message{
 				DemuxKey: packet.NodePutRequest,
 			}
-			n.numWaitingNodes = n.writeQuorumSize - 1
+			t.numWaitingNodes = t.quorumSize - 1
 		case packet.NodePutRequest:
+			// This node's lease may have been superseded while
+			// assembling the quorum
+			if !n.checkToken(t.token) {
+				n.abortProcessing(t)
+				return
+			}
+
+			if t.clientRequest.DemuxKey == packet.ClientTxnRequest {
+				n.stageTxn(t)
+				return
+			}
+
 			var latestTimestamp uint64
+			var latestTombstone bool
 
-			localVal, err := n.Store.Get(n.clientRequest.Key)
+			localVal, err := n.Store.Get(t.clientRequest.Key)
 			if err != nil {
-				n.abortProcessing()
+				n.abortProcessing(t)
 				return
 			}
 
 			if len(localVal) > 0 {
-				latestTimestamp, _ = decodeTimestampVal(localVal)
+				latestTimestamp, _, latestTombstone = decodeStoredVal(localVal)
 			}
 
-			for id, msg := range n.quorumMembers {
+			for _, id := range t.members() {
+				msg := t.quorumMembers[id]
 				if id == n.id {
 					continue
 				}
 
 				if msg.Timestamp > latestTimestamp {
 					latestTimestamp = msg.Timestamp
+					latestTombstone = msg.Tombstone
 				}
 			}
 
-			if n.clientRequest.DemuxKey == packet.ClientStrongWriteRequest && n.clientRequest.Timestamp != latestTimestamp+1 {
-				n.clientRequest.Timestamp = latestTimestamp + 1
-				n.abortProcessing()
+			if t.clientRequest.DemuxKey == packet.ClientStrongWriteRequest && t.clientRequest.Timestamp != latestTimestamp+1 {
+				t.clientRequest.Timestamp = latestTimestamp + 1
+				n.abortProcessing(t)
 				return
 			}
 
-			value := encodeTimestampVal(latestTimestamp+1, n.clientRequest.Value)
+			if t.clientRequest.DemuxKey == packet.InternalGarbageCollect {
+				// Every node is locked, so if the tombstone is the
+				// latest value on every node, it can be removed from
+				// every node without any older value reappearing.
+				// Otherwise, it has been overwritten, so there is
+				// nothing to collect (and a timestamp of 0 cancels the
+				// collection, rather than retrying it).
+				if latestTimestamp != t.clientRequest.Timestamp || !latestTombstone {
+					t.clientRequest.Timestamp = 0
+					n.abortProcessing(t)
+					return
+				}
+
+				n.rollbackStaged(t)
+				if n.replicates(t.clientRequest.Key) && !n.stage(t, t.clientRequest.Key, n.Store.Delete(t.clientRequest.Key)) {
+					n.abortProcessing(t)
+					return
+				}
+
+				for _, id := range t.members() {
+					if id == n.id {
+						continue
+					}
+
+					n.requestRepeater.Send(packet.Message{
+						Id:        t.clientRequest.Id,
+						Src:       n.id,
+						Dest:      id,
+						DemuxKey:  packet.NodeGarbageCollectRequest,
+						Key:       t.clientRequest.Key,
+						Timestamp: latestTimestamp,
+						Ok:        true,
+						Token:     t.token,
+					}, true)
+				}
+
+				t.quorumMembers[n.id] = packet.Message{
+					DemuxKey:  packet.NodeUnlockRequest,
+					Timestamp: latestTimestamp,
+				}
+				t.numWaitingNodes = t.quorumSize - 1
+
+				return
+			}
 
-			n.uncommitedTxid = n.Store.Put(n.clientRequest.Key, value)
-			n.uncommitedKey = n.clientRequest.Key
+			tombstone := t.clientRequest.DemuxKey == packet.ClientDeleteRequest
+			value := encodeStoredVal(latestTimestamp+1, t.clientRequest.Value, tombstone)
 
-			for id := range n.quorumMembers {
+			n.rollbackStaged(t)
+			if n.replicates(t.clientRequest.Key) && !n.stage(t, t.clientRequest.Key, n.Store.Put(t.clientRequest.Key, value)) {
+				n.abortProcessing(t)
+				return
+			}
+
+			for _, id := range t.members() {
 				if id == n.id {
 					continue
 				}
 
 				n.requestRepeater.Send(packet.Message{
-					Id:        n.clientRequest.Id,
+					Id:        t.clientRequest.Id,
 					Src:       n.id,
 					Dest:      id,
 					DemuxKey:  packet.NodePutRequest,
-					Key:       n.clientRequest.Key,
-					Value:     n.clientRequest.Value,
+					Key:       t.clientRequest.Key,
+					Value:     t.clientRequest.Value,
 					Timestamp: latestTimestamp + 1,
 					Ok:        true,
+					Tombstone: tombstone,
+					Token:     t.token,
 				}, true)
 			}
 
-			n.quorumMembers[n.id] = packet.Message{
+			t.quorumMembers[n.id] = packet.Message{
 				DemuxKey:  packet.NodeUnlockRequest,
 				Timestamp: latestTimestamp + 1,
 			}
-			n.numWaitingNodes = n.writeQuorumSize - 1
+			t.numWaitingNodes = t.quorumSize - 1
 		case packet.NodeUnlockRequest:
-			ok := n.Store.Commit(n.uncommitedKey, n.uncommitedTxid)
-			if !ok {
-				n.abortProcessing()
+			if !n.commitStaged(t) {
+				n.abortProcessing(t)
 				return
 			}
 
-			n.uncommitedKey = nil
-			n.uncommitedTxid = 0
-
-			for id := range n.quorumMembers {
+			for _, id := range t.members() {
 				if id == n.id {
 					continue
 				}
 
 				n.requestRepeater.Send(packet.Message{
-					Id:       n.clientRequest.Id,
+					Id:       t.clientRequest.Id,
 					Src:      n.id,
 					Dest:     id,
 					DemuxKey: packet.NodeUnlockRequest,
@@ -913,60 +1696,203 @@ func (n *Dbnode) continueProcessing() {
 				}, true)
 			}
 
-			n.Outgoing <- packet.Message{
-				Id:        n.clientRequest.Id,
-				Src:       n.id,
-				Dest:      n.clientRequest.Src,
-				DemuxKey:  packet.ClientWriteResponse,
-				Key:       n.clientRequest.Key,
-				Value:     n.clientRequest.Value,
-				Timestamp: n.quorumMembers[n.id].Timestamp,
-				Ok:        true,
-			}
+			timestamp := t.quorumMembers[n.id].Timestamp
+			tombstone := t.clientRequest.DemuxKey == packet.ClientDeleteRequest
 
-			if n.logWrites {
-				log.Println(n.id, "write commit", n.clientRequest.Key, n.quorumMembers[n.id].Timestamp)
-			}
+			if t.clientRequest.DemuxKey == packet.InternalGarbageCollect {
+				// There is no client to respond to
+				if n.logWrites {
+					n.events.Emit(eventlog.GarbageCollected(n.id, t.clientRequest.Key, timestamp))
+				}
+			} else if t.clientRequest.DemuxKey == packet.ClientTxnRequest {
+				n.finishTxn(t)
+			} else {
+				n.Outgoing.Send(packet.Message{
+					Id:        t.clientRequest.Id,
+					Src:       n.id,
+					Dest:      t.clientRequest.Src,
+					DemuxKey:  packet.ClientWriteResponse,
+					Key:       t.clientRequest.Key,
+					Value:     t.clientRequest.Value,
+					Timestamp: timestamp,
+					Ok:        true,
+					Tombstone: tombstone,
+				})
+
+				// A delete is logged as a write (of a tombstone)
+				if n.logWrites {
+					n.events.Emit(eventlog.WriteCommitted(n.id, t.clientRequest.Key, timestamp))
+				}
+
+				n.sendHints(t, []packet.Entry{{
+					Key:       t.clientRequest.Key,
+					Value:     t.clientRequest.Value,
+					Timestamp: timestamp,
+					Tombstone: tombstone,
+				}})
+
+				if n.backgroundWriteDaemon != nil {
+					n.backgroundWriteDaemon.propagateTransaction(
+						t.clientRequest.Id,
+						t.quorumMembers,
+						t.clientRequest.Key,
+						t.clientRequest.Value,
+						timestamp,
+						tombstone)
+				}
 
-			if n.backgroundWriteDaemon != nil {
-				n.backgroundWriteDaemon.propagateTransaction(
-					n.clientRequest.Id,
-					n.quorumMembers,
-					n.clientRequest.Key,
-					n.clientRequest.Value,
-					n.quorumMembers[n.id].Timestamp)
+				if tombstone {
+					n.scheduleGarbageCollection(t.clientRequest.Key, timestamp)
+				}
 			}
 
-			n.currentMode = idle
-			n.currentTxid = -1
-			n.quorumMembers = nil
-			n.numWaitingNodes = 0
+			n.release(t)
 		}
 	case assemblingQuorum:
-		if n.quorumMembers == nil {
-			n.assembleQuorum(n.writeQuorumSize, packet.NodeLockRequestNoTimeout)
+		if t.quorumMembers == nil {
+			n.assembleQuorum(t, n.writeQuorum(t), packet.NodeLockRequestNoTimeout)
+
+			if n.backgroundWriteDaemon != nil && t.clientRequest.DemuxKey != packet.InternalGarbageCollect {
+				n.scheduleSubstitution(t)
+			}
 		} else {
-			n.currentMode = coordinatingWrite
-			n.continueProcessing()
+			t.mode = coordinatingWrite
+			n.continueProcessing(t)
+		}
+	}
+}
+
+// stageTxn is the put phase of a multi-key transaction. It gives every write
+// the next timestamp of its key (failing if a conditional write expected a
+// different timestamp), then stages every write on every node in the quorum.
+func (n *Dbnode) stageTxn(t *txnState) {
+	writes, err := decodeTxn(t.clientRequest.Value)
+	if err != nil {
+		n.abortProcessing(t)
+		return
+	}
+
+	local, err := n.txnTimestamps(writes)
+	if err != nil {
+		n.abortProcessing(t)
+		return
+	}
+
+	results := [][]packet.Entry{local}
+	for _, id := range t.members() {
+		msg := t.quorumMembers[id]
+		if id == n.id {
+			continue
+		}
+
+		entries, err := packet.DecodeEntries(msg.Value)
+		if err != nil {
+			n.abortProcessing(t)
+			return
+		}
+		results = append(results, entries)
+	}
+
+	if !assignTxnTimestamps(writes, mergeEntries(results...)) {
+		// As for a strong write, the client is told which timestamps
+		// were required.
+		t.clientRequest.Value = packet.EncodeEntries(writes)
+		n.abortProcessing(t)
+		return
+	}
+
+	n.rollbackStaged(t)
+	for _, w := range writes {
+		if n.replicates(w.Key) && !n.stage(t, w.Key, n.Store.Put(w.Key, encodeStoredVal(w.Timestamp, w.Value, w.Tombstone))) {
+			n.abortProcessing(t)
+			return
+		}
+	}
+
+	encoded := packet.EncodeEntries(writes)
+
+	for _, id := range t.members() {
+		if id == n.id {
+			continue
+		}
+
+		n.requestRepeater.Send(packet.Message{
+			Id:       t.clientRequest.Id,
+			Src:      n.id,
+			Dest:     id,
+			DemuxKey: packet.NodeTxnPutRequest,
+			Key:      t.clientRequest.Key,
+			Value:    encoded,
+			Ok:       true,
+			Token:    t.token,
+		}, true)
+	}
+
+	t.quorumMembers[n.id] = packet.Message{
+		DemuxKey: packet.NodeUnlockRequest,
+		Value:    encoded,
+	}
+	t.numWaitingNodes = t.quorumSize - 1
+}
+
+// finishTxn responds to the client once every write in a transaction has been
+// committed, and propagates each write.
+func (n *Dbnode) finishTxn(t *txnState) {
+	encoded := t.quorumMembers[n.id].Value
+
+	n.Outgoing.Send(packet.Message{
+		Id:       t.clientRequest.Id,
+		Src:      n.id,
+		Dest:     t.clientRequest.Src,
+		DemuxKey: packet.ClientWriteResponse,
+		Key:      t.clientRequest.Key,
+		Value:    encoded,
+		Ok:       true,
+	})
+
+	// Encoded by stageTxn, so cannot fail
+	writes, _ := packet.DecodeEntries(encoded)
+
+	n.sendHints(t, writes)
+
+	for _, w := range writes {
+		if n.logWrites {
+			n.events.Emit(eventlog.WriteCommitted(n.id, w.Key, w.Timestamp))
+		}
+
+		if n.backgroundWriteDaemon != nil {
+			n.backgroundWriteDaemon.propagateTransaction(
+				t.clientRequest.Id,
+				t.quorumMembers,
+				w.Key,
+				w.Value,
+				w.Timestamp,
+				w.Tombstone)
+		}
+
+		if w.Tombstone {
+			n.scheduleGarbageCollection(w.Key, w.Timestamp)
 		}
 	}
 }
 
-func (n *Dbnode) abortProcessing() {
-	if n.uncommitedTxid > 0 {
-		n.Store.Rollback(n.uncommitedTxid)
-		n.uncommitedTxid = 0
-		n.uncommitedKey = nil
+func (n *Dbnode) abortProcessing(t *txnState) {
+	if n.awaitingRepair(t) {
+		// The read has already succeeded, and repairs are best effort
+		n.answerRead(t, t.quorumMembers[n.id])
+		return
 	}
 
-	if n.quorumMembers != nil {
-		for node := range n.quorumMembers {
+	n.rollbackStaged(t)
+
+	if t.quorumMembers != nil {
+		for _, node := range t.members() {
 			if node == n.id {
 				continue
 			}
 
 			n.requestRepeater.Send(packet.Message{
-				Id:       n.clientRequest.Id,
+				Id:       t.clientRequest.Id,
 				Src:      n.id,
 				Dest:     node,
 				DemuxKey: packet.NodeUnlockRequest,
@@ -975,84 +1901,235 @@ func (n *Dbnode) abortProcessing() {
 		}
 	}
 
-	switch n.currentMode {
-	case assemblingQuorum, coordinatingRead, coordinatingWrite:
+	switch t.mode {
+	case assemblingQuorum, coordinatingRead, coordinatingWrite, coordinatingFastRead:
+		if t.clientRequest.DemuxKey == packet.InternalGarbageCollect {
+			// There is no client to respond to. Instead, try again
+			// later, unless cancelled (see continueProcessing).
+			if t.clientRequest.Timestamp != 0 {
+				n.scheduleGarbageCollection(t.clientRequest.Key, t.clientRequest.Timestamp)
+			}
+			break
+		}
+
 		var resType packet.Messagetype
-		if n.currentMode == coordinatingRead {
+		if t.mode == coordinatingRead || t.mode == coordinatingFastRead {
 			resType = packet.ClientReadResponse
 		} else {
 			resType = packet.ClientWriteResponse
 		}
 
-		n.Outgoing <- packet.Message{
-			Id:        n.clientRequest.Id,
+		n.Outgoing.Send(packet.Message{
+			Id:        t.clientRequest.Id,
 			Src:       n.id,
-			Dest:      n.clientRequest.Src,
+			Dest:      t.clientRequest.Src,
 			DemuxKey:  resType,
-			Key:       n.clientRequest.Key,
-			Value:     n.clientRequest.Value,
-			Timestamp: n.clientRequest.Timestamp,
+			Key:       t.clientRequest.Key,
+			Value:     t.clientRequest.Value,
+			Timestamp: t.clientRequest.Timestamp,
 			Ok:        false,
-		}
+		})
+	case coordinatingScan:
+		n.Outgoing.Send(packet.Message{
+			Id:       t.clientRequest.Id,
+			Src:      n.id,
+			Dest:     t.clientRequest.Src,
+			DemuxKey: packet.ClientScanResponse,
+			Key:      t.clientRequest.Key,
+			Ok:       false,
+		})
 	case processingRead, processingWrite:
-		n.Outgoing <- packet.Message{
-			Id:       n.clientRequest.Id,
+		n.Outgoing.Send(packet.Message{
+			Id:       t.clientRequest.Id,
 			Src:      n.id,
-			Dest:     n.clientRequest.Src,
+			Dest:     t.clientRequest.Src,
 			DemuxKey: packet.NodeUnlockAck,
 			Ok:       false,
-		}
+		})
+	}
+
+	n.release(t)
+}
+
+// writeQuorum returns the size of the quorum required for the current write.
+// Garbage collection requires every replica of the key.
+func (n *Dbnode) writeQuorum(t *txnState) int {
+	numNodes := len(n.config.members)
+
+	switch t.clientRequest.DemuxKey {
+	case packet.InternalGarbageCollect:
+		return n.ring.Factor(numNodes)
+	case packet.ClientTxnRequest:
+		return n.writeQuorumSize + numNodes - n.ring.Factor(numNodes)
+	}
+
+	return n.writeQuorumSize
+}
+
+// scheduleGarbageCollection starts a transaction to garbage collect the
+// tombstone written for key at timestamp, once the grace period has passed.
+func (n *Dbnode) scheduleGarbageCollection(key []byte, timestamp uint64) {
+	// Client transaction ids are non-negative, and -1 means no transaction,
+	// so garbage collection transactions use distinct ids below -1.
+	n.numGarbageCollections++
+	id := -2 - (n.numGarbageCollections*(n.numPeers+1) + n.id)
+
+	msg := packet.Message{
+		Id:        id,
+		Src:       n.id,
+		Dest:      n.id,
+		DemuxKey:  packet.InternalGarbageCollect,
+		Key:       key,
+		Timestamp: timestamp,
+		Ok:        true,
 	}
 
-	n.currentMode = idle
-	n.currentTxid = -1
-	n.quorumMembers = nil
-	n.numWaitingNodes = 0
+	n.clock.Go(func() {
+		n.clock.Sleep(tombstoneGracePeriod * n.lockTimeout)
+		n.Incoming.Send(msg)
+	})
 }
 
-func (n *Dbnode) assembleQuorum(quorumSize int, requestType packet.Messagetype) {
-	n.quorumMembers = make(map[int]packet.Message)
+func (n *Dbnode) assembleQuorum(t *txnState, quorumSize int, requestType packet.Messagetype) {
+	t.quorumMembers = make(map[int]packet.Message)
 
 	var key []byte
 	var val []byte
-	if requestType == packet.NodeGetRequest {
-		key = n.clientRequest.Key
-		val = n.clientRequest.Value
+	if requestType == packet.NodeGetRequest || requestType == packet.NodeScanRequest {
+		key = t.clientRequest.Key
+		val = t.clientRequest.Value
+	} else {
+		// Each node locks the same keys as this node
+		val = encodeKeys(t.locks)
 	}
 
-	peers := rand.Perm(n.numPeers)
-	for _, node := range peers[:quorumSize-1] {
-		if node == n.id {
-			node = n.numPeers
-		}
-		n.quorumMembers[node] = packet.Message{
-			Id:       n.clientRequest.Id,
+	peers, local := n.replicaPeers(t)
+	if !local {
+		// This node's store is not part of the quorum (see replicaPeers)
+		quorumSize++
+	}
+
+	for _, i := range n.random.Perm(len(peers))[:quorumSize-1] {
+		node := peers[i]
+		t.quorumMembers[node] = packet.Message{
+			Id:       t.clientRequest.Id,
 			Src:      n.id,
 			Dest:     node,
 			DemuxKey: requestType,
 			Key:      key,
 			Value:    val,
-			Ok:       true,
+			// Participants refuse a coordinator with an old
+			// configuration (see membership.go)
+			Timestamp: t.version,
+			Ok:        true,
+			Token:     t.token,
 		}
-		n.requestRepeater.Send(n.quorumMembers[node], false)
+		n.requestRepeater.Send(t.quorumMembers[node], false)
 	}
 
-	// n.quorumMembers[n.id] is a marker of the next step
+	// t.quorumMembers[n.id] is a marker of the next step
 	if requestType == packet.NodeLockRequest {
-		n.quorumMembers[n.id] = packet.Message{
+		t.quorumMembers[n.id] = packet.Message{
 			DemuxKey: packet.NodeGetRequest,
 		}
 	} else if requestType == packet.NodeLockRequestNoTimeout {
-		n.quorumMembers[n.id] = packet.Message{
+		t.quorumMembers[n.id] = packet.Message{
 			DemuxKey: packet.NodeTimestampRequest,
 		}
 	}
 
-	n.numWaitingNodes = quorumSize - 1
+	t.quorumSize = quorumSize
+	t.numWaitingNodes = quorumSize - 1
 }
 
-// QueryState is for debugging/monitoring purposes. It returns currentTxid.
+// QueryState is for debugging/monitoring purposes. It returns the ID of the
+// oldest transaction in progress, or -1 if the node is idle.
 func (n *Dbnode) QueryState() int {
-	n.stateQueryReq <- true
-	return <-n.stateQueryRes
+	return n.QueryStats().OldestTxid
+}
+
+// Stats is a snapshot of the load on a node, for monitoring.
+// Fields:
+// OldestTxid: the ID of the oldest transaction in progress, or -1 if idle
+// Transactions: the number of transactions in progress
+// LockQueue: the number of requests waiting for locks
+// LockWaits: the time for which each request granted locks since the last
+// query waited in the queue
+type Stats struct {
+	OldestTxid   int
+	Transactions int
+	LockQueue    int
+	LockWaits    []time.Duration
+}
+
+// QueryStats returns a snapshot of the load on the node. Each lock wait is
+// returned by only one call (QueryStats or QueryState).
+func (n *Dbnode) QueryStats() Stats {
+	n.stateQueryReq.Send(true)
+	return n.stateQueryRes.Recv()
+}
+
+// A Status describes the state of a node, for inspecting a running simulation.
+// Fields:
+// Id: the ID of the node
+// Disabled: true iff the node has failed
+// Mode: the mode of the oldest transaction in progress (idle if there is none)
+// CurrentTxid: the ID of the oldest transaction in progress, or -1 if idle
+// Transactions: the number of transactions in progress
+// LockQueue: the number of requests waiting for locks
+// Leader: the leader, as far as the node knows (-1 if unknown)
+// Keys: the number of keys in the store (including deleted keys whose
+// tombstones have not been collected)
+// Hints: the number of writes held for other nodes (see substitute)
+// Config: the version of the node's configuration of the cluster
+// Members: the members of the cluster in that configuration
+// Joining: a new member which has not yet caught up (-1 if none)
+// ReadQuorum, WriteQuorum: the quorum sizes in that configuration
+type Status struct {
+	Id           int    `json:"id"`
+	Disabled     bool   `json:"disabled"`
+	Mode         string `json:"mode"`
+	CurrentTxid  int    `json:"current_txid"`
+	Transactions int    `json:"transactions"`
+	LockQueue    int    `json:"lock_queue"`
+	Leader       int    `json:"leader"`
+	Keys         int    `json:"keys"`
+	Hints        int    `json:"hints"`
+	Config       uint64 `json:"config"`
+	Members      []int  `json:"members"`
+	Joining      int    `json:"joining"`
+	ReadQuorum   int    `json:"read_quorum"`
+	WriteQuorum  int    `json:"write_quorum"`
+}
+
+// QueryStatus returns the current status of the node, including the number of
+// keys in its store.
+func (n *Dbnode) QueryStatus() Status {
+	n.statusQueryReq.Send(true)
+	return n.statusQueryRes.Recv()
+}
+
+func (n *Dbnode) status() Status {
+	s := Status{
+		Id:           n.id,
+		Disabled:     n.disabled,
+		Mode:         idle.String(),
+		CurrentTxid:  n.oldestTxid(),
+		Transactions: len(n.txns),
+		LockQueue:    n.lockRequests.length(),
+		Leader:       n.elector.Leader(),
+		Keys:         n.Store.Len(),
+		Hints:        n.numHints(),
+		Config:       n.config.version,
+		Members:      n.config.members,
+		Joining:      n.config.joining,
+		ReadQuorum:   n.config.rqs,
+		WriteQuorum:  n.config.wqs,
+	}
+
+	if t := n.txns[s.CurrentTxid]; t != nil {
+		s.Mode = t.mode.String()
+	}
+
+	return s
 }
@@ -3,66 +3,81 @@ package elector
 import (
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
-// A bully is an Elector based on the bully algorithm.
+// A bully is an Elector based on the bully algorithm, between the members. A
+// node which is not a member never starts or answers elections, but follows
+// the coordinator messages of members.
 type bully struct {
 	id       int
-	n        int
+	members  membership
 	timeout  time.Duration
-	outgoing chan packet.Message
+	outgoing *clock.Chan[packet.Message]
 
 	// leader == id => this node is leader.
 	// leader == -1 => election in progress.
 	leader      int
 	maybeLeader bool
 
-	messageQueue       chan packet.Message
-	leaderQueryResChan chan int
-	requestsToForward  chan packet.Message
+	messageQueue       *clock.Chan[packet.Message]
+	leaderQueryResChan *clock.Chan[int]
+	requestsToForward  *clock.Chan[packet.Message]
 
 	disabled bool
 
-	internalTimer chan int
+	internalTimer *clock.Chan[int]
+
+	clock clock.Clock
 }
 
-func newBully(id, n int, outgoing chan packet.Message) *bully {
+func newBully(id int, members membership, outgoing *clock.Chan[packet.Message], clk clock.Clock) *bully {
 	b := &bully{
 		id:       id,
-		n:        n,
+		members:  members,
 		timeout:  50 * time.Millisecond,
 		outgoing: outgoing,
 
-		leader: n - 1,
+		leader: members.highest(),
+
+		messageQueue:       clock.NewChan[packet.Message](clk, 10),
+		leaderQueryResChan: clock.NewChan[int](clk, 0),
+		requestsToForward:  clock.NewChan[packet.Message](clk, 100),
 
-		messageQueue:       make(chan packet.Message, 10),
-		leaderQueryResChan: make(chan int),
-		requestsToForward:  make(chan packet.Message, 100),
+		internalTimer: clock.NewChan[int](clk, 0),
 
-		internalTimer: make(chan int),
+		clock: clk,
 	}
 
-	go b.mainLoop()
-	go b.startHeartbeat()
+	b.clock.Go(b.mainLoop)
+	b.clock.Go(b.startHeartbeat)
 
 	return b
 }
 
 func (b *bully) mainLoop() {
-	go b.startInternalTimer()
+	b.clock.Go(b.startInternalTimer)
 
 	timeoutCounter := 0
-	b.internalTimer <- timeoutCounter
+	b.internalTimer.Send(timeoutCounter)
 
-	for msg := range b.messageQueue {
+	for {
+		msg := b.messageQueue.Recv()
 		if b.disabled || msg.DemuxKey == packet.ControlRecover {
+			if b.disabled && msg.DemuxKey == packet.InternalLeaderQuery {
+				// A failed node knows of no leader (but must still answer,
+				// since a lease may query it concurrently with a failure)
+				b.leaderQueryResChan.Send(-1)
+			}
 			if b.disabled && msg.DemuxKey == packet.ControlRecover {
 				b.disabled = false
 				timeoutCounter = 0
-				b.internalTimer <- timeoutCounter
+				b.internalTimer.Send(timeoutCounter)
 
-				b.startElection()
+				if b.members.contains(b.id) {
+					b.startElection()
+				}
 			}
 
 			continue
@@ -74,31 +89,39 @@ func (b *bully) mainLoop() {
 		}
 
 		if msg.DemuxKey == packet.InternalTimerSignal {
-			if msg.Id == timeoutCounter {
+			if msg.Id == timeoutCounter && b.members.contains(b.id) {
 				if b.leader == -1 && b.maybeLeader {
 					b.becomeCoordinator()
 				} else {
 					b.startElection()
 				}
 			}
-			b.internalTimer <- timeoutCounter
+			b.internalTimer.Send(timeoutCounter)
 		} else {
 			timeoutCounter++
 		}
 
 		switch msg.DemuxKey {
 		case packet.ElectionElect:
-			b.outgoing <- packet.Message{
+			if !b.members.contains(b.id) {
+				continue
+			}
+
+			b.outgoing.Send(packet.Message{
 				Src:      b.id,
 				Dest:     msg.Src,
 				DemuxKey: packet.ElectionAck,
 				Ok:       true,
-			}
+			})
 
 			b.startElection()
 		case packet.ElectionAck:
 			b.maybeLeader = false
 		case packet.ElectionCoordinator:
+			if !b.members.contains(msg.Src) {
+				continue
+			}
+
 			if b.leader == msg.Src || b.leader == -1 {
 				b.leader = msg.Src
 				b.forwardRequests()
@@ -110,45 +133,54 @@ func (b *bully) mainLoop() {
 				b.broadcastHeartbeat()
 			}
 		case packet.InternalLeaderQuery:
-			b.leaderQueryResChan <- b.leader
+			b.leaderQueryResChan.Send(b.leader)
+		case packet.InternalMembership:
+			b.members = decodeMembership(msg)
+			if b.leader != -1 && !b.members.contains(b.leader) {
+				if b.members.contains(b.id) {
+					b.startElection()
+				} else {
+					b.leader = -1
+				}
+			}
 		}
 	}
 }
 
 func (b *bully) startInternalTimer() {
 	for {
-		c := <-b.internalTimer
-		time.Sleep(b.timeout)
-		b.messageQueue <- packet.Message{
+		c := b.internalTimer.Recv()
+		b.clock.Sleep(b.timeout)
+		b.messageQueue.Send(packet.Message{
 			Id:       c,
 			DemuxKey: packet.InternalTimerSignal,
-		}
+		})
 	}
 }
 
 func (b *bully) startHeartbeat() {
 	for {
-		time.Sleep(b.timeout * 2 / 5)
-		b.messageQueue <- packet.Message{
+		b.clock.Sleep(b.timeout * 2 / 5)
+		b.messageQueue.Send(packet.Message{
 			DemuxKey: packet.InternalHeartbeat,
-		}
+		})
 	}
 }
 
 func (b *bully) becomeCoordinator() {
 	b.leader = b.id
 
-	for i := 0; i < b.n; i++ {
+	for _, i := range b.members {
 		if i == b.id {
 			continue
 		}
 
-		b.outgoing <- packet.Message{
+		b.outgoing.Send(packet.Message{
 			Src:      b.id,
 			Dest:     i,
 			DemuxKey: packet.ElectionCoordinator,
 			Ok:       true,
-		}
+		})
 	}
 
 }
@@ -157,40 +189,44 @@ func (b *bully) startElection() {
 	b.maybeLeader = true
 	b.leader = -1
 
-	for i := b.id + 1; i < b.n; i++ {
-		b.outgoing <- packet.Message{
+	for _, i := range b.members {
+		if i <= b.id {
+			continue
+		}
+
+		b.outgoing.Send(packet.Message{
 			Src:      b.id,
 			Dest:     i,
 			DemuxKey: packet.ElectionElect,
 			Ok:       true,
-		}
+		})
 	}
 
-	if b.id == b.n-1 {
+	if b.id == b.members.highest() {
 		b.becomeCoordinator()
 	}
 }
 
 func (b *bully) broadcastHeartbeat() {
-	for i := 0; i < b.n; i++ {
+	for _, i := range b.members {
 		if i == b.id {
 			continue
 		}
 
-		b.outgoing <- packet.Message{
+		b.outgoing.Send(packet.Message{
 			Src:      b.id,
 			Dest:     i,
 			DemuxKey: packet.ElectionCoordinator,
 			Ok:       true,
-		}
+		})
 	}
 }
 
 func (b *bully) forwardRequests() {
-	for len(b.requestsToForward) > 0 {
-		msg := <-b.requestsToForward
+	for b.requestsToForward.Len() > 0 {
+		msg := b.requestsToForward.Recv()
 
-		b.outgoing <- packet.Message{
+		b.outgoing.Send(packet.Message{
 			Id:        msg.Id,
 			Src:       msg.Src,
 			Dest:      b.leader,
@@ -199,28 +235,35 @@ func (b *bully) forwardRequests() {
 			Value:     msg.Value,
 			Timestamp: msg.Timestamp,
 			Ok:        msg.Ok,
-		}
+			Tombstone: msg.Tombstone,
+		})
 	}
 }
 
 // Leader returns the current leader, or -1 if an election is in progress.
 func (b *bully) Leader() int {
-	b.messageQueue <- packet.Message{
+	b.messageQueue.Send(packet.Message{
 		DemuxKey: packet.InternalLeaderQuery,
-	}
+	})
 
-	return <-b.leaderQueryResChan
+	return b.leaderQueryResChan.Recv()
 }
 
 // ProcessMsg is a receiver for packets. It should be sent all Election messages
 // received by a Dbnode.
 func (b *bully) ProcessMsg(msg packet.Message) {
-	b.messageQueue <- msg
+	b.messageQueue.Send(msg)
 }
 
 // ForwardToLeader forwards a message to the current leader. If an election is
 // in progress, it buffers the message and forwards it once a leader has been
 // elected.
 func (b *bully) ForwardToLeader(msg packet.Message) {
-	b.requestsToForward <- msg
+	b.requestsToForward.Send(msg)
+}
+
+// SetMembers changes the nodes taking part in elections. If the leader is no
+// longer a member, the remaining members elect a new one.
+func (b *bully) SetMembers(members []int) {
+	b.messageQueue.Send(membershipMsg(members))
 }
@@ -1,29 +1,41 @@
 package elector
 
-import "github.com/alexbostock/part-ii-project/net/packet"
+import (
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
 
-// A Dummy is a do-nothing elector, equivalent to no election algorithm
-type Dummy struct {
+// A dummy is a do-nothing elector, equivalent to no election algorithm
+type dummy struct {
 	id       int
-	outgoing chan packet.Message
+	outgoing *clock.Chan[packet.Message]
 }
 
-func newDummy(id int, outgoing chan packet.Message) *Dummy {
-	return &Dummy{
+func newDummy(id int, outgoing *clock.Chan[packet.Message]) *dummy {
+	return &dummy{
 		id:       id,
 		outgoing: outgoing,
 	}
 }
 
-func (d *Dummy) Leader() int {
+func (d *dummy) Leader() int {
 	return d.id
 }
 
-func (d *Dummy) ForwardToLeader(msg packet.Message) {
+func (d *dummy) ForwardToLeader(msg packet.Message) {
 	msg.Dest = d.id
-	d.outgoing <- msg
+	d.outgoing.Send(msg)
 }
 
-func (d *Dummy) ProcessMsg(msg packet.Message) {
+func (d *dummy) ProcessMsg(msg packet.Message) {
 	// Do nothing
 }
+
+func (d *dummy) SetMembers(members []int) {
+	// Do nothing
+}
+
+// Lease always succeeds, with no fencing token, since every node is a leader.
+func (d *dummy) Lease() (uint64, bool) {
+	return 0, true
+}
@@ -1,7 +1,14 @@
 // Package elector implements a leadership election.
 package elector
 
-import "github.com/alexbostock/part-ii-project/net/packet"
+import (
+	"errors"
+	"sort"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
 
 // An Elector acts as a node in an election. it should be instantiated using New
 type Elector interface {
@@ -13,9 +20,163 @@ type Elector interface {
 	// ProcessMsg is a receiver for packets. It should be sent all Election messages
 	// received by a Dbnode.
 	ProcessMsg(msg packet.Message)
+	// Lease returns true iff this node is leader and holds an unexpired lease,
+	// and the fencing token of that lease. Tokens of later leases (on any node)
+	// are greater.
+	Lease() (token uint64, ok bool)
+	// SetMembers changes the nodes which take part in elections. A node which
+	// is not a member never becomes leader, and a leader which stops being a
+	// member stands down.
+	SetMembers(members []int)
 }
 
-// New creates a new Elector (currently using the bully algorithm).
-func New(id, n int, outgoing chan packet.Message) Elector {
-	return newRing(id, n, outgoing)
+// An election is the part of an Elector which chooses a leader. Leases are
+// added to it by a leased.
+type election interface {
+	Leader() int
+	ForwardToLeader(packet.Message)
+	ProcessMsg(msg packet.Message)
+	SetMembers(members []int)
+}
+
+// A Kind is an enum indicating which election algorithm to use.
+// Ring: a token is passed around a ring of nodes, collecting live node IDs.
+// Bully: the live node with the highest ID becomes leader.
+// Dummy: no election; every node acts as its own leader.
+// Raft: randomised election timeouts and terms, as in Raft.
+type Kind int
+
+const (
+	Ring Kind = iota
+	Bully
+	Dummy
+	Raft
+)
+
+// New creates a new Elector of the given kind, for node id, in an election
+// between the given members (see SetMembers). All of its timeouts are measured
+// using clk, and any random timeouts are drawn from a source seeded with seed.
+// Each change of leader seen by this node is logged to events (which may be
+// nil).
+func New(kind Kind, id int, members []int, outgoing *clock.Chan[packet.Message], seed int64, events *eventlog.Log, clk clock.Clock) Elector {
+	m := newMembership(members)
+
+	switch kind {
+	case Bully:
+		return newLeased(newBully(id, m, outgoing, clk), id, m, outgoing, events, clk)
+	case Dummy:
+		return newDummy(id, outgoing)
+	case Raft:
+		return newLeased(newRaft(id, m, outgoing, seed, clk), id, m, outgoing, events, clk)
+	default:
+		return newLeased(newRing(id, m, outgoing, clk), id, m, outgoing, events, clk)
+	}
+}
+
+// A membership is the ids of the nodes taking part in elections, in
+// ascending order.
+type membership []int
+
+func newMembership(members []int) membership {
+	m := append(membership(nil), members...)
+	sort.Ints(m)
+	return m
+}
+
+func (m membership) contains(id int) bool {
+	i := sort.SearchInts(m, id)
+	return i < len(m) && m[i] == id
+}
+
+// after returns the next member after id, in order around the ring of ids (so
+// the lowest member follows the highest).
+func (m membership) after(id int) int {
+	i := sort.SearchInts(m, id+1)
+	if i == len(m) {
+		i = 0
+	}
+	return m[i]
+}
+
+// before returns the greatest member less than id, or -1 if there is none.
+func (m membership) before(id int) int {
+	i := sort.SearchInts(m, id)
+	if i == 0 {
+		return -1
+	}
+	return m[i-1]
+}
+
+// highest returns the member with the greatest id.
+func (m membership) highest() int {
+	return m[len(m)-1]
+}
+
+// count returns the number of members in a set of nodes.
+func (m membership) count(nodes map[int]bool) int {
+	c := 0
+	for id := range nodes {
+		if nodes[id] && m.contains(id) {
+			c++
+		}
+	}
+	return c
+}
+
+// membershipMsg is the message which tells an election's main loop about new
+// members (in the same format as the ids in a ring token).
+func membershipMsg(members []int) packet.Message {
+	var b []byte
+	for _, id := range members {
+		b = addId(b, id)
+	}
+
+	return packet.Message{
+		DemuxKey: packet.InternalMembership,
+		Value:    b,
+	}
+}
+
+// decodeMembership decodes the members in a membershipMsg.
+func decodeMembership(msg packet.Message) membership {
+	var members []int
+	for i := 0; i+3 <= len(msg.Value); i += 3 {
+		members = append(members, bytesAsId(msg.Value[i:i+3]))
+	}
+
+	return newMembership(members)
+}
+
+// String converts a Kind to a string
+func (k Kind) String() string {
+	switch k {
+	case Ring:
+		return "ring"
+	case Bully:
+		return "bully"
+	case Dummy:
+		return "dummy"
+	case Raft:
+		return "raft"
+	default:
+		return "UNKNOWN_ELECTOR_KIND"
+	}
+}
+
+// Set parses a Kind, so that a Kind can be used as a command line flag.
+func (k *Kind) Set(s string) error {
+	switch s {
+	case "ring":
+		*k = Ring
+	case "bully":
+		*k = Bully
+	case "dummy":
+		*k = Dummy
+	case "raft":
+		*k = Raft
+	default:
+		return errors.New("Unknown elector (expected ring, bully, dummy or raft)")
+	}
+
+	return nil
 }
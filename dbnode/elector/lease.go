@@ -0,0 +1,257 @@
+package elector
+
+import (
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A leased is an Elector which adds leader leases to another election
+// algorithm. An elected leader repeatedly asks every node to grant it a lease
+// (ElectionLeaseRequest), with a fencing token in the Timestamp field. A node
+// grants (ElectionLeaseResponse) a lease for a fixed duration, to one node at a
+// time, and only for a token greater than any it has granted before (unless it
+// is renewing the lease of the same node). The leader holds a lease while a
+// majority of members have granted it. Any two majorities intersect, so at most
+// one node holds a lease at any time, and each lease has a greater token than
+// every earlier lease. This still holds when one member joins or leaves at a
+// time, since a majority of the old members intersects a majority of the new.
+type leased struct {
+	election
+
+	id       int
+	members  membership
+	duration time.Duration
+	outgoing *clock.Chan[packet.Message]
+
+	// As leader:
+	token      uint64    // the token to request (0 to choose a new one)
+	leaseToken uint64    // the token of the lease held
+	expiry     time.Time // the lease is held until expiry
+	highest    uint64    // the highest token granted by any node, as far as this node knows
+	round      int
+	roundStart time.Time
+	grants     map[int]bool
+
+	// As a granter:
+	promised     uint64 // the highest token granted
+	holder       int    // the node granted promised, or -1
+	holderExpiry time.Time
+
+	messageQueue      *clock.Chan[packet.Message]
+	leaseQueryResChan *clock.Chan[lease]
+
+	disabled bool
+
+	// The leader when last checked, to log changes of leader
+	lastLeader int
+	events     *eventlog.Log
+
+	clock clock.Clock
+}
+
+type lease struct {
+	token uint64
+	ok    bool
+}
+
+func newLeased(e election, id int, members membership, outgoing *clock.Chan[packet.Message], events *eventlog.Log, clk clock.Clock) *leased {
+	l := &leased{
+		election: e,
+
+		id:       id,
+		members:  members,
+		duration: 200 * time.Millisecond,
+		outgoing: outgoing,
+
+		holder: -1,
+
+		lastLeader: -1,
+		events:     events,
+
+		messageQueue:      clock.NewChan[packet.Message](clk, 100),
+		leaseQueryResChan: clock.NewChan[lease](clk, 0),
+
+		clock: clk,
+	}
+
+	l.clock.Go(l.mainLoop)
+	l.clock.Go(l.startHeartbeat)
+
+	return l
+}
+
+func (l *leased) mainLoop() {
+	for {
+		msg := l.messageQueue.Recv()
+		switch msg.DemuxKey {
+		case packet.ControlFail:
+			l.disabled = true
+			l.expiry = time.Time{}
+			l.token = 0
+			l.lastLeader = -1
+		case packet.ControlRecover:
+			l.disabled = false
+		case packet.InternalMembership:
+			l.members = decodeMembership(msg)
+		case packet.InternalLeaderQuery:
+			if !l.disabled && l.clock.Now().Before(l.expiry) {
+				l.leaseQueryResChan.Send(lease{l.leaseToken, true})
+			} else {
+				l.leaseQueryResChan.Send(lease{0, false})
+			}
+		}
+
+		if l.disabled {
+			continue
+		}
+
+		switch msg.DemuxKey {
+		case packet.InternalHeartbeat:
+			l.renew()
+		case packet.ElectionLeaseRequest:
+			granted := l.grant(msg.Src, msg.Timestamp)
+
+			l.outgoing.Send(packet.Message{
+				Id:        msg.Id,
+				Src:       l.id,
+				Dest:      msg.Src,
+				DemuxKey:  packet.ElectionLeaseResponse,
+				Timestamp: l.promised,
+				Ok:        granted,
+			})
+		case packet.ElectionLeaseResponse:
+			if msg.Timestamp > l.highest {
+				l.highest = msg.Timestamp
+			}
+			if msg.Id != l.round || l.grants == nil {
+				continue
+			}
+
+			if msg.Ok {
+				l.grants[msg.Src] = true
+				l.acquireIfMajority()
+			} else if msg.Timestamp >= l.token {
+				// Another node has been granted this token, so choose
+				// a greater one in the next round
+				l.token = 0
+			}
+		}
+	}
+}
+
+func (l *leased) startHeartbeat() {
+	for {
+		l.clock.Sleep(l.duration / 5)
+		l.messageQueue.Send(packet.Message{
+			DemuxKey: packet.InternalHeartbeat,
+		})
+	}
+}
+
+// renew starts a new round of lease requests, if this node is leader.
+func (l *leased) renew() {
+	leader := l.election.Leader()
+	if leader != l.lastLeader {
+		l.lastLeader = leader
+		l.events.Emit(eventlog.Elected(l.id, leader))
+	}
+
+	if leader != l.id {
+		l.expiry = time.Time{}
+		l.token = 0
+		l.grants = nil
+		return
+	}
+
+	if l.token == 0 {
+		l.token = l.highest + 1
+	}
+
+	l.round++
+	l.roundStart = l.clock.Now()
+	l.grants = make(map[int]bool)
+
+	if l.grant(l.id, l.token) {
+		l.grants[l.id] = true
+	}
+
+	for _, i := range l.members {
+		if i == l.id {
+			continue
+		}
+
+		l.outgoing.Send(packet.Message{
+			Id:        l.round,
+			Src:       l.id,
+			Dest:      i,
+			DemuxKey:  packet.ElectionLeaseRequest,
+			Timestamp: l.token,
+		})
+	}
+
+	l.acquireIfMajority()
+}
+
+// grant grants a lease with the given token to src, if possible, and returns
+// true iff it did.
+func (l *leased) grant(src int, token uint64) bool {
+	now := l.clock.Now()
+
+	ok := token > l.promised && (src == l.holder || !now.Before(l.holderExpiry)) ||
+		token == l.promised && src == l.holder
+	if ok {
+		l.promised = token
+		l.holder = src
+		l.holderExpiry = now.Add(l.duration)
+	}
+
+	if l.promised > l.highest {
+		l.highest = l.promised
+	}
+
+	return ok
+}
+
+// acquireIfMajority takes the lease requested in the current round, if a
+// majority of members have granted it. The lease is measured from the start of
+// the round, since no grant was made before then.
+func (l *leased) acquireIfMajority() {
+	if l.members.count(l.grants) > len(l.members)/2 {
+		l.leaseToken = l.token
+		l.expiry = l.roundStart.Add(l.duration)
+	}
+}
+
+// ProcessMsg is a receiver for packets. It should be sent all Election messages
+// received by a Dbnode.
+func (l *leased) ProcessMsg(msg packet.Message) {
+	switch msg.DemuxKey {
+	case packet.ElectionLeaseRequest, packet.ElectionLeaseResponse:
+		l.messageQueue.Send(msg)
+	case packet.ControlFail, packet.ControlRecover:
+		l.election.ProcessMsg(msg)
+		l.messageQueue.Send(msg)
+	default:
+		l.election.ProcessMsg(msg)
+	}
+}
+
+// SetMembers changes the nodes taking part in elections, and granting leases.
+func (l *leased) SetMembers(members []int) {
+	l.election.SetMembers(members)
+	l.messageQueue.Send(membershipMsg(members))
+}
+
+// Lease returns true iff this node is leader and holds an unexpired lease,
+// and the fencing token of that lease.
+func (l *leased) Lease() (uint64, bool) {
+	l.messageQueue.Send(packet.Message{
+		DemuxKey: packet.InternalLeaderQuery,
+	})
+
+	res := l.leaseQueryResChan.Recv()
+	return res.token, res.ok
+}
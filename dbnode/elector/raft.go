@@ -0,0 +1,279 @@
+package elector
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A raft is an Elector based on the leader election of the Raft consensus
+// algorithm. Time is divided into terms, and each election message carries
+// its sender's term in its Timestamp field. A node which hears nothing from a
+// leader for a randomised timeout starts a new term, and asks every node for
+// its vote (ElectionElect). Each node votes (ElectionAck) for at most one
+// candidate in each term, so at most one candidate wins a majority. The winner
+// sends heartbeats (ElectionCoordinator), which stop other nodes starting
+// elections. A node which sees a newer term becomes a follower in that term.
+// Only members start elections and have their votes counted; a node which is
+// not a member follows the leader it hears from.
+type raft struct {
+	id       int
+	members  membership
+	timeout  time.Duration
+	outgoing *clock.Chan[packet.Message]
+
+	role     raftRole
+	term     uint64
+	votedFor int // -1 if this node has not voted in this term
+	votes    map[int]bool
+
+	// leader == id => this node is leader.
+	// leader == -1 => no leader is known in this term.
+	leader int
+
+	// True if a leader (or candidate) has been heard from since the last
+	// election timeout
+	heardFromLeader bool
+
+	messageQueue       *clock.Chan[packet.Message]
+	leaderQueryResChan *clock.Chan[int]
+	requestsToForward  *clock.Chan[packet.Message]
+
+	disabled bool
+
+	// Used only to randomise election timeouts
+	random *rand.Rand
+
+	clock clock.Clock
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func newRaft(id int, members membership, outgoing *clock.Chan[packet.Message], seed int64, clk clock.Clock) *raft {
+	r := &raft{
+		id:       id,
+		members:  members,
+		timeout:  50 * time.Millisecond,
+		outgoing: outgoing,
+
+		votedFor: -1,
+		leader:   -1,
+
+		messageQueue:       clock.NewChan[packet.Message](clk, 100),
+		leaderQueryResChan: clock.NewChan[int](clk, 0),
+		requestsToForward:  clock.NewChan[packet.Message](clk, 1000),
+
+		random: rand.New(rand.NewSource(seed)),
+
+		clock: clk,
+	}
+
+	r.clock.Go(r.mainLoop)
+	r.clock.Go(r.startInternalTimer)
+	r.clock.Go(r.startHeartbeat)
+
+	return r
+}
+
+func (r *raft) mainLoop() {
+	for {
+		msg := r.messageQueue.Recv()
+		if r.disabled || msg.DemuxKey == packet.ControlRecover {
+			if r.disabled && msg.DemuxKey == packet.InternalLeaderQuery {
+				// A failed node knows of no leader (but must still answer,
+				// since a lease may query it concurrently with a failure)
+				r.leaderQueryResChan.Send(-1)
+			}
+			if r.disabled && msg.DemuxKey == packet.ControlRecover {
+				r.disabled = false
+				r.heardFromLeader = false
+			}
+
+			continue
+		}
+
+		if msg.DemuxKey == packet.ControlFail {
+			r.disabled = true
+			r.role = raftFollower
+			r.leader = -1
+			continue
+		}
+
+		switch msg.DemuxKey {
+		case packet.ElectionElect, packet.ElectionAck, packet.ElectionCoordinator:
+			if msg.Timestamp > r.term {
+				r.term = msg.Timestamp
+				r.role = raftFollower
+				r.votedFor = -1
+				r.leader = -1
+			}
+		}
+
+		switch msg.DemuxKey {
+		case packet.InternalTimerSignal:
+			if !r.heardFromLeader && r.role != raftLeader && r.members.contains(r.id) {
+				r.startElection()
+			}
+			r.heardFromLeader = false
+		case packet.InternalHeartbeat:
+			if r.role == raftLeader {
+				r.broadcast(packet.ElectionCoordinator)
+			}
+		case packet.ElectionElect:
+			granted := msg.Timestamp == r.term && (r.votedFor == -1 || r.votedFor == msg.Src)
+			if granted {
+				r.votedFor = msg.Src
+				r.heardFromLeader = true
+			}
+
+			r.outgoing.Send(packet.Message{
+				Src:       r.id,
+				Dest:      msg.Src,
+				DemuxKey:  packet.ElectionAck,
+				Timestamp: r.term,
+				Ok:        granted,
+			})
+		case packet.ElectionAck:
+			if r.role == raftCandidate && msg.Timestamp == r.term && msg.Ok {
+				r.votes[msg.Src] = true
+				if r.members.count(r.votes) > len(r.members)/2 {
+					r.becomeLeader()
+				}
+			}
+		case packet.ElectionCoordinator:
+			if msg.Timestamp == r.term {
+				r.role = raftFollower
+				r.leader = msg.Src
+				r.heardFromLeader = true
+			} else {
+				// Tell a stale leader about the newer term
+				r.outgoing.Send(packet.Message{
+					Src:       r.id,
+					Dest:      msg.Src,
+					DemuxKey:  packet.ElectionAck,
+					Timestamp: r.term,
+					Ok:        false,
+				})
+			}
+		case packet.InternalLeaderQuery:
+			r.leaderQueryResChan.Send(r.leader)
+		case packet.InternalMembership:
+			r.members = decodeMembership(msg)
+			if r.role != raftFollower && !r.members.contains(r.id) {
+				// A leader which has been removed stands down, and
+				// the remaining members elect a new one once they
+				// stop hearing from it
+				r.role = raftFollower
+				r.leader = -1
+			}
+		}
+
+		if r.leader > -1 {
+			r.forwardRequests()
+		}
+	}
+}
+
+// startInternalTimer sends an election timeout signal after every randomised
+// timeout, of between 1 and 2 times r.timeout. Randomising the timeout makes it
+// unlikely that several nodes start elections at the same time.
+func (r *raft) startInternalTimer() {
+	for {
+		r.clock.Sleep(r.timeout + time.Duration(r.random.Int63n(int64(r.timeout))))
+		r.messageQueue.Send(packet.Message{
+			DemuxKey: packet.InternalTimerSignal,
+		})
+	}
+}
+
+func (r *raft) startHeartbeat() {
+	for {
+		r.clock.Sleep(r.timeout * 2 / 5)
+		r.messageQueue.Send(packet.Message{
+			DemuxKey: packet.InternalHeartbeat,
+		})
+	}
+}
+
+// startElection starts a new term, with this node as a candidate.
+func (r *raft) startElection() {
+	r.term++
+	r.role = raftCandidate
+	r.votedFor = r.id
+	r.votes = map[int]bool{r.id: true}
+	r.leader = -1
+
+	r.broadcast(packet.ElectionElect)
+
+	if r.members.count(r.votes) > len(r.members)/2 {
+		r.becomeLeader()
+	}
+}
+
+func (r *raft) becomeLeader() {
+	r.role = raftLeader
+	r.leader = r.id
+
+	r.broadcast(packet.ElectionCoordinator)
+}
+
+// broadcast sends a message of the given type, in the current term, to every
+// other member.
+func (r *raft) broadcast(demuxKey packet.Messagetype) {
+	for _, i := range r.members {
+		if i == r.id {
+			continue
+		}
+
+		r.outgoing.Send(packet.Message{
+			Src:       r.id,
+			Dest:      i,
+			DemuxKey:  demuxKey,
+			Timestamp: r.term,
+			Ok:        true,
+		})
+	}
+}
+
+func (r *raft) forwardRequests() {
+	for r.requestsToForward.Len() > 0 {
+		msg := r.requestsToForward.Recv()
+
+		msg.Dest = r.leader
+		r.outgoing.Send(msg)
+	}
+}
+
+// Leader returns the current leader, or -1 if an election is in progress.
+func (r *raft) Leader() int {
+	r.messageQueue.Send(packet.Message{
+		DemuxKey: packet.InternalLeaderQuery,
+	})
+
+	return r.leaderQueryResChan.Recv()
+}
+
+// ProcessMsg is a receiver for packets. It should be sent all Election messages
+// received by a Dbnode.
+func (r *raft) ProcessMsg(msg packet.Message) {
+	r.messageQueue.Send(msg)
+}
+
+// ForwardToLeader forwards a message to the current leader. If no leader is
+// known, it buffers the message and forwards it once a leader has been elected.
+func (r *raft) ForwardToLeader(msg packet.Message) {
+	r.requestsToForward.Send(msg)
+}
+
+// SetMembers changes the nodes taking part in elections.
+func (r *raft) SetMembers(members []int) {
+	r.messageQueue.Send(membershipMsg(members))
+}
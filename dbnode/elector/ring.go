@@ -5,50 +5,53 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
-// A ring is an Elector based on a ring-based algorithm.
+// A ring is an Elector based on a ring-based algorithm. The ring is made of the
+// members, in order of id. A node which is not a member passes on any token
+// it receives, without adding itself.
 type ring struct {
 	id       int
-	n        int
+	members  membership
 	timeout  time.Duration
-	outgoing chan packet.Message
+	outgoing *clock.Chan[packet.Message]
 
 	leader     int
 	nextInRing int
 	token      packet.Message
 
-	messageQueue       chan packet.Message
-	leaderQueryResChan chan int
-	requestsToForward  chan packet.Message
+	messageQueue       *clock.Chan[packet.Message]
+	leaderQueryResChan *clock.Chan[int]
+	requestsToForward  *clock.Chan[packet.Message]
 
 	disabled bool
 
-	internalTimer chan int
+	internalTimer *clock.Chan[int]
+
+	clock clock.Clock
 
 	tokenSentLast time.Time
 }
 
-func newRing(id, n int, outgoing chan packet.Message) *ring {
+func newRing(id int, members membership, outgoing *clock.Chan[packet.Message], clk clock.Clock) *ring {
 	r := &ring{
 		id:       id,
-		n:        n,
+		members:  members,
 		timeout:  50 * time.Millisecond,
 		outgoing: outgoing,
 
 		leader:     -1,
-		nextInRing: id + 1,
+		nextInRing: members.after(id),
 
-		messageQueue:       make(chan packet.Message, n),
-		leaderQueryResChan: make(chan int),
-		requestsToForward:  make(chan packet.Message, 1000),
+		messageQueue:       clock.NewChan[packet.Message](clk, len(members)),
+		leaderQueryResChan: clock.NewChan[int](clk, 0),
+		requestsToForward:  clock.NewChan[packet.Message](clk, 1000),
 
-		internalTimer: make(chan int),
-	}
+		internalTimer: clock.NewChan[int](clk, 0),
 
-	if r.nextInRing == n {
-		r.nextInRing = 0
+		clock: clk,
 	}
 
 	r.token = packet.Message{
@@ -59,28 +62,34 @@ func newRing(id, n int, outgoing chan packet.Message) *ring {
 		Ok:       true,
 	}
 
-	go r.mainLoop()
+	r.clock.Go(r.mainLoop)
 
 	return r
 }
 
 func (r *ring) mainLoop() {
-	go r.startInternalTimer()
+	r.clock.Go(r.startInternalTimer)
 
 	timeoutCounter := 0
-	r.internalTimer <- timeoutCounter
+	r.internalTimer.Send(timeoutCounter)
 
-	if r.id == r.n-1 {
+	if r.id == r.members.highest() {
 		r.token.Value = addId(r.token.Value, r.id)
 		r.forwardToken()
 	}
 
-	for msg := range r.messageQueue {
+	for {
+		msg := r.messageQueue.Recv()
 		if r.disabled || msg.DemuxKey == packet.ControlRecover {
+			if r.disabled && msg.DemuxKey == packet.InternalLeaderQuery {
+				// A failed node knows of no leader (but must still answer,
+				// since a lease may query it concurrently with a failure)
+				r.leaderQueryResChan.Send(-1)
+			}
 			if r.disabled && msg.DemuxKey == packet.ControlRecover {
 				r.disabled = false
 				timeoutCounter = 0
-				r.internalTimer <- timeoutCounter
+				r.internalTimer.Send(timeoutCounter)
 			}
 
 			continue
@@ -93,49 +102,49 @@ func (r *ring) mainLoop() {
 		}
 
 		if msg.DemuxKey == packet.InternalTimerSignal {
-			if msg.Id == timeoutCounter {
-				if r.leader == r.nextInRing-1 {
+			if msg.Id == timeoutCounter && r.members.contains(r.id) {
+				if r.leader == r.members.before(r.nextInRing) {
 					r.token.Value = removeId(r.token.Value, r.leader)
-					r.leader = highestId(r.token.Value)
+					r.leader = r.highestMember(r.token.Value)
 				}
 				r.token.Src = r.id
 				r.token.Dest = r.nextInRing
 				r.forwardToken()
-				r.nextInRing++
-				if r.nextInRing == r.n {
-					r.nextInRing = 0
-				}
+				r.nextInRing = r.members.after(r.nextInRing)
 			}
-			r.internalTimer <- timeoutCounter
+			r.internalTimer.Send(timeoutCounter)
 		} else {
 			timeoutCounter++
 		}
 
 		switch msg.DemuxKey {
 		case packet.ElectionElect:
-			r.outgoing <- packet.Message{
+			r.outgoing.Send(packet.Message{
 				Src:      r.id,
 				Dest:     msg.Src,
 				DemuxKey: packet.ElectionAck,
 				Ok:       true,
-			}
+			})
 
 			r.token = msg
-			r.token.Value = addId(r.token.Value, r.id)
-			r.leader = highestId(r.token.Value)
+			if r.members.contains(r.id) {
+				r.token.Value = addId(r.token.Value, r.id)
+			}
+			r.leader = r.highestMember(r.token.Value)
 
 			r.token.Src = r.id
 			r.token.Dest = r.nextInRing
 			r.forwardToken()
 
-			r.nextInRing = r.id + 1
-			if r.nextInRing == r.n {
-				r.nextInRing = 0
-			}
+			r.nextInRing = r.members.after(r.id)
 		case packet.ElectionAck:
 			continue
 		case packet.InternalLeaderQuery:
-			r.leaderQueryResChan <- r.leader
+			r.leaderQueryResChan.Send(r.leader)
+		case packet.InternalMembership:
+			r.members = decodeMembership(msg)
+			r.nextInRing = r.members.after(r.id)
+			r.leader = r.highestMember(r.token.Value)
 		}
 
 		if r.leader > -1 {
@@ -146,20 +155,20 @@ func (r *ring) mainLoop() {
 
 func (r *ring) startInternalTimer() {
 	for {
-		c := <-r.internalTimer
-		time.Sleep(r.timeout / 5)
-		r.messageQueue <- packet.Message{
+		c := r.internalTimer.Recv()
+		r.clock.Sleep(r.timeout / 5)
+		r.messageQueue.Send(packet.Message{
 			Id:       c,
 			DemuxKey: packet.InternalTimerSignal,
-		}
+		})
 	}
 }
 
 func (r *ring) forwardRequests() {
-	for len(r.requestsToForward) > 0 {
-		msg := <-r.requestsToForward
+	for r.requestsToForward.Len() > 0 {
+		msg := r.requestsToForward.Recv()
 
-		r.outgoing <- packet.Message{
+		r.outgoing.Send(packet.Message{
 			Id:        msg.Id,
 			Src:       msg.Src,
 			Dest:      r.leader,
@@ -168,31 +177,52 @@ func (r *ring) forwardRequests() {
 			Value:     msg.Value,
 			Timestamp: msg.Timestamp,
 			Ok:        msg.Ok,
-		}
+			Tombstone: msg.Tombstone,
+		})
 	}
 }
 
 func (r *ring) forwardToken() {
-	if time.Since(r.tokenSentLast) > r.timeout/5 {
-		r.outgoing <- r.token
-		r.tokenSentLast = time.Now()
+	if r.clock.Since(r.tokenSentLast) > r.timeout/5 {
+		r.outgoing.Send(r.token)
+		r.tokenSentLast = r.clock.Now()
 	}
 }
 
 func (r *ring) Leader() int {
-	r.messageQueue <- packet.Message{
+	r.messageQueue.Send(packet.Message{
 		DemuxKey: packet.InternalLeaderQuery,
-	}
+	})
 
-	return <-r.leaderQueryResChan
+	return r.leaderQueryResChan.Recv()
 }
 
 func (r *ring) ProcessMsg(msg packet.Message) {
-	r.messageQueue <- msg
+	r.messageQueue.Send(msg)
 }
 
 func (r *ring) ForwardToLeader(msg packet.Message) {
-	r.requestsToForward <- msg
+	r.requestsToForward.Send(msg)
+}
+
+func (r *ring) SetMembers(members []int) {
+	r.messageQueue.Send(membershipMsg(members))
+}
+
+// highestMember returns the highest id of a member in a token, or -1 if there
+// is none. Ids of nodes which have left stay in the token until it reaches
+// them, but they cannot be leader.
+func (r *ring) highestMember(b []byte) int {
+	max := -1
+
+	for i := 0; i+3 <= len(b); i += 3 {
+		id := bytesAsId(b[i : i+3])
+		if id > max && r.members.contains(id) {
+			max = id
+		}
+	}
+
+	return max
 }
 
 func containsId(b []byte, id int) bool {
@@ -230,23 +260,6 @@ func removeId(b []byte, id int) []byte {
 	return b
 }
 
-func highestId(b []byte) int {
-	if len(b)%3 > 0 {
-		log.Fatal("Invalid id ", b)
-	}
-
-	max := -1
-
-	for i := 0; i < len(b); i += 3 {
-		id := bytesAsId(b[i : i+3])
-		if id > max {
-			max = id
-		}
-	}
-
-	return max
-}
-
 func idAsBytes(id int) []byte {
 	b := []byte(strconv.Itoa(id))
 
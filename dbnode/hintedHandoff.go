@@ -0,0 +1,241 @@
+package dbnode
+
+import (
+	"log"
+	"sort"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// In a sloppy quorum system, a write does not wait for the replicas chosen by
+// assembleQuorum to answer. A replica which has not answered a lock request
+// within half the lock timeout is replaced by a substitute: a random replica
+// of the key not yet asked to take part. The replaced replica (the owner) is
+// unlocked, in case it locked but its response was lost. The substitute takes
+// part in the write as a normal replica, and once the write commits, the
+// coordinator sends it a hint: a copy of the write, tagged with the owner. (A
+// substitute which does not answer is itself replaced, with the same owner.)
+//
+// A node keeps its hints until it receives any message from their owner (such
+// as an election heartbeat, or a response to a read), which shows that the
+// owner has recovered. Then it hands off every hint for the owner, which stores
+// each one newer than its own value. Hints which the owner does not accept
+// (because a write to the key is in progress), or whose handoff is lost, are
+// handed off again at least a lock timeout later.
+//
+// Garbage collection needs every node, so its quorum is never sloppy.
+
+// scheduleSubstitution replaces every replica which has not answered a lock
+// request for t after half the lock timeout (see substitute).
+func (n *Dbnode) scheduleSubstitution(t *txnState) {
+	msg := packet.Message{
+		Id:       t.clientRequest.Id,
+		Src:      n.id,
+		Dest:     n.id,
+		DemuxKey: packet.InternalSubstitute,
+	}
+
+	n.clock.Go(func() {
+		n.clock.Sleep(n.lockTimeout / 2)
+		n.Incoming.Send(msg)
+	})
+}
+
+// substitute replaces every replica in the quorum of a write still being
+// assembled which has not answered its lock request, for as long as there are
+// nodes left to ask.
+func (n *Dbnode) substitute(msg packet.Message) {
+	t := n.txns[msg.Id]
+	if t == nil || t.mode != assemblingQuorum {
+		return
+	}
+
+	peers, _ := n.replicaPeers(t)
+
+	var candidates []int
+	for _, i := range n.random.Perm(len(peers)) {
+		if _, ok := t.quorumMembers[peers[i]]; !ok && !t.replaced[peers[i]] {
+			candidates = append(candidates, peers[i])
+		}
+	}
+
+	var unanswered []int
+	for node, req := range t.quorumMembers {
+		if node != n.id && req.DemuxKey == packet.NodeLockRequestNoTimeout {
+			unanswered = append(unanswered, node)
+		}
+	}
+	sort.Ints(unanswered)
+
+	substituted := false
+	for _, owner := range unanswered {
+		if len(candidates) == 0 {
+			break
+		}
+
+		// Stop asking the owner, and release it in case it locked
+		n.requestRepeater.Ack(packet.Message{
+			Id:       t.clientRequest.Id,
+			Src:      owner,
+			DemuxKey: packet.NodeLockResponse,
+		})
+		n.requestRepeater.Send(packet.Message{
+			Id:       t.clientRequest.Id,
+			Src:      n.id,
+			Dest:     owner,
+			DemuxKey: packet.NodeUnlockRequest,
+			Ok:       false,
+		}, true)
+
+		sub := candidates[0]
+		candidates = candidates[1:]
+
+		if t.hints == nil {
+			t.hints = make(map[int]int)
+			t.replaced = make(map[int]bool)
+		}
+		if original, ok := t.hints[owner]; ok {
+			// The owner was itself a substitute
+			delete(t.hints, owner)
+			t.hints[sub] = original
+		} else {
+			t.hints[sub] = owner
+		}
+		t.replaced[owner] = true
+
+		req := t.quorumMembers[owner]
+		delete(t.quorumMembers, owner)
+		req.Dest = sub
+		t.quorumMembers[sub] = req
+		n.requestRepeater.Send(req, false)
+
+		substituted = true
+	}
+
+	if substituted {
+		n.scheduleSubstitution(t)
+	}
+}
+
+// sendHints sends every substitute in the quorum of a committed write a hint
+// for its owner, of the given writes.
+func (n *Dbnode) sendHints(t *txnState, writes []packet.Entry) {
+	var subs []int
+	for sub := range t.hints {
+		subs = append(subs, sub)
+	}
+	sort.Ints(subs)
+
+	for _, sub := range subs {
+		owner := t.hints[sub]
+		n.Outgoing.Send(packet.Message{
+			Id:        t.clientRequest.Id,
+			Src:       n.id,
+			Dest:      sub,
+			DemuxKey:  packet.NodeHintRequest,
+			Value:     packet.EncodeEntries(writes),
+			Timestamp: uint64(owner),
+			Ok:        true,
+		})
+	}
+}
+
+func (n *Dbnode) handleHintReq(msg packet.Message) {
+	writes, err := packet.DecodeEntries(msg.Value)
+	if err != nil {
+		log.Fatal("Malformed hint", msg)
+	}
+
+	owner := int(msg.Timestamp)
+	n.hints[owner] = mergeEntries(n.hints[owner], writes)
+}
+
+// handOff sends every hint for owner to owner, unless a handoff was sent
+// within the last lock timeout.
+func (n *Dbnode) handOff(owner int) {
+	if sent, ok := n.handoffSent[owner]; ok && n.clock.Since(sent) < n.lockTimeout {
+		return
+	}
+	n.handoffSent[owner] = n.clock.Now()
+
+	n.Outgoing.Send(packet.Message{
+		Id:       -1,
+		Src:      n.id,
+		Dest:     owner,
+		DemuxKey: packet.NodeHandoffRequest,
+		Value:    packet.EncodeEntries(n.hints[owner]),
+		Ok:       true,
+	})
+}
+
+// handleHandoffReq stores every handed off write which is newer than this
+// node's value, and responds with every write accepted (without values). A
+// write to a key with a write in progress is not accepted.
+func (n *Dbnode) handleHandoffReq(msg packet.Message) {
+	writes, err := packet.DecodeEntries(msg.Value)
+	if err != nil {
+		log.Fatal("Malformed handoff", msg)
+	}
+
+	var accepted []packet.Entry
+	for _, w := range writes {
+		current, err := n.Store.Get(w.Key)
+		if err != nil {
+			continue
+		}
+
+		if timestamp, _, _ := decodeStoredVal(current); timestamp < w.Timestamp {
+			if n.hasStagedWrites(keyLocks(w.Key)) {
+				continue
+			}
+			n.repair(w)
+		}
+
+		accepted = append(accepted, packet.Entry{Key: w.Key, Timestamp: w.Timestamp})
+	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:       -1,
+		Src:      n.id,
+		Dest:     msg.Src,
+		DemuxKey: packet.NodeHandoffResponse,
+		Value:    packet.EncodeEntries(accepted),
+		Ok:       true,
+	})
+}
+
+// handleHandoffRes deletes every hint which the owner accepted (unless a newer
+// hint for the same key has been received since).
+func (n *Dbnode) handleHandoffRes(msg packet.Message) {
+	accepted, err := packet.DecodeEntries(msg.Value)
+	if err != nil {
+		log.Fatal("Malformed handoff response", msg)
+	}
+
+	done := make(map[string]uint64)
+	for _, e := range accepted {
+		done[string(e.Key)] = e.Timestamp
+	}
+
+	remaining := n.hints[msg.Src][:0]
+	for _, h := range n.hints[msg.Src] {
+		if timestamp, ok := done[string(h.Key)]; !ok || h.Timestamp > timestamp {
+			remaining = append(remaining, h)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(n.hints, msg.Src)
+	} else {
+		n.hints[msg.Src] = remaining
+	}
+}
+
+// numHints returns the number of writes held as hints for other nodes.
+func (n *Dbnode) numHints() int {
+	total := 0
+	for _, hints := range n.hints {
+		total += len(hints)
+	}
+	return total
+}
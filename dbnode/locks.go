@@ -0,0 +1,216 @@
+package dbnode
+
+import (
+	"bytes"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A lockSet is the set of keys locked by a transaction: either a list of keys,
+// or every key in a range (for a scan). Transactions with overlapping lock
+// sets cannot run at the same time on the same node, but transactions on
+// unrelated keys can.
+type lockSet struct {
+	keys [][]byte
+
+	isRange bool
+	start   []byte
+	end     []byte // nil for unbounded
+}
+
+func keyLocks(keys ...[]byte) lockSet {
+	return lockSet{keys: keys}
+}
+
+func rangeLock(start, end []byte) lockSet {
+	return lockSet{isRange: true, start: start, end: end}
+}
+
+// lockSetOf returns the keys which a request must lock. Lock requests list the
+// keys of the coordinator's transaction in Value (see encodeKeys).
+func lockSetOf(msg packet.Message) lockSet {
+	switch msg.DemuxKey {
+	case packet.ClientScanRequest, packet.NodeScanRequest:
+		var end []byte
+		if len(msg.Value) > 0 {
+			end = msg.Value
+		}
+		return rangeLock(msg.Key, end)
+	case packet.ClientTxnRequest:
+		// A malformed transaction locks nothing, and is aborted later
+		writes, _ := packet.DecodeEntries(msg.Value)
+
+		keys := make([][]byte, len(writes))
+		for i, w := range writes {
+			keys[i] = w.Key
+		}
+		return keyLocks(keys...)
+	case packet.NodeLockRequest, packet.NodeLockRequestNoTimeout:
+		keys, _ := decodeKeys(msg.Value)
+		return keyLocks(keys...)
+	default:
+		return keyLocks(msg.Key)
+	}
+}
+
+// contains returns true iff key is in l.
+func (l lockSet) contains(key []byte) bool {
+	if l.isRange {
+		return bytes.Compare(key, l.start) >= 0 && (l.end == nil || bytes.Compare(key, l.end) < 0)
+	}
+
+	for _, k := range l.keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// overlaps returns true iff some key is in both l and o.
+func (l lockSet) overlaps(o lockSet) bool {
+	if l.isRange && o.isRange {
+		return (o.end == nil || bytes.Compare(l.start, o.end) < 0) &&
+			(l.end == nil || bytes.Compare(o.start, l.end) < 0)
+	}
+	if l.isRange {
+		return o.overlaps(l)
+	}
+
+	for _, k := range l.keys {
+		if o.contains(k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encodeKeys encodes the keys of a lock set, to send in a lock request. A
+// range is never locked on other nodes, so is not encoded.
+func encodeKeys(l lockSet) []byte {
+	entries := make([]packet.Entry, len(l.keys))
+	for i, k := range l.keys {
+		entries[i].Key = k
+	}
+
+	return packet.EncodeEntries(entries)
+}
+
+func decodeKeys(encoded []byte) ([][]byte, error) {
+	entries, err := packet.DecodeEntries(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+
+	return keys, nil
+}
+
+// locked returns true iff a transaction in progress holds a lock on any key in
+// l.
+func (n *Dbnode) locked(l lockSet) bool {
+	for _, t := range n.txns {
+		if t.locks.overlaps(l) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasStagedWrites returns true iff a transaction in progress has staged a write
+// to any key in l.
+func (n *Dbnode) hasStagedWrites(l lockSet) bool {
+	for _, t := range n.txns {
+		for _, w := range t.uncommitted {
+			if l.contains(w.key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The maximum number of lock waits kept between stats queries, so that they
+// do not accumulate on a node which is never queried
+const maxLockWaits = 10000
+
+// queueLockRequest queues a request until its keys can be locked.
+func (n *Dbnode) queueLockRequest(msg *packet.Message) {
+	n.lockRequests.enqueue(msg)
+	n.lockQueuedAt[msg] = n.clock.Now()
+}
+
+// grantLockRequests starts every queued request whose keys are not locked. A
+// request also waits for every earlier queued request for any of the same
+// keys, so that the requests for each key are granted in order. A write to be
+// coordinated by this node also waits until this node holds a leader lease.
+func (n *Dbnode) grantLockRequests() {
+	var waiting []lockSet
+
+	var token uint64
+	var hasLease, leaseChecked bool
+
+	for i := 0; i < n.lockRequests.length(); {
+		msg := n.lockRequests.values[i]
+		locks := lockSetOf(*msg)
+
+		blocked := n.locked(locks)
+		for _, w := range waiting {
+			blocked = blocked || w.overlaps(locks)
+		}
+
+		if !blocked && n.leaderCoordinates(*msg) {
+			if !leaseChecked {
+				token, hasLease = n.elector.Lease()
+				leaseChecked = true
+			}
+			blocked = !hasLease
+		}
+
+		if blocked {
+			waiting = append(waiting, locks)
+			i++
+			continue
+		}
+
+		n.lockRequests.remove(msg)
+		if t, ok := n.lockQueuedAt[msg]; ok {
+			if len(n.lockWaits) < maxLockWaits {
+				n.lockWaits = append(n.lockWaits, n.clock.Since(t))
+			}
+			delete(n.lockQueuedAt, msg)
+		}
+
+		// Don't lock for a transaction for which we have previously
+		// received an unlock request (or which is already in progress,
+		// if the request was repeated).
+		if n.unlockTxids[msg.Id] || n.txns[msg.Id] != nil {
+			continue
+		}
+
+		if n.leaderCoordinates(*msg) {
+			n.startTxn(*msg, locks, token)
+		} else {
+			n.startTxn(*msg, locks, 0)
+		}
+	}
+}
+
+// leaderCoordinates returns true iff a request starts a write coordinated by
+// the leader, which needs the leader's lease.
+func (n *Dbnode) leaderCoordinates(msg packet.Message) bool {
+	switch msg.DemuxKey {
+	case packet.ClientWriteRequest, packet.ClientStrongWriteRequest, packet.ClientDeleteRequest, packet.ClientTxnRequest, packet.InternalGarbageCollect:
+		return !n.replicaCoordinates(msg)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,717 @@
+package dbnode
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// Nodes may join and leave the cluster while it runs, one at a time. The
+// members of the cluster, and the quorum sizes used with them, form a
+// configuration. Each configuration has a version, and every node agrees on
+// the configuration of each version.
+//
+// A client asks any node to make a change, and the request is forwarded to the
+// leader, which holds a lease. The leader proposes the next version by a round
+// of single-decree Paxos between the members of its current configuration,
+// with a ballot made from its lease's fencing token (so a later leader's
+// ballots are greater):
+// 1. The leader sends a NodeConfigPrepare to every member. A member promises
+// (NodeConfigPromise) to accept no lower ballot for that version, and returns
+// any configuration it has already accepted for it.
+// 2. Once a write quorum has promised, the leader sends a NodeConfigAccept,
+// with the accepted configuration of the highest ballot if any member returned
+// one (and its own otherwise). A member accepts (NodeConfigAccepted) unless it
+// has promised a higher ballot.
+// 3. Once a write quorum has accepted, the configuration is agreed. The leader
+// adopts it, and sends a NodeConfigCommit to every old and new member.
+// A proposal which makes no progress for a lock timeout is abandoned. A member
+// which has accepted a configuration which it has not seen committed a lock
+// timeout later asks the leader (NodeConfigRecover) to agree a version again,
+// so that an abandoned proposal is either finished or replaced.
+//
+// Every request a coordinator sends to assemble a quorum carries the version of
+// its configuration, and a node refuses the request if it has committed or
+// accepted a later version (telling the coordinator of any committed one). A
+// write quorum of the old configuration must accept a change, so once it is
+// agreed, no transaction can assemble a write quorum of the old configuration.
+//
+// Quorum sizes are recalculated for each configuration. A write quorum must be
+// a majority, and a read quorum must intersect every write quorum (if the
+// initial quorums did). Each configuration also records copies: the number of
+// members which hold every write made before it. A new member holds none, so
+// joining does not add a copy, and leaving may remove one. Every quorum must
+// intersect every set of copies, so includes N - copies + 1 of the N members.
+// Otherwise, each quorum leaves out as many members as the initial one did, if
+// possible. A node cannot leave if doing so could lose a write.
+//
+// A leader which stops being a member stands down (see elector.Elector).
+//
+// A new member catches up by asking the other members for their stores
+// (NodeCatchUpRequest). A member answers once it has committed the new
+// configuration, and no transaction from an older one is in progress. Then
+// every write made before the change is stored by some member of any N -
+// copies of the others. Once enough have answered, the leader agrees a
+// configuration in which the new member counts as a copy. Only then can
+// another node join or leave (except the new member, which may leave if it
+// cannot catch up).
+//
+// Keys cannot be partitioned between a changing set of members, so changes are
+// refused when there is a hashring.Ring.
+
+// A config is one version of the cluster's membership.
+// Fields:
+// version: agreed versions are numbered from 0 (the initial configuration)
+// members: the nodes in the cluster, in ascending order
+// rqs, wqs: the read and write quorum sizes
+// copies: the number of members which hold every write made before this version
+// joining: a new member which has not yet caught up (-1 if none)
+type config struct {
+	version uint64
+	members []int
+	rqs     int
+	wqs     int
+	copies  int
+	joining int
+}
+
+// A configProposal is the state of the leader's proposal of a configuration.
+// Fields:
+// request: the request for the change (a ClientMembershipRequest, or a message
+// from a member if the leader proposed it for another reason)
+// ballot: the ballot of this proposal
+// value: the configuration proposed
+// recovered: true iff value was accepted in an earlier ballot, so differs from
+// the change requested
+// highest: the ballot with which value was accepted, if recovered
+// promises, accepts: the members which have promised and accepted (accepts is
+// nil until a write quorum has promised)
+// active: false if no response has been received since the last internal
+// timer signal
+type configProposal struct {
+	request   packet.Message
+	ballot    uint64
+	value     config
+	recovered bool
+	highest   uint64
+	promises  map[int]bool
+	accepts   map[int]bool
+	active    bool
+}
+
+// A catchUp is the state of a new member catching up: the version of the
+// configuration in which it joined, and the members which have sent it their
+// stores.
+type catchUp struct {
+	version uint64
+	peers   map[int]bool
+}
+
+// initialConfig returns the configuration of version 0.
+func initialConfig(members []int, rqs, wqs int) config {
+	members = append([]int(nil), members...)
+	sort.Ints(members)
+
+	return config{
+		members: members,
+		rqs:     rqs,
+		wqs:     wqs,
+		copies:  len(members),
+		joining: -1,
+	}
+}
+
+func (c config) isMember(id int) bool {
+	i := sort.SearchInts(c.members, id)
+	return i < len(c.members) && c.members[i] == id
+}
+
+// joined returns the next configuration after id joins. Quorum sizes are
+// relative to initial (see resize).
+func (c config) joined(id int, initial config) config {
+	members := append([]int{id}, c.members...)
+	sort.Ints(members)
+
+	next := resize(members, minOf(c.copies, c.wqs), initial)
+	next.joining = id
+	return next
+}
+
+// left returns the next configuration after id leaves, and false if it cannot
+// leave without possibly losing a write. A new member which has not caught up
+// is not a copy, so may always leave.
+func (c config) left(id int, initial config) (config, bool) {
+	var members []int
+	for _, m := range c.members {
+		if m != id {
+			members = append(members, m)
+		}
+	}
+
+	copies := minOf(c.copies, c.wqs)
+	if id != c.joining {
+		copies--
+	}
+	if len(members) == 0 || copies < 1 {
+		return c, false
+	}
+
+	return resize(members, copies, initial), true
+}
+
+// caughtUp returns the next configuration after the new member has caught up,
+// so holds every write made before it joined.
+func (c config) caughtUp(initial config) config {
+	return resize(c.members, minOf(c.copies+1, c.wqs), initial)
+}
+
+// resize returns a configuration (without a version) of the given members, with
+// quorum sizes which intersect every set of copies. Each quorum leaves out as
+// many members as in the initial configuration, but a write quorum must be a
+// majority, and, if the initial quorums were strict, a read quorum must
+// intersect every write quorum.
+func resize(members []int, copies int, initial config) config {
+	n := len(members)
+	n0 := len(initial.members)
+
+	wqs := maxOf(n-(n0-initial.wqs), n/2+1, n-copies+1)
+	rqs := initial.rqs
+	if initial.rqs+initial.wqs > n0 {
+		rqs = maxOf(rqs, n-wqs+1, n-copies+1)
+	}
+
+	return config{
+		members: members,
+		rqs:     maxOf(1, minOf(rqs, n)),
+		wqs:     maxOf(1, minOf(wqs, n)),
+		copies:  copies,
+		joining: -1,
+	}
+}
+
+func minOf(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxOf(a int, others ...int) int {
+	for _, b := range others {
+		if b > a {
+			a = b
+		}
+	}
+	return a
+}
+
+// encode encodes every field of c except its version.
+func (c config) encode() []byte {
+	b := make([]byte, 4*(4+len(c.members)))
+
+	binary.BigEndian.PutUint32(b, uint32(c.rqs))
+	binary.BigEndian.PutUint32(b[4:], uint32(c.wqs))
+	binary.BigEndian.PutUint32(b[8:], uint32(c.copies))
+	binary.BigEndian.PutUint32(b[12:], uint32(c.joining+1))
+	for i, m := range c.members {
+		binary.BigEndian.PutUint32(b[16+4*i:], uint32(m))
+	}
+
+	return b
+}
+
+// decodeConfig decodes a configuration encoded by encode, with the given
+// version.
+func decodeConfig(version uint64, b []byte) (config, error) {
+	if len(b) < 20 || len(b)%4 != 0 {
+		return config{}, errors.New("Malformed configuration")
+	}
+
+	c := config{
+		version: version,
+		rqs:     int(binary.BigEndian.Uint32(b)),
+		wqs:     int(binary.BigEndian.Uint32(b[4:])),
+		copies:  int(binary.BigEndian.Uint32(b[8:])),
+		joining: int(binary.BigEndian.Uint32(b[12:])) - 1,
+	}
+	for i := 16; i < len(b); i += 4 {
+		c.members = append(c.members, int(binary.BigEndian.Uint32(b[i:])))
+	}
+
+	return c, nil
+}
+
+// adoptConfig makes c the configuration of this node. A proposal of this node
+// for the same version (or an earlier one) is abandoned.
+func (n *Dbnode) adoptConfig(c config) {
+	if n.proposal != nil && n.proposal.value.version <= c.version {
+		n.endProposal(false)
+	}
+
+	if c.joining == n.id && n.config.joining != n.id {
+		n.catchUp = &catchUp{
+			version: c.version,
+			peers:   make(map[int]bool),
+		}
+	} else if c.joining != n.id {
+		n.catchUp = nil
+	}
+
+	n.config = c
+	n.readQuorumSize = c.rqs
+	n.writeQuorumSize = c.wqs
+
+	n.elector.SetMembers(c.members)
+	n.backgroundWriteDaemon.reconfigure(c.members, c.rqs)
+
+	n.events.Emit(eventlog.Reconfigured(n.id, c.version, c.members))
+}
+
+// sendConfig sends this node's configuration to dest, which has an older one.
+func (n *Dbnode) sendConfig(dest int) {
+	n.Outgoing.Send(packet.Message{
+		Id:        -1,
+		Src:       n.id,
+		Dest:      dest,
+		DemuxKey:  packet.NodeConfigCommit,
+		Value:     n.config.encode(),
+		Timestamp: n.config.version,
+		Ok:        true,
+	})
+}
+
+// fenced returns true iff msg, a request to take part in a quorum, must be
+// refused because this node has committed or accepted a later configuration
+// than the coordinator's (see assembleQuorum).
+func (n *Dbnode) fenced(msg packet.Message) bool {
+	if msg.Timestamp >= n.config.version && msg.Timestamp >= n.accepted.version {
+		return false
+	}
+
+	if msg.Timestamp < n.config.version {
+		n.sendConfig(msg.Src)
+	}
+	return true
+}
+
+// handleMembershipReq starts agreeing the configuration requested by a client,
+// as leader. A request for a change already made succeeds at once.
+func (n *Dbnode) handleMembershipReq(msg packet.Message) {
+	node := int(msg.Timestamp)
+	join := !msg.Tombstone
+
+	switch {
+	case node < 0 || node > n.numPeers:
+		n.answerMembershipReq(msg, false)
+	case join == n.config.isMember(node):
+		n.answerMembershipReq(msg, true)
+	case n.ring != nil || n.proposal != nil || n.config.joining != -1 && n.config.joining != node:
+		n.answerMembershipReq(msg, false)
+	case join:
+		n.proposeConfig(msg, n.config.joined(node, n.initialConfig))
+	default:
+		if c, ok := n.config.left(node, n.initialConfig); ok {
+			n.proposeConfig(msg, c)
+		} else {
+			n.answerMembershipReq(msg, false)
+		}
+	}
+}
+
+// answerMembershipReq responds to a client's request (and does nothing for
+// changes proposed for another reason), with this node's configuration.
+func (n *Dbnode) answerMembershipReq(msg packet.Message, ok bool) {
+	if msg.DemuxKey != packet.ClientMembershipRequest {
+		return
+	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:        msg.Id,
+		Src:       n.id,
+		Dest:      msg.Src,
+		DemuxKey:  packet.ClientMembershipResponse,
+		Value:     n.config.encode(),
+		Timestamp: n.config.version,
+		Ok:        ok,
+	})
+}
+
+// proposeConfig proposes c as the next version of the configuration, as
+// leader, for request.
+func (n *Dbnode) proposeConfig(request packet.Message, c config) {
+	token, ok := n.elector.Lease()
+	if !ok {
+		n.answerMembershipReq(request, false)
+		return
+	}
+
+	// A ballot is unique to this node, and greater than any of an earlier
+	// lease
+	n.numBallots++
+	c.version = n.config.version + 1
+
+	n.proposal = &configProposal{
+		request:  request,
+		ballot:   token<<40 | uint64(n.numBallots%(1<<30))<<10 | uint64(n.id),
+		value:    c,
+		promises: make(map[int]bool),
+		active:   true,
+	}
+
+	prepare := packet.Message{
+		Id:        -1,
+		Src:       n.id,
+		DemuxKey:  packet.NodeConfigPrepare,
+		Value:     n.config.encode(),
+		Timestamp: c.version,
+		Ok:        true,
+		Token:     n.proposal.ballot,
+	}
+	if n.sendToMembers(prepare) {
+		n.handleConfigPromise(n.configPrepare(prepare))
+	}
+}
+
+// sendToMembers sends msg to every other member, and returns true iff this
+// node is a member.
+func (n *Dbnode) sendToMembers(msg packet.Message) bool {
+	for _, m := range n.config.members {
+		if m != n.id {
+			msg.Dest = m
+			n.Outgoing.Send(msg)
+		}
+	}
+
+	return n.config.isMember(n.id)
+}
+
+// endProposal abandons (or finishes) the leader's proposal, answering the
+// request for it.
+func (n *Dbnode) endProposal(ok bool) {
+	n.answerMembershipReq(n.proposal.request, ok)
+	n.proposal = nil
+}
+
+// skipBallots makes the next ballot of this node greater than the given ballot,
+// if it has the same fencing token.
+func (n *Dbnode) skipBallots(ballot uint64) {
+	if used := int(ballot>>10) % (1 << 30); used > n.numBallots%(1<<30) {
+		n.numBallots = used
+	}
+}
+
+// configPrepare promises a ballot, if possible, and returns the response.
+func (n *Dbnode) configPrepare(msg packet.Message) packet.Message {
+	res := packet.Message{
+		Id:        msg.Id,
+		Src:       n.id,
+		Dest:      msg.Src,
+		DemuxKey:  packet.NodeConfigPromise,
+		Timestamp: n.promised,
+		Token:     msg.Token,
+	}
+
+	// The leader's configuration has been agreed, and may be newer
+	if c, err := decodeConfig(msg.Timestamp-1, msg.Value); err == nil && c.version > n.config.version {
+		n.adoptConfig(c)
+	}
+
+	if n.config.version >= msg.Timestamp {
+		n.sendConfig(msg.Src)
+		return res
+	}
+	if msg.Token < n.promised {
+		return res
+	}
+
+	n.promised = msg.Token
+
+	res.Ok = true
+	res.Timestamp = 0
+	if n.accepted.version == msg.Timestamp {
+		res.Timestamp = n.acceptedBallot
+		res.Value = n.accepted.encode()
+	}
+
+	return res
+}
+
+func (n *Dbnode) handleConfigPrepare(msg packet.Message) {
+	n.Outgoing.Send(n.configPrepare(msg))
+}
+
+func (n *Dbnode) handleConfigPromise(msg packet.Message) {
+	p := n.proposal
+	if p == nil || msg.Token != p.ballot || p.accepts != nil {
+		return
+	}
+	p.active = true
+
+	if !msg.Ok {
+		n.skipBallots(msg.Timestamp)
+		n.endProposal(false)
+		return
+	}
+
+	p.promises[msg.Src] = true
+
+	// A configuration already accepted may have been agreed, so must be
+	// proposed instead
+	if len(msg.Value) > 0 && msg.Timestamp > p.highest {
+		if c, err := decodeConfig(p.value.version, msg.Value); err == nil {
+			p.value = c
+			p.recovered = true
+			p.highest = msg.Timestamp
+		}
+	}
+
+	if len(p.promises) < n.config.wqs {
+		return
+	}
+
+	p.accepts = make(map[int]bool)
+
+	accept := packet.Message{
+		Id:        -1,
+		Src:       n.id,
+		DemuxKey:  packet.NodeConfigAccept,
+		Value:     p.value.encode(),
+		Timestamp: p.value.version,
+		Ok:        true,
+		Token:     p.ballot,
+	}
+	if n.sendToMembers(accept) {
+		n.handleConfigAccepted(n.configAccept(accept))
+	}
+}
+
+// configAccept accepts a configuration, if possible, and returns the response.
+func (n *Dbnode) configAccept(msg packet.Message) packet.Message {
+	res := packet.Message{
+		Id:        msg.Id,
+		Src:       n.id,
+		Dest:      msg.Src,
+		DemuxKey:  packet.NodeConfigAccepted,
+		Timestamp: n.promised,
+		Token:     msg.Token,
+	}
+
+	if n.config.version >= msg.Timestamp {
+		n.sendConfig(msg.Src)
+		return res
+	}
+	if msg.Token < n.promised {
+		return res
+	}
+
+	c, err := decodeConfig(msg.Timestamp, msg.Value)
+	if err != nil {
+		return res
+	}
+
+	n.promised = msg.Token
+	n.accepted = c
+	n.acceptedBallot = msg.Token
+	n.acceptedStale = false
+
+	res.Ok = true
+	return res
+}
+
+func (n *Dbnode) handleConfigAccept(msg packet.Message) {
+	n.Outgoing.Send(n.configAccept(msg))
+}
+
+func (n *Dbnode) handleConfigAccepted(msg packet.Message) {
+	p := n.proposal
+	if p == nil || msg.Token != p.ballot || p.accepts == nil {
+		return
+	}
+	p.active = true
+
+	if !msg.Ok {
+		n.skipBallots(msg.Timestamp)
+		n.endProposal(false)
+		return
+	}
+
+	p.accepts[msg.Src] = true
+	if len(p.accepts) < n.config.wqs {
+		return
+	}
+
+	// Agreed, so every old and new member is told
+	n.proposal = nil
+	old := n.config
+	n.adoptConfig(p.value)
+
+	notified := make(map[int]bool)
+	for _, m := range append(old.members, p.value.members...) {
+		if m != n.id && !notified[m] {
+			n.sendConfig(m)
+			notified[m] = true
+		}
+	}
+
+	n.answerMembershipReq(p.request, !p.recovered)
+}
+
+func (n *Dbnode) handleConfigCommit(msg packet.Message) {
+	if c, err := decodeConfig(msg.Timestamp, msg.Value); err == nil && c.version > n.config.version {
+		n.adoptConfig(c)
+	}
+}
+
+// handleConfigRecover agrees the version after this node's configuration
+// again, as leader, since a member has accepted a configuration for it which
+// may have been abandoned.
+func (n *Dbnode) handleConfigRecover(msg packet.Message) {
+	if msg.Timestamp <= n.config.version {
+		n.sendConfig(msg.Src)
+		return
+	}
+
+	if n.proposal == nil {
+		// Unless the accepted configuration is recovered, nothing changes
+		n.proposeConfig(msg, n.config)
+	}
+}
+
+// configTimerSignal abandons a proposal which has made no progress since the
+// last internal timer signal, and starts recovery of a configuration accepted
+// before then but not yet committed. A new member asks for stores.
+func (n *Dbnode) configTimerSignal() {
+	if p := n.proposal; p != nil {
+		if !p.active {
+			n.endProposal(false)
+		} else {
+			p.active = false
+		}
+	}
+
+	if n.accepted.version > n.config.version {
+		if n.acceptedStale {
+			n.elector.ForwardToLeader(packet.Message{
+				Id:        -1,
+				Src:       n.id,
+				DemuxKey:  packet.NodeConfigRecover,
+				Timestamp: n.accepted.version,
+				Ok:        true,
+			})
+		}
+		n.acceptedStale = true
+	}
+
+	if n.catchUp != nil {
+		n.requestCatchUp()
+	}
+}
+
+// requestCatchUp asks every member which has not yet sent its store for it, as
+// a new member, or tells the leader that it has caught up.
+func (n *Dbnode) requestCatchUp() {
+	if len(n.catchUp.peers) >= len(n.config.members)-n.config.copies {
+		n.elector.ForwardToLeader(packet.Message{
+			Id:        -1,
+			Src:       n.id,
+			DemuxKey:  packet.NodeCaughtUp,
+			Timestamp: n.config.version,
+			Ok:        true,
+		})
+		return
+	}
+
+	for _, m := range n.config.members {
+		if m != n.id && !n.catchUp.peers[m] {
+			n.Outgoing.Send(packet.Message{
+				Id:        -1,
+				Src:       n.id,
+				Dest:      m,
+				DemuxKey:  packet.NodeCatchUpRequest,
+				Timestamp: n.catchUp.version,
+				Ok:        true,
+			})
+		}
+	}
+}
+
+// handleCatchUpReq sends a new member every committed entry in the store, once
+// no transaction from before it joined can still write.
+func (n *Dbnode) handleCatchUpReq(msg packet.Message) {
+	res := packet.Message{
+		Id:        msg.Id,
+		Src:       n.id,
+		Dest:      msg.Src,
+		DemuxKey:  packet.NodeCatchUpResponse,
+		Timestamp: msg.Timestamp,
+	}
+
+	older := n.config.version < msg.Timestamp
+	for _, t := range n.txns {
+		older = older || t.version < msg.Timestamp
+	}
+
+	if !older {
+		entries, err := n.scanLocal(nil, nil)
+		res.Value = packet.EncodeEntries(entries)
+		res.Ok = err == nil
+	}
+
+	n.Outgoing.Send(res)
+}
+
+// handleCatchUpRes stores every newer entry in a member's store, as a new
+// member. The member is only counted if every entry was stored (a key locked
+// by a transaction is left until the member is asked again).
+func (n *Dbnode) handleCatchUpRes(msg packet.Message) {
+	if n.catchUp == nil || msg.Timestamp != n.catchUp.version || !msg.Ok {
+		return
+	}
+
+	entries, err := packet.DecodeEntries(msg.Value)
+	if err != nil {
+		return
+	}
+
+	complete := true
+	for _, e := range entries {
+		current, err := n.Store.Get(e.Key)
+		if err != nil {
+			complete = false
+			continue
+		}
+
+		if timestamp, _, _ := decodeStoredVal(current); e.Timestamp <= timestamp {
+			continue
+		}
+
+		if n.locked(keyLocks(e.Key)) {
+			complete = false
+			continue
+		}
+
+		n.repair(e)
+	}
+
+	if complete {
+		n.catchUp.peers[msg.Src] = true
+	}
+}
+
+// handleCaughtUp agrees a configuration in which a new member which has caught
+// up counts as a copy, as leader.
+func (n *Dbnode) handleCaughtUp(msg packet.Message) {
+	if n.config.joining != msg.Src {
+		if msg.Timestamp < n.config.version {
+			n.sendConfig(msg.Src)
+		}
+		return
+	}
+
+	if n.proposal == nil {
+		n.proposeConfig(msg, n.config.caughtUp(n.initialConfig))
+	}
+}
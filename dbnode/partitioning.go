@@ -0,0 +1,104 @@
+package dbnode
+
+import (
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// Keys may be partitioned between nodes by a hashring.Ring, so that each key
+// is only stored by R of the n nodes (its replicas). Then quorum sizes are
+// relative to R: the quorum of a single key operation is drawn from the key's
+// replicas. A coordinator which is not a replica still coordinates, but does
+// not store the key, so it asks one more replica instead.
+//
+// A scan or multi-key transaction may access keys with any replicas, so its
+// quorum is drawn from every node. A quorum of q + n - R nodes includes at
+// least q replicas of every key. Each node only stores the keys it replicates.
+//
+// A single key write is coordinated by a replica of the key, rather than the
+// leader, which may not be one: a replica which receives the write coordinates
+// it, and any other node forwards it to the key's first replica on the ring (if
+// that replica has failed, the client retries with another). Conflicting
+// writes to a key are still serialised by the locks of their write quorums,
+// which each include a majority of the key's replicas, but they are not fenced
+// by the leader's lease (see checkToken). Multi-key transactions and garbage
+// collection are still coordinated by the leader.
+//
+// Without a ring (R = n), each of these is the same as before partitioning,
+// and quorums are drawn from the members (see membership.go).
+
+// replicates returns true iff this node stores key.
+func (n *Dbnode) replicates(key []byte) bool {
+	return n.ring.Contains(key, n.id)
+}
+
+// replicaCoordinates returns true iff msg is a write coordinated by a replica
+// of its key, rather than the leader.
+func (n *Dbnode) replicaCoordinates(msg packet.Message) bool {
+	if n.ring == nil {
+		return false
+	}
+
+	switch msg.DemuxKey {
+	case packet.ClientWriteRequest, packet.ClientStrongWriteRequest, packet.ClientDeleteRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+// forwardToReplica forwards a write which this node cannot coordinate (see
+// replicaCoordinates) to the first replica of its key.
+func (n *Dbnode) forwardToReplica(msg packet.Message) {
+	msg.Dest = n.ring.Replicas(msg.Key)[0]
+	n.Outgoing.Send(msg)
+}
+
+// replicaPeers returns the other nodes from which the quorum of t may be drawn,
+// and whether this node's store is part of the quorum.
+func (n *Dbnode) replicaPeers(t *txnState) (peers []int, local bool) {
+	var replicas []int
+	switch t.clientRequest.DemuxKey {
+	case packet.ClientScanRequest, packet.ClientTxnRequest:
+		// Every node
+	default:
+		replicas = n.ring.Replicas(t.clientRequest.Key)
+	}
+
+	if replicas == nil {
+		members := n.config.members
+		if !n.config.isMember(n.id) {
+			return members, false
+		}
+
+		// Every other member, with the last in place of this one
+		last := len(members) - 1
+		for _, i := range members[:last] {
+			if i == n.id {
+				peers = append(peers, members[last])
+			} else {
+				peers = append(peers, i)
+			}
+		}
+		return peers, true
+	}
+
+	for _, node := range replicas {
+		if node == n.id {
+			local = true
+		} else {
+			peers = append(peers, node)
+		}
+	}
+	return peers, local
+}
+
+// readQuorum returns the size of the quorum required for the current read or
+// scan.
+func (n *Dbnode) readQuorum(t *txnState) int {
+	if t.clientRequest.DemuxKey == packet.ClientScanRequest {
+		numNodes := len(n.config.members)
+		return n.readQuorumSize + numNodes - n.ring.Factor(numNodes)
+	}
+
+	return n.readQuorumSize
+}
@@ -0,0 +1,199 @@
+package dbnode
+
+import (
+	"errors"
+
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A ReadRepair is an enum indicating whether the coordinator of a read repairs
+// the replicas in its read quorum (including itself) which returned an older
+// value than the latest, by sending them the latest value.
+// NoRepair: stale replicas are not repaired.
+// AsyncRepair: the coordinator answers the client, then repairs stale
+// replicas without waiting for them.
+// SyncRepair: the coordinator only answers the client once every stale replica
+// has acknowledged its repair. Repairs are best effort, so if a replica does
+// not respond before the read would time out, the client is answered anyway.
+type ReadRepair int
+
+const (
+	NoRepair ReadRepair = iota
+	AsyncRepair
+	SyncRepair
+)
+
+// repairRead answers a read transaction with latest, the latest value read
+// from its quorum (see ReadRepair). localTimestamp is the timestamp of the
+// value read from this node's store.
+func (n *Dbnode) repairRead(t *txnState, latest packet.Message, localTimestamp uint64) {
+	if n.readRepair == NoRepair || latest.Timestamp == 0 {
+		n.answerRead(t, latest)
+		return
+	}
+
+	if localTimestamp < latest.Timestamp && n.replicates(latest.Key) && !n.hasStagedWrites(keyLocks(latest.Key)) {
+		n.repair(packet.Entry{
+			Key:       latest.Key,
+			Value:     latest.Value,
+			Timestamp: latest.Timestamp,
+			Tombstone: latest.Tombstone,
+		})
+	}
+
+	numStale := 0
+	for _, id := range t.members() {
+		res := t.quorumMembers[id]
+		if id == n.id || res.Timestamp >= latest.Timestamp {
+			continue
+		}
+
+		req := packet.Message{
+			Id:        t.clientRequest.Id,
+			Src:       n.id,
+			Dest:      id,
+			DemuxKey:  packet.NodeRepairRequest,
+			Key:       latest.Key,
+			Value:     latest.Value,
+			Timestamp: latest.Timestamp,
+			Ok:        true,
+			Tombstone: latest.Tombstone,
+		}
+
+		if n.readRepair == SyncRepair {
+			t.quorumMembers[id] = req
+			n.requestRepeater.Send(req, false)
+		} else {
+			n.Outgoing.Send(req)
+		}
+		numStale++
+	}
+
+	if n.readRepair == AsyncRepair || numStale == 0 {
+		n.answerRead(t, latest)
+		return
+	}
+
+	// t.quorumMembers[n.id] marks that the read is waiting for repairs,
+	// and holds the response
+	latest.DemuxKey = packet.NodeRepairRequest
+	t.quorumMembers[n.id] = latest
+	t.numWaitingNodes = numStale
+}
+
+// awaitingRepair returns true iff t is a read waiting for stale replicas to
+// acknowledge their repairs.
+func (n *Dbnode) awaitingRepair(t *txnState) bool {
+	return (t.mode == coordinatingRead || t.mode == coordinatingFastRead) &&
+		t.quorumMembers[n.id].DemuxKey == packet.NodeRepairRequest
+}
+
+// answerRead sends the client the result of a read, and ends the transaction.
+func (n *Dbnode) answerRead(t *txnState, latest packet.Message) {
+	n.Outgoing.Send(packet.Message{
+		Id:        t.clientRequest.Id,
+		Src:       n.id,
+		Dest:      t.clientRequest.Src,
+		DemuxKey:  packet.ClientReadResponse,
+		Key:       t.clientRequest.Key,
+		Value:     latest.Value,
+		Timestamp: latest.Timestamp,
+		Ok:        true,
+	})
+
+	n.release(t)
+}
+
+// handleRepairReq stores the value in a repair request, if it is newer than
+// this node's. The response is Ok iff this node now has the value (or a newer
+// one). A key with a write in progress is not repaired.
+func (n *Dbnode) handleRepairReq(msg packet.Message) {
+	current, err := n.Store.Get(msg.Key)
+	timestamp, _, _ := decodeStoredVal(current)
+
+	ok := err == nil && timestamp >= msg.Timestamp
+	if err == nil && !ok && !n.hasStagedWrites(keyLocks(msg.Key)) {
+		n.repair(packet.Entry{
+			Key:       msg.Key,
+			Value:     msg.Value,
+			Timestamp: msg.Timestamp,
+			Tombstone: msg.Tombstone,
+		})
+		ok = true
+	}
+
+	n.Outgoing.Send(packet.Message{
+		Id:        msg.Id,
+		Src:       n.id,
+		Dest:      msg.Src,
+		DemuxKey:  packet.NodeRepairResponse,
+		Key:       msg.Key,
+		Timestamp: msg.Timestamp,
+		Ok:        ok,
+	})
+}
+
+func (n *Dbnode) handleRepairRes(msg packet.Message) {
+	n.requestRepeater.Ack(msg)
+
+	t := n.txns[msg.Id]
+	if t == nil || !n.awaitingRepair(t) || t.quorumMembers[msg.Src].DemuxKey != packet.NodeRepairRequest {
+		return
+	}
+
+	// A failed repair is not retried, since repairs are best effort
+	t.quorumMembers[msg.Src] = msg
+	t.numWaitingNodes--
+	if t.numWaitingNodes == 0 {
+		n.continueProcessing(t)
+	}
+}
+
+// repair stores an entry learnt from another node (by read repair or
+// anti-entropy), which is newer than this node's. A repaired tombstone is
+// scheduled for garbage collection, in case the tombstone had already been
+// collected from every other node.
+func (n *Dbnode) repair(e packet.Entry) {
+	txid := n.Store.Put(e.Key, encodeStoredVal(e.Timestamp, e.Value, e.Tombstone))
+	n.Store.Commit(e.Key, txid)
+
+	if e.Tombstone {
+		n.scheduleGarbageCollection(e.Key, e.Timestamp)
+	}
+
+	if n.logWrites {
+		n.events.Emit(eventlog.Repaired(n.id, e.Key, e.Timestamp))
+	}
+}
+
+// String converts a ReadRepair to a string
+func (r ReadRepair) String() string {
+	switch r {
+	case NoRepair:
+		return "none"
+	case AsyncRepair:
+		return "async"
+	case SyncRepair:
+		return "sync"
+	default:
+		return "UNKNOWN_READ_REPAIR"
+	}
+}
+
+// Set parses a ReadRepair, so that a ReadRepair can be used as a command line
+// flag.
+func (r *ReadRepair) Set(s string) error {
+	switch s {
+	case "none":
+		*r = NoRepair
+	case "async":
+		*r = AsyncRepair
+	case "sync":
+		*r = SyncRepair
+	default:
+		return errors.New("Unknown read repair (expected none, async or sync)")
+	}
+
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
@@ -15,7 +16,7 @@ import (
 // assembly and 2PC procedures. Repeater should be instantiated using New.
 // There should be 1 Repeater per dbnode.Dbnode.
 type Repeater struct {
-	outgoing   chan packet.Message
+	outgoing   *clock.Chan[packet.Message]
 	timeout    time.Duration
 	numRetries int
 	lock       sync.Mutex
@@ -24,19 +25,23 @@ type Repeater struct {
 	unackedReqs map[int]map[int]map[packet.Messagetype]bool
 
 	disabled bool
+
+	clock clock.Clock
 }
 
 // New creates an instance of Repeater. numNodes is the total number of
 // database nodes. outgoing is the Outgoing link for the calling node. timeout
 // is the delay between sends. numRetries is the maximum number of resends
-// (except for messages with an unlimited number of resends).
-func New(numNodes int, outgoing chan packet.Message, timeout time.Duration, numRetries int) *Repeater {
+// (except for messages with an unlimited number of resends). clk is the clock
+// used to time resends.
+func New(numNodes int, outgoing *clock.Chan[packet.Message], timeout time.Duration, numRetries int, clk clock.Clock) *Repeater {
 	r := Repeater{
 		outgoing:    outgoing,
 		timeout:     timeout,
 		numRetries:  numRetries,
 		lock:        sync.Mutex{},
 		unackedReqs: make(map[int]map[int]map[packet.Messagetype]bool),
+		clock:       clk,
 	}
 
 	for i := 0; i < numNodes; i++ {
@@ -50,9 +55,6 @@ func New(numNodes int, outgoing chan packet.Message, timeout time.Duration, numR
 // or the max number of retries is reached. If unlimitedRepeats, keep resending
 // until an acknowledgement is received.
 func (r *Repeater) Send(msg packet.Message, unlimitedRepeats bool) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
 	var demuxKey packet.Messagetype
 
 	switch msg.DemuxKey {
@@ -64,44 +66,61 @@ func (r *Repeater) Send(msg packet.Message, unlimitedRepeats bool) {
 		demuxKey = packet.NodeUnlockAck
 	case packet.NodeGetRequest:
 		demuxKey = packet.NodeGetResponse
-	case packet.NodePutRequest:
+	case packet.NodePutRequest, packet.NodeGarbageCollectRequest, packet.NodeTxnPutRequest:
 		demuxKey = packet.NodePutResponse
-	case packet.NodeTimestampRequest:
+	case packet.NodeTimestampRequest, packet.NodeTxnTimestampRequest:
 		demuxKey = packet.NodeGetResponse
+	case packet.NodeScanRequest:
+		demuxKey = packet.NodeScanResponse
+	case packet.NodeRepairRequest:
+		demuxKey = packet.NodeRepairResponse
 	default:
 		log.Fatal("Unexpected message type in Repeater.Send", msg)
 	}
 
+	r.lock.Lock()
 	if r.unackedReqs[msg.Dest][msg.Id] == nil {
 		r.unackedReqs[msg.Dest][msg.Id] = make(map[packet.Messagetype]bool)
 	}
 	r.unackedReqs[msg.Dest][msg.Id][demuxKey] = true
+	disabled := r.disabled
+	r.lock.Unlock()
+
+	// The first copy is sent before returning, so that messages are sent in
+	// the order Send is called (rather than the order in which the
+	// goroutines below happen to be scheduled)
+	if r.numRetries > 0 && !disabled {
+		r.outgoing.Send(msg)
+	}
 
-	go r.send(msg, demuxKey, unlimitedRepeats)
+	r.clock.Go(func() {
+		r.resend(msg, demuxKey, unlimitedRepeats)
+	})
 }
 
-func (r *Repeater) send(msg packet.Message, demuxKey packet.Messagetype, unlimited bool) {
-	for i := 0; i < r.numRetries; i++ {
+func (r *Repeater) resend(msg packet.Message, demuxKey packet.Messagetype, unlimited bool) {
+	for i := 1; i < r.numRetries; i++ {
+		if !r.disabled || unlimited {
+			r.clock.Sleep(r.timeout)
+		}
+
 		r.lock.Lock()
+		disabled := r.disabled
+		unacked := r.unackedReqs[msg.Dest][msg.Id][demuxKey]
+		r.lock.Unlock()
 
-		if !r.disabled {
-			if !r.unackedReqs[msg.Dest][msg.Id][demuxKey] {
-				r.lock.Unlock()
+		if !disabled {
+			if !unacked {
 				return
 			}
 
-			r.outgoing <- msg
+			// Sending may block, so must not hold the lock
+			r.outgoing.Send(msg)
 		}
 
-		r.lock.Unlock()
-
 		if unlimited {
 			i--
 		}
-
-		if !r.disabled || unlimited {
-			time.Sleep(r.timeout)
-		}
 	}
 }
 
@@ -0,0 +1,275 @@
+// Package eventlog implements the stream of events which describes a
+// simulation: client transactions, node failures, partitions, elections and
+// writes. Events are written to a Sink, either as JSON lines or in the
+// original plain text format.
+package eventlog
+
+import (
+	"sort"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/history"
+)
+
+// A Type is the type of an Event.
+type Type string
+
+const (
+	TxnStart        Type = "txn_start"        // A client sent a request
+	TxnEnd          Type = "txn_end"          // A client request completed (or timed out)
+	NodeFail        Type = "node_fail"        // A node failed
+	NodeRecover     Type = "node_recover"     // A node recovered
+	PartitionCreate Type = "partition_create" // Some links between nodes became unavailable
+	PartitionHeal   Type = "partition_heal"   // Some links between nodes became available
+	Election        Type = "election"         // A node learnt of a new leader (-1 if an election is in progress)
+	WriteCommit     Type = "write_commit"     // A node committed a write, as coordinator
+	GarbageCollect  Type = "garbage_collect"  // A node collected a tombstone, as coordinator
+	BackgroundWrite Type = "background_write" // A node made a background write (in a sloppy quorum)
+	Repair          Type = "repair"           // A node stored a newer value learnt by anti-entropy or read repair
+	Linearizability Type = "linearizability"  // The result of checking the client history
+	Violation       Type = "violation"        // An operation in a history which is not linearizable
+	Metrics         Type = "metrics"          // A snapshot of the simulation's metrics
+	Replay          Type = "replay"           // The result of replaying a trace
+	Divergence      Type = "divergence"       // A response in a replay which differs from the trace
+	Reconfigure     Type = "reconfigure"      // A node adopted a new configuration of the cluster's members
+)
+
+// An Event is one entry in an event log. Only the fields relevant to its Type
+// are set (zero values are omitted from JSON). All times are in microseconds
+// since the start of the simulation.
+// Fields:
+// Time: the time of the event
+// Type: the type of event (see Type)
+// Txn: the client's sequence number for a transaction
+// Op: the type of a transaction (read or write) or operation
+// Node: the node which failed, recovered, committed, elected or reconfigured
+// Leader: the leader elected
+// Key, Value, Timestamp: the key, value and timestamp read or written (or the
+// version of a configuration)
+// Result: the result of a transaction, operation or check
+// Start, End: the time at which a transaction (or operation) started and ended
+// InProgress: the number of transactions in progress on a failed node
+// Links: the links (pairs of source and destination nodes) partitioned or healed
+// Metrics: the value of each metric, by its name in the Prometheus text format
+// Messages: the number of messages replayed
+// Diverged: the number of responses in a replay which differ from the trace
+// Members: the members of a configuration
+type Event struct {
+	Time       int64              `json:"time"`
+	Type       Type               `json:"type"`
+	Txn        int                `json:"txn,omitempty"`
+	Op         string             `json:"op,omitempty"`
+	Node       *int               `json:"node,omitempty"`
+	Leader     *int               `json:"leader,omitempty"`
+	Key        []byte             `json:"key,omitempty"`
+	Value      []byte             `json:"value,omitempty"`
+	Timestamp  uint64             `json:"timestamp,omitempty"`
+	Result     string             `json:"result,omitempty"`
+	Start      int64              `json:"start,omitempty"`
+	End        int64              `json:"end,omitempty"`
+	InProgress int                `json:"in_progress,omitempty"`
+	Links      [][2]int           `json:"links,omitempty"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+	Messages   int                `json:"messages,omitempty"`
+	Diverged   int                `json:"diverged,omitempty"`
+	Members    []int              `json:"members,omitempty"`
+}
+
+// A Log timestamps events and writes them to a Sink. It is safe for
+// concurrent use. A nil *Log discards every event.
+type Log struct {
+	sink      Sink
+	startTime time.Time
+	clock     clock.Clock
+}
+
+// New creates a Log which writes to sink. Times are measured using clk,
+// relative to the time at which New is called.
+func New(sink Sink, clk clock.Clock) *Log {
+	return &Log{
+		sink:      sink,
+		startTime: clk.Now(),
+		clock:     clk,
+	}
+}
+
+// Now returns the time since the log was created.
+func (l *Log) Now() time.Duration {
+	return l.clock.Since(l.startTime)
+}
+
+// Emit timestamps e and writes it to the sink.
+func (l *Log) Emit(e Event) {
+	if l == nil {
+		return
+	}
+
+	e.Time = Micros(l.Now())
+	l.sink.Write(e)
+}
+
+// Close returns the first error writing an event to the sink, if any.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.sink.Close()
+}
+
+// Micros converts d to whole microseconds, the unit of every time written to
+// an event log.
+func Micros(d time.Duration) int64 {
+	return d.Nanoseconds() / 1000
+}
+
+// TxnStarted is the event of a client sending a transaction.
+func TxnStarted(txn int, op string, key []byte) Event {
+	return Event{Type: TxnStart, Txn: txn, Op: op, Key: key}
+}
+
+// TxnEnded is the event of a transaction which started at start completing,
+// with the given result.
+func TxnEnded(txn int, op string, key, value []byte, timestamp uint64, result string, start time.Duration) Event {
+	return Event{
+		Type:      TxnEnd,
+		Txn:       txn,
+		Op:        op,
+		Key:       key,
+		Value:     value,
+		Timestamp: timestamp,
+		Result:    result,
+		Start:     Micros(start),
+	}
+}
+
+// NodeFailed is the event of a node failing.
+func NodeFailed(node, inProgress int) Event {
+	return Event{Type: NodeFail, Node: &node, InProgress: inProgress}
+}
+
+// NodeRecovered is the event of a node recovering.
+func NodeRecovered(node int) Event {
+	return Event{Type: NodeRecover, Node: &node}
+}
+
+// PartitionCreated is the event of links (source -> dest -> true) becoming
+// unavailable.
+func PartitionCreated(links map[int]map[int]bool) Event {
+	return Event{Type: PartitionCreate, Links: LinkList(links)}
+}
+
+// PartitionHealed is the event of links becoming available again.
+func PartitionHealed(links map[int]map[int]bool) Event {
+	return Event{Type: PartitionHeal, Links: LinkList(links)}
+}
+
+// Elected is the event of node learning that leader has been elected.
+func Elected(node, leader int) Event {
+	return Event{Type: Election, Node: &node, Leader: &leader}
+}
+
+// WriteCommitted is the event of a coordinator committing a write.
+func WriteCommitted(node int, key []byte, timestamp uint64) Event {
+	return Event{Type: WriteCommit, Node: &node, Key: key, Timestamp: timestamp}
+}
+
+// GarbageCollected is the event of a coordinator collecting a tombstone.
+func GarbageCollected(node int, key []byte, timestamp uint64) Event {
+	return Event{Type: GarbageCollect, Node: &node, Key: key, Timestamp: timestamp}
+}
+
+// BackgroundWritten is the event of a node making a background write.
+func BackgroundWritten(node int, key []byte, timestamp uint64) Event {
+	return Event{Type: BackgroundWrite, Node: &node, Key: key, Timestamp: timestamp}
+}
+
+// Repaired is the event of a node storing a newer value learnt by
+// anti-entropy or read repair.
+func Repaired(node int, key []byte, timestamp uint64) Event {
+	return Event{Type: Repair, Node: &node, Key: key, Timestamp: timestamp}
+}
+
+// Checked is the result of checking a history for linearizability.
+func Checked(linearizable bool) Event {
+	result := "ok"
+	if !linearizable {
+		result = "violation"
+	}
+
+	return Event{Type: Linearizability, Result: result}
+}
+
+// Violated is an operation in a history which is not linearizable.
+func Violated(op history.Op) Event {
+	e := Event{
+		Type:      Violation,
+		Op:        op.Kind.String(),
+		Key:       op.Key,
+		Value:     op.Value,
+		Timestamp: op.Timestamp,
+		Result:    op.Outcome.String(),
+		Start:     Micros(op.Start),
+	}
+	if op.Outcome != history.Unknown {
+		e.End = Micros(op.End)
+	}
+
+	return e
+}
+
+// MetricsSnapshot is a snapshot of the value of each metric.
+func MetricsSnapshot(metrics map[string]float64) Event {
+	return Event{Type: Metrics, Metrics: metrics}
+}
+
+// Replayed is the result of replaying a trace: the number of messages
+// delivered, and the number of responses which differ from the trace.
+func Replayed(messages, diverged int) Event {
+	result := "ok"
+	if diverged > 0 {
+		result = "diverged"
+	}
+
+	return Event{Type: Replay, Messages: messages, Diverged: diverged, Result: result}
+}
+
+// Diverged is a response from node in a replay which differs from the trace
+// (result is missing, extra or different).
+func Diverged(node, txn int, op string, key, value []byte, timestamp uint64, result string) Event {
+	return Event{
+		Type:      Divergence,
+		Node:      &node,
+		Txn:       txn,
+		Op:        op,
+		Key:       key,
+		Value:     value,
+		Timestamp: timestamp,
+		Result:    result,
+	}
+}
+
+// Reconfigured is the event of node adopting version of the cluster's
+// configuration, with the given members.
+func Reconfigured(node int, version uint64, members []int) Event {
+	return Event{Type: Reconfigure, Node: &node, Timestamp: version, Members: members}
+}
+
+// LinkList converts links (source -> dest -> true) to a list of pairs, sorted
+// by source, then dest.
+func LinkList(links map[int]map[int]bool) [][2]int {
+	var list [][2]int
+
+	for s, dests := range links {
+		for d := range dests {
+			list = append(list, [2]int{s, d})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i][0] < list[j][0] || list[i][0] == list[j][0] && list[i][1] < list[j][1]
+	})
+
+	return list
+}
@@ -0,0 +1,156 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Sink writes events somewhere. Implementations must be safe for concurrent
+// use. Close returns the first error writing an event, if any; events after
+// an error are discarded.
+type Sink interface {
+	Write(e Event)
+	Close() error
+}
+
+// A Format is an enum indicating how a Sink writes events.
+// Text: the original plain text output of the simulator, which is parsed by
+// the scripts in scripts/. Some types of event are not written.
+// JSON: one JSON object per line, for every event.
+type Format int
+
+const (
+	Text Format = iota
+	JSON
+)
+
+// NewSink creates a Sink which writes events to w in the given format.
+func NewSink(f Format, w io.Writer) Sink {
+	switch f {
+	case JSON:
+		return &jsonSink{enc: json.NewEncoder(w)}
+	default:
+		return &textSink{w: w}
+	}
+}
+
+type jsonSink struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+	err  error
+}
+
+func (s *jsonSink) Write(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = s.enc.Encode(e)
+	}
+}
+
+func (s *jsonSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// A textSink writes each event in the same format as the print statement it
+// replaced. Writes are prefixed with the time of the event in microseconds,
+// like the end of a transaction.
+type textSink struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+}
+
+func (s *textSink) Write(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = s.write(e)
+	}
+}
+
+func (s *textSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+func (s *textSink) write(e Event) (err error) {
+	switch e.Type {
+	case TxnEnd:
+		_, err = fmt.Fprintf(s.w, "%v %v %v %v\n", e.Start, e.Time, fmt.Sprint(e.Op+" ", e.Key, e.Value, e.Timestamp), e.Result)
+	case NodeFail:
+		_, err = fmt.Fprintf(s.w, "Node %v failed with %v transactions in progress\n", *e.Node, e.InProgress)
+	case NodeRecover:
+		_, err = fmt.Fprintf(s.w, "Node %v recovered\n", *e.Node)
+	case PartitionCreate:
+		_, err = fmt.Fprintln(s.w, "Partition created")
+	case PartitionHeal:
+		_, err = fmt.Fprintln(s.w, "Partition recovered")
+	case WriteCommit:
+		_, err = fmt.Fprintln(s.w, e.Time, *e.Node, "write commit", e.Key, e.Timestamp)
+	case GarbageCollect:
+		_, err = fmt.Fprintln(s.w, e.Time, *e.Node, "garbage collect", e.Key, e.Timestamp)
+	case BackgroundWrite:
+		_, err = fmt.Fprintln(s.w, e.Time, *e.Node, "background write", e.Key, e.Timestamp)
+	case Repair:
+		_, err = fmt.Fprintln(s.w, e.Time, *e.Node, "repair", e.Key, e.Timestamp)
+	case Linearizability:
+		if e.Result == "ok" {
+			_, err = fmt.Fprintln(s.w, "Linearizable")
+		} else {
+			_, err = fmt.Fprintln(s.w, "Not linearizable")
+		}
+	case Replay:
+		if e.Result == "ok" {
+			_, err = fmt.Fprintln(s.w, "Replayed", e.Messages, "messages with the same responses")
+		} else {
+			_, err = fmt.Fprintln(s.w, "Replayed", e.Messages, "messages with", e.Diverged, "different responses")
+		}
+	case Divergence:
+		_, err = fmt.Fprintln(s.w, "Divergence:", *e.Node, e.Txn, e.Op, e.Key, e.Value, e.Timestamp, e.Result)
+	case Violation:
+		end := fmt.Sprint(e.End)
+		if e.Result == "unknown" {
+			end = "?"
+		}
+		_, err = fmt.Fprintln(s.w, "Violation:", fmt.Sprint(e.Start, " ", end, " ", e.Op, " ", e.Key, e.Value, e.Timestamp, " ", e.Result))
+	}
+
+	return err
+}
+
+// String converts a Format to a string
+func (f Format) String() string {
+	switch f {
+	case Text:
+		return "text"
+	case JSON:
+		return "json"
+	default:
+		return "UNKNOWN_FORMAT"
+	}
+}
+
+// Set parses a Format, so that a Format can be used as a command line flag.
+func (f *Format) Set(s string) error {
+	switch s {
+	case "text":
+		*f = Text
+	case "json":
+		*f = JSON
+	default:
+		return errors.New("Unknown event format (expected text or json)")
+	}
+
+	return nil
+}
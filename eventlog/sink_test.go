@@ -0,0 +1,96 @@
+package eventlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextSink(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewSink(Text, &b)
+
+	e := TxnEnded(1, "write", []byte{1, 2}, []byte{3}, 4, "success", 2*time.Millisecond)
+	e.Time = 5000
+	sink.Write(e)
+	sink.Write(NodeFailed(3, 2))
+	sink.Write(PartitionCreated(map[int]map[int]bool{0: {1: true}}))
+	sink.Write(TxnStarted(2, "read", []byte{1}))
+	sink.Write(Elected(1, 2))
+	e = WriteCommitted(2, []byte{1}, 7)
+	e.Time = 6000
+	sink.Write(e)
+
+	expected := "2000 5000 write [1 2] [3] 4 success\n" +
+		"Node 3 failed with 2 transactions in progress\n" +
+		"Partition created\n" +
+		"6000 2 write commit [1] 7\n"
+	if b.String() != expected {
+		t.Error("Text sink should match the original output.", b.String())
+	}
+	if err := sink.Close(); err != nil {
+		t.Error("Unexpected error.", err)
+	}
+}
+
+// A failingWriter fails every write.
+type failingWriter struct {
+	writes int
+}
+
+var errWrite = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errWrite
+}
+
+func TestSinkError(t *testing.T) {
+	for _, f := range []Format{Text, JSON} {
+		var w failingWriter
+		sink := NewSink(f, &w)
+
+		sink.Write(NodeFailed(3, 2))
+		sink.Write(NodeRecovered(3))
+
+		if err := sink.Close(); err != errWrite {
+			t.Error("Close should return the first error.", f, err)
+		}
+		if w.writes != 1 {
+			t.Error("Events after an error should be discarded.", f, w.writes)
+		}
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewSink(JSON, &b)
+
+	sink.Write(Elected(0, 2))
+	sink.Write(TxnEnded(1, "read", []byte{1}, nil, 0, "true", 0))
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Every event should be written as 1 line.", lines)
+	}
+
+	var e Event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal("Invalid JSON.", err)
+	}
+	if e.Type != Election || e.Node == nil || *e.Node != 0 || e.Leader == nil || *e.Leader != 2 {
+		t.Error("Round trip changed event.", lines[0])
+	}
+
+	if strings.Contains(lines[1], "node") || strings.Contains(lines[1], "value") {
+		t.Error("Fields not relevant to an event should be omitted.", lines[1])
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Emit(NodeRecovered(1))
+}
@@ -0,0 +1,128 @@
+// Package hashring partitions keys between database nodes by consistent
+// hashing, so that each key is only replicated by some of the nodes.
+package hashring
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// A Ring places each node at several pseudorandom points (virtual nodes) on a
+// ring of 64 bit hashes. The replicas of a key are the first distinct nodes
+// found walking clockwise from the hash of the key, so adding or removing a
+// node only moves the keys next to its points.
+//
+// A nil *Ring places every key on every node, so that nodes can use the same
+// code whether or not keys are partitioned.
+type Ring struct {
+	numNodes int
+	factor   int
+	points   []point
+}
+
+// A point is one virtual node: the position on the ring of a node.
+type point struct {
+	hash uint64
+	node int
+}
+
+// New creates a Ring placing each key on factor of the numNodes nodes (with ids
+// 0 to numNodes-1), each with vnodes points on the ring. If factor is 0, or at
+// least numNodes, every node replicates every key, so New returns nil.
+func New(numNodes, factor, vnodes int) *Ring {
+	if factor <= 0 || factor >= numNodes {
+		return nil
+	}
+	if vnodes < 1 {
+		vnodes = 1
+	}
+
+	r := &Ring{
+		numNodes: numNodes,
+		factor:   factor,
+		points:   make([]point, 0, numNodes*vnodes),
+	}
+
+	var buf [16]byte
+	for node := 0; node < numNodes; node++ {
+		for v := 0; v < vnodes; v++ {
+			binary.BigEndian.PutUint64(buf[:8], uint64(node))
+			binary.BigEndian.PutUint64(buf[8:], uint64(v))
+			r.points = append(r.points, point{hash(buf[:]), node})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// Factor returns the number of replicas of each key, given the total number of
+// nodes (which is the factor of a nil Ring).
+func (r *Ring) Factor(numNodes int) int {
+	if r == nil {
+		return numNodes
+	}
+	return r.factor
+}
+
+// Replicas returns the nodes which replicate key, in order around the ring
+// (the first is the key's primary). A nil Ring returns nil, meaning every node.
+func (r *Ring) Replicas(key []byte) []int {
+	if r == nil {
+		return nil
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	replicas := make([]int, 0, r.factor)
+	found := make(map[int]bool)
+	for j := 0; len(replicas) < r.factor; j++ {
+		p := r.points[(i+j)%len(r.points)]
+		if !found[p.node] {
+			found[p.node] = true
+			replicas = append(replicas, p.node)
+		}
+	}
+
+	return replicas
+}
+
+// Contains returns true iff node replicates key.
+func (r *Ring) Contains(key []byte, node int) bool {
+	if r == nil {
+		return true
+	}
+
+	for _, replica := range r.Replicas(key) {
+		if replica == node {
+			return true
+		}
+	}
+	return false
+}
+
+// hash returns the position of b on the ring. FNV alone maps similar short
+// keys to nearby points, so its result is mixed (by the MurmurHash3 finaliser)
+// to spread them around the ring.
+func hash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,78 @@
+package hashring
+
+import (
+	"testing"
+)
+
+func TestReplicas(t *testing.T) {
+	numNodes := 10
+	r := New(numNodes, 3, 64)
+
+	counts := make([]int, numNodes)
+	for k := 0; k < 1000; k++ {
+		key := []byte{byte(k), byte(k >> 8)}
+
+		replicas := r.Replicas(key)
+		if len(replicas) != 3 {
+			t.Fatal("Every key should have 3 replicas.", key, replicas)
+		}
+
+		distinct := make(map[int]bool)
+		for _, node := range replicas {
+			if node < 0 || node >= numNodes || distinct[node] {
+				t.Fatal("Replicas should be distinct nodes.", key, replicas)
+			}
+			distinct[node] = true
+			counts[node]++
+
+			if !r.Contains(key, node) {
+				t.Error("A replica should contain its key.", key, node)
+			}
+		}
+
+		if replicas[0] != r.Replicas(key)[0] {
+			t.Error("Placement should be deterministic.", key)
+		}
+	}
+
+	// Each node should have roughly 300 keys
+	for node, c := range counts {
+		if c < 150 || c > 450 {
+			t.Error("Keys are unevenly distributed.", node, c)
+		}
+	}
+}
+
+func TestNilRing(t *testing.T) {
+	if New(5, 0, 64) != nil || New(5, 5, 64) != nil {
+		t.Error("A ring replicating every key on every node should be nil.")
+	}
+
+	var r *Ring
+	if r.Replicas([]byte{1}) != nil || !r.Contains([]byte{1}, 3) || r.Factor(5) != 5 {
+		t.Error("A nil ring should place every key on every node.")
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	// Adding a node should only move keys to the new node
+	before := New(9, 1, 64)
+	after := New(10, 1, 64)
+
+	moved := 0
+	for k := 0; k < 1000; k++ {
+		key := []byte{byte(k), byte(k >> 8)}
+
+		b, a := before.Replicas(key)[0], after.Replicas(key)[0]
+		if a != b {
+			if a != 9 {
+				t.Error("A key moved between existing nodes.", key, b, a)
+			}
+			moved++
+		}
+	}
+
+	if moved == 0 || moved > 250 {
+		t.Error("Roughly a tenth of keys should move to a new node.", moved)
+	}
+}
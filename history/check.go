@@ -0,0 +1,223 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Check returns true iff ops is linearizable: iff there is an order of the
+// operations, consistent with the order in which they were made (an operation
+// which ended before another started must come first), in which every
+// operation is correct for a single copy of each key. Operations with an
+// Unknown outcome may appear anywhere after they started, or not at all.
+//
+// Operations on different keys are independent, so each key is checked
+// separately, using the search of Wing and Gong. If ops is not linearizable,
+// Check also returns the operations on one key which are not linearizable,
+// reduced so that removing any one of them gives a linearizable history.
+func Check(ops []Op) (bool, []Op) {
+	byKey := make(map[string][]Op)
+	var keys []string
+
+	for _, op := range ops {
+		// A failed operation has no effect, and a read without a response
+		// says nothing about the key.
+		if op.Outcome == Failed || op.Kind == Read && op.Outcome != Ok {
+			continue
+		}
+
+		k := string(op.Key)
+		if byKey[k] == nil {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], op)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !linearizable(byKey[k]) {
+			return false, minimise(byKey[k])
+		}
+	}
+
+	return true, nil
+}
+
+// A register is the state of a single key in the model against which histories
+// are checked. Every write gives its key a greater timestamp. A client may
+// retry a write, which may then take effect more than once, so a write with an
+// Unknown outcome only gives a lower bound for the new timestamp (until it is
+// read).
+type register struct {
+	value     []byte
+	timestamp uint64
+	exact     bool // false if timestamp is only a lower bound
+}
+
+func (r register) String() string {
+	return fmt.Sprint(r.value, r.timestamp, r.exact)
+}
+
+// apply returns the state of r after op, and false if op is not possible in
+// state r.
+func (r register) apply(op Op) (register, bool) {
+	switch op.Kind {
+	case Read:
+		if !bytes.Equal(op.Value, r.value) {
+			return r, false
+		}
+
+		// A garbage collected tombstone has no timestamp
+		if len(op.Value) == 0 && op.Timestamp == 0 {
+			return r, true
+		}
+
+		if op.Timestamp < r.timestamp || r.exact && op.Timestamp != r.timestamp {
+			return r, false
+		}
+		return register{r.value, op.Timestamp, true}, true
+	case Write, Delete:
+		value := op.Value
+		if op.Kind == Delete {
+			value = nil
+		}
+
+		if op.Outcome == Unknown {
+			return register{value, r.timestamp + 1, false}, true
+		}
+		if op.Timestamp <= r.timestamp {
+			return r, false
+		}
+		return register{value, op.Timestamp, true}, true
+	case StrongWrite:
+		if op.Timestamp == 0 || op.Timestamp-1 < r.timestamp || r.exact && op.Timestamp-1 != r.timestamp {
+			return r, false
+		}
+		return register{op.Value, op.Timestamp, true}, true
+	default:
+		return r, false
+	}
+}
+
+// linearizable returns true iff ops, which are all on the same key, are
+// linearizable. The key starts with no value, at timestamp 0.
+func linearizable(ops []Op) bool {
+	ops = append([]Op{}, ops...)
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Start < ops[j].Start
+	})
+
+	remaining := 0
+	for _, op := range ops {
+		if op.Outcome != Unknown {
+			remaining++
+		}
+	}
+
+	s := &search{
+		ops:     ops,
+		done:    make([]byte, len(ops)),
+		visited: make(map[string]bool),
+	}
+
+	return s.run(register{exact: true}, remaining)
+}
+
+// A search is the state of a depth-first search for a linearization. done[i]
+// is 1 iff ops[i] has been linearized. visited records every combination of
+// done and register state already searched (without success).
+type search struct {
+	ops     []Op
+	done    []byte
+	visited map[string]bool
+}
+
+// run returns true iff the operations not yet done can be linearized, starting
+// in state r. remaining is the number of them which must be linearized (every
+// operation not Unknown).
+func (s *search) run(r register, remaining int) bool {
+	if remaining == 0 {
+		return true
+	}
+
+	k := string(s.done) + r.String()
+	if s.visited[k] {
+		return false
+	}
+	s.visited[k] = true
+
+	// An operation can be next iff it started before every other operation
+	// still to be linearized ended.
+	minEnd := time.Duration(1<<63 - 1)
+	for i, op := range s.ops {
+		if s.done[i] == 0 && op.Outcome != Unknown && op.End < minEnd {
+			minEnd = op.End
+		}
+	}
+
+	// A read which does not change the state can always go first, which
+	// avoids trying every order of concurrent reads.
+	for i, op := range s.ops {
+		if op.Start > minEnd {
+			break
+		}
+		if s.done[i] != 0 || op.Kind != Read || !r.exact {
+			continue
+		}
+
+		if next, ok := r.apply(op); ok && next.timestamp == r.timestamp {
+			s.done[i] = 1
+			ok = s.run(r, remaining-1)
+			s.done[i] = 0
+			return ok
+		}
+	}
+
+	for i, op := range s.ops {
+		if op.Start > minEnd {
+			break
+		}
+		if s.done[i] != 0 {
+			continue
+		}
+
+		next, ok := r.apply(op)
+		if !ok {
+			continue
+		}
+
+		n := remaining
+		if op.Outcome != Unknown {
+			n--
+		}
+
+		s.done[i] = 1
+		ok = s.run(next, n)
+		s.done[i] = 0
+
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// minimise removes operations from a history which is not linearizable, for as
+// long as it remains not linearizable.
+func minimise(ops []Op) []Op {
+	for i := 0; i < len(ops); {
+		without := append(append([]Op{}, ops[:i]...), ops[i+1:]...)
+
+		if linearizable(without) {
+			i++
+		} else {
+			ops = without
+		}
+	}
+
+	return ops
+}
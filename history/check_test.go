@@ -0,0 +1,140 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func op(kind Kind, value string, timestamp uint64, outcome Outcome, start, end time.Duration) Op {
+	var v []byte
+	if value != "" {
+		v = []byte(value)
+	}
+
+	return Op{
+		Kind:      kind,
+		Key:       []byte{1},
+		Value:     v,
+		Timestamp: timestamp,
+		Outcome:   outcome,
+		Start:     start,
+		End:       end,
+	}
+}
+
+func TestLinearizable(t *testing.T) {
+	histories := [][]Op{
+		{},
+		{
+			op(Read, "", 0, Ok, 0, 1),
+			op(Write, "a", 1, Ok, 2, 3),
+			op(Read, "a", 1, Ok, 4, 5),
+		},
+		// Concurrent read and write: the read may see either value
+		{
+			op(Write, "a", 1, Ok, 0, 10),
+			op(Read, "", 0, Ok, 1, 2),
+			op(Read, "a", 1, Ok, 3, 4),
+		},
+		// A write which timed out may be read much later
+		{
+			op(Write, "a", 0, Unknown, 0, 0),
+			op(Read, "", 0, Ok, 5, 6),
+			op(Read, "a", 1, Ok, 100, 101),
+		},
+		// Or never
+		{
+			op(Write, "a", 0, Unknown, 0, 0),
+			op(Read, "", 0, Ok, 100, 101),
+		},
+		{
+			op(Write, "a", 1, Ok, 0, 1),
+			op(StrongWrite, "b", 2, Ok, 2, 3),
+			op(Read, "b", 2, Ok, 4, 5),
+			op(Delete, "", 3, Ok, 6, 7),
+			op(Read, "", 3, Ok, 8, 9),
+		},
+		// Failed operations have no effect
+		{
+			op(Write, "a", 1, Ok, 0, 1),
+			op(Write, "b", 0, Failed, 2, 3),
+			op(Read, "a", 1, Ok, 4, 5),
+		},
+	}
+
+	for _, h := range histories {
+		if ok, violation := Check(h); !ok {
+			t.Error("Linearizable history was rejected.", h, violation)
+		}
+	}
+}
+
+func TestNotLinearizable(t *testing.T) {
+	histories := [][]Op{
+		// Stale read
+		{
+			op(Write, "a", 1, Ok, 0, 1),
+			op(Write, "b", 2, Ok, 2, 3),
+			op(Read, "a", 1, Ok, 4, 5),
+		},
+		// Reads in the wrong order, after a write which timed out
+		{
+			op(Write, "a", 1, Ok, 0, 1),
+			op(Write, "b", 0, Unknown, 2, 0),
+			op(Read, "b", 2, Ok, 3, 4),
+			op(Read, "a", 1, Ok, 5, 6),
+		},
+		// A timestamp which goes backwards
+		{
+			op(Write, "a", 2, Ok, 0, 1),
+			op(Write, "b", 1, Ok, 2, 3),
+		},
+		// Strong write at a stale timestamp
+		{
+			op(Write, "a", 1, Ok, 0, 1),
+			op(Write, "b", 2, Ok, 2, 3),
+			op(StrongWrite, "c", 2, Ok, 4, 5),
+		},
+	}
+
+	for _, h := range histories {
+		ok, violation := Check(h)
+		if ok {
+			t.Error("History which is not linearizable was accepted.", h)
+			continue
+		}
+
+		// Every operation in a minimal violation is needed
+		for i := range violation {
+			without := append(append([]Op{}, violation[:i]...), violation[i+1:]...)
+			if ok, _ := Check(without); !ok {
+				t.Error("Violation is not minimal.", violation)
+			}
+		}
+	}
+}
+
+func TestCheckSeparatesKeys(t *testing.T) {
+	a := op(Write, "a", 1, Ok, 0, 1)
+	b := op(Read, "", 0, Ok, 2, 3)
+	b.Key = []byte{2}
+
+	if ok, violation := Check([]Op{a, b}); !ok {
+		t.Error("Operations on different keys should be independent.", violation)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	h := []Op{op(Write, "a", 1, Ok, 0, 1000)}
+	for i := 0; i < 200; i++ {
+		value, timestamp := "", uint64(0)
+		if i >= 100 {
+			value, timestamp = "a", 1
+		}
+		h = append(h, op(Read, value, timestamp, Ok, time.Duration(i), time.Duration(i+500)))
+	}
+
+	if ok, violation := Check(h); !ok {
+		t.Error("Concurrent reads should be linearizable.", violation)
+	}
+}
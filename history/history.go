@@ -0,0 +1,139 @@
+// Package history records the operations made by clients of the database, and
+// checks whether a recorded history is linearizable.
+package history
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+)
+
+// A Kind is an enum indicating the type of an operation.
+// Read: a get, returning Value at Timestamp.
+// Write: a blind put of Value, at the returned Timestamp.
+// StrongWrite: a put of Value at Timestamp, which fails unless Timestamp is
+// the next timestamp of the key.
+// Delete: a blind delete, at the returned Timestamp.
+type Kind int
+
+const (
+	Read Kind = iota
+	Write
+	StrongWrite
+	Delete
+)
+
+// An Outcome is an enum indicating what a client learnt of an operation.
+// Ok: the operation succeeded.
+// Failed: the operation had no effect.
+// Unknown: the operation may or may not have taken effect, at any time after
+// it started.
+type Outcome int
+
+const (
+	Ok Outcome = iota
+	Failed
+	Unknown
+)
+
+// An Op is one client operation on a single key.
+// Fields:
+// Kind: the type of operation (see Kind)
+// Key: the key read or written
+// Value: the value read or written (nil if not found, or for a delete)
+// Timestamp: the timestamp read, or of the write (if Ok, or for a StrongWrite)
+// Outcome: the result of the operation (see Outcome)
+// Start: the time at which the client sent the operation
+// End: the time at which the client received a response (if Ok or Failed)
+type Op struct {
+	Kind      Kind
+	Key       []byte
+	Value     []byte
+	Timestamp uint64
+	Outcome   Outcome
+	Start     time.Duration
+	End       time.Duration
+}
+
+// A History is a record of operations, which is safe for concurrent use by
+// several clients. It should be instantiated using New.
+type History struct {
+	startTime time.Time
+	clock     clock.Clock
+
+	lock sync.Mutex
+	ops  []Op
+}
+
+// New creates an empty History. Times are measured using clk, relative to the
+// time at which New is called.
+func New(clk clock.Clock) *History {
+	return &History{
+		startTime: clk.Now(),
+		clock:     clk,
+	}
+}
+
+// Now returns the current time, to use as the start or end of an Op.
+func (h *History) Now() time.Duration {
+	return h.clock.Since(h.startTime)
+}
+
+// Add records a completed operation.
+func (h *History) Add(op Op) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.ops = append(h.ops, op)
+}
+
+// Ops returns every operation recorded so far.
+func (h *History) Ops() []Op {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]Op{}, h.ops...)
+}
+
+// String converts a Kind to a string
+func (k Kind) String() string {
+	switch k {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case StrongWrite:
+		return "strongwrite"
+	case Delete:
+		return "delete"
+	default:
+		return "UNKNOWN_OP_KIND"
+	}
+}
+
+// String converts an Outcome to a string
+func (o Outcome) String() string {
+	switch o {
+	case Ok:
+		return "ok"
+	case Failed:
+		return "failed"
+	case Unknown:
+		return "unknown"
+	default:
+		return "UNKNOWN_OUTCOME"
+	}
+}
+
+// String formats an Op in the same style as the simulator's log lines, with
+// times in microseconds.
+func (op Op) String() string {
+	end := fmt.Sprint(op.End.Nanoseconds() / 1000)
+	if op.Outcome == Unknown {
+		end = "?"
+	}
+
+	return fmt.Sprint(op.Start.Nanoseconds()/1000, " ", end, " ", op.Kind, " ", op.Key, op.Value, op.Timestamp, " ", op.Outcome)
+}
@@ -2,11 +2,30 @@ package main
 
 import (
 	"flag"
+	"log"
 
+	"github.com/alexbostock/part-ii-project/datastore"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+	"github.com/alexbostock/part-ii-project/eventlog"
 	"github.com/alexbostock/part-ii-project/net"
 )
 
 func main() {
+	var store datastore.Kind
+	var electorKind elector.Kind
+	var eventFormat eventlog.Format
+	var latencyKind net.LatencyKind
+	var policy net.Policy
+	var readRepair dbnode.ReadRepair
+	flag.Var(&electorKind, "elector", "leader election algorithm (ring, bully, dummy or raft)")
+	flag.Var(&latencyKind, "latencydist", "distribution of network message latency, with mean latencymean and variance latencyvar (normal, lognormal or pareto)")
+	flag.Var(&readRepair, "readrepair", "whether a read repairs replicas in its quorum which returned older values (none, async to repair after answering the client, or sync to wait for repairs before answering)")
+	flag.Var(&policy, "policy", "how the client picks the coordinator of each attempt at a transaction (random, roundrobin, leader to stick to the coordinator of the last success, or leastlatency)")
+	flag.Var(&eventFormat, "eventformat", "format of the event log (text, as parsed by scripts/, or json for one JSON object per event)")
+
+	flag.Var(&store, "persistent", "use persistent data stores on disk rather than in-memory stores (-persistent or -persistent=paged for a hash map, -persistent=log for a log-structured store)")
+
 	opt := net.Options{
 		flag.Uint("n", 5, "positive integer number of database nodes"),
 		flag.Int64("seed", 0, "pseudorandom number generator seed"),
@@ -18,16 +37,42 @@ func main() {
 		flag.Float64("failurevar", 5, "variance of node recovery time"),
 		flag.Uint("t", 100, "number of transactions"),
 		flag.Float64("w", 0.05, "proportion of transactions which are writes"),
-		flag.Bool("persistent", false, "use persistent data stores on disk rather than in-memory stores"),
+		&store,
 		flag.Uint("vr", 3, "read quorum size"),
 		flag.Uint("vw", 3, "write quorum size, must satisfy vw > n/2"),
 		flag.Uint("numattempts", 1, "maximum number of attempts per transaction from the client"),
-		flag.Bool("sloppy", false, "add background writes to provide eventually consistency in a sloppy quorum system"),
+		flag.Bool("sloppy", false, "add background writes to provide eventually consistency in a sloppy quorum system, and let writes substitute unresponsive replicas, which are handed the writes they missed once they recover"),
 		flag.Bool("convergence", false, "implies -sloppy=true; test time for eventual consistency to converge with strong consistency"),
 		flag.Bool("logwrites", false, "log every write commit and background write with microsecond timestamps"),
+		flag.Bool("virtualclock", false, "run on a deterministic virtual clock rather than in real time, so that runs with the same seed are reproducible"),
+		&electorKind,
+		flag.Bool("checklinear", false, "record every client request, and check that the history is linearizable"),
+		flag.String("scenario", "", "JSON file of timed failures, partitions and latency changes to run alongside random failures (use -failurerate 0 for only the scenario)"),
+		&eventFormat,
+		flag.String("eventlog", "", "file to write the event log to (default stdout)"),
+		flag.String("metrics", "", "address (eg. :9100) on which to serve metrics in the Prometheus text format at /metrics during the simulation"),
+		flag.String("admin", "", "address (eg. :8080) on which to serve an HTTP API to inspect nodes, fail and recover nodes, and create and heal partitions during the simulation"),
+		&latencyKind,
+		flag.String("latencymatrix", "", "JSON file of the mean latency in ms of each link, as an n x n (or n+1 x n+1, including the client) matrix, overriding latencymean"),
+		flag.Float64("loss", 0, "probability that the network loses a message"),
+		flag.Float64("duplicate", 0, "probability that the network delivers a message twice"),
+		flag.Float64("reorder", 0, "probability that the network holds back a message, so that later messages may overtake it"),
+		flag.Float64("oneway", 0, "probability that each link failed by a random partition fails in one direction only"),
+		flag.String("trace", "", "file to record every message delivered or dropped by the network to, for -replay"),
+		flag.String("replay", "", "trace file (see -trace) whose deliveries to replay into fresh nodes, instead of running tests, reporting any responses to the client which differ (use the same -n, and preferably -virtualclock)"),
+		&policy,
+		flag.Float64("backoff", 0, "maximum time in ms to wait before the first retry of a transaction, doubling with each retry (the wait is uniformly random up to the maximum; 0 to retry immediately)"),
+		flag.Float64("maxbackoff", 1000, "cap in ms on the maximum time to wait before a retry"),
+		flag.Float64("antientropy", 0, "mean interval in s between anti-entropy rounds, in which each node compares Merkle trees of its store with a random peer and repairs differing keys (0 to disable)"),
+		&readRepair,
+		flag.Uint("replicas", 0, "number of nodes storing each key, chosen by a consistent hash ring, to which vr and vw are relative (0 for every node)"),
+		flag.Uint("vnodes", 64, "number of points (virtual nodes) of each node on the consistent hash ring, with -replicas"),
+		flag.Uint("spares", 0, "number of spare nodes, with ids from n, which only become members of the cluster once they join (in a scenario or through the admin API); node ids in a scenario, latency matrix or trace then range over the n + spares nodes"),
 	}
 
 	flag.Parse()
 
-	net.Simulate(opt)
+	if err := net.Simulate(opt); err != nil {
+		log.Fatal(err)
+	}
 }
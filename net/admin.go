@@ -0,0 +1,319 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// An admin serves an HTTP API to inspect and steer a running simulation:
+//
+//	GET  /nodes                  the status of every node (see dbnode.Status)
+//	GET  /nodes/{id}             the status of one node
+//	POST /nodes/{id}/fail        fail a node
+//	POST /nodes/{id}/recover     recover a failed node
+//	POST /nodes/{id}/join        add a node to the cluster (see Client.Join)
+//	POST /nodes/{id}/leave       remove a node from the cluster (see Client.Leave)
+//	GET  /partitions             every partition created through the API
+//	POST /partitions             create a partition, eg. {"groups": [[0, 1], [2, 3, 4]]}
+//	                             (with "oneway": true, as in a scenario)
+//	POST /partitions/{id}/heal   heal a partition created through the API
+//	POST /partitions/heal        heal every partition created through the API
+//
+// Nodes are failed and recovered using control messages, as by
+// triggerNodeFailures, so the admin and random failures may interfere. Joins
+// and leaves are requested through the simulation's client, and wait for the
+// cluster to respond. HTTP handlers are not registered with the simulation's
+// clock, so they use its channels through clock.Run.
+type admin struct {
+	// The last node is the client, which cannot be inspected or failed
+	nodes  []*dbnode.Dbnode
+	client *Client
+	p      *partitions
+
+	lock       sync.Mutex
+	partitions map[int]map[int]map[int]bool // partition id -> links
+	nextId     int
+
+	events *eventlog.Log
+	tracer *tracer
+
+	clock clock.Clock
+}
+
+// A partition is a partition created through the API.
+type partition struct {
+	Id    int      `json:"id"`
+	Links [][2]int `json:"links"`
+}
+
+func newAdmin(nodes []*dbnode.Dbnode, client *Client, p *partitions, events *eventlog.Log, tr *tracer, clk clock.Clock) *admin {
+	return &admin{
+		nodes:      nodes,
+		client:     client,
+		p:          p,
+		partitions: make(map[int]map[int]map[int]bool),
+		events:     events,
+		tracer:     tr,
+		clock:      clk,
+	}
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case path[0] == "nodes" && len(path) <= 3:
+		a.serveNodes(w, r, path[1:])
+	case path[0] == "partitions" && len(path) <= 3:
+		a.servePartitions(w, r, path[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *admin) serveNodes(w http.ResponseWriter, r *http.Request, path []string) {
+	numNodes := len(a.nodes) - 1
+
+	if len(path) == 0 {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		statuses := make([]dbnode.Status, numNodes)
+		clock.Run(a.clock, func() {
+			for i := range statuses {
+				statuses[i] = a.nodes[i].QueryStatus()
+			}
+		})
+
+		writeJSON(w, statuses)
+		return
+	}
+
+	id, err := strconv.Atoi(path[0])
+	if err != nil || id < 0 || id >= numNodes {
+		http.Error(w, "No such node", http.StatusNotFound)
+		return
+	}
+
+	if len(path) == 1 {
+		if allowMethod(w, r, http.MethodGet) {
+			var status dbnode.Status
+			clock.Run(a.clock, func() {
+				status = a.nodes[id].QueryStatus()
+			})
+			writeJSON(w, status)
+		}
+		return
+	}
+
+	var msgType packet.Messagetype
+	switch path[1] {
+	case "fail":
+		msgType = packet.ControlFail
+	case "recover":
+		msgType = packet.ControlRecover
+	case "join", "leave":
+		if allowMethod(w, r, http.MethodPost) {
+			a.changeMembership(w, id, path[1] == "join")
+		}
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	// The node handles the message after any already queued, so report
+	// only that it has been sent
+	clock.Run(a.clock, func() {
+		a.tracer.sendControl(a.nodes[id], id, msgType)
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// changeMembership adds node id to the cluster (or removes it), and responds
+// with the node's status once the change has been made.
+func (a *admin) changeMembership(w http.ResponseWriter, id int, join bool) {
+	var res PutResponse
+	var status dbnode.Status
+	clock.Run(a.clock, func() {
+		if join {
+			res = a.client.Join(id)
+		} else {
+			res = a.client.Leave(id)
+		}
+		if res == Success {
+			status = a.nodes[id].QueryStatus()
+		}
+	})
+
+	switch res {
+	case Success:
+		writeJSON(w, status)
+	case Error:
+		http.Error(w, "Membership change refused", http.StatusConflict)
+	default:
+		http.Error(w, "No response from the cluster", http.StatusGatewayTimeout)
+	}
+}
+
+func (a *admin) servePartitions(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, a.list())
+	case len(path) == 0:
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		var req struct {
+			Groups [][]int `json:"groups"`
+			OneWay bool    `json:"oneway"`
+		}
+
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p, err := a.create(req.Groups, req.OneWay)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, p)
+	case len(path) == 1 && path[0] == "heal":
+		if allowMethod(w, r, http.MethodPost) {
+			writeJSON(w, a.heal(-1))
+		}
+	case len(path) == 2 && path[1] == "heal":
+		id, err := strconv.Atoi(path[0])
+		if err != nil {
+			http.Error(w, "No such partition", http.StatusNotFound)
+			return
+		}
+
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		healed := a.heal(id)
+		if len(healed) == 0 {
+			http.Error(w, "No such partition", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, healed[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// create partitions the given groups of nodes from each other, as in a
+// scenario (see event).
+func (a *admin) create(groups [][]int, oneWay bool) (partition, error) {
+	e := event{Action: "partition", Groups: groups, OneWay: oneWay}
+	if err := e.validate(len(a.nodes) - 1); err != nil {
+		return partition{}, err
+	}
+
+	links := e.links()
+	if len(links) == 0 {
+		return partition{}, errors.New("Every group is empty")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id := a.nextId
+	a.nextId++
+	a.partitions[id] = links
+
+	a.events.Emit(eventlog.PartitionCreated(links))
+	a.p.createPartition(links)
+
+	return partition{id, eventlog.LinkList(links)}, nil
+}
+
+// heal heals the partition with the given id, or every partition if id is -1,
+// and returns the partitions healed.
+func (a *admin) heal(id int) []partition {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	healed := []partition{}
+	for _, p := range a.listLocked() {
+		if id != -1 && p.Id != id {
+			continue
+		}
+
+		links := a.partitions[p.Id]
+		delete(a.partitions, p.Id)
+
+		a.events.Emit(eventlog.PartitionHealed(links))
+		a.p.removePartition(links)
+
+		healed = append(healed, p)
+	}
+
+	return healed
+}
+
+func (a *admin) list() []partition {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.listLocked()
+}
+
+// listLocked returns every partition, in order of id. The caller must hold
+// a.lock.
+func (a *admin) listLocked() []partition {
+	list := []partition{}
+	for id, links := range a.partitions {
+		list = append(list, partition{id, eventlog.LinkList(links)})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+
+	return list
+}
+
+// allowMethod writes an error and returns false if r does not use method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
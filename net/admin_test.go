@@ -0,0 +1,143 @@
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+)
+
+func TestAdmin(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, p := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+
+	client := NewClient(nodes, timeout, 1, clk)
+	if res, _ := client.Put([]byte{1}, []byte{2}); res != Success {
+		t.Fatal("Write transaction failed.")
+	}
+
+	server := httptest.NewServer(newAdmin(nodes, nil, p, nil, nil, clk))
+	defer server.Close()
+
+	// The test is registered with the clock, so it must not block on the
+	// network, or the handler could never run
+	request := func(method, path, body string) *http.Response {
+		responses := clock.NewChan[*http.Response](clk, 1)
+		go func() {
+			req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+			}
+			clock.Run(clk, func() {
+				responses.Send(res)
+			})
+		}()
+
+		res := responses.Recv()
+		if res == nil {
+			t.FailNow()
+		}
+		return res
+	}
+
+	res := request("GET", "/nodes", "")
+	var statuses []dbnode.Status
+	json.NewDecoder(res.Body).Decode(&statuses)
+	res.Body.Close()
+
+	if len(statuses) != numNodes {
+		t.Fatal("Expected the status of every node.", statuses)
+	}
+	keys := 0
+	for i, s := range statuses {
+		if s.Id != i || s.Disabled || s.Leader != statuses[0].Leader {
+			t.Error("Unexpected node status.", s)
+		}
+		keys += s.Keys
+	}
+	if keys < int(quorumSize) {
+		t.Error("The key written should be stored by a write quorum.", statuses)
+	}
+
+	if res := request("POST", "/nodes/1/fail", ""); res.StatusCode != http.StatusAccepted {
+		t.Error("Failing a node should be accepted.", res.Status)
+	}
+
+	deadline := clk.Now().Add(5 * time.Second)
+	for !nodeDisabled(t, request("GET", "/nodes/1", "")) {
+		if clk.Now().After(deadline) {
+			t.Fatal("Node not failed.")
+		}
+		clk.Sleep(10 * time.Millisecond)
+	}
+
+	request("POST", "/nodes/1/recover", "")
+	for nodeDisabled(t, request("GET", "/nodes/1", "")) {
+		if clk.Now().After(deadline) {
+			t.Fatal("Node not recovered.")
+		}
+		clk.Sleep(10 * time.Millisecond)
+	}
+
+	notFound := []string{"/nodes/3", "/nodes/x/fail", "/nodes/0/explode", "/partitions/0/heal", "/other"}
+	for _, path := range notFound {
+		if res := request("POST", path, ""); res.StatusCode != http.StatusNotFound {
+			t.Error("Expected not found.", path, res.Status)
+		}
+	}
+	if res := request("GET", "/nodes/0/fail", ""); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Failing a node should require POST.", res.Status)
+	}
+
+	if res := request("POST", "/partitions", `{"groups": [[0], [0, 1]]}`); res.StatusCode != http.StatusBadRequest {
+		t.Error("Invalid partitions should be rejected.", res.Status)
+	}
+
+	res = request("POST", "/partitions", `{"groups": [[0], [1, 2]]}`)
+	var created partition
+	json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+
+	if len(created.Links) != 4 || p.linkAvailable(0, 1) || p.linkAvailable(0, 2) || !p.linkAvailable(1, 2) {
+		t.Error("Partition not created.", created)
+	}
+
+	// A link also cut by a partition made outside the admin API
+	other := make(map[int]map[int]bool)
+	addLink(other, 2, 0, true)
+	p.createPartition(other)
+
+	res = request("POST", "/partitions/heal", "")
+	var healed []partition
+	json.NewDecoder(res.Body).Decode(&healed)
+	res.Body.Close()
+
+	if len(healed) != 1 || healed[0].Id != created.Id || !p.linkAvailable(0, 1) || !p.linkAvailable(0, 2) {
+		t.Error("Partition not healed.", healed)
+	}
+	if p.linkAvailable(2, 0) {
+		t.Error("Healing should not heal links of other partitions.")
+	}
+}
+
+func nodeDisabled(t *testing.T, res *http.Response) bool {
+	defer res.Body.Close()
+
+	var s dbnode.Status
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	return s.Disabled
+}
@@ -8,8 +8,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/datastore"
 	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/hashring"
+	"github.com/alexbostock/part-ii-project/history"
 	"github.com/alexbostock/part-ii-project/net/packet"
+	"github.com/alexbostock/part-ii-project/net/transport"
 )
 
 // A PutResponse indicates whether a put transaction succeeded, if that is
@@ -38,6 +43,9 @@ func (p PutResponse) String() string {
 	}
 }
 
+// idStream supplies transaction ids. It is an ordinary channel rather than a
+// clock.Chan, since it is shared by every clock, but goroutines registered with
+// a clock may still receive from it: generateIds never waits for them.
 var idStream chan int
 
 func init() {
@@ -55,78 +63,295 @@ func generateIds() {
 // instantiated using NewClient. All methods block until either a response is
 // received from the remote coordinator, or a timeout lapses.
 type Client struct {
+	id          int
 	nodes       []*dbnode.Dbnode
 	numNodes    int
 	numAttempts int
 	timeout     time.Duration
+	clock       clock.Clock
 
 	responseChans sync.Map
+
+	// Picks the coordinator of each attempt (see SetPolicy and SetBackoff)
+	selector *selector
+
+	// The nodes which store each key (see SetRing)
+	ring *hashring.Ring
+
+	// The members of the cluster (see SetMembers)
+	membersLock sync.Mutex
+	members     []int
+
+	// If not nil, every Get, Put, StrongPut and Delete is recorded here
+	history *history.History
 }
 
-// NewClient creates a new Client. Its arguments are the list of database nodes
-// and the time to wait before giving up on a transaction.
-func NewClient(nodes []*dbnode.Dbnode, timeout time.Duration, numAttempts int) *Client {
+// NewClient creates a new Client. Its arguments are the list of database nodes,
+// the time to wait before giving up on a transaction, the maximum number of
+// attempts per transaction, and the clock used to measure timeouts.
+func NewClient(nodes []*dbnode.Dbnode, timeout time.Duration, numAttempts int, clk clock.Clock) *Client {
 	// The last 'node' is the client node
 
 	c := &Client{
+		id:          len(nodes) - 1,
 		nodes:       nodes,
 		numNodes:    len(nodes) - 1,
 		numAttempts: numAttempts,
 		timeout:     3 * timeout,
+		clock:       clk,
+
+		selector: newSelector(len(nodes) - 1),
+	}
+
+	clk.Go(c.routeResponses)
+
+	return c
+}
+
+// NewTCPClient creates a Client which sends requests to database nodes running
+// as separate processes (see cmd/dbnode). addrs lists the TCP address of every
+// node, indexed by node id. id is this client's network address, which must be
+// at least len(addrs), and distinct for every client connected to the same
+// nodes. Transaction ids are only unique within a process, so clients used
+// concurrently should all run in the same process. clk must be a real clock
+// (see clock.NewReal).
+func NewTCPClient(id int, addrs []string, timeout time.Duration, numAttempts int, clk clock.Clock) *Client {
+	incoming := clock.NewChan[packet.Message](clk, 500)
+	outgoing := clock.NewChan[packet.Message](clk, 500)
+
+	transport.Dial(id, addrs, incoming, outgoing)
+
+	// Every node shares the same outgoing link. The last 'node' is the
+	// client itself.
+	nodes := make([]*dbnode.Dbnode, len(addrs)+1)
+	for i := range addrs {
+		nodes[i] = &dbnode.Dbnode{Outgoing: outgoing}
 	}
+	nodes[len(addrs)] = &dbnode.Dbnode{Incoming: incoming}
 
-	go c.routeResponses()
+	c := NewClient(nodes, timeout, numAttempts, clk)
+	c.id = id
 
 	return c
 }
 
+// SetPolicy sets how the client picks the coordinator of each attempt at a
+// transaction (RandomCoordinator by default).
+func (c *Client) SetPolicy(p Policy) {
+	c.selector.lock.Lock()
+	defer c.selector.lock.Unlock()
+
+	c.selector.policy = p
+}
+
+// SetBackoff makes the client wait before retrying a transaction, for a
+// uniformly random time (jitter) up to base, doubling with each retry up to
+// max. By default (or if base is 0), the client retries immediately.
+func (c *Client) SetBackoff(base, max time.Duration) {
+	if max < base {
+		max = base
+	}
+
+	c.selector.lock.Lock()
+	defer c.selector.lock.Unlock()
+
+	c.selector.backoff = base
+	c.selector.maxBackoff = max
+}
+
+// SetSeed seeds the client's random choices of coordinators and backoff delays.
+// By default, they differ between runs.
+func (c *Client) SetSeed(seed int64) {
+	c.selector.lock.Lock()
+	defer c.selector.lock.Unlock()
+
+	c.selector.random = rand.New(rand.NewSource(seed))
+}
+
+// SetRing tells the client how keys are partitioned between nodes, so that
+// transactions on a single key are coordinated by one of its replicas. By
+// default (or if r is nil), any node may coordinate any transaction.
+func (c *Client) SetRing(r *hashring.Ring) {
+	c.ring = r
+}
+
+// SetMembers tells the client which nodes are members of the cluster, so that
+// only members coordinate transactions. By default (or if members is nil),
+// every node is a member. Join and Leave keep the members up to date.
+func (c *Client) SetMembers(members []int) {
+	c.membersLock.Lock()
+	defer c.membersLock.Unlock()
+
+	c.members = append([]int(nil), members...)
+}
+
+// Join asks the cluster to add node id as a member, and returns whether it
+// was added (Success if it was already a member). Only one node may join or
+// leave at a time, and a new member must catch up with the others before
+// another can, so a change may fail (Error) if another is in progress. The
+// new member coordinates transactions as soon as it has been added.
+func (c *Client) Join(id int) PutResponse {
+	return c.changeMembership(id, false)
+}
+
+// Leave asks the cluster to remove node id, which stops coordinating
+// transactions, and returns whether it was removed (Success if it was not a
+// member). A node cannot leave if that could lose a write.
+func (c *Client) Leave(id int) PutResponse {
+	return c.changeMembership(id, true)
+}
+
+func (c *Client) changeMembership(id int, leave bool) PutResponse {
+	resType, _ := c.write(packet.Message{
+		DemuxKey:  packet.ClientMembershipRequest,
+		Timestamp: uint64(id),
+		Tombstone: leave,
+	})
+	if resType != Success {
+		return resType
+	}
+
+	c.membersLock.Lock()
+	defer c.membersLock.Unlock()
+
+	if c.members == nil {
+		for i := 0; i < c.numNodes; i++ {
+			c.members = append(c.members, i)
+		}
+	}
+
+	var members []int
+	for _, m := range c.members {
+		if m != id {
+			members = append(members, m)
+		}
+	}
+	if !leave {
+		members = append(members, id)
+	}
+	c.members = members
+
+	return Success
+}
+
+// coordinator waits before the given attempt at a transaction (attempt 0 is
+// the first), if backing off, and returns its coordinator, adding it to the
+// nodes already tried. replicas are the nodes eligible to coordinate (nil if
+// every member is eligible), of which only current members are picked. It
+// returns an error if none of them is a member.
+func (c *Client) coordinator(attempt int, tried map[int]bool, replicas []int) (int, error) {
+	if d := c.selector.delay(attempt); d > 0 {
+		c.clock.Sleep(d)
+	}
+
+	dest, err := c.selector.pick(tried, c.eligible(replicas))
+	if err != nil {
+		return -1, err
+	}
+	tried[dest] = true
+
+	return dest, nil
+}
+
+// eligible returns the nodes in replicas (every node if nil) which are
+// members, or nil if every node is eligible.
+func (c *Client) eligible(replicas []int) []int {
+	c.membersLock.Lock()
+	defer c.membersLock.Unlock()
+
+	if c.members == nil {
+		return replicas
+	}
+	if replicas == nil {
+		return c.members
+	}
+
+	isMember := make(map[int]bool)
+	for _, m := range c.members {
+		isMember[m] = true
+	}
+
+	eligible := []int{}
+	for _, r := range replicas {
+		if isMember[r] {
+			eligible = append(eligible, r)
+		}
+	}
+
+	return eligible
+}
+
 func (c *Client) routeResponses() {
-	for msg := range c.nodes[c.numNodes].Incoming {
+	for {
+		msg := c.nodes[c.numNodes].Incoming.Recv()
 		resChan, ok := c.responseChans.Load(msg.Id)
 		if !ok {
 			// Missing response channel just means the request timed out.
 			continue
 		}
-		responseChan, ok := resChan.(chan packet.Message)
+		responseChan, ok := resChan.(*clock.Chan[packet.Message])
 		if !ok {
 			log.Fatal("Wrong type in responseChans map in client")
 		}
 
-		responseChan <- msg
+		// If the channel is full, the request already has a response,
+		// so this is a duplicate (which the network or a node may send).
+		responseChan.TrySend(msg)
 	}
 }
 
-// Get picks a random database node as coordinator, sends a ClientReadRequest
-// to that node, and either returns the response or returns an error response
-// when the request times out. The third return value ok is true iff the
-// request was successful. If ok, the first return value is the value returned
-// (which may be nil) and the second is the timestamp associated with the value.
-func (c *Client) Get(key []byte) ([]byte, uint64, bool) {
+// Get picks a database node as coordinator (see SetPolicy), sends a
+// ClientReadRequest to that node, and either returns the response or returns
+// an error response when the request times out. The third return value ok is
+// true iff the request was successful. If ok, the first return value is the
+// value returned (which is nil if the key is not found) and the second is the
+// timestamp associated with the value. A deleted key is not found, but has the timestamp
+// of the delete.
+func (c *Client) Get(key []byte) (val []byte, timestamp uint64, ok bool) {
+	if c.history != nil {
+		start := c.history.Now()
+		defer func() {
+			outcome := history.Ok
+			if !ok {
+				outcome = history.Failed
+			}
+			c.record(history.Read, key, val, timestamp, outcome, start)
+		}()
+	}
+
+	replicas := c.ring.Replicas(key)
+	tried := make(map[int]bool)
 	for i := 0; i < c.numAttempts; i++ {
+		dest, err := c.coordinator(i, tried, replicas)
+		if err != nil {
+			return nil, 0, false
+		}
 		id := <-idStream
 
-		resChan := make(chan packet.Message, 1)
+		resChan := clock.NewChan[packet.Message](c.clock, 1)
 		c.responseChans.Store(id, resChan)
 
-		timer := time.NewTimer(c.timeout)
+		timer := c.clock.After(c.timeout)
+		sent := c.clock.Now()
 
-		dest := int(rand.Float64() * float64(c.numNodes))
-
-		c.nodes[dest].Outgoing <- packet.Message{
+		c.nodes[dest].Outgoing.Send(packet.Message{
 			Id:       id,
-			Src:      c.numNodes,
+			Src:      c.id,
 			Dest:     dest,
 			DemuxKey: packet.ClientReadRequest,
 			Key:      key,
 			Ok:       true,
-		}
+		})
 
-		select {
-		case msg := <-resChan:
+		var msg packet.Message
+		switch clock.Select(resChan.RecvCase(&msg, nil), timer.RecvCase(nil, nil)) {
+		case 0:
+			c.selector.observe(dest, msg.Src, c.clock.Since(sent), msg.Ok)
 			if msg.Ok {
 				return msg.Value, msg.Timestamp, msg.Ok
 			}
-		case <-timer.C:
+		case 1:
+			c.selector.observe(dest, -1, c.timeout, false)
 			continue
 		}
 
@@ -136,11 +361,68 @@ func (c *Client) Get(key []byte) ([]byte, uint64, bool) {
 	return nil, 0, false
 }
 
-// Put picks a random database node as coordinator, sends a ClientWriteRequest,
-// and returns whether the transaction was successful (if possible). If the
-// transaction was successful, it returns a timestamp.
+// Scan picks a database node as coordinator (see SetPolicy), and sends a
+// ClientScanRequest for every key k, start <= k < end (a nil end is
+// unbounded). The coordinator scans a read quorum, and merges the results,
+// keeping the value with the latest timestamp for each key. Scan returns the
+// merged results in order of key, and ok, which is true iff the request was
+// successful.
+func (c *Client) Scan(start, end []byte) ([]packet.Entry, bool) {
+	tried := make(map[int]bool)
+	for i := 0; i < c.numAttempts; i++ {
+		dest, err := c.coordinator(i, tried, nil)
+		if err != nil {
+			return nil, false
+		}
+		id := <-idStream
+
+		resChan := clock.NewChan[packet.Message](c.clock, 1)
+		c.responseChans.Store(id, resChan)
+
+		timer := c.clock.After(c.timeout)
+		sent := c.clock.Now()
+
+		c.nodes[dest].Outgoing.Send(packet.Message{
+			Id:       id,
+			Src:      c.id,
+			Dest:     dest,
+			DemuxKey: packet.ClientScanRequest,
+			Key:      start,
+			Value:    end,
+			Ok:       true,
+		})
+
+		var msg packet.Message
+		switch clock.Select(resChan.RecvCase(&msg, nil), timer.RecvCase(nil, nil)) {
+		case 0:
+			c.selector.observe(dest, msg.Src, c.clock.Since(sent), msg.Ok)
+			if msg.Ok {
+				entries, err := packet.DecodeEntries(msg.Value)
+				if err == nil {
+					return entries, true
+				}
+			}
+		case 1:
+			c.selector.observe(dest, -1, c.timeout, false)
+			continue
+		}
+
+		c.responseChans.Delete(id)
+	}
+
+	return nil, false
+}
+
+// ScanPrefix is the same as Scan, but returns every key starting with prefix.
+func (c *Client) ScanPrefix(prefix []byte) ([]packet.Entry, bool) {
+	return c.Scan(prefix, datastore.PrefixEnd(prefix))
+}
+
+// Put picks a database node as coordinator (see SetPolicy), sends a
+// ClientWriteRequest, and returns whether the transaction was successful (if
+// possible). If the transaction was successful, it returns a timestamp.
 func (c *Client) Put(key, val []byte) (PutResponse, uint64) {
-	return c.put(key, val, false, 0)
+	return c.put(packet.ClientWriteRequest, key, val, 0)
 }
 
 // StrongPut is the same as Put, but will only write the value at the given
@@ -148,48 +430,160 @@ func (c *Client) Put(key, val []byte) (PutResponse, uint64) {
 // the transaction is aborted. Note that the next time is current timestamp+1
 // eg. oldVal, ts = Get(key); StrongPut(key, newVal, ts+1)
 func (c *Client) StrongPut(key, val []byte, timestamp uint64) (PutResponse, uint64) {
-	return c.put(key, val, true, timestamp)
+	return c.put(packet.ClientStrongWriteRequest, key, val, timestamp)
 }
 
-func (c *Client) put(key, val []byte, strong bool, ts uint64) (resType PutResponse, timestamp uint64) {
-	for i := 0; i < c.numAttempts; i++ {
-		id := <-idStream
+// Delete is the same as Put, but deletes key. The key is replaced by a
+// tombstone, which is removed once every node has seen it. If the transaction
+// was successful, it returns the timestamp of the tombstone.
+func (c *Client) Delete(key []byte) (PutResponse, uint64) {
+	return c.put(packet.ClientDeleteRequest, key, nil, 0)
+}
 
-		resChan := make(chan packet.Message, 1)
-		c.responseChans.Store(id, resChan)
+// Txn atomically writes several keys: either every write is committed, or none
+// are. A write with Tombstone set deletes its key (ignoring Value). A write with
+// a non-zero Timestamp is conditional, as for StrongPut: the transaction is
+// aborted unless that is the next timestamp of the key. Each key may only be
+// written once. If the transaction was successful, Txn returns the timestamp of
+// each write, in order.
+func (c *Client) Txn(writes []packet.Entry) (PutResponse, []uint64) {
+	if len(writes) == 0 {
+		return Success, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, w := range writes {
+		if seen[string(w.Key)] {
+			return Error, nil
+		}
+		seen[string(w.Key)] = true
+	}
+
+	resType, res := c.write(packet.Message{
+		DemuxKey: packet.ClientTxnRequest,
+		Value:    packet.EncodeEntries(writes),
+	})
+	if resType != Success {
+		return resType, nil
+	}
+
+	// A malformed response fails the transaction, not the whole process
+	committed, err := packet.DecodeEntries(res.Value)
+	if err != nil || len(committed) != len(writes) {
+		log.Println("Malformed transaction response", res)
+		return Error, nil
+	}
 
-		timer := time.NewTimer(c.timeout)
+	timestamps := make([]uint64, len(committed))
+	for i, w := range committed {
+		timestamps[i] = w.Timestamp
+	}
+
+	return Success, timestamps
+}
 
-		dest := int(rand.Float64() * float64(c.numNodes))
+func (c *Client) put(demuxKey packet.Messagetype, key, val []byte, ts uint64) (PutResponse, uint64) {
+	var start time.Duration
+	if c.history != nil {
+		start = c.history.Now()
+	}
 
-		var demuxKey packet.Messagetype
-		if strong {
-			demuxKey = packet.ClientStrongWriteRequest
-		} else {
-			demuxKey = packet.ClientWriteRequest
+	resType, res := c.write(packet.Message{
+		DemuxKey:  demuxKey,
+		Key:       key,
+		Value:     val,
+		Timestamp: ts,
+	})
+
+	if c.history != nil {
+		kind := history.Write
+		switch demuxKey {
+		case packet.ClientStrongWriteRequest:
+			kind = history.StrongWrite
+		case packet.ClientDeleteRequest:
+			kind = history.Delete
 		}
 
-		c.nodes[dest].Outgoing <- packet.Message{
-			Id:        id,
-			Src:       c.numNodes,
-			Dest:      dest,
-			DemuxKey:  demuxKey,
-			Key:       key,
-			Value:     val,
-			Timestamp: ts,
-			Ok:        true,
+		outcome := history.Unknown
+		switch {
+		case resType == Success:
+			outcome = history.Ok
+			ts = res.Timestamp
+		case resType == Error && c.numAttempts == 1:
+			// After several attempts, an error only means that the
+			// last attempt failed
+			outcome = history.Failed
 		}
 
-		select {
-		case msg := <-resChan:
+		c.record(kind, key, val, ts, outcome, start)
+	}
+
+	return resType, res.Timestamp
+}
+
+// Record makes the client record every Get, Put, StrongPut and Delete in h, so
+// that the history can be checked for linearizability. Transactions and scans
+// are not recorded.
+func (c *Client) Record(h *history.History) {
+	c.history = h
+}
+
+func (c *Client) record(kind history.Kind, key, val []byte, timestamp uint64, outcome history.Outcome, start time.Duration) {
+	c.history.Add(history.Op{
+		Kind:      kind,
+		Key:       key,
+		Value:     val,
+		Timestamp: timestamp,
+		Outcome:   outcome,
+		Start:     start,
+		End:       c.history.Now(),
+	})
+}
+
+// write sends req (which only needs its DemuxKey, Key, Value and Timestamp set)
+// to a coordinator, retrying up to numAttempts times, and returns the
+// response if the write was successful. A write to a single key is coordinated
+// by a replica of the key.
+func (c *Client) write(req packet.Message) (resType PutResponse, res packet.Message) {
+	var replicas []int
+	if req.DemuxKey != packet.ClientTxnRequest {
+		replicas = c.ring.Replicas(req.Key)
+	}
+
+	tried := make(map[int]bool)
+	for i := 0; i < c.numAttempts; i++ {
+		dest, err := c.coordinator(i, tried, replicas)
+		if err != nil {
+			return Error, res
+		}
+		id := <-idStream
+
+		resChan := clock.NewChan[packet.Message](c.clock, 1)
+		c.responseChans.Store(id, resChan)
+
+		timer := c.clock.After(c.timeout)
+		sent := c.clock.Now()
+
+		req.Id = id
+		req.Src = c.id
+		req.Dest = dest
+		req.Ok = true
+
+		c.nodes[dest].Outgoing.Send(req)
+
+		var msg packet.Message
+		switch clock.Select(resChan.RecvCase(&msg, nil), timer.RecvCase(nil, nil)) {
+		case 0:
+			c.selector.observe(dest, msg.Src, c.clock.Since(sent), msg.Ok)
 			if msg.Ok {
 				resType = Success
-				timestamp = msg.Timestamp
+				res = msg
 				return
 			} else {
 				resType = Error
 			}
-		case <-timer.C:
+		case 1:
+			c.selector.observe(dest, -1, c.timeout, false)
 			resType = Unknown
 			continue
 		}
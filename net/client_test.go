@@ -2,34 +2,73 @@ package net
 
 import (
 	"bytes"
+	gonet "net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/hashring"
+	"github.com/alexbostock/part-ii-project/history"
 	"github.com/alexbostock/part-ii-project/net/packet"
+	"github.com/alexbostock/part-ii-project/net/transport"
 )
 
-func TestDatabase(t *testing.T) {
-	numNodes := 5
-	quorumSize := uint(numNodes/2 + 1)
-	timeout := 500 * time.Millisecond
-
-	nodes := make([]*dbnode.Dbnode, 6)
-
-	p := newPartitions(numNodes)
+// newNodes creates numNodes database nodes, with the given lock timeout, quorum
+// sizes and options, followed by a node with no behaviour for the client (see
+// NewClient). The nodes are not connected.
+func newNodes(numNodes int, timeout time.Duration, rqs, wqs uint, o dbnode.Options, clk clock.Clock) []*dbnode.Dbnode {
+	nodes := make([]*dbnode.Dbnode, numNodes+1)
 
 	for i := 0; i < numNodes; i++ {
-		nodes[i] = dbnode.New(numNodes, i, timeout, false, quorumSize, quorumSize, false, true)
-		go startHelper(nodes[i].Outgoing, nodes, 0, 0, nil, p)
+		nodes[i] = dbnode.New(numNodes, i, timeout, rqs, wqs, o, clk)
 	}
 
 	nodes[numNodes] = &dbnode.Dbnode{
-		Incoming: make(chan packet.Message, 100),
-		Outgoing: make(chan packet.Message, 100),
+		Incoming: clock.NewChan[packet.Message](clk, 100),
+		Outgoing: clock.NewChan[packet.Message](clk, 100),
+	}
+
+	return nodes
+}
+
+// startCluster creates nodes as newNodes does, and connects them by a
+// simulated network with no latency, which may be partitioned.
+func startCluster(numNodes int, timeout time.Duration, rqs, wqs uint, o dbnode.Options, clk clock.Clock) ([]*dbnode.Dbnode, *partitions) {
+	nodes := newNodes(numNodes, timeout, rqs, wqs, o, clk)
+
+	p := newPartitions(numNodes)
+	for i := 0; i <= numNodes; i++ {
+		outgoing, seed := nodes[i].Outgoing, int64(i)
+		clk.Go(func() {
+			startHelper(outgoing, nodes, 0, 0, nil, p, clk, seed)
+		})
+	}
+
+	return nodes, p
+}
+
+// stopCluster fails every database node, so that a test can start another
+// cluster without the first one still running in the background.
+func stopCluster(nodes []*dbnode.Dbnode) {
+	for _, node := range nodes[:len(nodes)-1] {
+		node.Incoming.Send(packet.Message{DemuxKey: packet.ControlFail})
 	}
-	go startHelper(nodes[numNodes].Outgoing, nodes, 0, 0, nil, p)
+}
+
+func TestDatabase(t *testing.T) {
+	numNodes := 5
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
 
-	client := NewClient(nodes, timeout, 1)
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{LogWrites: true}, clk)
+
+	client := NewClient(nodes, timeout, 1, clk)
 
 	k := []byte{1}
 	v := []byte{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
@@ -89,3 +128,790 @@ func TestDatabase(t *testing.T) {
 		t.Error("Strong write failed")
 	}
 }
+
+func TestTCPClient(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+	clk := clock.NewReal()
+
+	addrs := make([]string, numNodes)
+	for i := range addrs {
+		// Find a free port
+		l, err := gonet.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+
+	nodes := newNodes(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+	for i := 0; i < numNodes; i++ {
+		e, err := transport.Listen(i, addrs, nodes[i].Incoming, nodes[i].Outgoing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Close()
+	}
+
+	client := NewTCPClient(numNodes, addrs, timeout, 3, clk)
+
+	k := []byte{1}
+	v := []byte{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+
+	res, _ := client.Put(k, v)
+	if res != Success {
+		t.Error("Write transaction over TCP failed")
+	}
+
+	val, _, ok := client.Get(k)
+	if !ok {
+		t.Error("Read transaction over TCP failed")
+	}
+	if !bytes.Equal(v, val) {
+		t.Error("Incorrect value read over TCP", val)
+	}
+}
+
+func TestScan(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+
+	client := NewClient(nodes, timeout, 3, clk)
+
+	keys := [][]byte{[]byte("a/2"), []byte("b"), []byte("a/1"), []byte("a")}
+	for _, k := range keys {
+		if res, _ := client.Put(k, k); res != Success {
+			t.Error("Write transaction failed", k)
+		}
+	}
+
+	// Overwrite a key, so that nodes disagree on its value
+	if res, _ := client.Put(keys[0], []byte("new")); res != Success {
+		t.Error("Write transaction failed")
+	}
+
+	entries, ok := client.ScanPrefix([]byte("a/"))
+	if !ok {
+		t.Fatal("Scan failed")
+	}
+	if len(entries) != 2 {
+		t.Fatal("Scan returned the wrong number of keys", entries)
+	}
+	if !bytes.Equal(entries[0].Key, []byte("a/1")) || !bytes.Equal(entries[0].Value, []byte("a/1")) {
+		t.Error("Scan returned the wrong first entry", entries[0])
+	}
+	if !bytes.Equal(entries[1].Key, []byte("a/2")) || !bytes.Equal(entries[1].Value, []byte("new")) || entries[1].Timestamp != 2 {
+		t.Error("Scan did not return the latest value", entries[1])
+	}
+
+	entries, ok = client.Scan(nil, nil)
+	if !ok || len(entries) != len(keys) {
+		t.Error("Unbounded scan failed", entries)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+
+	// A short timeout, so that tombstones are collected quickly
+	timeout := 50 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{SloppyQuorum: true}, clk)
+
+	client := NewClient(nodes, timeout, 10, clk)
+
+	k := []byte{1}
+	k2 := []byte{2}
+	v := []byte{10, 9, 8}
+
+	for _, key := range [][]byte{k, k2} {
+		if res, _ := client.Put(key, v); res != Success {
+			t.Fatal("Write transaction failed")
+		}
+	}
+
+	res, ts := client.Delete(k)
+	if res != Success || ts != 2 {
+		t.Fatal("Delete failed", res, ts)
+	}
+
+	val, ts, ok := client.Get(k)
+	if !ok || val != nil {
+		t.Error("Deleted key should not be found", val, ok)
+	}
+	if ts != 2 {
+		t.Error("Deleted key should have the timestamp of the delete", ts)
+	}
+
+	entries, ok := client.Scan(nil, nil)
+	if !ok || len(entries) != 1 || !bytes.Equal(entries[0].Key, k2) {
+		t.Error("Scan should not return deleted keys", entries)
+	}
+
+	// Once every node has the tombstone, it is collected, so the key has
+	// no timestamp at all
+	deadline := clk.Now().Add(5 * time.Second)
+	for ts != 0 && clk.Now().Before(deadline) {
+		clk.Sleep(100 * time.Millisecond)
+		val, ts, ok = client.Get(k)
+	}
+	if ts != 0 || val != nil {
+		t.Error("Tombstone should be garbage collected", val, ts)
+	}
+
+	if res, _ := client.Put(k, v); res != Success {
+		t.Error("Write after garbage collection failed")
+	}
+	val, _, _ = client.Get(k)
+	if !bytes.Equal(val, v) {
+		t.Error("Write after garbage collection should be visible", val)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+
+	client := NewClient(nodes, timeout, 3, clk)
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+
+	if res, _ := client.Put(a, []byte{1}); res != Success {
+		t.Fatal("Write transaction failed")
+	}
+
+	res, timestamps := client.Txn([]packet.Entry{
+		{Key: a, Value: []byte{2}},
+		{Key: b, Value: []byte{3}},
+		{Key: c, Value: []byte{4}},
+	})
+	if res != Success || len(timestamps) != 3 || timestamps[0] != 2 || timestamps[1] != 1 || timestamps[2] != 1 {
+		t.Fatal("Multi-key transaction failed", res, timestamps)
+	}
+
+	for i, key := range [][]byte{a, b, c} {
+		val, _, ok := client.Get(key)
+		if !ok || !bytes.Equal(val, []byte{byte(i + 2)}) {
+			t.Error("Multi-key transaction did not write every key", key, val)
+		}
+	}
+
+	// The condition on b does not hold, so neither write happens
+	res, _ = client.Txn([]packet.Entry{
+		{Key: a, Value: []byte{5}, Timestamp: 3},
+		{Key: b, Value: []byte{6}, Timestamp: 1},
+	})
+	if res != Error {
+		t.Error("Conditional transaction should fail", res)
+	}
+	if val, ts, _ := client.Get(a); ts != 2 || !bytes.Equal(val, []byte{2}) {
+		t.Error("Failed transaction should not write any key", val, ts)
+	}
+
+	res, timestamps = client.Txn([]packet.Entry{
+		{Key: a, Value: []byte{5}, Timestamp: 3},
+		{Key: b, Tombstone: true, Timestamp: 2},
+	})
+	if res != Success || len(timestamps) != 2 || timestamps[0] != 3 || timestamps[1] != 2 {
+		t.Fatal("Conditional transaction failed", res, timestamps)
+	}
+	if val, _, _ := client.Get(b); val != nil {
+		t.Error("Transaction should delete a key", val)
+	}
+
+	if res, _ := client.Txn([]packet.Entry{{Key: a}, {Key: a}}); res != Error {
+		t.Error("Transaction writing a key twice should fail", res)
+	}
+}
+
+// A malformed response to a transaction fails the transaction.
+func TestTxnMalformedResponse(t *testing.T) {
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	nodes := []*dbnode.Dbnode{
+		{Incoming: clock.NewChan[packet.Message](clk, 1), Outgoing: clock.NewChan[packet.Message](clk, 1)},
+		{Incoming: clock.NewChan[packet.Message](clk, 1), Outgoing: clock.NewChan[packet.Message](clk, 1)},
+	}
+
+	// The only node commits one write of two
+	clk.Go(func() {
+		req := nodes[0].Outgoing.Recv()
+		nodes[1].Incoming.Send(packet.Message{
+			Id:       req.Id,
+			Src:      0,
+			Dest:     req.Src,
+			DemuxKey: packet.ClientWriteResponse,
+			Value:    packet.EncodeEntries([]packet.Entry{{Key: []byte("a"), Timestamp: 1}}),
+			Ok:       true,
+		})
+	})
+
+	client := NewClient(nodes, time.Second, 1, clk)
+	res, timestamps := client.Txn([]packet.Entry{{Key: []byte("a")}, {Key: []byte("b")}})
+	if res != Error || timestamps != nil {
+		t.Error("A malformed response should fail the transaction.", res, timestamps)
+	}
+}
+
+func TestElectors(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	for _, kind := range []elector.Kind{elector.Ring, elector.Bully, elector.Dummy, elector.Raft} {
+		t.Run(kind.String(), func(t *testing.T) {
+			clk := clock.NewVirtual()
+			defer clk.Stop()
+			nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Elector: kind}, clk)
+
+			client := NewClient(nodes, timeout, 3, clk)
+
+			k := []byte{1}
+			v := []byte(kind.String())
+
+			if res, _ := client.Put(k, v); res != Success {
+				t.Error("Write transaction failed.", kind, res)
+				return
+			}
+			if val, _, ok := client.Get(k); !ok || !bytes.Equal(val, v) {
+				t.Error("Read returned the wrong value.", kind, val, ok)
+			}
+		})
+	}
+}
+
+// A strict quorum system is linearizable, so the history of concurrent
+// requests recorded by a client should pass history.Check. (This lives here
+// rather than in package history, which cannot import net.)
+func TestLinearizableHistory(t *testing.T) {
+	numNodes := 5
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+
+	client := NewClient(nodes, timeout, 3, clk)
+	h := history.New(clk)
+	client.Record(h)
+
+	// Concurrent writes, reads and deletes of two keys
+	numWorkers := 4
+	numRequests := 10
+
+	done := clock.NewChan[bool](clk, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		i := i
+		clk.Go(func() {
+			defer done.Send(true)
+
+			for j := 0; j < numRequests; j++ {
+				key := []byte{byte(1 + j%2)}
+				switch (i + j) % 3 {
+				case 0:
+					client.Put(key, []byte{byte(i + 1), byte(j + 1)})
+				case 1:
+					client.Get(key)
+				default:
+					client.Delete(key)
+				}
+			}
+		})
+	}
+	for i := 0; i < numWorkers; i++ {
+		done.Recv()
+	}
+
+	ops := h.Ops()
+	if len(ops) != numWorkers*numRequests {
+		t.Error("Every request should be recorded.", len(ops))
+	}
+
+	succeeded := 0
+	for _, op := range ops {
+		if op.Outcome == history.Ok {
+			succeeded++
+		}
+	}
+	if succeeded == 0 {
+		t.Error("Some requests should succeed.")
+	}
+
+	if ok, violation := history.Check(ops); !ok {
+		t.Error("The history of a strict quorum system should be linearizable.", violation)
+	}
+}
+
+func TestFencing(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+
+	client := NewClient(nodes, timeout, 3, clk)
+
+	if res, _ := client.Put([]byte{1}, []byte{2}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	// lockAll sends a write lock request with the given fencing token to
+	// every node, as if from a leader, and returns the number of nodes
+	// which granted it.
+	lockAll := func(token uint64, key []byte) int {
+		id := <-idStream
+		resChan := clock.NewChan[packet.Message](clk, numNodes)
+		client.responseChans.Store(id, resChan)
+		defer client.responseChans.Delete(id)
+
+		for i := 0; i < numNodes; i++ {
+			nodes[numNodes].Outgoing.Send(packet.Message{
+				Id:       id,
+				Src:      numNodes,
+				Dest:     i,
+				DemuxKey: packet.NodeLockRequestNoTimeout,
+				Value:    packet.EncodeEntries([]packet.Entry{{Key: key}}),
+				Ok:       true,
+				Token:    token,
+			})
+		}
+
+		granted := 0
+		for i := 0; i < numNodes; i++ {
+			var res packet.Message
+			if clock.Select(resChan.RecvCase(&res, nil), clk.After(timeout).RecvCase(nil, nil)) != 0 {
+				t.Fatal("Lock request timed out.")
+			}
+			if res.Ok {
+				granted++
+			}
+		}
+
+		return granted
+	}
+
+	// A write quorum has seen the leader's token, so rejects older tokens
+	if granted := lockAll(0, []byte{3}); granted > numNodes-int(quorumSize) {
+		t.Error("Nodes should reject a lock request with a stale token.", granted)
+	}
+
+	if granted := lockAll(1<<40, []byte{4}); granted != numNodes {
+		t.Error("Nodes should grant a lock request with a newer token.", granted)
+	}
+
+	// Now the leader's own token is stale
+	if res, _ := client.Put([]byte{1}, []byte{5}); res != Error {
+		t.Error("Write with a stale token should fail.", res)
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	numNodes := 5
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	// A read quorum of 1, so that each node's store can be read directly.
+	// Each write only reaches a write quorum of 3 nodes, so without
+	// anti-entropy, the other nodes would never learn it.
+	nodes, _ := startCluster(numNodes, timeout, 1, 3, dbnode.Options{AntiEntropy: 100 * time.Millisecond}, clk)
+
+	client := NewClient(nodes, timeout, 10, clk)
+
+	expected := make(map[byte]byte)
+	for k := byte(1); k <= 5; k++ {
+		if res, _ := client.Put([]byte{k}, []byte{k}); res != Success {
+			t.Fatal("Write transaction failed.", res)
+		}
+		expected[k] = k
+	}
+	if res, _ := client.Put([]byte{1}, []byte{10}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+	expected[1] = 10
+
+	// scan reads every key from a node's store
+	scan := func(node int) []packet.Entry {
+		id := <-idStream
+		resChan := clock.NewChan[packet.Message](clk, 1)
+		client.responseChans.Store(id, resChan)
+		defer client.responseChans.Delete(id)
+
+		nodes[numNodes].Outgoing.Send(packet.Message{
+			Id:       id,
+			Src:      numNodes,
+			Dest:     node,
+			DemuxKey: packet.ClientScanRequest,
+			Ok:       true,
+		})
+
+		var res packet.Message
+		if clock.Select(resChan.RecvCase(&res, nil), clk.After(timeout).RecvCase(nil, nil)) != 0 {
+			return nil
+		}
+		entries, _ := packet.DecodeEntries(res.Value)
+		return entries
+	}
+
+	repaired := func(entries []packet.Entry) bool {
+		if len(entries) != len(expected) {
+			return false
+		}
+		for _, e := range entries {
+			if len(e.Key) != 1 || !bytes.Equal(e.Value, []byte{expected[e.Key[0]]}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	deadline := clk.Now().Add(5 * time.Second)
+	for i := 0; i < numNodes; i++ {
+		entries := scan(i)
+		for !repaired(entries) {
+			if clk.Now().After(deadline) {
+				t.Fatal("Anti-entropy did not repair every node.", i, entries)
+			}
+			clk.Sleep(50 * time.Millisecond)
+			entries = scan(i)
+		}
+	}
+}
+
+// A repairSink records which nodes have repaired each timestamp.
+type repairSink struct {
+	lock     sync.Mutex
+	repaired map[uint64]map[int]bool
+}
+
+func (s *repairSink) Write(e eventlog.Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e.Type == eventlog.Repair {
+		if s.repaired[e.Timestamp] == nil {
+			s.repaired[e.Timestamp] = make(map[int]bool)
+		}
+		s.repaired[e.Timestamp][*e.Node] = true
+	}
+}
+
+func (s *repairSink) Close() error {
+	return nil
+}
+
+func (s *repairSink) numRepaired(timestamp uint64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.repaired[timestamp])
+}
+
+func TestReadRepair(t *testing.T) {
+	numNodes := 5
+	wqs := 3
+	timeout := 500 * time.Millisecond
+
+	for _, mode := range []dbnode.ReadRepair{dbnode.SyncRepair, dbnode.AsyncRepair} {
+		t.Run(mode.String(), func(t *testing.T) {
+			clk := clock.NewVirtual()
+			defer clk.Stop()
+			sink := &repairSink{repaired: make(map[uint64]map[int]bool)}
+			events := eventlog.New(sink, clk)
+
+			// Each write only reaches a write quorum, but every read
+			// reaches every node
+			nodes, _ := startCluster(numNodes, timeout, uint(numNodes), uint(wqs), dbnode.Options{ReadRepair: mode, LogWrites: true, Events: events}, clk)
+
+			client := NewClient(nodes, timeout, 10, clk)
+
+			if res, _ := client.Put([]byte{1}, []byte{1}); res != Success {
+				t.Fatal("Write transaction failed.", mode, res)
+			}
+
+			val, timestamp, ok := client.Get([]byte{1})
+			if !ok || !bytes.Equal(val, []byte{1}) {
+				t.Fatal("Read transaction failed.", mode, val)
+			}
+
+			// A synchronous repair is complete before the client is
+			// answered
+			deadline := clk.Now()
+			if mode == dbnode.AsyncRepair {
+				deadline = deadline.Add(5 * time.Second)
+			}
+			for sink.numRepaired(timestamp) < numNodes-wqs {
+				if clk.Now().After(deadline) {
+					t.Fatal("A read did not repair every stale replica.", mode, sink.numRepaired(timestamp))
+				}
+				clk.Sleep(10 * time.Millisecond)
+			}
+
+			// Every replica is now up to date
+			client.Get([]byte{1})
+			clk.Sleep(100 * time.Millisecond)
+			if n := sink.numRepaired(timestamp); n != numNodes-wqs {
+				t.Error("Only stale replicas should be repaired.", mode, n)
+			}
+		})
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	numNodes := 5
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{SloppyQuorum: true}, clk)
+
+	client := NewClient(nodes, timeout, 10, clk)
+
+	if res, _ := client.Put([]byte{1}, []byte{1}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	// Only the leader and 2 other nodes remain, so a write only succeeds if
+	// every replica it chose which has failed is substituted
+	var tr *tracer
+	leader := nodes[0].QueryStatus().Leader
+	failed := []int{(leader + 1) % numNodes, (leader + 2) % numNodes}
+	for _, f := range failed {
+		tr.sendControl(nodes[f], f, packet.ControlFail)
+	}
+
+	for k := byte(1); k <= 5; k++ {
+		if res, _ := client.Put([]byte{k}, []byte{k + 10}); res != Success {
+			t.Fatal("A sloppy quorum should not need the failed replicas.", k, res)
+		}
+	}
+
+	numHints := func() int {
+		total := 0
+		for i := 0; i < numNodes; i++ {
+			total += nodes[i].QueryStatus().Hints
+		}
+		return total
+	}
+	if numHints() == 0 {
+		t.Error("Substitutes should hold hints for the failed replicas.")
+	}
+
+	for _, f := range failed {
+		tr.sendControl(nodes[f], f, packet.ControlRecover)
+	}
+
+	// Reads make the recovered nodes send messages to the substitutes
+	deadline := clk.Now().Add(10 * time.Second)
+	for k := byte(1); numHints() > 0; k = k%5 + 1 {
+		if clk.Now().After(deadline) {
+			t.Fatal("Hints were not handed off after recovery.", numHints())
+		}
+		client.Get([]byte{k})
+	}
+}
+
+func TestPartitioning(t *testing.T) {
+	numNodes := 7
+	quorumSize := uint(2)
+	timeout := 500 * time.Millisecond
+
+	ring := hashring.New(numNodes, 3, 64)
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Ring: ring}, clk)
+
+	client := NewClient(nodes, timeout, 10, clk)
+	client.SetRing(ring)
+
+	numKeys := 20
+	for k := 1; k <= numKeys; k++ {
+		if res, _ := client.Put([]byte{byte(k)}, []byte{byte(k)}); res != Success {
+			t.Fatal("Write transaction failed.", k, res)
+		}
+	}
+
+	for k := 1; k <= numKeys; k++ {
+		if val, _, ok := client.Get([]byte{byte(k)}); !ok || !bytes.Equal(val, []byte{byte(k)}) {
+			t.Error("A read should see the latest write to its key.", k, val, ok)
+		}
+	}
+
+	// Every key is stored by a write quorum of its replicas, and no other
+	// nodes
+	total := 0
+	for i := 0; i < numNodes; i++ {
+		total += nodes[i].QueryStatus().Keys
+	}
+	if total < numKeys*int(quorumSize) || total > numKeys*3 {
+		t.Error("Keys should only be stored by their replicas.", total)
+	}
+
+	// A scan sees every key, although no node stores them all
+	entries, ok := client.Scan(nil, nil)
+	if !ok || len(entries) != numKeys {
+		t.Error("A scan should see every key.", ok, len(entries))
+	}
+
+	res, _ := client.Txn([]packet.Entry{
+		{Key: []byte{1}, Value: []byte{100}},
+		{Key: []byte{2}, Value: []byte{200}},
+	})
+	if res != Success {
+		t.Fatal("Multi-key transaction failed.", res)
+	}
+	if val, _, ok := client.Get([]byte{2}); !ok || !bytes.Equal(val, []byte{200}) {
+		t.Error("A read should see a transaction's write.", val, ok)
+	}
+}
+
+// With keys partitioned, a write is coordinated by a replica of its key, even
+// if the leader is not one.
+func TestReplicaCoordinatesWrites(t *testing.T) {
+	numNodes := 7
+	quorumSize := uint(2)
+	timeout := 500 * time.Millisecond
+
+	ring := hashring.New(numNodes, 3, 64)
+
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Ring: ring}, clk)
+
+	// The client does not know the ring, so it may send writes to any node
+	client := NewClient(nodes, timeout, 10, clk)
+	client.SetPolicy(StickyLeader)
+	if res, _ := client.Put([]byte{0}, []byte{0}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	leader := nodes[0].QueryStatus().Leader
+	for k := 1; k <= 20; k++ {
+		key := []byte{byte(k)}
+		if ring.Contains(key, leader) {
+			continue
+		}
+
+		for i := 0; i < 5; i++ {
+			client.selector.sticky = -1
+			if res, _ := client.Put(key, []byte{byte(i)}); res != Success {
+				t.Fatal("Write transaction failed.", k, res)
+			}
+			if src := client.selector.sticky; !ring.Contains(key, src) {
+				t.Error("A write should be coordinated by a replica of its key.", k, src, ring.Replicas(key))
+			}
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	numMembers := 3
+	numNodes := 5
+	quorumSize := uint(2)
+	timeout := 500 * time.Millisecond
+
+	// Replace every initial member in turn with a spare, as in a rolling
+	// node replacement
+	steps := []struct {
+		node int
+		join bool
+	}{{3, true}, {0, false}, {4, true}, {1, false}}
+
+	for _, kind := range []elector.Kind{elector.Ring, elector.Bully, elector.Raft} {
+		t.Run(kind.String(), func(t *testing.T) {
+			members := []int{0, 1, 2}
+
+			clk := clock.NewVirtual()
+			defer clk.Stop()
+			nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Elector: kind, Members: members}, clk)
+
+			client := NewClient(nodes, timeout, 10, clk)
+			client.SetMembers(members)
+
+			numKeys := 10
+			for k := 1; k <= numKeys; k++ {
+				if res, _ := client.Put([]byte{byte(k)}, []byte{byte(k)}); res != Success {
+					t.Fatal("Write transaction failed.", kind, k, res)
+				}
+			}
+
+			if s := nodes[3].QueryStatus(); s.Config != 0 || len(s.Members) != numMembers {
+				t.Error("A spare should start with the initial configuration.", kind, s.Config, s.Members)
+			}
+
+			var version uint64
+			for i, step := range steps {
+				// A join makes two configurations: one with the new member,
+				// and one once it has caught up
+				var res PutResponse
+				if step.join {
+					res = client.Join(step.node)
+					version += 2
+				} else {
+					res = client.Leave(step.node)
+					version++
+				}
+				if res != Success {
+					t.Fatal("Membership change failed.", kind, step, res)
+				}
+
+				// A new member must catch up before the next change
+				deadline := clk.Now().Add(10 * time.Second)
+				for s := nodes[2].QueryStatus(); s.Config != version; s = nodes[2].QueryStatus() {
+					if clk.Now().After(deadline) {
+						t.Fatal("A new member did not catch up.", kind, step, s)
+					}
+					clk.Sleep(10 * time.Millisecond)
+				}
+
+				k := byte(numKeys + 1 + i)
+				if res, _ := client.Put([]byte{k}, []byte{k}); res != Success {
+					t.Error("Writes should succeed during a rolling replacement.", kind, step, res)
+				}
+			}
+
+			s := nodes[2].QueryStatus()
+			if len(s.Members) != numMembers || s.Members[0] != 2 || s.Members[1] != 3 || s.Members[2] != 4 {
+				t.Error("The spares should have replaced the initial members.", kind, s.Members)
+			}
+			if s.ReadQuorum != int(quorumSize) || s.WriteQuorum != int(quorumSize) {
+				t.Error("Quorum sizes should be restored once every member has caught up.", kind, s.ReadQuorum, s.WriteQuorum)
+			}
+
+			// Nodes which have left store nothing needed
+			var tr *tracer
+			tr.sendControl(nodes[0], 0, packet.ControlFail)
+			tr.sendControl(nodes[1], 1, packet.ControlFail)
+
+			for k := 1; k <= numKeys+len(steps); k++ {
+				if val, _, ok := client.Get([]byte{byte(k)}); !ok || !bytes.Equal(val, []byte{byte(k)}) {
+					t.Error("A read should see every write made before the replacement.", kind, k, val, ok)
+				}
+			}
+		})
+	}
+}
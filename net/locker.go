@@ -3,6 +3,8 @@ package net
 import (
 	"strconv"
 	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
 )
 
 // A ClientLocker is a primitive used to acquire a distributed lock using my
@@ -22,8 +24,8 @@ type ClientLocker struct {
 	wantLock bool
 	haveLock bool
 
-	lockResChan   chan bool
-	unlockResChan chan bool
+	lockResChan   *clock.Chan[bool]
+	unlockResChan *clock.Chan[bool]
 }
 
 // NewClientLocker instantiates a ClientLocker. Its argument are a client ID
@@ -39,7 +41,7 @@ func NewClientLocker(id int, client *Client) *ClientLocker {
 		haveLock: false,
 	}
 
-	go cl.daemon()
+	client.clock.Go(cl.daemon)
 
 	return cl
 }
@@ -60,7 +62,7 @@ func (cl *ClientLocker) daemon() {
 			if res == Success {
 				cl.haveLock = false
 				if cl.unlockResChan != nil {
-					cl.unlockResChan <- true
+					cl.unlockResChan.Send(true)
 					cl.unlockResChan = nil
 				}
 			}
@@ -71,13 +73,13 @@ func (cl *ClientLocker) daemon() {
 			if res == Success {
 				cl.haveLock = true
 				if cl.lockResChan != nil {
-					cl.lockResChan <- true
+					cl.lockResChan.Send(true)
 					cl.lockResChan = nil
 				}
 			}
 		}
 
-		time.Sleep(time.Second / 5)
+		cl.client.clock.Sleep(time.Second / 5)
 	}
 }
 
@@ -85,18 +87,18 @@ func (cl *ClientLocker) daemon() {
 // acquired. Lock must not be called concurrently with other Lock calls, or
 // with Unlock calls. Lock must not be called when the lock is already held.
 func (cl *ClientLocker) Lock() {
-	c := make(chan bool)
+	c := clock.NewChan[bool](cl.client.clock, 0)
 	cl.lockResChan = c
 	cl.wantLock = true
-	<-c
+	c.Recv()
 }
 
 // Lock is used to release the lock. Calls will block until the lock has been
 // released. Unlock must not be called concurrently with other Unlock calls, or
 // with Lock calls. Unlock must not be called when the lock is not already held.
 func (cl *ClientLocker) Unlock() {
-	c := make(chan bool)
+	c := clock.NewChan[bool](cl.client.clock, 0)
 	cl.unlockResChan = c
 	cl.wantLock = false
-	<-c
+	c.Recv()
 }
@@ -4,8 +4,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/dbnode"
-	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
 func TestClientLocker(t *testing.T) {
@@ -13,22 +13,11 @@ func TestClientLocker(t *testing.T) {
 	quorumSize := uint(numNodes/2 + 1)
 	timeout := 500 * time.Millisecond
 
-	nodes := make([]*dbnode.Dbnode, 6)
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{LogWrites: true}, clk)
 
-	p := newPartitions(numNodes)
-
-	for i := 0; i < numNodes; i++ {
-		nodes[i] = dbnode.New(numNodes, i, timeout, false, quorumSize, quorumSize, false, true)
-		go startHelper(nodes[i].Outgoing, nodes, 0, 0, nil, p)
-	}
-
-	nodes[numNodes] = &dbnode.Dbnode{
-		Incoming: make(chan packet.Message, 100),
-		Outgoing: make(chan packet.Message, 100),
-	}
-	go startHelper(nodes[numNodes].Outgoing, nodes, 0, 0, nil, p)
-
-	client := NewClient(nodes, timeout, 1)
+	client := NewClient(nodes, timeout, 1, clk)
 
 	clientLocker := NewClientLocker(0, client)
 
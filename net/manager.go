@@ -5,32 +5,23 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"net/http"
 	"os"
-	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/datastore"
 	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/hashring"
+	"github.com/alexbostock/part-ii-project/history"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
-type logger struct {
-	startTime time.Time
-	lock      sync.Mutex
-}
-
-func (l *logger) log(startTime time.Duration, msg string) {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-
-	t1 := startTime.Nanoseconds() / 1000
-	t2 := l.timestamp().Nanoseconds() / 1000
-
-	fmt.Printf("%v %v %v\n", t1, t2, msg)
-}
-
-func (l *logger) timestamp() time.Duration {
-	return time.Since(l.startTime)
-}
+// The sequence number of the last test transaction (see eventlog.Event)
+var txnCounter int64
 
 // Options represents the parameters with which to run the system. These map
 // directly to the command line options in main.
@@ -45,87 +36,274 @@ type Options struct {
 	FailTimeVariance            *float64
 	NumTransactions             *uint
 	ProportionWriteTransactions *float64
-	PersistentStore             *bool
+	PersistentStore             *datastore.Kind
 	ReadQuorumSize              *uint
 	WriteQuorumSize             *uint
 	NumAttempts                 *uint
 	SloppyQuorum                *bool
 	ConvergenceTest             *bool
 	LogWrites                   *bool
+	VirtualClock                *bool
+	Elector                     *elector.Kind
+	CheckLinearizability        *bool
+	Scenario                    *string
+	EventFormat                 *eventlog.Format
+	EventLog                    *string
+	MetricsAddr                 *string
+	AdminAddr                   *string
+	LatencyDistribution         *LatencyKind
+	LatencyMatrix               *string
+	LossProbability             *float64
+	DuplicateProbability        *float64
+	ReorderProbability          *float64
+	OneWayProbability           *float64
+	Trace                       *string
+	Replay                      *string
+	CoordinatorPolicy           *Policy
+	Backoff                     *float64
+	MaxBackoff                  *float64
+	AntiEntropyInterval         *float64
+	ReadRepair                  *dbnode.ReadRepair
+	ReplicationFactor           *uint
+	VirtualNodes                *uint
+	Spares                      *uint
 }
 
 // Simulate starts database nodes, sets up the simulated network, and sends
-// random client requests as tests, based on the given parameters.
-func Simulate(o Options) {
+// random client requests as tests, based on the given parameters. It returns
+// the first error writing the trace or the event log, if any.
+func Simulate(o Options) error {
 	log.SetFlags(log.Lmicroseconds)
 	log.SetOutput(os.Stdout)
 
 	sloppyQuorum := *o.SloppyQuorum || *o.ConvergenceTest
 
+	// Spare nodes run from the start, but only become members of the cluster
+	// once they join (see dbnode/membership.go)
 	numNodes := *o.NumNodes
+	total := numNodes + *o.Spares
 
 	rqs := *o.ReadQuorumSize
 	wqs := *o.WriteQuorumSize
 
-	if rqs > numNodes {
-		log.Fatal("Read quorum size must not be greater than the number of nodes.")
+	ring := hashring.New(int(numNodes), int(*o.ReplicationFactor), int(*o.VirtualNodes))
+	numReplicas := uint(ring.Factor(int(numNodes)))
+
+	if rqs > numReplicas {
+		log.Fatal("Read quorum size must not be greater than the number of replicas.")
+	}
+	if wqs > numReplicas {
+		log.Fatal("Write quorum size must not be greater than the number of replicas.")
 	}
-	if wqs > numNodes {
-		log.Fatal("Write quorum size must not be greater than the number of nodes.")
+	if wqs <= numReplicas/2 {
+		log.Fatal("Write quorum size must greater than half the number of replicas.")
 	}
-	if wqs <= numNodes/2 {
-		log.Fatal("Write quorum size must greater than half the number of nodes.")
+	if !sloppyQuorum && rqs+wqs <= numReplicas {
+		log.Fatal("Strict quorum requires V_R + V_W > R.")
 	}
-	if !sloppyQuorum && rqs+wqs <= numNodes {
-		log.Fatal("Strict quorum requires V_R + V_W > n.")
+	if *o.Spares > 0 && ring != nil {
+		log.Fatal("Spare nodes cannot join a cluster partitioned by a ring.")
 	}
 	if *o.TransactionRate <= 0 {
 		log.Fatal("Transaction rate must be greater than 0.")
 	}
 
-	rand.Seed(*o.RandomSeed)
+	// Each component (and each node and link) makes its random choices
+	// from its own source, seeded from seeds, so that a run does not depend
+	// on the order in which the components happen to run
+	seeds := rand.New(rand.NewSource(*o.RandomSeed))
 
-	nodes := make([]*dbnode.Dbnode, numNodes+1)
+	atomic.StoreInt64(&txnCounter, 0)
 
-	monitor := newMonitor(nodes)
+	var clk clock.Clock
+	if *o.VirtualClock {
+		v := clock.NewVirtual()
+		defer v.Stop()
+		clk = v
+	} else {
+		clk = clock.NewReal()
+	}
+
+	out := os.Stdout
+	if *o.EventLog != "" {
+		var err error
+		out, err = os.Create(*o.EventLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+
+	events := eventlog.New(eventlog.NewSink(*o.EventFormat, out), clk)
+
+	nodes := make([]*dbnode.Dbnode, total+1)
+
+	// The initial members (nil if every node is a member)
+	var members []int
+	if total > numNodes {
+		for i := 0; i < int(numNodes); i++ {
+			members = append(members, i)
+		}
+	}
 
 	// TODO: Parameterise timeout length
 	timeout := 500 * time.Millisecond
 
+	nodeOptions := dbnode.Options{
+		Store:        *o.PersistentStore,
+		Elector:      *o.Elector,
+		SloppyQuorum: sloppyQuorum,
+		AntiEntropy:  time.Duration(*o.AntiEntropyInterval * float64(time.Second)),
+		ReadRepair:   *o.ReadRepair,
+		Ring:         ring,
+		Members:      members,
+		LogWrites:    *o.LogWrites,
+		Events:       events,
+		Seed:         seeds.Int63(),
+	}
+
 	var i uint
-	for i = 0; i < numNodes; i++ {
-		nodes[i] = dbnode.New(int(numNodes), int(i), timeout, *o.PersistentStore, rqs, wqs, sloppyQuorum, *o.LogWrites)
+	for i = 0; i < total; i++ {
+		nodes[i] = dbnode.New(int(total), int(i), timeout, rqs, wqs, nodeOptions, clk)
+	}
+
+	// Address total is the "client" address, used by the manager
+	nodes[total] = &dbnode.Dbnode{
+		Incoming: clock.NewChan[packet.Message](clk, 500),
+		Outgoing: clock.NewChan[packet.Message](clk, 500),
+	}
+
+	if *o.Replay != "" {
+		entries, err := loadTrace(*o.Replay, int(total))
+		if err != nil {
+			log.Fatal("Invalid trace: ", err)
+		}
+
+		replayTrace(entries, nodes, 20*timeout, events, clk)
+		deleteStores(nodes)
+		return eventsError(events)
 	}
 
-	// Address numNodes is the "client" address, used by the manager
-	nodes[numNodes] = &dbnode.Dbnode{
-		Incoming: make(chan packet.Message, 500),
-		Outgoing: make(chan packet.Message, 500),
+	var tr *tracer
+	if *o.Trace != "" {
+		f, err := os.Create(*o.Trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		tr = newTracer(f, int(total), clk)
 	}
 
-	timer := &logger{startTime: time.Now()}
+	// The monitor queries node states, so it also needs every node to exist
+	monitor := newMonitor(nodes, events, clk)
 
-	partitionTracker := newPartitions(int(numNodes))
+	if *o.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", monitor)
+		go func() {
+			log.Fatal(http.ListenAndServe(*o.MetricsAddr, mux))
+		}()
+	}
+
+	partitionTracker := newPartitions(int(total))
+
+	var s *scenario
+	if *o.Scenario != "" {
+		var err error
+		s, err = loadScenario(*o.Scenario, int(total))
+		if err != nil {
+			log.Fatal("Invalid scenario: ", err)
+		}
+	}
+
+	var means [][]float64
+	if *o.LatencyMatrix != "" {
+		var err error
+		means, err = loadLatencyMatrix(*o.LatencyMatrix, int(total))
+		if err != nil {
+			log.Fatal("Invalid latency matrix: ", err)
+		}
+	}
+
+	lat := newLatency(*o.MeanMsgLatency, *o.MsgLatencyVariance)
+	model := newNetworkModel(*o.LatencyDistribution, lat, means, *o.LossProbability, *o.DuplicateProbability, *o.ReorderProbability)
+
+	client := NewClient(nodes, 10*timeout, int(*o.NumAttempts), clk)
+	client.SetPolicy(*o.CoordinatorPolicy)
+	client.SetBackoff(time.Duration(*o.Backoff*float64(time.Millisecond)), time.Duration(*o.MaxBackoff*float64(time.Millisecond)))
+	client.SetRing(ring)
+	client.SetMembers(members)
+	client.SetSeed(seeds.Int63())
+
+	if *o.AdminAddr != "" {
+		a := newAdmin(nodes, client, partitionTracker, events, tr, clk)
+		go func() {
+			log.Fatal(http.ListenAndServe(*o.AdminAddr, a))
+		}()
+	}
 
 	// Start the network only after all nodes have been created to avoid
 	// deferencing nil pointers
-	for i = 0; i < numNodes; i++ {
-		go startHelper(nodes[i].Outgoing, nodes, *o.MeanMsgLatency, math.Sqrt(*o.MsgLatencyVariance), monitor, partitionTracker)
+	for i = 0; i <= total; i++ {
+		linkSeed := seeds.Int63()
+		outgoing := nodes[i].Outgoing
+		clk.Go(func() {
+			startLink(outgoing, nodes, model, monitor, tr, partitionTracker, clk, linkSeed)
+		})
 	}
 
-	go startHelper(nodes[numNodes].Outgoing, nodes, *o.MeanMsgLatency, math.Sqrt(*o.MsgLatencyVariance), monitor, partitionTracker)
-
 	if *o.NodeFailureRate > 0 {
-		go triggerNodeFailures(nodes, *o.NodeFailureRate, *o.MeanFailTime, *o.FailTimeVariance, timer, partitionTracker)
+		failureSeed := seeds.Int63()
+		clk.Go(func() {
+			triggerNodeFailures(nodes, *o.NodeFailureRate, *o.MeanFailTime, *o.FailTimeVariance, *o.OneWayProbability, events, tr, partitionTracker, clk, failureSeed)
+		})
+	}
+	if s != nil {
+		clk.Go(func() {
+			runScenario(s, nodes, client, partitionTracker, lat, events, tr, clk)
+		})
+	}
+
+	var h *history.History
+	if *o.CheckLinearizability {
+		h = history.New(clk)
+		client.Record(h)
 	}
 
 	if *o.ConvergenceTest {
-		go sendTests(nodes, timeout, timer, *o.NumTransactions, *o.TransactionRate*3/4, *o.ProportionWriteTransactions, *o.NumAttempts, monitor)
-		sendConvergenceTests(nodes, timeout, timer, *o.NumTransactions/1000, monitor)
+		testSeed := seeds.Int63()
+		clk.Go(func() {
+			sendTests(client, timeout, events, *o.NumTransactions, *o.TransactionRate*3/4, *o.ProportionWriteTransactions, monitor, clk, testSeed)
+		})
+		sendConvergenceTests(nodes, ring, members, timeout, events, *o.NumTransactions/1000, monitor, clk, seeds.Int63())
 	} else {
-		sendTests(nodes, timeout, timer, *o.NumTransactions, *o.TransactionRate, *o.ProportionWriteTransactions, *o.NumAttempts, monitor)
+		sendTests(client, timeout, events, *o.NumTransactions, *o.TransactionRate, *o.ProportionWriteTransactions, monitor, clk, seeds.Int63())
+	}
+
+	monitor.stop()
+
+	if h != nil {
+		reportLinearizability(h, events)
 	}
 
+	deleteStores(nodes)
+
+	if err := tr.close(); err != nil {
+		return fmt.Errorf("Failed to write the trace: %v", err)
+	}
+	return eventsError(events)
+}
+
+// eventsError returns the first error writing events to l, if any.
+func eventsError(l *eventlog.Log) error {
+	if err := l.Close(); err != nil {
+		return fmt.Errorf("Failed to write events: %v", err)
+	}
+	return nil
+}
+
+func deleteStores(nodes []*dbnode.Dbnode) {
 	for _, node := range nodes {
 		if node.Store != nil {
 			node.Store.DeleteStore()
@@ -133,63 +311,117 @@ func Simulate(o Options) {
 	}
 }
 
-func startHelper(outgoing chan packet.Message, links []*dbnode.Dbnode, mean float64, stddev float64, m *monitor, p *partitions) {
-	for msg := range outgoing {
+// startHelper delivers every message sent on outgoing to its destination after
+// a random delay, with a fixed distribution (see startLink).
+func startHelper(outgoing *clock.Chan[packet.Message], links []*dbnode.Dbnode, mean float64, stddev float64, m *monitor, p *partitions, clk clock.Clock, seed int64) {
+	startLink(outgoing, links, newLatencyModel(Normal, &latency{mean: mean, stddev: stddev}, nil), m, nil, p, clk, seed)
+}
+
+// startLink delivers every message sent on outgoing to its destination, as
+// decided by model (normally once, after a random delay). Delays on each link
+// are drawn from a separate pseudorandom source derived from seed, so that they
+// do not depend on the order in which the sender happens to send messages to
+// different destinations.
+func startLink(outgoing *clock.Chan[packet.Message], links []*dbnode.Dbnode, model NetworkModel, m *monitor, tr *tracer, p *partitions, clk clock.Clock, seed int64) {
+	linkRands := make(map[int]*rand.Rand)
+
+	for {
+		msg := outgoing.Recv()
 		if msg.Dest < len(links) {
-			if msg.Src < msg.Dest && !p.linkAvailable(msg.Src, msg.Dest) {
+			m.logMsg(msg)
+			sent := tr.now()
+
+			if !p.linkAvailable(msg.Src, msg.Dest) {
+				m.logDrop(msg)
+				tr.drop(msg, sent, "partition")
 				continue
 			}
-			if msg.Dest < msg.Src && !p.linkAvailable(msg.Dest, msg.Src) {
-				continue
+
+			r := linkRands[msg.Dest]
+			if r == nil {
+				r = rand.New(rand.NewSource(seed + int64(msg.Dest)))
+				linkRands[msg.Dest] = r
 			}
 
-			delay := rand.NormFloat64()*stddev + mean
+			delays := model.Delays(msg, r)
+			if len(delays) == 0 {
+				m.logDrop(msg)
+				tr.drop(msg, sent, "loss")
+			}
 
-			go sendAfterDelay(msg, links[msg.Dest].Incoming, time.Duration(delay)*time.Millisecond)
+			// Schedule each delivery before starting the goroutine, so
+			// that deliveries are scheduled in the order they were sent.
+			for _, delay := range delays {
+				msg, link, after := msg, links[msg.Dest].Incoming, clk.After(delay)
+				clk.Go(func() {
+					sendAfterDelay(msg, link, after, m, tr, sent)
+				})
+			}
 		} else {
 			log.Printf("Misaddressed message from %d to %d", msg.Src, msg.Dest)
 		}
 	}
 }
 
-func sendAfterDelay(msg packet.Message, link chan packet.Message, delay time.Duration) {
-	time.Sleep(delay)
+// sendAfterDelay delivers msg, which was sent at the given time, on link once
+// delay fires, unless the link's buffer is full.
+func sendAfterDelay(msg packet.Message, link *clock.Chan[packet.Message], delay *clock.Chan[time.Time], m *monitor, tr *tracer, sent time.Duration) {
+	delay.Recv()
 
-	select {
-	case link <- msg:
-		// If the destination buffer is not full, send the message
-	default:
-		// Else, discard the message
+	if !tr.deliver(msg, link, sent) {
+		m.logDrop(msg)
 	}
 }
 
-func sendTests(nodes []*dbnode.Dbnode, timeout time.Duration, l *logger, numTransactions uint, transactionRate, proportionWrites float64, numAttempts uint, m *monitor) {
-	client := NewClient(nodes, 10*timeout, int(numAttempts))
+// sendTests sends random client requests using client, chosen by a source
+// seeded with seed.
+func sendTests(client *Client, timeout time.Duration, l *eventlog.Log, numTransactions uint, transactionRate, proportionWrites float64, m *monitor, clk clock.Clock, seed int64) {
+	r := rand.New(rand.NewSource(seed))
 
 	var i uint
 	for i = 0; i < numTransactions; i++ {
 		key := make([]byte, 1)
-		rand.Read(key)
-		removeZeroBytes(key)
+		r.Read(key)
+		removeZeroBytes(key, r)
 
-		if rand.Float64() < proportionWrites {
+		if r.Float64() < proportionWrites {
 			val := make([]byte, 8)
-			rand.Read(val)
+			r.Read(val)
 
-			go writeRequest(client, l, key, val)
+			clk.Go(func() {
+				writeRequest(client, l, m, key, val)
+			})
 		} else {
-			go readRequest(client, l, key)
+			clk.Go(func() {
+				readRequest(client, l, m, key)
+			})
 		}
 
-		time.Sleep(time.Duration(1000*rand.ExpFloat64()/transactionRate) * time.Millisecond)
+		clk.Sleep(time.Duration(1000*r.ExpFloat64()/transactionRate) * time.Millisecond)
 	}
 
 	// Wait for the last responses before halting)
-	time.Sleep(20 * timeout)
+	clk.Sleep(20 * timeout)
 }
 
-func sendConvergenceTests(nodes []*dbnode.Dbnode, timeout time.Duration, l *logger, numTests uint, m *monitor) {
-	client := NewClient(nodes, 10*timeout, 1)
+// reportLinearizability logs whether the history of the test requests is
+// linearizable, and if not, a minimal set of requests which are not.
+func reportLinearizability(h *history.History, l *eventlog.Log) {
+	ok, violation := history.Check(h.Ops())
+
+	l.Emit(eventlog.Checked(ok))
+	for _, op := range violation {
+		l.Emit(eventlog.Violated(op))
+	}
+}
+
+func sendConvergenceTests(nodes []*dbnode.Dbnode, ring *hashring.Ring, members []int, timeout time.Duration, l *eventlog.Log, numTests uint, m *monitor, clk clock.Clock, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+
+	client := NewClient(nodes, 10*timeout, 1, clk)
+	client.SetRing(ring)
+	client.SetMembers(members)
+	client.SetSeed(r.Int63())
 
 	var i uint
 	for i = 0; i < numTests; i++ {
@@ -198,51 +430,57 @@ func sendConvergenceTests(nodes []*dbnode.Dbnode, timeout time.Duration, l *logg
 		key := []byte{0}
 
 		oldVal := make([]byte, 8)
-		rand.Read(oldVal)
+		r.Read(oldVal)
 
 		newVal := make([]byte, 8)
-		rand.Read(newVal)
+		r.Read(newVal)
 
-		writeRequest(client, l, key, oldVal)
-		readRequest(client, l, key)
-		go writeRequest(client, l, key, newVal)
+		writeRequest(client, l, m, key, oldVal)
+		readRequest(client, l, m, key)
+		clk.Go(func() {
+			writeRequest(client, l, m, key, newVal)
+		})
 
 		for j := 0; j < 249; j++ {
-			go readRequest(client, l, key)
-			time.Sleep(4 * time.Millisecond)
+			clk.Go(func() {
+				readRequest(client, l, m, key)
+			})
+			clk.Sleep(4 * time.Millisecond)
 		}
 
-		readRequest(client, l, key)
+		readRequest(client, l, m, key)
 	}
 
-	time.Sleep(20 * timeout)
+	clk.Sleep(20 * timeout)
 }
 
-func triggerNodeFailures(nodes []*dbnode.Dbnode, failRate, mean, variance float64, l *logger, p *partitions) {
+// triggerNodeFailures randomly fails nodes and partitions the network, at the
+// given rate (per 100s), until the simulation ends. Each link failed by a
+// partition fails in one direction only with probability oneWay. Failures are
+// chosen by a source seeded with seed.
+func triggerNodeFailures(nodes []*dbnode.Dbnode, failRate, mean, variance, oneWay float64, l *eventlog.Log, tr *tracer, p *partitions, clk clock.Clock, seed int64) {
+	r := rand.New(rand.NewSource(seed))
 	stddev := math.Sqrt(variance)
 
 	for {
-		time.Sleep(time.Duration(rand.ExpFloat64()/(failRate/100)) * time.Second)
+		clk.Sleep(time.Duration(r.ExpFloat64()/(failRate/100)) * time.Second)
 
 		// 50/50 chance of a single node failure or a partition
-		if rand.Float64() < 0.5 {
+		if r.Float64() < 0.5 {
 			// Single node failure
 
-			id := int(rand.Float64() * float64(len(nodes)-1))
+			id := int(r.Float64() * float64(len(nodes)-1))
 
-			nodes[id].Incoming <- packet.Message{
-				DemuxKey: packet.ControlFail,
-			}
+			tr.sendControl(nodes[id], id, packet.ControlFail)
 
-			delay := rand.NormFloat64()*stddev + mean
+			delay := r.NormFloat64()*stddev + mean
 
-			go func(node *dbnode.Dbnode, delay time.Duration) {
-				time.Sleep(delay)
+			recoverAfter := time.Duration(delay) * time.Second
+			clk.Go(func() {
+				clk.Sleep(recoverAfter)
 
-				node.Incoming <- packet.Message{
-					DemuxKey: packet.ControlRecover,
-				}
-			}(nodes[id], time.Duration(delay)*time.Second)
+				tr.sendControl(nodes[id], id, packet.ControlRecover)
+			})
 		} else {
 			// Partition
 
@@ -251,59 +489,56 @@ func triggerNodeFailures(nodes []*dbnode.Dbnode, failRate, mean, variance float6
 			links := make(map[int]map[int]bool)
 
 			for i := 0; i < n; i++ {
-				s := rand.Intn(n)
-				d := rand.Intn(n)
-
-				if s < d {
-					l := links[s]
-					if l == nil {
-						l = make(map[int]bool)
-					}
-					l[d] = true
-					links[s] = l
-				} else {
-					l := links[d]
-					if l == nil {
-						l = make(map[int]bool)
-					}
-					l[s] = true
-					links[d] = l
-				}
+				s := r.Intn(n)
+				d := r.Intn(n)
+
+				// The link fails in one direction only with
+				// probability oneWay
+				addLink(links, s, d, oneWay > 0 && r.Float64() < oneWay)
 			}
 
-			fmt.Println("Partition created")
+			l.Emit(eventlog.PartitionCreated(links))
 
 			p.createPartition(links) // map[int]map[int]bool
 
-			delay := rand.NormFloat64()*stddev + mean
+			delay := r.NormFloat64()*stddev + mean
 
-			go func(links map[int]map[int]bool, delay time.Duration) {
-				time.Sleep(delay)
+			healAfter := time.Duration(delay) * time.Second
+			clk.Go(func() {
+				clk.Sleep(healAfter)
 
-				fmt.Println("Partition recovered")
+				l.Emit(eventlog.PartitionHealed(links))
 
 				p.removePartition(links)
-			}(links, time.Duration(delay)*time.Second)
+			})
 		}
 	}
 }
 
-func writeRequest(c *Client, l *logger, key, val []byte) {
-	startTime := l.timestamp()
+func writeRequest(c *Client, l *eventlog.Log, m *monitor, key, val []byte) {
+	txn := int(atomic.AddInt64(&txnCounter, 1))
+
+	startTime := l.Now()
+	l.Emit(eventlog.TxnStarted(txn, "write", key))
 	res, timestamp := c.Put(key, val)
-	l.log(startTime, fmt.Sprint("write ", key, val, timestamp, res))
+	l.Emit(eventlog.TxnEnded(txn, "write", key, val, timestamp, res.String(), startTime))
+	m.logTxn("write", res.String(), l.Now()-startTime)
 }
 
-func readRequest(c *Client, l *logger, key []byte) {
-	startTime := l.timestamp()
+func readRequest(c *Client, l *eventlog.Log, m *monitor, key []byte) {
+	txn := int(atomic.AddInt64(&txnCounter, 1))
+
+	startTime := l.Now()
+	l.Emit(eventlog.TxnStarted(txn, "read", key))
 	val, timestamp, ok := c.Get(key)
-	l.log(startTime, fmt.Sprint("read ", key, val, timestamp, ok))
+	l.Emit(eventlog.TxnEnded(txn, "read", key, val, timestamp, fmt.Sprint(ok), startTime))
+	m.logTxn("read", fmt.Sprint(ok), l.Now()-startTime)
 }
 
-func removeZeroBytes(b []byte) {
+func removeZeroBytes(b []byte, r *rand.Rand) {
 	for i := 0; i < len(b); i++ {
 		for b[i] == 0 {
-			rand.Read(b[i : i+1])
+			r.Read(b[i : i+1])
 		}
 	}
 }
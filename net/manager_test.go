@@ -0,0 +1,121 @@
+package net
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alexbostock/part-ii-project/datastore"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+	"github.com/alexbostock/part-ii-project/eventlog"
+)
+
+func TestSimulateDeterministic(t *testing.T) {
+	// Simulate logs to stdout
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+
+	dir := t.TempDir()
+	run := func(name string) []byte {
+		path := filepath.Join(dir, name)
+		if err := Simulate(simulationOptions(7, path)); err != nil {
+			t.Fatal("Failed to write the event log.", err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal("Failed to read the event log.", err)
+		}
+		return b
+	}
+
+	first := run("first.log")
+	second := run("second.log")
+
+	if len(first) == 0 {
+		t.Fatal("The simulation should log events.")
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("Simulations on a virtual clock with the same seed should log the same events.")
+	}
+}
+
+// simulationOptions returns the options of a short simulation on a virtual
+// clock, with some writes and failures and otherwise the defaults of main.go,
+// logging events to eventLog.
+func simulationOptions(seed int64, eventLog string) Options {
+	var (
+		numNodes        uint = 5
+		rate                 = 10.0
+		latencyMean          = 10.0
+		latencyVar           = 5.0
+		failureRate          = 5.0
+		failureMean          = 10.0
+		failureVar           = 5.0
+		numTransactions uint = 30
+		writes               = 0.3
+		store                = datastore.InMemory
+		quorumSize      uint = 3
+		numAttempts     uint = 1
+		no                   = false
+		yes                  = true
+		electorKind          = elector.Ring
+		empty                = ""
+		eventFormat          = eventlog.Text
+		latencyKind          = Normal
+		zero                 = 0.0
+		policy               = RandomCoordinator
+		maxBackoff           = 1000.0
+		readRepair           = dbnode.NoRepair
+		replicas        uint = 0
+		vnodes          uint = 64
+		spares          uint = 0
+	)
+
+	return Options{
+		NumNodes:                    &numNodes,
+		RandomSeed:                  &seed,
+		TransactionRate:             &rate,
+		MeanMsgLatency:              &latencyMean,
+		MsgLatencyVariance:          &latencyVar,
+		NodeFailureRate:             &failureRate,
+		MeanFailTime:                &failureMean,
+		FailTimeVariance:            &failureVar,
+		NumTransactions:             &numTransactions,
+		ProportionWriteTransactions: &writes,
+		PersistentStore:             &store,
+		ReadQuorumSize:              &quorumSize,
+		WriteQuorumSize:             &quorumSize,
+		NumAttempts:                 &numAttempts,
+		SloppyQuorum:                &no,
+		ConvergenceTest:             &no,
+		LogWrites:                   &no,
+		VirtualClock:                &yes,
+		Elector:                     &electorKind,
+		CheckLinearizability:        &no,
+		Scenario:                    &empty,
+		EventFormat:                 &eventFormat,
+		EventLog:                    &eventLog,
+		MetricsAddr:                 &empty,
+		AdminAddr:                   &empty,
+		LatencyDistribution:         &latencyKind,
+		LatencyMatrix:               &empty,
+		LossProbability:             &zero,
+		DuplicateProbability:        &zero,
+		ReorderProbability:          &zero,
+		OneWayProbability:           &zero,
+		Trace:                       &empty,
+		Replay:                      &empty,
+		CoordinatorPolicy:           &policy,
+		Backoff:                     &zero,
+		MaxBackoff:                  &maxBackoff,
+		AntiEntropyInterval:         &zero,
+		ReadRepair:                  &readRepair,
+		ReplicationFactor:           &replicas,
+		VirtualNodes:                &vnodes,
+		Spares:                      &spares,
+	}
+}
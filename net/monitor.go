@@ -1,92 +1,370 @@
 package net
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/alexbostock/part-ii-project/clock"
 	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/eventlog"
 	"github.com/alexbostock/part-ii-project/net/packet"
 )
 
+// A monitor observes the simulated network and the database nodes during a
+// simulation. It counts the messages of each type sent and dropped by the
+// network, samples the queues of every node once a second, and records the
+// time for which requests wait for locks and the latency of each client
+// transaction. The metrics can be served in the Prometheus text format (see
+// ServeHTTP), and a snapshot of them is logged as an event once a second.
+//
+// Every method of a nil *monitor does nothing, so that tests can run the
+// network without one.
 type monitor struct {
-	nodes      []*dbnode.Dbnode
-	msgTypes   map[int]map[packet.Messagetype]int // time -> Messagetype -> frequency
-	nodeStates map[int]map[int]int                // time -> txid -> frequency
+	// The last node is the client, which has no state to query
+	nodes []*dbnode.Dbnode
 
-	msgStream chan packet.Messagetype
+	lock       sync.Mutex
+	sent       map[packet.Messagetype]int
+	dropped    map[packet.Messagetype]int
+	incoming   []int // The number of messages in each node's Incoming buffer
+	lockQueue  []int // The number of requests waiting for locks on each node
+	txns       []int // The number of transactions in progress on each node
+	lockWait   *histogram
+	txnLatency map[txnKind]*histogram
 
-	ticker *time.Ticker
+	events *eventlog.Log
+
+	clock   clock.Clock
+	stopped *clock.Chan[bool]
+	done    *clock.Chan[bool]
+}
+
+// A txnKind is the label of a transaction latency: the type of transaction
+// (read or write) and its result.
+type txnKind struct {
+	op     string
+	result string
 }
 
-func newMonitor(nodes []*dbnode.Dbnode) *monitor {
+func newMonitor(nodes []*dbnode.Dbnode, events *eventlog.Log, clk clock.Clock) *monitor {
 	m := &monitor{
-		nodes:      nodes,
-		nodeStates: make(map[int]map[int]int),
-		msgTypes:   make(map[int]map[packet.Messagetype]int),
+		nodes: nodes,
 
-		msgStream: make(chan packet.Messagetype),
+		sent:       make(map[packet.Messagetype]int),
+		dropped:    make(map[packet.Messagetype]int),
+		incoming:   make([]int, len(nodes)),
+		lockQueue:  make([]int, len(nodes)-1),
+		txns:       make([]int, len(nodes)-1),
+		lockWait:   newHistogram(),
+		txnLatency: make(map[txnKind]*histogram),
 
-		ticker: time.NewTicker(time.Second),
+		events: events,
+
+		clock:   clk,
+		stopped: clock.NewChan[bool](clk, 0),
+		done:    clock.NewChan[bool](clk, 0),
 	}
 
-	go m.monitorMsgTypes()
-	go m.monitorNodeStates()
+	clk.Go(m.sampleNodes)
 
 	return m
 }
 
+// logMsg counts a message sent on the network.
 func (m *monitor) logMsg(msg packet.Message) {
-	m.msgStream <- msg.DemuxKey
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sent[msg.DemuxKey]++
 }
 
-func (m *monitor) monitorMsgTypes() {
-	counter := 0
-	ticker := time.NewTicker(time.Second)
+// logDrop counts a message which the network did not deliver, because of a
+// partition or because the destination's buffer was full.
+func (m *monitor) logDrop(msg packet.Message) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	m.msgTypes[counter] = make(map[packet.Messagetype]int)
+	m.dropped[msg.DemuxKey]++
+}
+
+// logTxn records the latency of a client transaction.
+func (m *monitor) logTxn(op, result string, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	k := txnKind{op, result}
+	h := m.txnLatency[k]
+	if h == nil {
+		h = newHistogram()
+		m.txnLatency[k] = h
+	}
+	h.observe(latency)
+}
+
+func (m *monitor) sampleNodes() {
+	defer m.done.Close()
 
 	for {
-		select {
-		case <-ticker.C:
-			counter++
-			m.msgTypes[counter] = make(map[packet.Messagetype]int)
-		case t := <-m.msgStream:
-			count := m.msgTypes[counter][t]
-			m.msgTypes[counter][t] = count + 1
+		if clock.Select(m.clock.After(time.Second).RecvCase(nil, nil), m.stopped.RecvCase(nil, nil)) == 1 {
+			return
 		}
+
+		m.sample()
+		m.events.Emit(eventlog.MetricsSnapshot(m.snapshot()))
 	}
 }
 
-func (m *monitor) monitorNodeStates() {
-	counter := 0
+// sample queries the state of every node.
+func (m *monitor) sample() {
+	stats := make([]dbnode.Stats, len(m.nodes)-1)
+	for i := range stats {
+		stats[i] = m.nodes[i].QueryStats()
+	}
 
-	for {
-		<-m.ticker.C
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, node := range m.nodes {
+		m.incoming[i] = node.Incoming.Len()
+	}
+
+	for i, s := range stats {
+		m.lockQueue[i] = s.LockQueue
+		m.txns[i] = s.Transactions
+		for _, wait := range s.LockWaits {
+			m.lockWait.observe(wait)
+		}
+	}
+}
+
+// stop stops sampling, then takes a final sample and logs a final snapshot.
+func (m *monitor) stop() {
+	if m == nil {
+		return
+	}
 
-		m.nodeStates[counter] = make(map[int]int)
+	m.stopped.Close()
+	m.done.Recv()
 
-		for i, node := range m.nodes {
-			if i == len(m.nodes)-1 {
-				continue
-			}
+	m.sample()
+	m.events.Emit(eventlog.MetricsSnapshot(m.snapshot()))
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (m *monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeMetrics(w)
+}
 
-			txid := node.QueryState()
+// A metric is a named set of samples, each identified by a suffix and labels,
+// as in the Prometheus text format. A histogram has a sample for each bucket,
+// its sum and its count.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples []sample
+}
+
+type sample struct {
+	suffix string
+	labels string
+	value  float64
+}
 
-			count := m.nodeStates[counter][txid]
-			m.nodeStates[counter][txid] = count + 1
+func (m *monitor) writeMetrics(w io.Writer) {
+	for _, metric := range m.metrics() {
+		fmt.Fprintf(w, "# HELP %v %v\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %v %v\n", metric.name, metric.kind)
+		for _, s := range metric.samples {
+			fmt.Fprintf(w, "%v%v%v %v\n", metric.name, s.suffix, s.labels, formatFloat(s.value))
 		}
+	}
+}
+
+// snapshot returns the value of every sample, by its name in the Prometheus
+// text format.
+func (m *monitor) snapshot() map[string]float64 {
+	values := make(map[string]float64)
 
-		counter++
+	for _, metric := range m.metrics() {
+		for _, s := range metric.samples {
+			values[metric.name+s.suffix+s.labels] = s.value
+		}
 	}
+
+	return values
 }
 
-func (m *monitor) stop() {
-	m.ticker.Stop()
+// metrics returns the current value of every metric, in a fixed order.
+func (m *monitor) metrics() []metric {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sent := metric{
+		name: "sim_messages_sent_total",
+		help: "Messages sent on the simulated network, by type.",
+		kind: "counter",
+	}
+	for _, t := range sortedTypes(m.sent) {
+		sent.samples = append(sent.samples, sample{"", labels("type", t.String()), float64(m.sent[t])})
+	}
+
+	dropped := metric{
+		name: "sim_messages_dropped_total",
+		help: "Messages dropped by the simulated network (by a partition or a full buffer), by type.",
+		kind: "counter",
+	}
+	for _, t := range sortedTypes(m.dropped) {
+		dropped.samples = append(dropped.samples, sample{"", labels("type", t.String()), float64(m.dropped[t])})
+	}
+
+	incoming := metric{
+		name: "sim_node_incoming_queue_depth",
+		help: "Messages waiting in each node's incoming buffer (the client is node n).",
+		kind: "gauge",
+	}
+	for i, depth := range m.incoming {
+		incoming.samples = append(incoming.samples, sample{"", labels("node", strconv.Itoa(i)), float64(depth)})
+	}
+
+	lockQueue := metric{
+		name: "sim_node_lock_queue_depth",
+		help: "Requests waiting for locks on each node.",
+		kind: "gauge",
+	}
+	txns := metric{
+		name: "sim_node_transactions",
+		help: "Transactions in progress on each node.",
+		kind: "gauge",
+	}
+	for i := range m.lockQueue {
+		lockQueue.samples = append(lockQueue.samples, sample{"", labels("node", strconv.Itoa(i)), float64(m.lockQueue[i])})
+		txns.samples = append(txns.samples, sample{"", labels("node", strconv.Itoa(i)), float64(m.txns[i])})
+	}
+
+	lockWait := metric{
+		name:    "sim_lock_wait_seconds",
+		help:    "Time for which requests waited for locks.",
+		kind:    "histogram",
+		samples: m.lockWait.samples(nil),
+	}
+
+	var kinds []txnKind
+	for k := range m.txnLatency {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].op < kinds[j].op || kinds[i].op == kinds[j].op && kinds[i].result < kinds[j].result
+	})
+
+	txnLatency := metric{
+		name: "sim_transaction_latency_seconds",
+		help: "Latency of client transactions, by type and result.",
+		kind: "histogram",
+	}
+	for _, k := range kinds {
+		txnLatency.samples = append(txnLatency.samples, m.txnLatency[k].samples([]string{"op", k.op, "result", k.result})...)
+	}
+
+	return []metric{sent, dropped, incoming, lockQueue, txns, lockWait, txnLatency}
+}
+
+func sortedTypes(counts map[packet.Messagetype]int) []packet.Messagetype {
+	var types []packet.Messagetype
+	for t := range counts {
+		types = append(types, t)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	return types
+}
+
+// labels formats pairs of label names and values, eg. {node="0"}.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	s := "{"
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			s += ","
+		}
+		s += pairs[i] + "=" + strconv.Quote(pairs[i+1])
+	}
+
+	return s + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// The upper bounds of the buckets of every histogram, in seconds
+var buckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A histogram counts durations in buckets, as a Prometheus histogram.
+type histogram struct {
+	counts []int // The number of observations in each bucket (not cumulative)
+	count  int
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]int, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+
+	h.count++
+	h.sum += s
+
+	for i, b := range buckets {
+		if s <= b {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// samples returns the cumulative count of each bucket, the sum and the count,
+// with the given label pairs.
+func (h *histogram) samples(pairs []string) []sample {
+	var samples []sample
+
+	cumulative := 0
+	for i, b := range buckets {
+		cumulative += h.counts[i]
+		samples = append(samples, sample{"_bucket", labels(append(pairs, "le", formatFloat(b))...), float64(cumulative)})
+	}
+	samples = append(samples, sample{"_bucket", labels(append(pairs, "le", "+Inf")...), float64(h.count)})
 
-	a, _ := json.Marshal(m.msgTypes)
-	b, _ := json.Marshal(m.nodeStates)
+	samples = append(samples, sample{"_sum", labels(pairs...), h.sum})
+	samples = append(samples, sample{"_count", labels(pairs...), float64(h.count)})
 
-	fmt.Println(string(a))
-	fmt.Println(string(b))
+	return samples
 }
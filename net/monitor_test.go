@@ -0,0 +1,106 @@
+package net
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/eventlog"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(time.Millisecond)
+	h.observe(30 * time.Millisecond)
+	h.observe(time.Minute)
+
+	s := h.samples([]string{"op", "read"})
+
+	if s[0].labels != `{op="read",le="0.001"}` || s[0].value != 1 {
+		t.Error("A duration equal to a bound should be counted in its bucket.", s[0])
+	}
+	if s[5].labels != `{op="read",le="0.05"}` || s[5].value != 2 {
+		t.Error("Bucket counts should be cumulative.", s[5])
+	}
+
+	inf := s[len(buckets)]
+	if inf.labels != `{op="read",le="+Inf"}` || inf.value != 3 {
+		t.Error("The +Inf bucket should count every observation.", inf)
+	}
+
+	sum, count := s[len(s)-2], s[len(s)-1]
+	if sum.suffix != "_sum" || math.Abs(sum.value-60.031) > 1e-9 {
+		t.Error("Incorrect histogram sum.", sum)
+	}
+	if count.suffix != "_count" || count.value != 3 {
+		t.Error("Incorrect histogram count.", count)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	p := newPartitions(numNodes)
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	var buf bytes.Buffer
+	events := eventlog.New(eventlog.NewSink(eventlog.JSON, &buf), clk)
+
+	nodes := newNodes(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+
+	m := newMonitor(nodes, events, clk)
+
+	for i := 0; i <= numNodes; i++ {
+		outgoing, seed := nodes[i].Outgoing, int64(i)
+		clk.Go(func() {
+			startHelper(outgoing, nodes, 0, 0, m, p, clk, seed)
+		})
+	}
+
+	client := NewClient(nodes, timeout, 1, clk)
+
+	key := []byte{1}
+	start := clk.Now()
+	res, _ := client.Put(key, []byte{2})
+	m.logTxn("write", res.String(), clk.Since(start))
+
+	m.stop()
+
+	var out bytes.Buffer
+	m.writeMetrics(&out)
+	metrics := out.String()
+
+	expected := []string{
+		"# TYPE sim_messages_sent_total counter\n",
+		`sim_messages_sent_total{type="clientWriteRequest"} `,
+		`sim_node_incoming_queue_depth{node="3"} 0` + "\n",
+		`sim_node_lock_queue_depth{node="0"} 0` + "\n",
+		`sim_node_transactions{node="2"} `,
+		"# TYPE sim_lock_wait_seconds histogram\n",
+		`sim_transaction_latency_seconds_count{op="write",result="` + res.String() + `"} 1` + "\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(metrics, e) {
+			t.Error("Missing metric.", e, metrics)
+		}
+	}
+
+	snapshot := m.snapshot()
+	if snapshot[`sim_messages_sent_total{type="clientWriteResponse"}`] < 1 {
+		t.Error("The response to the client should have been counted.", snapshot)
+	}
+	if snapshot["sim_lock_wait_seconds_count"] < 1 {
+		t.Error("The coordinator's lock wait should have been recorded.", snapshot)
+	}
+
+	if !strings.Contains(buf.String(), `"type":"metrics"`) {
+		t.Error("Stopping the monitor should log a snapshot.", buf.String())
+	}
+}
@@ -0,0 +1,221 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A NetworkModel decides when, and how many times, the simulated network
+// delivers each message.
+type NetworkModel interface {
+	// Delays returns the delay before each delivery of msg: none if it is
+	// lost, or more than one if it is duplicated. r is the pseudorandom
+	// source of the link on which msg is sent, so that delays do not depend
+	// on messages sent on other links.
+	Delays(msg packet.Message, r *rand.Rand) []time.Duration
+}
+
+// A LatencyKind is an enum indicating the distribution of message latencies.
+// Each is parameterised by its mean and variance (with a variance of 0, every
+// latency is the mean).
+// Normal: a normal distribution (negative latencies are delivered immediately).
+// LogNormal: a log-normal distribution, which is heavy-tailed.
+// Pareto: a Pareto distribution, which is heavier-tailed than LogNormal.
+type LatencyKind int
+
+const (
+	Normal LatencyKind = iota
+	LogNormal
+	Pareto
+)
+
+// A latencyModel delivers every message exactly once, after a latency drawn
+// from a distribution of the given kind, with the current mean and variance of
+// lat. If means is not nil, it overrides the mean of each link (means[s][d] is
+// the mean latency from node s to node d).
+type latencyModel struct {
+	kind  LatencyKind
+	lat   *latency
+	means [][]float64
+}
+
+func newLatencyModel(kind LatencyKind, lat *latency, means [][]float64) *latencyModel {
+	return &latencyModel{
+		kind:  kind,
+		lat:   lat,
+		means: means,
+	}
+}
+
+func (m *latencyModel) Delays(msg packet.Message, r *rand.Rand) []time.Duration {
+	mean, stddev := m.lat.get()
+	if msg.Src < len(m.means) && msg.Dest < len(m.means[msg.Src]) {
+		mean = m.means[msg.Src][msg.Dest]
+	}
+
+	var delay float64
+	switch m.kind {
+	case LogNormal:
+		delay = logNormal(r, mean, stddev)
+	case Pareto:
+		delay = pareto(r, mean, stddev)
+	default:
+		delay = r.NormFloat64()*stddev + mean
+	}
+
+	return []time.Duration{time.Duration(delay) * time.Millisecond}
+}
+
+// logNormal draws from the log-normal distribution with the given mean and
+// standard deviation.
+func logNormal(r *rand.Rand, mean, stddev float64) float64 {
+	if mean <= 0 || stddev <= 0 {
+		return math.Max(mean, 0)
+	}
+
+	sigma2 := math.Log(1 + stddev*stddev/(mean*mean))
+	mu := math.Log(mean) - sigma2/2
+
+	return math.Exp(mu + math.Sqrt(sigma2)*r.NormFloat64())
+}
+
+// pareto draws from the Pareto distribution with the given mean and standard
+// deviation, whose shape is chosen so that the variance is finite.
+func pareto(r *rand.Rand, mean, stddev float64) float64 {
+	if mean <= 0 || stddev <= 0 {
+		return math.Max(mean, 0)
+	}
+
+	alpha := 1 + math.Sqrt(1+mean*mean/(stddev*stddev))
+	scale := mean * (alpha - 1) / alpha
+
+	// 1 - Float64() is in (0, 1], so the result is finite
+	return scale / math.Pow(1-r.Float64(), 1/alpha)
+}
+
+// A faultyModel adds packet loss, duplication and reordering to another
+// NetworkModel. Each message is lost with probability loss, or else duplicated
+// with probability duplicate (each copy with its own latency). Each delivery is
+// held back with probability reorder, by a uniformly random extra delay of up
+// to 10 times the mean latency, so that later messages may overtake it.
+type faultyModel struct {
+	NetworkModel
+
+	loss      float64
+	duplicate float64
+	reorder   float64
+
+	lat *latency
+}
+
+func (m *faultyModel) Delays(msg packet.Message, r *rand.Rand) []time.Duration {
+	if r.Float64() < m.loss {
+		return nil
+	}
+
+	delays := m.NetworkModel.Delays(msg, r)
+	if r.Float64() < m.duplicate {
+		delays = append(delays, m.NetworkModel.Delays(msg, r)...)
+	}
+
+	mean, _ := m.lat.get()
+	for i := range delays {
+		if r.Float64() < m.reorder {
+			delays[i] += time.Duration(r.Float64() * 10 * mean * float64(time.Millisecond))
+		}
+	}
+
+	return delays
+}
+
+// newNetworkModel creates the NetworkModel for a simulation, with latencies of
+// the given kind drawn using lat (and the per-link means in means, if not nil).
+// Faults are only added if some probability is non-zero, so that the latencies
+// drawn on each link are otherwise unchanged.
+func newNetworkModel(kind LatencyKind, lat *latency, means [][]float64, loss, duplicate, reorder float64) NetworkModel {
+	var model NetworkModel = newLatencyModel(kind, lat, means)
+
+	if loss > 0 || duplicate > 0 || reorder > 0 {
+		model = &faultyModel{
+			NetworkModel: model,
+			loss:         loss,
+			duplicate:    duplicate,
+			reorder:      reorder,
+			lat:          lat,
+		}
+	}
+
+	return model
+}
+
+// loadLatencyMatrix reads a matrix of mean latencies in ms from a JSON file,
+// eg. [[0, 5, 80], [5, 0, 80], [80, 80, 0]]. Row s is the latencies of messages
+// sent by node s. The matrix has a row and column for each of numNodes nodes,
+// and optionally the client (node numNodes), whose links otherwise use the
+// mean latency.
+func loadLatencyMatrix(path string, numNodes int) ([][]float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var means [][]float64
+	if err := json.Unmarshal(b, &means); err != nil {
+		return nil, err
+	}
+
+	if len(means) != numNodes && len(means) != numNodes+1 {
+		return nil, fmt.Errorf("Expected %v or %v rows", numNodes, numNodes+1)
+	}
+
+	for _, row := range means {
+		if len(row) != len(means) {
+			return nil, errors.New("Matrix is not square")
+		}
+		for _, mean := range row {
+			if mean < 0 {
+				return nil, errors.New("Negative latency")
+			}
+		}
+	}
+
+	return means, nil
+}
+
+// String converts a LatencyKind to a string
+func (k LatencyKind) String() string {
+	switch k {
+	case Normal:
+		return "normal"
+	case LogNormal:
+		return "lognormal"
+	case Pareto:
+		return "pareto"
+	default:
+		return "UNKNOWN_LATENCY_KIND"
+	}
+}
+
+// Set parses a LatencyKind, so that a LatencyKind can be used as a command line
+// flag.
+func (k *LatencyKind) Set(s string) error {
+	switch s {
+	case "normal":
+		*k = Normal
+	case "lognormal":
+		*k = LogNormal
+	case "pareto":
+		*k = Pareto
+	default:
+		return errors.New("Unknown latency distribution (expected normal, lognormal or pareto)")
+	}
+
+	return nil
+}
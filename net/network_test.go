@@ -0,0 +1,132 @@
+package net
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+func TestLatencyModel(t *testing.T) {
+	lat := newLatency(20, 100)
+	msg := packet.Message{Src: 0, Dest: 1}
+
+	for _, kind := range []LatencyKind{Normal, LogNormal, Pareto} {
+		model := newLatencyModel(kind, lat, nil)
+		r := rand.New(rand.NewSource(1))
+
+		var sum, sumSquares float64
+		n := 100000
+		for i := 0; i < n; i++ {
+			delays := model.Delays(msg, r)
+			if len(delays) != 1 {
+				t.Fatal("Every message should be delivered once.", delays)
+			}
+
+			d := float64(delays[0]) / float64(time.Millisecond)
+			sum += d
+			sumSquares += d * d
+		}
+
+		// Delays are truncated to whole ms, so are on average 0.5ms less
+		// than the latency drawn
+		mean := sum / float64(n)
+		if math.Abs(mean+0.5-20) > 0.5 {
+			t.Error("Incorrect mean latency.", kind, mean)
+		}
+
+		if kind != Pareto {
+			stddev := math.Sqrt(sumSquares/float64(n) - mean*mean)
+			if math.Abs(stddev-10) > 0.5 {
+				t.Error("Incorrect latency standard deviation.", kind, stddev)
+			}
+		}
+	}
+
+	lat.set(20, 0)
+	for _, kind := range []LatencyKind{Normal, LogNormal, Pareto} {
+		model := newLatencyModel(kind, lat, nil)
+		if d := model.Delays(msg, rand.New(rand.NewSource(1)))[0]; d != 20*time.Millisecond {
+			t.Error("With no variance, every latency should be the mean.", kind, d)
+		}
+	}
+
+	model := newLatencyModel(Normal, lat, [][]float64{{0, 5}, {5, 0}})
+	if d := model.Delays(msg, rand.New(rand.NewSource(1)))[0]; d != 5*time.Millisecond {
+		t.Error("A latency matrix should override the mean.", d)
+	}
+	if d := model.Delays(packet.Message{Src: 2, Dest: 0}, rand.New(rand.NewSource(1)))[0]; d != 20*time.Millisecond {
+		t.Error("Links not in the matrix should use the mean.", d)
+	}
+}
+
+func TestFaultyModel(t *testing.T) {
+	lat := newLatency(10, 0)
+	model := newNetworkModel(Normal, lat, nil, 0.1, 0.2, 0.3)
+	r := rand.New(rand.NewSource(1))
+
+	counts := make(map[int]int)
+	reordered := 0
+
+	n := 100000
+	for i := 0; i < n; i++ {
+		delays := model.Delays(packet.Message{}, r)
+		counts[len(delays)]++
+
+		for _, d := range delays {
+			if d < 10*time.Millisecond || d > 110*time.Millisecond {
+				t.Fatal("Delay out of range.", d)
+			}
+			if d > 10*time.Millisecond {
+				reordered++
+			}
+		}
+	}
+
+	expected := map[int]float64{0: 0.1, 1: 0.9 * 0.8, 2: 0.9 * 0.2}
+	for k, p := range expected {
+		if math.Abs(float64(counts[k])/float64(n)-p) > 0.01 {
+			t.Error("Incorrect proportion of messages delivered.", k, counts[k])
+		}
+	}
+
+	deliveries := counts[1] + 2*counts[2]
+	if math.Abs(float64(reordered)/float64(deliveries)-0.3) > 0.01 {
+		t.Error("Incorrect proportion of messages held back.", reordered, deliveries)
+	}
+
+	if _, ok := newNetworkModel(Normal, lat, nil, 0, 0, 0).(*latencyModel); !ok {
+		t.Error("Faults should only be added if some probability is non-zero.")
+	}
+}
+
+func TestLoadLatencyMatrix(t *testing.T) {
+	dir := t.TempDir()
+
+	contents := map[string]bool{
+		`[[0, 1], [1, 0]]`:                     true,
+		`[[0, 1, 2], [1, 0, 2], [2, 2, 0]]`:    true,
+		`[[0]]`:                                false,
+		`[[0, 1], [1]]`:                        false,
+		`[[0, -1], [1, 0]]`:                    false,
+		`{"0": [0, 1]}`:                        false,
+		`[[0, 1, 2, 3], [1, 0, 2], [2, 2, 0]]`: false,
+	}
+
+	for c, valid := range contents {
+		path := filepath.Join(dir, "matrix.json")
+		os.WriteFile(path, []byte(c), 0644)
+
+		_, err := loadLatencyMatrix(path, 2)
+		if valid && err != nil {
+			t.Error("Failed to load a valid matrix.", c, err)
+		}
+		if !valid && err == nil {
+			t.Error("Loaded an invalid matrix.", c)
+		}
+	}
+}
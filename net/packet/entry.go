@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"encoding/binary"
+)
+
+// An Entry is one key, value pair, along with the Lamport timestamp of the
+// value. Lists of entries are encoded in the Value of messages which refer to
+// several keys (see EncodeEntries):
+// Scans: the results of a scan. Nodes include tombstones in a
+// NodeScanResponse, so that the coordinator can tell which keys have been
+// deleted, but never in a ClientScanResponse.
+// Transactions: the keys written by a multi-key transaction (see
+// ClientTxnRequest).
+type Entry struct {
+	Key       []byte
+	Value     []byte
+	Timestamp uint64
+	Tombstone bool
+}
+
+// Entry format (all integers big endian), repeated for every entry:
+// key_length(4) key timestamp(8) tombstone(1) value_length(4) value
+
+// EncodeEntries encodes a list of entries, for use as the Value of a
+// message.
+func EncodeEntries(entries []Entry) []byte {
+	var size int
+	for _, e := range entries {
+		size += 4 + len(e.Key) + 8 + 1 + 4 + len(e.Value)
+	}
+
+	b := make([]byte, 0, size)
+	for _, e := range entries {
+		var buf [8]byte
+
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(e.Key)))
+		b = append(b, buf[:4]...)
+		b = append(b, e.Key...)
+
+		binary.BigEndian.PutUint64(buf[:], e.Timestamp)
+		b = append(b, buf[:]...)
+
+		if e.Tombstone {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(e.Value)))
+		b = append(b, buf[:4]...)
+		b = append(b, e.Value...)
+	}
+
+	return b
+}
+
+// DecodeEntries decodes a list of entries produced by EncodeEntries. It
+// returns ErrMalformed if b is not a valid encoding.
+func DecodeEntries(b []byte) ([]Entry, error) {
+	var entries []Entry
+
+	for len(b) > 0 {
+		var e Entry
+		var err error
+
+		if e.Key, b, err = readField(b); err != nil {
+			return nil, err
+		}
+
+		if len(b) < 9 || b[8] > 1 {
+			return nil, ErrMalformed
+		}
+		e.Timestamp = binary.BigEndian.Uint64(b[:8])
+		e.Tombstone = b[8] == 1
+		b = b[9:]
+
+		if e.Value, b, err = readField(b); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
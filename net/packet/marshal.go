@@ -0,0 +1,193 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+)
+
+// Version is the current version of the wire format produced by Marshal.
+const Version = 2
+
+// Wire format, version 1 (all integers big endian):
+// version(1) length(4) id(8) src(8) dest(8) demux_key(4) timestamp(8) flags(1)
+// key_length(4) key value_length(4) value checksum(4)
+// length is the length of the entire encoding, including the version byte and
+// the checksum. checksum is the CRC-32 (Castagnoli) of every preceding byte.
+// Id, Src and Dest are two's complement. Bit 0 of flags is Ok, and bit 1 is
+// Tombstone. Other bits must be 0. (Tombstone was added after the first
+// decoders, which only accept flags of 0 or 1, so they reject tombstones rather
+// than misreading them as values.)
+//
+// Version 2 is the same as version 1, but with token(8) after flags. Marshal
+// only uses version 2 for messages with a non-zero Token, so that version 1
+// decoders can still read every other message. A version 2 encoding with a
+// token of 0 is malformed, so that every message has exactly one encoding.
+
+const (
+	headerSize   = 1 + 4 + 8 + 8 + 8 + 4 + 8 + 1
+	tokenSize    = 8
+	checksumSize = 4
+	minSize      = headerSize + 4 + 4 + checksumSize
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Errors returned by Unmarshal.
+var (
+	ErrUnsupportedVersion = errors.New("Unsupported message format version")
+	ErrTruncated          = errors.New("Encoded message truncated")
+	ErrLength             = errors.New("Encoded message length mismatch")
+	ErrChecksum           = errors.New("Encoded message checksum mismatch")
+	ErrMalformed          = errors.New("Malformed encoded message")
+)
+
+// Errors returned by Marshal.
+var (
+	ErrDemuxKey = errors.New("Message type out of range of the wire format")
+	ErrTooLarge = errors.New("Message too large for the wire format")
+)
+
+const (
+	flagOk        = 1 << 0
+	flagTombstone = 1 << 1
+)
+
+// Marshal encodes a Message in the current version of the wire format. It
+// returns an error if a field does not fit in the format, rather than
+// truncating it.
+func (m Message) Marshal() ([]byte, error) {
+	version := byte(1)
+	header := headerSize
+	if m.Token != 0 {
+		version = 2
+		header += tokenSize
+	}
+
+	if uint64(m.DemuxKey) > math.MaxUint32 {
+		return nil, ErrDemuxKey
+	}
+
+	size := minSize + header - headerSize + len(m.Key) + len(m.Value)
+	if uint64(size) > math.MaxUint32 {
+		return nil, ErrTooLarge
+	}
+	b := make([]byte, size)
+
+	b[0] = version
+	binary.BigEndian.PutUint32(b[1:5], uint32(size))
+	binary.BigEndian.PutUint64(b[5:13], uint64(int64(m.Id)))
+	binary.BigEndian.PutUint64(b[13:21], uint64(int64(m.Src)))
+	binary.BigEndian.PutUint64(b[21:29], uint64(int64(m.Dest)))
+	binary.BigEndian.PutUint32(b[29:33], uint32(m.DemuxKey))
+	binary.BigEndian.PutUint64(b[33:41], m.Timestamp)
+	if m.Ok {
+		b[41] |= flagOk
+	}
+	if m.Tombstone {
+		b[41] |= flagTombstone
+	}
+	if m.Token != 0 {
+		binary.BigEndian.PutUint64(b[42:50], m.Token)
+	}
+
+	i := header
+	binary.BigEndian.PutUint32(b[i:i+4], uint32(len(m.Key)))
+	i += 4
+	i += copy(b[i:], m.Key)
+
+	binary.BigEndian.PutUint32(b[i:i+4], uint32(len(m.Value)))
+	i += 4
+	i += copy(b[i:], m.Value)
+
+	binary.BigEndian.PutUint32(b[i:], crc32.Checksum(b[:i], crcTable))
+
+	return b, nil
+}
+
+// Unmarshal decodes a Message produced by Marshal. b must contain exactly one
+// encoded message. It returns an error if b is not a valid encoding, in which
+// case the returned Message should be ignored. Key and Value never alias b, and
+// are nil if empty.
+func Unmarshal(b []byte) (m Message, err error) {
+	if len(b) < 1 {
+		return m, ErrTruncated
+	}
+	if b[0] != 1 && b[0] != 2 {
+		return m, ErrUnsupportedVersion
+	}
+
+	header := headerSize
+	if b[0] == 2 {
+		header += tokenSize
+	}
+
+	if len(b) < minSize+header-headerSize {
+		return m, ErrTruncated
+	}
+
+	size := binary.BigEndian.Uint32(b[1:5])
+	if uint64(size) != uint64(len(b)) {
+		return m, ErrLength
+	}
+
+	body := b[:len(b)-checksumSize]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(b[len(body):]) {
+		return m, ErrChecksum
+	}
+
+	if b[41]&^(flagOk|flagTombstone) != 0 {
+		return m, ErrMalformed
+	}
+
+	m.Id = int(int64(binary.BigEndian.Uint64(b[5:13])))
+	m.Src = int(int64(binary.BigEndian.Uint64(b[13:21])))
+	m.Dest = int(int64(binary.BigEndian.Uint64(b[21:29])))
+	m.DemuxKey = Messagetype(binary.BigEndian.Uint32(b[29:33]))
+	m.Timestamp = binary.BigEndian.Uint64(b[33:41])
+	m.Ok = b[41]&flagOk != 0
+	m.Tombstone = b[41]&flagTombstone != 0
+
+	if b[0] == 2 {
+		m.Token = binary.BigEndian.Uint64(b[42:50])
+		if m.Token == 0 {
+			return Message{}, ErrMalformed
+		}
+	}
+
+	rest := body[header:]
+
+	if m.Key, rest, err = readField(rest); err != nil {
+		return Message{}, err
+	}
+	if m.Value, rest, err = readField(rest); err != nil {
+		return Message{}, err
+	}
+	if len(rest) > 0 {
+		return Message{}, ErrMalformed
+	}
+
+	return m, nil
+}
+
+// readField reads one length-prefixed byte string from the start of b. It
+// returns a copy of the string (nil if empty) and the remainder of b.
+func readField(b []byte) (field, rest []byte, err error) {
+	if len(b) < 4 {
+		return nil, nil, ErrMalformed
+	}
+
+	n := binary.BigEndian.Uint32(b[:4])
+	b = b[4:]
+	if uint64(n) > uint64(len(b)) {
+		return nil, nil, ErrMalformed
+	}
+
+	if n > 0 {
+		field = make([]byte, n)
+		copy(field, b[:n])
+	}
+
+	return field, b[n:], nil
+}
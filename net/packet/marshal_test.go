@@ -0,0 +1,188 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"testing"
+)
+
+var testMessages = []Message{
+	{},
+	{
+		Id:        42,
+		Src:       3,
+		Dest:      1,
+		DemuxKey:  ClientWriteRequest,
+		Key:       []byte{1, 2, 3},
+		Value:     []byte{4, 5, 6, 7, 8, 9},
+		Timestamp: 7,
+		Ok:        true,
+	},
+	{
+		Id:        -1,
+		Src:       0,
+		Dest:      -1,
+		DemuxKey:  ElectionElect,
+		Value:     []byte("001002"),
+		Timestamp: 1<<64 - 1,
+	},
+	{
+		Id:        7,
+		DemuxKey:  NodePutRequest,
+		Key:       []byte{1},
+		Timestamp: 3,
+		Ok:        true,
+		Tombstone: true,
+	},
+	{
+		Id:        8,
+		Src:       2,
+		Dest:      4,
+		DemuxKey:  NodeLockRequestNoTimeout,
+		Value:     []byte{1, 2},
+		Timestamp: 5,
+		Ok:        true,
+		Token:     1<<64 - 1,
+	},
+}
+
+func TestEntriesRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{Key: []byte{1}, Value: []byte{2, 3}, Timestamp: 4},
+		{Key: []byte{5, 6}, Timestamp: 1<<64 - 1, Tombstone: true},
+	}
+
+	decoded, err := DecodeEntries(EncodeEntries(entries))
+	if err != nil || len(decoded) != len(entries) {
+		t.Fatal("Decoding entries failed.", decoded, err)
+	}
+	for i := range entries {
+		if !bytes.Equal(entries[i].Key, decoded[i].Key) ||
+			!bytes.Equal(entries[i].Value, decoded[i].Value) ||
+			entries[i].Timestamp != decoded[i].Timestamp ||
+			entries[i].Tombstone != decoded[i].Tombstone {
+			t.Error("Round trip changed entry.", entries[i], decoded[i])
+		}
+	}
+
+	if _, err := DecodeEntries(EncodeEntries(entries)[:10]); err != ErrMalformed {
+		t.Error("Truncated entries should be malformed.", err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, msg := range testMessages {
+		encoded := marshal(t, msg)
+
+		decoded, err := Unmarshal(encoded)
+		if err != nil {
+			t.Error("Unmarshal failed for a valid encoding.", msg, err)
+		}
+		if !MessagesEqual(msg, decoded) || msg.Timestamp != decoded.Timestamp || msg.Ok != decoded.Ok || msg.Tombstone != decoded.Tombstone || msg.Token != decoded.Token {
+			t.Error("Round trip changed message.", msg, decoded)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	if _, err := (Message{DemuxKey: math.MaxUint32 + 1}).Marshal(); err != ErrDemuxKey {
+		t.Error("A message type which does not fit in 32 bits should not be truncated.", err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	encoded := marshal(t, testMessages[1])
+
+	if _, err := Unmarshal(nil); err != ErrTruncated {
+		t.Error("Empty input should be truncated.", err)
+	}
+
+	if _, err := Unmarshal(encoded[:len(encoded)-1]); err != ErrLength {
+		t.Error("Missing bytes should be a length mismatch.", err)
+	}
+
+	wrongVersion := append([]byte{}, encoded...)
+	wrongVersion[0] = Version + 1
+	if _, err := Unmarshal(wrongVersion); err != ErrUnsupportedVersion {
+		t.Error("Unknown version should be rejected.", err)
+	}
+
+	corrupt := append([]byte{}, encoded...)
+	corrupt[headerSize+5] ^= 0xff
+	if _, err := Unmarshal(corrupt); err != ErrChecksum {
+		t.Error("Corrupted key should fail the checksum.", err)
+	}
+
+	if encoded[0] != 1 || marshal(t, testMessages[4])[0] != 2 {
+		t.Error("Only messages with a token should use version 2.")
+	}
+
+	// A version 2 encoding of a token of 0 is not canonical
+	zeroToken := marshal(t, testMessages[4])
+	for i := headerSize; i < headerSize+tokenSize; i++ {
+		zeroToken[i] = 0
+	}
+	binary.BigEndian.PutUint32(zeroToken[len(zeroToken)-checksumSize:], crc32.Checksum(zeroToken[:len(zeroToken)-checksumSize], crcTable))
+	if _, err := Unmarshal(zeroToken); err != ErrMalformed {
+		t.Error("A token of 0 should not use version 2.", err)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, msg := range testMessages {
+		f.Add(marshal(f, msg))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{Version, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Unmarshal(b)
+		if err != nil {
+			return
+		}
+
+		// Every valid encoding is canonical
+		if !bytes.Equal(marshal(t, msg), b) {
+			t.Error("Re-encoding a decoded message changed it.", b, msg)
+		}
+	})
+}
+
+func FuzzMarshal(f *testing.F) {
+	for _, msg := range testMessages {
+		f.Add(msg.Id, msg.Src, msg.Dest, uint(msg.DemuxKey), msg.Key, msg.Value, msg.Timestamp, msg.Ok, msg.Token)
+	}
+
+	f.Fuzz(func(t *testing.T, id, src, dest int, demuxKey uint, key, value []byte, timestamp uint64, ok bool, token uint64) {
+		msg := Message{
+			Id:        id,
+			Src:       src,
+			Dest:      dest,
+			DemuxKey:  Messagetype(uint32(demuxKey)),
+			Key:       key,
+			Value:     value,
+			Timestamp: timestamp,
+			Ok:        ok,
+			Token:     token,
+		}
+
+		decoded, err := Unmarshal(marshal(t, msg))
+		if err != nil {
+			t.Fatal("Unmarshal failed for a valid encoding.", err)
+		}
+		if !MessagesEqual(msg, decoded) || msg.Timestamp != decoded.Timestamp || msg.Ok != decoded.Ok || msg.Token != decoded.Token {
+			t.Error("Round trip changed message.", msg, decoded)
+		}
+	})
+}
+
+// marshal encodes m, failing the test if it cannot be encoded.
+func marshal(t testing.TB, m Message) []byte {
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal("Marshal failed for a valid message.", m, err)
+	}
+	return b
+}
@@ -52,6 +52,50 @@ const (
 
 	ControlFail
 	ControlRecover
+
+	// Types added since version 1 of the wire format are appended here, so
+	// that the values of existing types do not change.
+
+	ClientScanRequest // Key is the start of the range, Value is the end (empty for unbounded)
+	ClientScanResponse
+	NodeScanRequest
+	NodeScanResponse
+
+	ClientDeleteRequest       // Blind delete (the response is a ClientWriteResponse)
+	NodeGarbageCollectRequest // Remove a tombstone from the store (the response is a NodePutResponse)
+	InternalGarbageCollect    // Start garbage collection of the tombstone for Key at Timestamp
+
+	ClientTxnRequest        // Multi-key write: Value is a list of Entry (the response is a ClientWriteResponse)
+	NodeTxnTimestampRequest // Timestamps of every key in a ClientTxnRequest (the response is a NodeGetResponse)
+	NodeTxnPutRequest       // Stage every write in a transaction (the response is a NodePutResponse)
+
+	ElectionLeaseRequest  // Request a lease as leader, with fencing token Timestamp
+	ElectionLeaseResponse // Ok iff the lease was granted; Timestamp is the highest token granted
+
+	InternalSync    // Start an anti-entropy round with a random peer
+	NodeSyncRequest // Anti-entropy: Value is a list of the sender's Merkle tree hashes to compare
+	NodeSyncEntries // Anti-entropy: Key is a list of Merkle tree leaves, and Value every Entry in them; Ok iff the receiver should reply with its own
+
+	NodeRepairRequest  // Read repair: store Value (or a tombstone) at Timestamp, if newer
+	NodeRepairResponse // Ok iff the receiver has the repaired value (or a newer one)
+
+	InternalSubstitute  // Replace every replica which has not answered a lock request for write Id
+	NodeHintRequest     // Hold every Entry in Value for node Timestamp, which missed the write
+	NodeHandoffRequest  // Store every Entry in Value, which the receiver missed, if newer
+	NodeHandoffResponse // Value is every Entry accepted (without values)
+
+	ClientMembershipRequest  // Add node Timestamp to the cluster, or remove it if Tombstone
+	ClientMembershipResponse // Ok iff the change was made; Value is the new configuration, of version Timestamp
+	InternalMembership       // Value is the new members of the election
+	NodeConfigPrepare        // Promise ballot Token for configuration version Timestamp; Value is the sender's configuration
+	NodeConfigPromise        // Ok iff promised (else Timestamp is the ballot promised); Value is the configuration accepted with ballot Timestamp (if any)
+	NodeConfigAccept         // Accept Value as configuration version Timestamp, with ballot Token
+	NodeConfigAccepted       // Ok iff accepted (else Timestamp is the ballot promised)
+	NodeConfigCommit         // Value is a configuration agreed as version Timestamp
+	NodeConfigRecover        // Ask the leader to finish agreeing configuration version Timestamp
+	NodeCatchUpRequest       // Send every committed Entry in the store, once no transaction from before configuration version Timestamp is in progress
+	NodeCatchUpResponse      // Ok iff Value is every committed Entry in the sender's store
+	NodeCaughtUp             // The sender, a new member, stores every write agreed before configuration version Timestamp
 )
 
 // A Message represents 1 simulated network message.
@@ -62,8 +106,11 @@ const (
 // DemuxKey: the type of message (see MessageType)
 // Key: a database key
 // Value: a database value
-// Timestamp: a Lamport clock value for a database value
+// Timestamp: a Lamport clock value for a database value (or, in election
+// messages, a term)
 // Ok: false iff an error has occurred
+// Tombstone: true iff the key was deleted at Timestamp (so there is no Value)
+// Token: the fencing token of the leader which sent a write request (0 if none)
 type Message struct {
 	Id        int
 	Src       int
@@ -73,6 +120,8 @@ type Message struct {
 	Value     []byte
 	Timestamp uint64
 	Ok        bool
+	Tombstone bool
+	Token     uint64
 }
 
 // String converts a MessageType to a string
@@ -108,6 +157,10 @@ func (m Messagetype) String() string {
 		return "nodePutResponse"
 	case NodeTimestampRequest:
 		return "nodeTimestampRequest"
+	case NodeBackgroundWriteRequest:
+		return "nodeBackgroundWriteRequest"
+	case NodeBackgroundWriteResponse:
+		return "nodeBackgroundWriteResponse"
 	case ElectionElect:
 		return "electionElect"
 	case ElectionCoordinator:
@@ -118,6 +171,78 @@ func (m Messagetype) String() string {
 		return "internalTimerSignal"
 	case InternalHeartbeat:
 		return "internalHeartbeat"
+	case InternalLeaderQuery:
+		return "internalLeaderQuery"
+	case ControlFail:
+		return "controlFail"
+	case ControlRecover:
+		return "controlRecover"
+	case ClientScanRequest:
+		return "clientScanRequest"
+	case ClientScanResponse:
+		return "clientScanResponse"
+	case NodeScanRequest:
+		return "nodeScanRequest"
+	case NodeScanResponse:
+		return "nodeScanResponse"
+	case ClientDeleteRequest:
+		return "clientDeleteRequest"
+	case NodeGarbageCollectRequest:
+		return "nodeGarbageCollectRequest"
+	case InternalGarbageCollect:
+		return "internalGarbageCollect"
+	case ClientTxnRequest:
+		return "clientTxnRequest"
+	case NodeTxnTimestampRequest:
+		return "nodeTxnTimestampRequest"
+	case NodeTxnPutRequest:
+		return "nodeTxnPutRequest"
+	case ElectionLeaseRequest:
+		return "electionLeaseRequest"
+	case ElectionLeaseResponse:
+		return "electionLeaseResponse"
+	case InternalSync:
+		return "internalSync"
+	case NodeSyncRequest:
+		return "nodeSyncRequest"
+	case NodeSyncEntries:
+		return "nodeSyncEntries"
+	case NodeRepairRequest:
+		return "nodeRepairRequest"
+	case NodeRepairResponse:
+		return "nodeRepairResponse"
+	case InternalSubstitute:
+		return "internalSubstitute"
+	case NodeHintRequest:
+		return "nodeHintRequest"
+	case NodeHandoffRequest:
+		return "nodeHandoffRequest"
+	case NodeHandoffResponse:
+		return "nodeHandoffResponse"
+	case ClientMembershipRequest:
+		return "clientMembershipRequest"
+	case ClientMembershipResponse:
+		return "clientMembershipResponse"
+	case InternalMembership:
+		return "internalMembership"
+	case NodeConfigPrepare:
+		return "nodeConfigPrepare"
+	case NodeConfigPromise:
+		return "nodeConfigPromise"
+	case NodeConfigAccept:
+		return "nodeConfigAccept"
+	case NodeConfigAccepted:
+		return "nodeConfigAccepted"
+	case NodeConfigCommit:
+		return "nodeConfigCommit"
+	case NodeConfigRecover:
+		return "nodeConfigRecover"
+	case NodeCatchUpRequest:
+		return "nodeCatchUpRequest"
+	case NodeCatchUpResponse:
+		return "nodeCatchUpResponse"
+	case NodeCaughtUp:
+		return "nodeCaughtUp"
 	default:
 		return "UNKNOWN_MESSAGE_TYPE"
 	}
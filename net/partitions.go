@@ -2,51 +2,99 @@ package net
 
 import "sync"
 
+// partitions tracks the links of the simulated network which are unavailable.
+// Links are directed, so a link may fail in one direction only (node s cannot
+// send to node d, but d can still send to s). Sets of links are represented as
+// maps, source -> dest -> true. Partitions may overlap, so each link counts the
+// partitions which include it, and is only available again once all of them
+// have been removed.
 type partitions struct {
-	unavailableLinks map[int]map[int]bool
-	// node -> node -> unavailable?
-	// 1st node id <= 2nd node id
+	unavailableLinks map[int]map[int]int
+	// source -> dest -> number of partitions including the link
 
 	lock sync.RWMutex
 }
 
 func newPartitions(n int) *partitions {
 	p := &partitions{
-		unavailableLinks: make(map[int]map[int]bool),
+		unavailableLinks: make(map[int]map[int]int),
 	}
 
 	for i := 0; i <= n; i++ {
-		p.unavailableLinks[i] = make(map[int]bool)
+		p.unavailableLinks[i] = make(map[int]int)
 	}
 
 	return p
 }
 
+// linkAvailable returns true iff node s can send messages to node d.
 func (p *partitions) linkAvailable(s, d int) bool {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 
-	return !p.unavailableLinks[s][d]
+	return p.unavailableLinks[s][d] == 0
 }
 
+// createPartition makes every link in links unavailable, until the same set of
+// links is passed to removePartition.
 func (p *partitions) createPartition(links map[int]map[int]bool) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
 	for source, dests := range links {
 		for dest := range dests {
-			p.unavailableLinks[source][dest] = true
+			p.unavailableLinks[source][dest]++
 		}
 	}
 }
 
+// removePartition removes a partition made by createPartition. Links which are
+// also part of another partition remain unavailable.
 func (p *partitions) removePartition(links map[int]map[int]bool) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
 	for source, dests := range links {
 		for dest := range dests {
-			delete(p.unavailableLinks[source], dest)
+			if p.unavailableLinks[source][dest] > 0 {
+				p.unavailableLinks[source][dest]--
+			}
+			if p.unavailableLinks[source][dest] == 0 {
+				delete(p.unavailableLinks[source], dest)
+			}
 		}
 	}
 }
+
+// addLink adds the link from s to d to a set of links, and also the link from
+// d to s unless oneWay.
+func addLink(links map[int]map[int]bool, s, d int, oneWay bool) {
+	if links[s] == nil {
+		links[s] = make(map[int]bool)
+	}
+	links[s][d] = true
+
+	if !oneWay {
+		addLink(links, d, s, true)
+	}
+}
+
+// takeLinks removes every link in links from held, and returns the links which
+// were removed. Sources with no links left are removed from held.
+func takeLinks(held, links map[int]map[int]bool) map[int]map[int]bool {
+	taken := make(map[int]map[int]bool)
+
+	for source, dests := range links {
+		for dest := range dests {
+			if held[source][dest] {
+				delete(held[source], dest)
+				addLink(taken, source, dest, true)
+			}
+		}
+		if len(held[source]) == 0 {
+			delete(held, source)
+		}
+	}
+
+	return taken
+}
@@ -0,0 +1,183 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+)
+
+func TestOneWayPartitions(t *testing.T) {
+	p := newPartitions(3)
+
+	oneWay := event{Action: "partition", Groups: [][]int{{0}, {1, 2}}, OneWay: true}
+	p.createPartition(oneWay.links())
+
+	if p.linkAvailable(0, 1) || p.linkAvailable(0, 2) {
+		t.Error("The first group should not be able to send to the second.")
+	}
+	if !p.linkAvailable(1, 0) || !p.linkAvailable(2, 0) || !p.linkAvailable(1, 2) || !p.linkAvailable(0, 3) {
+		t.Error("Only links from the first group to the second should be unavailable.")
+	}
+
+	symmetric := event{Action: "partition", Groups: [][]int{{0}, {1, 2}}}
+	p.createPartition(symmetric.links())
+	if p.linkAvailable(1, 0) || p.linkAvailable(2, 0) {
+		t.Error("A partition should make links unavailable in both directions.")
+	}
+
+	p.removePartition(oneWay.links())
+	if p.linkAvailable(0, 1) || p.linkAvailable(1, 0) {
+		t.Error("Healing a one-way partition should not heal links of the symmetric partition.")
+	}
+
+	p.removePartition(symmetric.links())
+	if !p.linkAvailable(0, 1) || !p.linkAvailable(1, 0) {
+		t.Error("Healing both partitions should heal links in both directions.")
+	}
+}
+
+func TestOverlappingPartitions(t *testing.T) {
+	p := newPartitions(3)
+
+	first := event{Action: "partition", Groups: [][]int{{0}, {1, 2}}}
+	second := event{Action: "partition", Groups: [][]int{{0, 1}, {2}}}
+	p.createPartition(first.links())
+	p.createPartition(second.links())
+
+	p.removePartition(first.links())
+	if p.linkAvailable(0, 2) || p.linkAvailable(2, 1) {
+		t.Error("Links of a partition which has not been healed should remain unavailable.")
+	}
+	if !p.linkAvailable(0, 1) || !p.linkAvailable(1, 0) {
+		t.Error("Links only in a healed partition should be available.")
+	}
+
+	p.removePartition(second.links())
+	if !p.linkAvailable(0, 2) || !p.linkAvailable(2, 1) {
+		t.Error("Every link should be available once every partition is healed.")
+	}
+}
+
+// mute makes every link from node unavailable, so that it can receive
+// messages but not send them.
+func mute(p *partitions, node, numNodes int) map[int]map[int]bool {
+	links := make(map[int]map[int]bool)
+	for i := 0; i <= numNodes; i++ {
+		if i != node {
+			addLink(links, node, i, true)
+		}
+	}
+
+	p.createPartition(links)
+	return links
+}
+
+func TestOneWayParticipant(t *testing.T) {
+	numNodes := 5
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	nodes, p := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+	client := NewClient(nodes, timeout, 3, clk)
+
+	if res, _ := client.Put([]byte{1}, []byte{1}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	// A participant which can receive lock requests, but whose responses
+	// are lost, locks keys for the coordinator without taking part
+	leader := nodes[0].QueryStatus().Leader
+	participant := (leader + 1) % numNodes
+	links := mute(p, participant, numNodes)
+
+	succeeded := false
+	for i := 0; i < 3 && !succeeded; i++ {
+		res, _ := client.Put([]byte{1}, []byte{2})
+		succeeded = res == Success
+	}
+	if !succeeded {
+		t.Error("A write quorum is available, so writes should succeed.")
+	}
+
+	// The coordinator still releases the participant's locks
+	deadline := clk.Now().Add(5 * time.Second)
+	for nodes[participant].QueryStatus().Transactions > 0 {
+		if clk.Now().After(deadline) {
+			t.Fatal("The participant did not release its locks.", nodes[participant].QueryStatus())
+		}
+		clk.Sleep(10 * time.Millisecond)
+	}
+
+	p.removePartition(links)
+	if res, _ := client.Put([]byte{1}, []byte{3}); res != Success {
+		t.Error("Write transaction failed after healing.", res)
+	}
+}
+
+func TestOneWayLeader(t *testing.T) {
+	numNodes := 5
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	// The ring elector only replaces a leader which fails to respond to
+	// election messages, so a leader which can still receive is never
+	// replaced, and every write fails
+	nodes, p := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+	client := NewClient(nodes, timeout, 1, clk)
+	if res, _ := client.Put([]byte{1}, []byte{1}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	leader := nodes[0].QueryStatus().Leader
+	mute(p, leader, numNodes)
+
+	if res, _ := client.Put([]byte{1}, []byte{2}); res == Success {
+		t.Error("A leader which cannot send should not complete a write.")
+	}
+	for i := 0; i < numNodes; i++ {
+		if l := nodes[i].QueryStatus().Leader; l != leader {
+			t.Error("The ring elector should not replace a leader which can receive.", i, l)
+		}
+	}
+
+	stopCluster(nodes)
+
+	// In Raft, followers which stop receiving heartbeats elect a new
+	// leader, which the old leader accepts since it can still receive
+	nodes, p = startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Elector: elector.Raft}, clk)
+	client = NewClient(nodes, timeout, 5, clk)
+	if res, _ := client.Put([]byte{1}, []byte{1}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	leader = nodes[0].QueryStatus().Leader
+	mute(p, leader, numNodes)
+
+	deadline := clk.Now().Add(5 * time.Second)
+	for {
+		newLeader := nodes[(leader+1)%numNodes].QueryStatus().Leader
+		agreed := newLeader != leader && newLeader != -1
+		for i := 0; i < numNodes; i++ {
+			agreed = agreed && nodes[i].QueryStatus().Leader == newLeader
+		}
+
+		if agreed {
+			break
+		}
+		if clk.Now().After(deadline) {
+			t.Fatal("Raft did not elect a new leader.")
+		}
+		clk.Sleep(10 * time.Millisecond)
+	}
+
+	if res, _ := client.Put([]byte{1}, []byte{2}); res != Success {
+		t.Error("Writes should succeed with the new leader.", res)
+	}
+}
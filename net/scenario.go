@@ -0,0 +1,252 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A scenario is a list of events to run at fixed times during a simulation, to
+// reproduce a particular sequence of failures. It is read from a JSON file, eg.
+//
+//	{"events": [
+//		{"at": "5s", "action": "fail", "node": 2},
+//		{"at": "8s", "action": "recover", "node": 2},
+//		{"at": "10s", "action": "partition", "groups": [[0, 1], [2, 3, 4]]},
+//		{"at": "20s", "action": "heal"},
+//		{"at": "22s", "action": "partition", "groups": [[0], [1, 2, 3, 4]], "oneway": true},
+//		{"at": "25s", "action": "latency", "mean": 50, "variance": 10},
+//		{"at": "30s", "action": "join", "node": 5},
+//		{"at": "40s", "action": "leave", "node": 0}
+//	]}
+type scenario struct {
+	Events []event `json:"events"`
+}
+
+// An event is a single step of a scenario.
+// Fields:
+// At: the time of the event, since the start of the simulation
+// Action: one of fail, recover, partition, heal, latency, join or leave
+// Node: the node to fail, recover, join or leave (a join or leave waits for the
+// cluster to respond, so delays later events)
+// Groups: for partition, sets of nodes which cannot send messages to nodes in
+// other sets (the client is node n); for heal, the partition to heal, of those
+// made by the scenario (every partition made by the scenario if empty)
+// OneWay: for partition and heal, if true, nodes in each group cannot send
+// messages to nodes in later groups, but can still receive messages from them
+// Mean, Variance: for latency, the new network message latency in ms
+type event struct {
+	At       duration `json:"at"`
+	Action   string   `json:"action"`
+	Node     int      `json:"node"`
+	Groups   [][]int  `json:"groups"`
+	OneWay   bool     `json:"oneway"`
+	Mean     float64  `json:"mean"`
+	Variance float64  `json:"variance"`
+}
+
+// A duration is a time.Duration which is written in JSON as a string, eg. "1.5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+// loadScenario reads a scenario from a file, for a system of numNodes nodes,
+// and sorts its events by time.
+func loadScenario(path string, numNodes int) (*scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	var s scenario
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
+	}
+
+	for i, e := range s.Events {
+		if err := e.validate(numNodes); err != nil {
+			return nil, fmt.Errorf("Event %v: %v", i, err)
+		}
+	}
+
+	sort.SliceStable(s.Events, func(i, j int) bool {
+		return s.Events[i].At < s.Events[j].At
+	})
+
+	return &s, nil
+}
+
+func (e event) validate(numNodes int) error {
+	if e.At < 0 {
+		return errors.New("Negative time")
+	}
+
+	switch e.Action {
+	case "fail", "recover", "join", "leave":
+		if e.Node < 0 || e.Node >= numNodes {
+			return errors.New("No such node")
+		}
+	case "partition", "heal":
+		if e.Action == "partition" && len(e.Groups) < 2 {
+			return errors.New("A partition needs at least 2 groups")
+		}
+
+		seen := make(map[int]bool)
+		for _, g := range e.Groups {
+			for _, node := range g {
+				if node < 0 || node > numNodes {
+					return errors.New("No such node")
+				}
+				if seen[node] {
+					return errors.New("Node in more than one group")
+				}
+				seen[node] = true
+			}
+		}
+	case "latency":
+		if e.Mean < 0 {
+			return errors.New("Negative latency")
+		}
+		if e.Variance < 0 {
+			return errors.New("Negative latency variance")
+		}
+	default:
+		return errors.New("Unknown action (expected fail, recover, partition, heal, latency, join or leave)")
+	}
+
+	if e.OneWay && e.Action != "partition" && e.Action != "heal" {
+		return errors.New("Only a partition or heal can be one-way")
+	}
+
+	return nil
+}
+
+// links returns every link between nodes in different groups of a partition
+// (only those from earlier to later groups, if one-way), in the form used by
+// partitions.
+func (e event) links() map[int]map[int]bool {
+	links := make(map[int]map[int]bool)
+
+	for i, g := range e.Groups {
+		for _, h := range e.Groups[i+1:] {
+			for _, s := range g {
+				for _, d := range h {
+					addLink(links, s, d, e.OneWay)
+				}
+			}
+		}
+	}
+
+	return links
+}
+
+// runScenario runs each event of s at its time, measured from when it is
+// called. Joins and leaves are requested through c.
+func runScenario(s *scenario, nodes []*dbnode.Dbnode, c *Client, p *partitions, lat *latency, l *eventlog.Log, tr *tracer, clk clock.Clock) {
+	start := clk.Now()
+
+	var partitioned []map[int]map[int]bool
+
+	for _, e := range s.Events {
+		if wait := time.Duration(e.At) - clk.Since(start); wait > 0 {
+			clk.Sleep(wait)
+		}
+
+		switch e.Action {
+		case "fail":
+			tr.sendControl(nodes[e.Node], e.Node, packet.ControlFail)
+		case "recover":
+			tr.sendControl(nodes[e.Node], e.Node, packet.ControlRecover)
+		case "join":
+			c.Join(e.Node)
+		case "leave":
+			c.Leave(e.Node)
+		case "partition":
+			links := e.links()
+			partitioned = append(partitioned, links)
+
+			l.Emit(eventlog.PartitionCreated(links))
+
+			p.createPartition(links)
+		case "heal":
+			if len(e.Groups) > 0 {
+				// Only heal links of partitions made by this
+				// scenario, which other partitions may share
+				links := e.links()
+				for _, held := range partitioned {
+					if taken := takeLinks(held, links); len(taken) > 0 {
+						l.Emit(eventlog.PartitionHealed(taken))
+						p.removePartition(taken)
+					}
+				}
+			} else {
+				for _, links := range partitioned {
+					if len(links) > 0 {
+						l.Emit(eventlog.PartitionHealed(links))
+						p.removePartition(links)
+					}
+				}
+				partitioned = nil
+			}
+		case "latency":
+			lat.set(e.Mean, e.Variance)
+		}
+	}
+}
+
+// A latency is the distribution of network message latencies in ms, which a
+// scenario may change during a simulation.
+type latency struct {
+	mean   float64
+	stddev float64
+
+	lock sync.RWMutex
+}
+
+func newLatency(mean, variance float64) *latency {
+	l := &latency{}
+	l.set(mean, variance)
+	return l
+}
+
+func (l *latency) get() (mean, stddev float64) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.mean, l.stddev
+}
+
+func (l *latency) set(mean, variance float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.mean = mean
+	l.stddev = math.Sqrt(variance)
+}
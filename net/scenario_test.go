@@ -0,0 +1,90 @@
+package net
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alexbostock/part-ii-project/clock"
+)
+
+func TestLoadScenario(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.json")
+	os.WriteFile(valid, []byte(`{"events": [
+		{"at": "2s", "action": "heal"},
+		{"at": "1s", "action": "partition", "groups": [[0, 1], [2, 3]]},
+		{"at": "500ms", "action": "fail", "node": 2},
+		{"at": "3s", "action": "leave", "node": 0}
+	]}`), 0644)
+
+	s, err := loadScenario(valid, 3)
+	if err != nil {
+		t.Fatal("Failed to load a valid scenario.", err)
+	}
+	if len(s.Events) != 4 || s.Events[0].Action != "fail" || s.Events[2].Action != "heal" {
+		t.Error("Events should be sorted by time.", s.Events)
+	}
+
+	invalid := []string{
+		`{"events": [{"at": "1s", "action": "explode"}]}`,
+		`{"events": [{"at": "1s", "action": "fail", "node": 3}]}`,
+		`{"events": [{"at": "1s", "action": "join", "node": -1}]}`,
+		`{"events": [{"at": "1s", "action": "partition", "groups": [[0, 1]]}]}`,
+		`{"events": [{"at": "1s", "action": "partition", "groups": [[0, 1], [1, 2]]}]}`,
+		`{"events": [{"at": "soon", "action": "heal"}]}`,
+		`{"events": [{"at": "1s", "action": "heal", "nodes": [1]}]}`,
+		`{"events": [{"at": "1s", "action": "fail", "node": 1, "oneway": true}]}`,
+		`{"events": [{"at": "1s", "action": "latency", "mean": -5}]}`,
+	}
+	for i, contents := range invalid {
+		path := filepath.Join(dir, "invalid.json")
+		os.WriteFile(path, []byte(contents), 0644)
+
+		if _, err := loadScenario(path, 3); err == nil {
+			t.Error("Invalid scenario was loaded.", i, contents)
+		}
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+	p := newPartitions(3)
+	lat := newLatency(10, 0)
+
+	s := &scenario{Events: []event{
+		{Action: "partition", Groups: [][]int{{0, 3}, {1, 2}}},
+		{Action: "latency", Mean: 20, Variance: 4},
+	}}
+	runScenario(s, nil, nil, p, lat, nil, nil, clock.NewReal())
+
+	if p.linkAvailable(0, 1) || p.linkAvailable(1, 3) || !p.linkAvailable(0, 3) || !p.linkAvailable(1, 2) {
+		t.Error("Partition should split the groups, and only the groups.")
+	}
+	if mean, stddev := lat.get(); mean != 20 || stddev != 2 {
+		t.Error("Latency was not changed.", mean, stddev)
+	}
+
+	runScenario(&scenario{Events: []event{{Action: "heal"}}}, nil, nil, p, lat, nil, nil, clock.NewReal())
+	if p.linkAvailable(0, 1) {
+		t.Error("Heal without groups should only heal partitions made by the same scenario.")
+	}
+
+	// The first scenario still holds the link from 1 to 3
+	s = &scenario{Events: []event{
+		{Action: "partition", Groups: [][]int{{0, 1}, {3}}},
+		{Action: "heal", Groups: [][]int{{0, 1}, {3}}},
+	}}
+	runScenario(s, nil, nil, p, lat, nil, nil, clock.NewReal())
+	if !p.linkAvailable(0, 3) || !p.linkAvailable(3, 0) {
+		t.Error("Heal with groups should heal that partition.")
+	}
+	if p.linkAvailable(1, 3) {
+		t.Error("Heal should not heal links of other partitions.")
+	}
+
+	runScenario(&scenario{Events: []event{{Action: "heal", Groups: [][]int{{0, 3}, {1, 2}}}}}, nil, nil, p, lat, nil, nil, clock.NewReal())
+	if p.linkAvailable(0, 1) {
+		t.Error("Heal with groups should only heal partitions made by the same scenario.")
+	}
+}
@@ -0,0 +1,243 @@
+package net
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Policy is an enum indicating how a Client picks the coordinator of each
+// attempt at a transaction. Whatever the policy, a retry never picks a node
+// already tried in the same transaction, unless every node has been tried, and
+// a transaction on a single key only picks replicas of the key (when keys are
+// partitioned).
+// RandomCoordinator: a uniformly random node.
+// RoundRobin: each node in turn.
+// StickyLeader: the node which coordinated the last successful transaction.
+// Writes are forwarded to the leader (when there is one), so this is usually
+// the leader (or, if keys are partitioned, a replica of the key written).
+// After a failure, or before any success, a random node.
+// LeastLatency: the node with the lowest average response time observed (a
+// timeout counts as a response time of the client's timeout), trying nodes
+// not yet observed first. Occasionally a random node, so that the average of
+// a node which has recovered from a failure is updated.
+type Policy int
+
+const (
+	RandomCoordinator Policy = iota
+	RoundRobin
+	StickyLeader
+	LeastLatency
+)
+
+// The proportion of LeastLatency picks which are random
+const explorationRate = 0.1
+
+// Errors returned by pick.
+var (
+	errNoCoordinator = errors.New("No node is eligible to coordinate")
+)
+
+// A selector picks coordinators for a Client, and waits between attempts.
+// Fields:
+// policy: how coordinators are picked
+// backoff, maxBackoff: before the ith retry of a transaction, the selector
+// waits for a uniformly random time up to backoff * 2^(i-1), capped at
+// maxBackoff (no time, if backoff is 0)
+// next: the next node for RoundRobin
+// sticky: the node for StickyLeader (-1 if none)
+// latencies: the moving average response time of each node, for LeastLatency
+// (0 if not yet observed)
+// random: the source of random picks and backoff delays
+type selector struct {
+	lock sync.Mutex
+
+	numNodes int
+	policy   Policy
+
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	next      int
+	sticky    int
+	latencies []time.Duration
+
+	random *rand.Rand
+}
+
+func newSelector(numNodes int) *selector {
+	return &selector{
+		numNodes:  numNodes,
+		sticky:    -1,
+		latencies: make([]time.Duration, numNodes),
+		random:    rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// pick returns the coordinator of the next attempt at a transaction, given the
+// nodes already tried and the nodes eligible to coordinate (nil if every node
+// is eligible), or errNoCoordinator if no node is eligible.
+func (s *selector) pick(tried map[int]bool, eligible []int) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.numNodes == 0 || (eligible != nil && len(eligible) == 0) {
+		return -1, errNoCoordinator
+	}
+
+	tried = s.skipped(tried, eligible)
+
+	switch s.policy {
+	case RoundRobin:
+		for {
+			dest := s.next
+			s.next = (s.next + 1) % s.numNodes
+			if !tried[dest] {
+				return dest, nil
+			}
+		}
+	case StickyLeader:
+		if s.sticky >= 0 && !tried[s.sticky] {
+			return s.sticky, nil
+		}
+	case LeastLatency:
+		if s.random.Float64() >= explorationRate {
+			best := -1
+			for i, l := range s.latencies {
+				if tried[i] {
+					continue
+				}
+				if l == 0 {
+					return i, nil
+				}
+				if best < 0 || l < s.latencies[best] {
+					best = i
+				}
+			}
+			return best, nil
+		}
+	}
+
+	dest := int(s.random.Float64() * float64(s.numNodes-len(tried)))
+	for i := 0; i < s.numNodes; i++ {
+		if tried[i] {
+			continue
+		}
+		if dest == 0 {
+			return i, nil
+		}
+		dest--
+	}
+
+	return -1, errNoCoordinator
+}
+
+// skipped returns the nodes which pick must not return: every node tried, and
+// every node not eligible. If every eligible node has been tried, only the
+// nodes not eligible are skipped.
+func (s *selector) skipped(tried map[int]bool, eligible []int) map[int]bool {
+	if eligible == nil {
+		if len(tried) >= s.numNodes {
+			return nil
+		}
+		return tried
+	}
+
+	skip := make(map[int]bool)
+	for i := 0; i < s.numNodes; i++ {
+		skip[i] = true
+	}
+
+	untried := false
+	for _, node := range eligible {
+		delete(skip, node)
+		untried = untried || !tried[node]
+	}
+
+	if untried {
+		for node := range tried {
+			skip[node] = true
+		}
+	}
+
+	return skip
+}
+
+// observe records the outcome of an attempt coordinated by dest: the time it
+// took, and whether it succeeded. src is the node which responded, which may
+// not be dest if the request was forwarded (to the leader).
+func (s *selector) observe(dest, src int, d time.Duration, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if l := s.latencies[dest]; l == 0 {
+		s.latencies[dest] = d
+	} else {
+		s.latencies[dest] = l + (d-l)/5
+	}
+
+	if ok && src < s.numNodes {
+		s.sticky = src
+	} else if dest == s.sticky {
+		s.sticky = -1
+	}
+}
+
+// delay returns how long to wait before the given attempt at a transaction
+// (attempt 0 is the first).
+func (s *selector) delay(attempt int) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if attempt == 0 || s.backoff <= 0 {
+		return 0
+	}
+
+	limit := s.backoff
+	for i := 1; i < attempt && limit < s.maxBackoff; i++ {
+		limit *= 2
+	}
+	if limit > s.maxBackoff {
+		limit = s.maxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+
+	return time.Duration(s.random.Int63n(int64(limit) + 1))
+}
+
+// String converts a Policy to a string
+func (p Policy) String() string {
+	switch p {
+	case RandomCoordinator:
+		return "random"
+	case RoundRobin:
+		return "roundrobin"
+	case StickyLeader:
+		return "leader"
+	case LeastLatency:
+		return "leastlatency"
+	default:
+		return "UNKNOWN_POLICY"
+	}
+}
+
+// Set parses a Policy, so that a Policy can be used as a command line flag.
+func (p *Policy) Set(s string) error {
+	switch s {
+	case "random":
+		*p = RandomCoordinator
+	case "roundrobin":
+		*p = RoundRobin
+	case "leader":
+		*p = StickyLeader
+	case "leastlatency":
+		*p = LeastLatency
+	default:
+		return errors.New("Unknown coordinator policy (expected random, roundrobin, leader or leastlatency)")
+	}
+
+	return nil
+}
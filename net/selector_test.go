@@ -0,0 +1,210 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+func TestPolicies(t *testing.T) {
+	numNodes := 5
+
+	s := newSelector(numNodes)
+	tried := make(map[int]bool)
+	for i := 0; i < numNodes; i++ {
+		dest := mustPick(t, s, tried, nil)
+		if tried[dest] {
+			t.Error("A retry should not pick a node already tried.", dest, tried)
+		}
+		tried[dest] = true
+	}
+	if dest := mustPick(t, s, tried, nil); dest < 0 || dest >= numNodes {
+		t.Error("Once every node has been tried, any node may be picked.", dest)
+	}
+
+	s.policy = RoundRobin
+	for i := 0; i < 2*numNodes; i++ {
+		if dest := mustPick(t, s, nil, nil); dest != i%numNodes {
+			t.Error("Incorrect round robin coordinator.", i, dest)
+		}
+	}
+	if dest := mustPick(t, s, map[int]bool{0: true, 1: true}, nil); dest != 2 {
+		t.Error("Round robin should skip nodes already tried.", dest)
+	}
+
+	s.policy = StickyLeader
+	s.observe(1, 3, time.Millisecond, true)
+	for i := 0; i < 10; i++ {
+		if dest := mustPick(t, s, nil, nil); dest != 3 {
+			t.Error("Coordinator should be the node which last succeeded.", dest)
+		}
+	}
+	if dest := mustPick(t, s, map[int]bool{3: true}, nil); dest == 3 {
+		t.Error("A retry should not pick a node already tried.", dest)
+	}
+	s.observe(3, -1, time.Second, false)
+	if s.sticky != -1 {
+		t.Error("A failure should unstick the coordinator.", s.sticky)
+	}
+
+	s = newSelector(numNodes)
+	s.policy = LeastLatency
+	for i := 0; i < numNodes; i++ {
+		s.observe(i, i, time.Duration(10-i)*time.Millisecond, true)
+	}
+	s.observe(4, -1, time.Second, false)
+
+	counts := make([]int, numNodes)
+	for i := 0; i < 1000; i++ {
+		counts[mustPick(t, s, nil, nil)]++
+	}
+	if counts[3] < 800 {
+		t.Error("Most coordinators should be the fastest node.", counts)
+	}
+	if counts[4] == 0 {
+		t.Error("A slow node should occasionally be tried again.", counts)
+	}
+}
+
+func TestNoCoordinator(t *testing.T) {
+	s := newSelector(3)
+	for _, policy := range []Policy{RandomCoordinator, RoundRobin, StickyLeader, LeastLatency} {
+		s.policy = policy
+		if dest, err := s.pick(nil, []int{}); err != errNoCoordinator {
+			t.Error("No node should be picked if none is eligible.", policy, dest, err)
+		}
+	}
+}
+
+// Only members coordinate, even if other nodes are replicas of the key.
+func TestCoordinatorMembers(t *testing.T) {
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	nodes := make([]*dbnode.Dbnode, 4)
+	for i := range nodes {
+		nodes[i] = &dbnode.Dbnode{Incoming: clock.NewChan[packet.Message](clk, 0)}
+	}
+
+	client := NewClient(nodes, time.Second, 1, clk)
+	client.SetMembers([]int{0, 1})
+	client.SetPolicy(RoundRobin)
+
+	for i := 0; i < 5; i++ {
+		if dest, err := client.coordinator(0, make(map[int]bool), nil); err != nil || dest > 1 {
+			t.Error("A node which is not a member should not coordinate.", dest, err)
+		}
+		if dest, err := client.coordinator(0, make(map[int]bool), []int{1, 2}); err != nil || dest != 1 {
+			t.Error("Only a replica which is a member should coordinate.", dest, err)
+		}
+	}
+
+	if dest, err := client.coordinator(0, make(map[int]bool), []int{2}); err != errNoCoordinator {
+		t.Error("No node should coordinate if no replica is a member.", dest, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := newSelector(1)
+	for i := 0; i < 5; i++ {
+		if d := s.delay(i); d != 0 {
+			t.Error("Retries should be immediate without backoff.", d)
+		}
+	}
+
+	s.backoff = 10 * time.Millisecond
+	s.maxBackoff = 50 * time.Millisecond
+
+	limits := []time.Duration{0, 10, 20, 40, 50, 50}
+	for i, limit := range limits {
+		var max time.Duration
+		for j := 0; j < 1000; j++ {
+			d := s.delay(i)
+			if d < 0 || d > limit*time.Millisecond {
+				t.Error("Backoff out of range.", i, d)
+			}
+			if d > max {
+				max = d
+			}
+		}
+		if max < limit*time.Millisecond/2 {
+			t.Error("Backoff should be jittered up to its limit.", i, max)
+		}
+	}
+}
+
+// A client using StickyLeader sends every write to the leader, once it has
+// found it.
+func TestStickyLeader(t *testing.T) {
+	numNodes := 5
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	nodes, _ := startCluster(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{}, clk)
+	client := NewClient(nodes, timeout, 1, clk)
+	client.SetPolicy(StickyLeader)
+
+	if res, _ := client.Put([]byte{1}, []byte{1}); res != Success {
+		t.Fatal("Write transaction failed.", res)
+	}
+
+	leader := nodes[0].QueryStatus().Leader
+	if client.selector.sticky != leader {
+		t.Error("The client should stick to the leader.", client.selector.sticky, leader)
+	}
+
+	for i := 0; i < 5; i++ {
+		if dest := mustPick(t, client.selector, nil, nil); dest != leader {
+			t.Error("Writes should be sent to the leader.", dest, leader)
+		}
+	}
+}
+
+// With backoff, a client waits between attempts at a transaction.
+func TestClientBackoff(t *testing.T) {
+	numNodes := 3
+	timeout := 100 * time.Millisecond
+	clk := clock.NewVirtual()
+	defer clk.Stop()
+
+	nodes := make([]*dbnode.Dbnode, numNodes+1)
+	for i := range nodes {
+		// Nothing receives the client's requests, so every attempt times out
+		nodes[i] = &dbnode.Dbnode{
+			Incoming: clock.NewChan[packet.Message](clk, 100),
+			Outgoing: clock.NewChan[packet.Message](clk, 100),
+		}
+	}
+
+	client := NewClient(nodes, timeout, 3, clk)
+	client.SetBackoff(time.Second, time.Second)
+
+	start := clk.Now()
+	if _, _, ok := client.Get([]byte{1}); ok {
+		t.Fatal("Read transaction should time out.")
+	}
+
+	if d := clk.Since(start); d < 3*3*timeout || d > 3*3*timeout+2*time.Second {
+		t.Error("Incorrect time taken with backoff.", d)
+	}
+	for i := 0; i < numNodes; i++ {
+		if nodes[i].Outgoing.Len() != 1 {
+			t.Error("Each attempt should be sent to a different node.", i, nodes[i].Outgoing.Len())
+		}
+	}
+}
+
+// mustPick returns s.pick(tried, eligible), failing the test if no node is
+// picked.
+func mustPick(t testing.TB, s *selector, tried map[int]bool, eligible []int) int {
+	dest, err := s.pick(tried, eligible)
+	if err != nil {
+		t.Fatal("No coordinator picked.", err)
+	}
+	return dest
+}
@@ -0,0 +1,358 @@
+package net
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// A trace records every message handled by the simulated network, so that the
+// deliveries can be replayed into fresh nodes (see replayTrace). A trace file
+// is a traceHeader followed by a traceRecord for each delivery or drop, as
+// JSON lines, in the order in which they happened.
+//
+// Messages are delivered to each node in the order recorded, and control
+// messages (node failures and recoveries) are recorded as deliveries. Signals
+// which nodes send directly to themselves (timers), rather than through the
+// network, are not recorded, since a node replaying a trace sends them itself.
+// So a replay only follows the trace exactly if timers fire at the same times,
+// which is most likely using a virtual clock.
+type traceHeader struct {
+	Version int `json:"version"`
+	Nodes   int `json:"nodes"`
+}
+
+const traceVersion = 1
+
+// A traceRecord is one message delivered or dropped by the network.
+// Fields:
+// Sent: the time at which the message was sent (µs since the start)
+// At: the time at which the message was delivered or dropped
+// Dropped: why the message was dropped (partition, loss or full, if the
+// destination's buffer was full), or empty if it was delivered
+// Src, Dest, Type: copied from Msg, to make traces easier to read
+// Msg: the message, in the wire format (see packet.Message.Marshal)
+type traceRecord struct {
+	Sent    int64  `json:"sent"`
+	At      int64  `json:"at"`
+	Dropped string `json:"dropped,omitempty"`
+	Src     int    `json:"src"`
+	Dest    int    `json:"dest"`
+	Type    string `json:"type"`
+	Msg     []byte `json:"msg"`
+}
+
+// A tracer writes a trace. Every method of a nil *tracer does nothing (except
+// delivering messages), so that the network can run without one. If writing
+// the trace fails, the tracer stops recording, and close returns the error.
+type tracer struct {
+	lock sync.Mutex
+	w    *bufio.Writer
+	enc  *json.Encoder
+
+	closed bool
+	err    error
+
+	startTime time.Time
+	clock     clock.Clock
+}
+
+func newTracer(w io.Writer, numNodes int, clk clock.Clock) *tracer {
+	bw := bufio.NewWriter(w)
+
+	tr := &tracer{
+		w:   bw,
+		enc: json.NewEncoder(bw),
+
+		startTime: clk.Now(),
+		clock:     clk,
+	}
+
+	tr.encode(traceHeader{traceVersion, numNodes})
+
+	return tr
+}
+
+// now returns the time since the trace started.
+func (tr *tracer) now() time.Duration {
+	if tr == nil {
+		return 0
+	}
+
+	return tr.clock.Since(tr.startTime)
+}
+
+// deliver sends msg on link, unless link's buffer is full, and records
+// whether it did. It returns true iff msg was delivered.
+func (tr *tracer) deliver(msg packet.Message, link *clock.Chan[packet.Message], sent time.Duration) bool {
+	if tr != nil {
+		// Hold the lock while delivering, so that messages are recorded in
+		// the order in which they were delivered
+		tr.lock.Lock()
+		defer tr.lock.Unlock()
+	}
+
+	if link.TrySend(msg) {
+		tr.write(msg, sent, "")
+		return true
+	}
+
+	tr.write(msg, sent, "full")
+	return false
+}
+
+// sendControl sends a control message to a node, and records it.
+func (tr *tracer) sendControl(node *dbnode.Dbnode, id int, msgType packet.Messagetype) {
+	msg := packet.Message{
+		Src:      id,
+		Dest:     id,
+		DemuxKey: msgType,
+	}
+
+	// Sending may block, so must not hold the lock
+	node.Incoming.Send(msg)
+
+	if tr != nil {
+		tr.lock.Lock()
+		defer tr.lock.Unlock()
+	}
+
+	tr.write(msg, tr.now(), "")
+}
+
+// drop records that msg, sent at the given time, was dropped.
+func (tr *tracer) drop(msg packet.Message, sent time.Duration, reason string) {
+	if tr == nil {
+		return
+	}
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	tr.write(msg, sent, reason)
+}
+
+// write records msg. The caller must hold tr.lock.
+func (tr *tracer) write(msg packet.Message, sent time.Duration, dropped string) {
+	if tr == nil || tr.closed || tr.err != nil {
+		return
+	}
+
+	encoded, err := msg.Marshal()
+	if err != nil {
+		tr.err = err
+		return
+	}
+
+	tr.encode(traceRecord{
+		Sent:    eventlog.Micros(sent),
+		At:      eventlog.Micros(tr.now()),
+		Dropped: dropped,
+		Src:     msg.Src,
+		Dest:    msg.Dest,
+		Type:    msg.DemuxKey.String(),
+		Msg:     encoded,
+	})
+}
+
+// encode writes v, unless writing has already failed. The caller must hold
+// tr.lock (unless no other goroutine can use tr yet).
+func (tr *tracer) encode(v interface{}) {
+	if tr.err == nil {
+		tr.err = tr.enc.Encode(v)
+	}
+}
+
+// close flushes the trace (up to any error), and returns the first error
+// writing it, if any.
+// Messages handled after the trace is closed (by links which are still
+// running) are not recorded.
+func (tr *tracer) close() error {
+	if tr == nil {
+		return nil
+	}
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	if !tr.closed {
+		if err := tr.w.Flush(); tr.err == nil {
+			tr.err = err
+		}
+	}
+	tr.closed = true
+
+	return tr.err
+}
+
+// A traceEntry is a traceRecord with its message decoded.
+type traceEntry struct {
+	traceRecord
+	msg packet.Message
+}
+
+// loadTrace reads a trace of a simulation of numNodes nodes from a file.
+func loadTrace(path string, numNodes int) ([]traceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	var h traceHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, err
+	}
+	if h.Version != traceVersion {
+		return nil, fmt.Errorf("Unsupported trace version %v", h.Version)
+	}
+	if h.Nodes != numNodes {
+		return nil, fmt.Errorf("Trace is of %v nodes, not %v", h.Nodes, numNodes)
+	}
+
+	var entries []traceEntry
+	for {
+		var e traceEntry
+		if err := dec.Decode(&e.traceRecord); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		e.msg, err = packet.Unmarshal(e.Msg)
+		if err != nil {
+			return nil, fmt.Errorf("Record %v: %v", len(entries), err)
+		}
+		if e.msg.Dest < 0 || e.msg.Dest > numNodes {
+			return nil, fmt.Errorf("Record %v: %v", len(entries), errors.New("No such node"))
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// replayTrace delivers every message which was delivered to a node in a trace
+// to the same node, in the same order, and at the same time (measured from
+// when replayTrace is called). Messages sent by the nodes are not delivered;
+// instead, once the nodes have had time (settle) to respond to the last
+// messages, the responses sent to the client are compared with those in the
+// trace (see compareResponses), and the result is logged.
+func replayTrace(entries []traceEntry, nodes []*dbnode.Dbnode, settle time.Duration, l *eventlog.Log, clk clock.Clock) {
+	numNodes := len(nodes) - 1
+	start := clk.Now()
+
+	var lock sync.Mutex
+	var responses []packet.Message
+
+	for i := 0; i < numNodes; i++ {
+		outgoing := nodes[i].Outgoing
+		clk.Go(func() {
+			for {
+				msg := outgoing.Recv()
+				if msg.Dest == numNodes {
+					lock.Lock()
+					responses = append(responses, msg)
+					lock.Unlock()
+				}
+			}
+		})
+	}
+
+	delivered := 0
+	var recorded []packet.Message
+
+	for _, e := range entries {
+		if e.msg.Dest == numNodes {
+			recorded = append(recorded, e.msg)
+			continue
+		}
+		if e.Dropped != "" {
+			continue
+		}
+
+		if wait := time.Duration(e.At)*time.Microsecond - clk.Since(start); wait > 0 {
+			clk.Sleep(wait)
+		}
+
+		nodes[e.msg.Dest].Incoming.Send(e.msg)
+		delivered++
+	}
+
+	clk.Sleep(settle)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	diverged := compareResponses(recorded, responses)
+
+	l.Emit(eventlog.Replayed(delivered, len(diverged)))
+	for _, d := range diverged {
+		l.Emit(eventlog.Diverged(d.msg.Src, d.msg.Id, d.msg.DemuxKey.String(), d.msg.Key, d.msg.Value, d.msg.Timestamp, d.result))
+	}
+}
+
+// A divergence is a response in a replay which differs from the trace.
+type divergence struct {
+	msg    packet.Message
+	result string // missing (from the replay), extra, or different
+}
+
+// compareResponses compares the responses sent to the client in a trace with
+// those sent when the trace was replayed, and returns those which differ, in
+// order of source and transaction ID. Each response is identified by its
+// source, transaction ID and type. Duplicates are ignored.
+func compareResponses(recorded, replayed []packet.Message) []divergence {
+	type id struct {
+		src, txid int
+		msgType   packet.Messagetype
+	}
+
+	index := func(msgs []packet.Message) map[id]packet.Message {
+		byId := make(map[id]packet.Message)
+		for _, msg := range msgs {
+			byId[id{msg.Src, msg.Id, msg.DemuxKey}] = msg
+		}
+		return byId
+	}
+
+	before := index(recorded)
+	after := index(replayed)
+
+	var diverged []divergence
+	for k, msg := range before {
+		other, ok := after[k]
+		if !ok {
+			diverged = append(diverged, divergence{msg, "missing"})
+		} else if !packet.MessagesEqual(msg, other) || msg.Ok != other.Ok || msg.Timestamp != other.Timestamp || msg.Tombstone != other.Tombstone {
+			diverged = append(diverged, divergence{other, "different"})
+		}
+	}
+	for k, msg := range after {
+		if _, ok := before[k]; !ok {
+			diverged = append(diverged, divergence{msg, "extra"})
+		}
+	}
+
+	sort.Slice(diverged, func(i, j int) bool {
+		a, b := diverged[i].msg, diverged[j].msg
+		return a.Src < b.Src || a.Src == b.Src && (a.Id < b.Id || a.Id == b.Id && a.DemuxKey < b.DemuxKey)
+	})
+
+	return diverged
+}
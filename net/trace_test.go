@@ -0,0 +1,183 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/dbnode"
+	"github.com/alexbostock/part-ii-project/dbnode/elector"
+	"github.com/alexbostock/part-ii-project/eventlog"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+func TestLoadTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	f, _ := os.Create(path)
+
+	clk := clock.NewReal()
+	node := &dbnode.Dbnode{
+		Incoming: clock.NewChan[packet.Message](clk, 1),
+	}
+
+	tr := newTracer(f, 2, clk)
+
+	msg := packet.Message{Id: 7, Src: 2, Dest: 0, DemuxKey: packet.ClientReadRequest, Key: []byte{1}, Ok: true}
+	if !tr.deliver(msg, node.Incoming, 0) {
+		t.Error("Message not delivered.")
+	}
+	if tr.deliver(msg, node.Incoming, 0) {
+		t.Error("Message delivered to a full buffer.")
+	}
+	node.Incoming.Recv()
+
+	tr.drop(msg, 0, "partition")
+	tr.sendControl(node, 0, packet.ControlFail)
+
+	if err := tr.close(); err != nil {
+		t.Fatal("Failed to write trace.", err)
+	}
+	f.Close()
+
+	entries, err := loadTrace(path, 2)
+	if err != nil {
+		t.Fatal("Failed to load trace.", err)
+	}
+	if len(entries) != 4 {
+		t.Fatal("Expected a record of every delivery and drop.", entries)
+	}
+
+	dropped := []string{"", "full", "partition", ""}
+	for i, e := range entries {
+		if e.Dropped != dropped[i] {
+			t.Error("Incorrect drop decision.", i, e.Dropped)
+		}
+	}
+
+	if !packet.MessagesEqual(entries[0].msg, msg) || !entries[0].msg.Ok || entries[0].Type != "clientReadRequest" {
+		t.Error("Message not recorded correctly.", entries[0])
+	}
+	if entries[3].msg.DemuxKey != packet.ControlFail || entries[3].Dest != 0 {
+		t.Error("Control message not recorded correctly.", entries[3])
+	}
+
+	if _, err := loadTrace(path, 3); err == nil {
+		t.Error("A trace should only be replayed with the same number of nodes.")
+	}
+}
+
+// A failingWriter fails every write.
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+func TestTraceErrors(t *testing.T) {
+	clk := clock.NewReal()
+	node := &dbnode.Dbnode{
+		Incoming: clock.NewChan[packet.Message](clk, 2),
+	}
+
+	tr := newTracer(failingWriter{}, 2, clk)
+	tr.deliver(packet.Message{DemuxKey: packet.ClientReadRequest}, node.Incoming, 0)
+	if err := tr.close(); err != errWrite {
+		t.Error("Closing a trace should return the error writing it.", err)
+	}
+
+	var buf bytes.Buffer
+	tr = newTracer(&buf, 2, clk)
+	if !tr.deliver(packet.Message{DemuxKey: math.MaxUint32 + 1}, node.Incoming, 0) {
+		t.Error("A message should be delivered even if it cannot be recorded.")
+	}
+	tr.deliver(packet.Message{DemuxKey: packet.ClientReadRequest}, node.Incoming, 0)
+	if err := tr.close(); err != packet.ErrDemuxKey {
+		t.Error("Closing a trace should return the error recording a message.", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 {
+		t.Error("The trace should stop recording after an error.", buf.String())
+	}
+}
+
+func TestCompareResponses(t *testing.T) {
+	recorded := []packet.Message{
+		{Id: 1, Src: 0, DemuxKey: packet.ClientReadResponse, Value: []byte{1}, Ok: true},
+		{Id: 1, Src: 0, DemuxKey: packet.ClientReadResponse, Value: []byte{1}, Ok: true},
+		{Id: 2, Src: 1, DemuxKey: packet.ClientWriteResponse, Ok: true},
+		{Id: 3, Src: 1, DemuxKey: packet.ClientWriteResponse, Ok: true},
+	}
+	replayed := []packet.Message{
+		{Id: 1, Src: 0, DemuxKey: packet.ClientReadResponse, Value: []byte{1}, Ok: true},
+		{Id: 2, Src: 1, DemuxKey: packet.ClientWriteResponse, Ok: false},
+		{Id: 4, Src: 1, DemuxKey: packet.ClientWriteResponse, Ok: true},
+	}
+
+	diverged := compareResponses(recorded, replayed)
+
+	expected := []divergence{{replayed[1], "different"}, {recorded[3], "missing"}, {replayed[2], "extra"}}
+	if len(diverged) != len(expected) {
+		t.Fatal("Incorrect divergences.", diverged)
+	}
+	for i, d := range diverged {
+		if d.msg.Id != expected[i].msg.Id || d.result != expected[i].result {
+			t.Error("Incorrect divergence.", d, expected[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	numNodes := 3
+	quorumSize := uint(numNodes/2 + 1)
+	timeout := 500 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	f, _ := os.Create(path)
+
+	clk := clock.NewVirtual()
+	nodes := newNodes(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Elector: elector.Bully}, clk)
+	tr := newTracer(f, numNodes, clk)
+
+	p := newPartitions(numNodes)
+	model := newLatencyModel(Normal, newLatency(10, 5), nil)
+	for i := 0; i <= numNodes; i++ {
+		outgoing, seed := nodes[i].Outgoing, int64(i)
+		clk.Go(func() {
+			startLink(outgoing, nodes, model, nil, tr, p, clk, seed)
+		})
+	}
+
+	client := NewClient(nodes, timeout, 3, clk)
+	for i := byte(0); i < 5; i++ {
+		client.Put([]byte{i}, []byte{i})
+		client.Get([]byte{i})
+	}
+
+	if err := tr.close(); err != nil {
+		t.Fatal("Failed to write trace.", err)
+	}
+	f.Close()
+	clk.Stop()
+
+	entries, err := loadTrace(path, numNodes)
+	if err != nil {
+		t.Fatal("Failed to load trace.", err)
+	}
+
+	var buf bytes.Buffer
+	clk = clock.NewVirtual()
+	defer clk.Stop()
+	nodes = newNodes(numNodes, timeout, quorumSize, quorumSize, dbnode.Options{Elector: elector.Bully}, clk)
+	replayTrace(entries, nodes, 20*timeout, eventlog.New(eventlog.NewSink(eventlog.Text, &buf), clk), clk)
+
+	if !strings.Contains(buf.String(), "with the same responses") {
+		t.Error("Replaying a trace on a virtual clock should give the same responses.", buf.String())
+	}
+}
@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// Frame format: frame_length(4, big endian) message
+// message is a packet.Message encoded with Marshal, and frame_length is its
+// length in bytes.
+
+// maxFrameSize bounds the memory a single (possibly corrupt) frame can make a
+// reader allocate.
+const maxFrameSize = 64 << 20
+
+var errFrameTooLong = errors.New("Frame too long")
+
+// encodeMessage serialises msg as a complete frame, including its length
+// prefix. It returns an error if msg cannot be encoded, or is too long for a
+// reader to accept.
+func encodeMessage(msg packet.Message) ([]byte, error) {
+	encoded, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > maxFrameSize {
+		return nil, errFrameTooLong
+	}
+
+	frame := make([]byte, 4+len(encoded))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(encoded)))
+	copy(frame[4:], encoded)
+
+	return frame, nil
+}
+
+// readFrame reads a single frame from r and decodes it. It returns io.EOF only
+// if r ends before the frame starts.
+func readFrame(r io.Reader) (packet.Message, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return packet.Message{}, err
+	}
+
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n > maxFrameSize {
+		return packet.Message{}, errFrameTooLong
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			// The frame was cut off after its length
+			err = io.ErrUnexpectedEOF
+		}
+		return packet.Message{}, err
+	}
+
+	return packet.Unmarshal(body)
+}
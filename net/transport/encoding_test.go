@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	msgs := []packet.Message{
+		{},
+		{Id: 3, Src: 1, Dest: 0, DemuxKey: packet.ClientWriteRequest, Key: []byte{1}, Value: []byte{2, 3}, Timestamp: 4, Ok: true},
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		frame, err := encodeMessage(msg)
+		if err != nil {
+			t.Fatal("Failed to encode message.", msg, err)
+		}
+		buf.Write(frame)
+	}
+
+	for _, msg := range msgs {
+		decoded, err := readFrame(&buf)
+		if err != nil || !packet.MessagesEqual(decoded, msg) {
+			t.Error("Frame did not round trip.", msg, decoded, err)
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Error("Reading past the last frame should return EOF.", err)
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	frame, err := encodeMessage(packet.Message{Id: 1, DemuxKey: packet.ClientReadRequest, Key: []byte{1, 2, 3}})
+	if err != nil {
+		t.Fatal("Failed to encode message.", err)
+	}
+
+	for _, n := range []int{2, 4, len(frame) - 1} {
+		if _, err := readFrame(bytes.NewReader(frame[:n])); err != io.ErrUnexpectedEOF {
+			t.Error("A truncated frame should not be decoded.", n, err)
+		}
+	}
+}
+
+func TestOversizedFrame(t *testing.T) {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], maxFrameSize+1)
+
+	// The body is never read, so it need not be there
+	if _, err := readFrame(bytes.NewReader(prefix[:])); err != errFrameTooLong {
+		t.Error("A frame longer than the maximum should be rejected.", err)
+	}
+
+	if _, err := encodeMessage(packet.Message{DemuxKey: math.MaxUint32 + 1}); err != packet.ErrDemuxKey {
+		t.Error("A message which cannot be marshalled should not be encoded.", err)
+	}
+}
@@ -0,0 +1,346 @@
+// Package transport carries packet.Message values between processes over TCP,
+// so that database nodes can run as separate processes rather than in the
+// simulated network.
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+// An Endpoint connects one network address (a pair of Incoming and Outgoing
+// channels, as used by dbnode.Dbnode) to every other address over TCP. Every
+// message sent on outgoing is delivered to the endpoint for msg.Dest, and every
+// message received is sent on incoming. Like the simulated network, delivery is
+// best effort: messages which cannot be sent (or which arrive when incoming is
+// full) are silently dropped. Messages to each address are sent in order by a
+// goroutine of their own, so an unreachable address only delays messages to
+// itself.
+//
+// Addresses 0 to len(addrs)-1 are database nodes, which listen on addrs[id].
+// Any higher address is a client, which does not listen: nodes reply to a
+// client over the most recent connection the client opened to them. Since
+// requests may be forwarded between nodes (eg. to the leader), a client
+// connects to every node as soon as it is created. Every
+// connection starts with the dialler's address (8 bytes, big endian) so that
+// the listener knows who is on the other end.
+//
+// Since an Endpoint's goroutines block on the network, incoming and outgoing
+// must be owned by a real clock (see clock.NewReal).
+//
+// An Endpoint should be instantiated using Listen or Dial.
+type Endpoint struct {
+	id       int
+	addrs    []string
+	incoming *clock.Chan[packet.Message]
+	outgoing *clock.Chan[packet.Message]
+
+	listener net.Listener
+
+	lock     sync.Mutex
+	conns    map[int]net.Conn
+	accepted map[net.Conn]bool
+	closed   bool
+}
+
+// dialTimeout and writeTimeout bound how long an unreachable peer stalls the
+// messages queued for it.
+const dialTimeout = time.Second
+const writeTimeout = time.Second
+
+// peerQueueSize is the number of messages to each peer which may wait to be
+// sent, beyond which further messages to that peer are dropped.
+const peerQueueSize = 100
+
+// After failing to dial a node, messages to it are dropped for minRedial,
+// doubling with each consecutive failure up to maxRedial, rather than dialling
+// again for every message.
+const minRedial = 100 * time.Millisecond
+const maxRedial = 5 * time.Second
+
+// Listen creates an Endpoint for the database node with the given id, which
+// accepts connections on addrs[id]. It returns an error if it cannot listen on
+// that address.
+func Listen(id int, addrs []string, incoming, outgoing *clock.Chan[packet.Message]) (*Endpoint, error) {
+	listener, err := net.Listen("tcp", addrs[id])
+	if err != nil {
+		return nil, err
+	}
+
+	e := newEndpoint(id, addrs, incoming, outgoing)
+	e.listener = listener
+
+	go e.acceptConnections()
+	go e.sendMessages()
+
+	return e, nil
+}
+
+// Dial creates an Endpoint for a client with the given id (which must be at
+// least len(addrs)), and starts connecting to every node. Connections which
+// fail are retried when a message is next sent to that node (see minRedial).
+func Dial(id int, addrs []string, incoming, outgoing *clock.Chan[packet.Message]) *Endpoint {
+	e := newEndpoint(id, addrs, incoming, outgoing)
+
+	go e.sendMessages()
+
+	return e
+}
+
+func newEndpoint(id int, addrs []string, incoming, outgoing *clock.Chan[packet.Message]) *Endpoint {
+	return &Endpoint{
+		id:       id,
+		addrs:    addrs,
+		incoming: incoming,
+		outgoing: outgoing,
+		conns:    make(map[int]net.Conn),
+		accepted: make(map[net.Conn]bool),
+	}
+}
+
+// Close stops accepting connections and closes every open connection, so
+// that peers notice and reconnect if the endpoint is restarted. Messages
+// subsequently sent on outgoing are dropped.
+func (e *Endpoint) Close() {
+	if e.listener != nil {
+		e.listener.Close()
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.closed = true
+
+	for id, conn := range e.conns {
+		conn.Close()
+		delete(e.conns, id)
+	}
+	for conn := range e.accepted {
+		conn.Close()
+		delete(e.accepted, conn)
+	}
+}
+
+func (e *Endpoint) acceptConnections() {
+	for {
+		conn, err := e.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go e.handleConnection(conn)
+	}
+}
+
+// handleConnection reads the dialler's address from a newly accepted
+// connection, then receives messages from it. Connections from clients are
+// remembered so that replies can be sent back on them.
+func (e *Endpoint) handleConnection(conn net.Conn) {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		conn.Close()
+		return
+	}
+	e.accepted[conn] = true
+	e.lock.Unlock()
+
+	var preamble [8]byte
+	if _, err := io.ReadFull(conn, preamble[:]); err != nil {
+		conn.Close()
+		e.forget(conn)
+		return
+	}
+
+	peer := int(int64(binary.BigEndian.Uint64(preamble[:])))
+	if peer >= len(e.addrs) {
+		e.lock.Lock()
+		if old := e.conns[peer]; old != nil {
+			old.Close()
+		}
+		e.conns[peer] = conn
+		e.lock.Unlock()
+	}
+
+	e.receiveMessages(conn)
+}
+
+// receiveMessages reads messages from conn until it is closed.
+func (e *Endpoint) receiveMessages(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		msg, err := readFrame(conn)
+		if err != nil {
+			e.forget(conn)
+			return
+		}
+
+		e.deliver(msg)
+	}
+}
+
+// sendMessages passes each outgoing message to the queue of its destination,
+// starting a goroutine to send the messages in each queue (see sendTo) when the
+// first message to that destination is sent. A client starts one for every
+// node immediately, since it connects to every node as soon as it is created.
+func (e *Endpoint) sendMessages() {
+	queues := make(map[int]chan packet.Message)
+	start := func(dest int) chan packet.Message {
+		queue := make(chan packet.Message, peerQueueSize)
+		queues[dest] = queue
+		go e.sendTo(dest, queue)
+		return queue
+	}
+
+	if e.id >= len(e.addrs) {
+		for dest := range e.addrs {
+			start(dest)
+		}
+	}
+
+	for {
+		msg := e.outgoing.Recv()
+		if msg.Dest == e.id {
+			e.deliver(msg)
+			continue
+		}
+
+		queue := queues[msg.Dest]
+		if queue == nil {
+			queue = start(msg.Dest)
+		}
+
+		select {
+		case queue <- msg:
+			// If the queue is not full, send the message
+		default:
+			// Else, the peer is not keeping up, so discard the message
+		}
+	}
+}
+
+// sendTo sends the messages in queue to dest, dropping any which cannot be
+// sent. After failing to dial dest, it drops messages without dialling again
+// until a backoff has passed. Only sendTo dials dest, so that a client never
+// opens two connections to a node at once (the node only replies on the most
+// recent).
+func (e *Endpoint) sendTo(dest int, queue chan packet.Message) {
+	backoff := minRedial
+	var redialAt time.Time
+
+	if e.id >= len(e.addrs) && dest < len(e.addrs) {
+		e.connection(dest)
+	}
+
+	for msg := range queue {
+		if time.Now().Before(redialAt) {
+			continue
+		}
+
+		frame, err := encodeMessage(msg)
+		if err != nil {
+			log.Println("Cannot send message", msg, err)
+			continue
+		}
+
+		conn := e.connection(dest)
+		if conn == nil {
+			// Clients are never dialled, so there is nothing to back
+			// off from
+			if dest < len(e.addrs) {
+				redialAt = time.Now().Add(backoff)
+				if backoff *= 2; backoff > maxRedial {
+					backoff = maxRedial
+				}
+			}
+			continue
+		}
+		backoff = minRedial
+
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(frame); err != nil {
+			conn.Close()
+			e.forget(conn)
+		}
+	}
+}
+
+// deliver delivers msg if the incoming buffer is not full, and otherwise
+// discards it.
+func (e *Endpoint) deliver(msg packet.Message) {
+	e.incoming.TrySend(msg)
+}
+
+// connection returns an open connection to dest, dialling a node if necessary.
+// It returns nil if dest cannot be reached.
+func (e *Endpoint) connection(dest int) net.Conn {
+	e.lock.Lock()
+	conn := e.conns[dest]
+	e.lock.Unlock()
+
+	if conn != nil {
+		return conn
+	}
+
+	if dest >= len(e.addrs) {
+		// A client which is not (or no longer) connected
+		return nil
+	}
+	if dest < 0 {
+		log.Printf("Misaddressed message from %d to %d", e.id, dest)
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", e.addrs[dest], dialTimeout)
+	if err != nil {
+		return nil
+	}
+
+	var preamble [8]byte
+	binary.BigEndian.PutUint64(preamble[:], uint64(int64(e.id)))
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write(preamble[:]); err != nil {
+		conn.Close()
+		return nil
+	}
+
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		conn.Close()
+		return nil
+	}
+	if existing := e.conns[dest]; existing != nil {
+		e.lock.Unlock()
+		conn.Close()
+		return existing
+	}
+	e.conns[dest] = conn
+	e.lock.Unlock()
+
+	// Clients receive replies on the connections they open.
+	go e.receiveMessages(conn)
+
+	return conn
+}
+
+// forget removes conn from the set of open connections, if present.
+func (e *Endpoint) forget(conn net.Conn) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	delete(e.accepted, conn)
+	for id, c := range e.conns {
+		if c == conn {
+			delete(e.conns, id)
+		}
+	}
+}
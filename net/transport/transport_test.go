@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alexbostock/part-ii-project/clock"
+	"github.com/alexbostock/part-ii-project/net/packet"
+)
+
+var clk = clock.NewReal()
+
+// freeAddr returns a local address which nothing is listening on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen.", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// listen starts an Endpoint for node id, with new channels.
+func listen(t *testing.T, id int, addrs []string) (*Endpoint, *clock.Chan[packet.Message], *clock.Chan[packet.Message]) {
+	incoming := clock.NewChan[packet.Message](clk, 10)
+	outgoing := clock.NewChan[packet.Message](clk, 10)
+
+	e, err := Listen(id, addrs, incoming, outgoing)
+	if err != nil {
+		t.Fatal("Failed to listen.", id, err)
+	}
+
+	return e, incoming, outgoing
+}
+
+func TestSendAndReply(t *testing.T) {
+	addrs := []string{freeAddr(t)}
+	node, nodeIn, nodeOut := listen(t, 0, addrs)
+	defer node.Close()
+
+	clientIn := clock.NewChan[packet.Message](clk, 10)
+	clientOut := clock.NewChan[packet.Message](clk, 10)
+	client := Dial(1, addrs, clientIn, clientOut)
+	defer client.Close()
+
+	req := packet.Message{Id: 1, Src: 1, Dest: 0, DemuxKey: packet.ClientReadRequest, Key: []byte{1}}
+	clientOut.Send(req)
+
+	var msg packet.Message
+	if clock.Select(nodeIn.RecvCase(&msg, nil), clk.After(5*time.Second).RecvCase(nil, nil)) != 0 {
+		t.Fatal("Request not delivered.")
+	}
+	if !packet.MessagesEqual(msg, req) {
+		t.Error("Request changed in transit.", msg)
+	}
+
+	// The node replies over the connection the client opened
+	res := packet.Message{Id: 1, Src: 0, Dest: 1, DemuxKey: packet.ClientReadResponse, Value: []byte{2}, Ok: true}
+	nodeOut.Send(res)
+
+	if clock.Select(clientIn.RecvCase(&msg, nil), clk.After(5*time.Second).RecvCase(nil, nil)) != 0 {
+		t.Fatal("Response not delivered.")
+	}
+	if !packet.MessagesEqual(msg, res) {
+		t.Error("Response changed in transit.", msg)
+	}
+}
+
+// A node which restarts is reconnected to once its peers notice that the old
+// connection has closed.
+func TestReconnect(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+
+	sender, _, senderOut := listen(t, 1, addrs)
+	defer sender.Close()
+
+	receiver, receiverIn, _ := listen(t, 0, addrs)
+
+	msg := packet.Message{Id: 1, Src: 1, Dest: 0, DemuxKey: packet.NodePutRequest, Key: []byte{1}}
+	if !sendUntilDelivered(msg, senderOut, receiverIn) {
+		t.Fatal("Message not delivered.")
+	}
+
+	receiver.Close()
+	receiver, receiverIn, _ = listen(t, 0, addrs)
+	defer receiver.Close()
+
+	msg.Id = 2
+	if !sendUntilDelivered(msg, senderOut, receiverIn) {
+		t.Fatal("Message not delivered after the receiver restarted.")
+	}
+}
+
+// sendUntilDelivered sends msg on outgoing every 50ms until it arrives on
+// incoming, and returns whether it arrived within 10s. Messages sent before a
+// connection is (re)established may be dropped.
+func sendUntilDelivered(msg packet.Message, outgoing, incoming *clock.Chan[packet.Message]) bool {
+	deadline := clk.After(10 * time.Second)
+	for {
+		outgoing.Send(msg)
+
+		var received packet.Message
+		switch clock.Select(incoming.RecvCase(&received, nil), clk.After(50*time.Millisecond).RecvCase(nil, nil), deadline.RecvCase(nil, nil)) {
+		case 0:
+			if packet.MessagesEqual(received, msg) {
+				return true
+			}
+		case 2:
+			return false
+		}
+	}
+}
+
+// After failing to dial a node, messages to it are dropped until minRedial has
+// passed, without dialling it again.
+func TestSendBackoff(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+
+	sender, _, senderOut := listen(t, 1, addrs)
+	defer sender.Close()
+
+	// Nothing is listening yet, so the first dial fails
+	first := packet.Message{Id: 1, Src: 1, Dest: 0, DemuxKey: packet.NodePutRequest}
+	failedAt := time.Now()
+	senderOut.Send(first)
+	time.Sleep(minRedial / 5)
+
+	l, err := net.Listen("tcp", addrs[0])
+	if err != nil {
+		t.Fatal("Failed to listen.", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	dropped := first
+	dropped.Id = 2
+	senderOut.Send(dropped)
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		if time.Since(failedAt) < minRedial {
+			t.Fatal("A node should not be dialled again before the backoff has passed.")
+		}
+		t.Skip("Too slow to check the backoff.")
+	case <-time.After(minRedial / 5):
+	}
+
+	// The backoff starts when the dial fails, a little after failedAt, so
+	// keep sending until the node is dialled again
+	time.Sleep(minRedial - time.Since(failedAt))
+	sent := first
+	sent.Id = 3
+
+	var conn net.Conn
+	deadline := time.After(5 * time.Second)
+	for conn == nil {
+		senderOut.Send(sent)
+		select {
+		case conn = <-accepted:
+		case <-time.After(minRedial / 5):
+		case <-deadline:
+			t.Fatal("The node should be dialled again after the backoff.")
+		}
+	}
+	defer conn.Close()
+
+	var preamble [8]byte
+	if _, err := io.ReadFull(conn, preamble[:]); err != nil || binary.BigEndian.Uint64(preamble[:]) != 1 {
+		t.Fatal("Incorrect preamble.", preamble, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := readFrame(conn)
+	if err != nil || msg.Id != sent.Id {
+		t.Error("Messages sent during the backoff should be dropped.", msg, err)
+	}
+}
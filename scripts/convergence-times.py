@@ -2,18 +2,13 @@ import re
 import sys
 
 def calculate_latency(start, end):
-    s = start.split(':')
-    s = 3600*int(s[0]) + 60*int(s[1]) + float(s[2])
-
-    e = end.split(':')
-    e = 3600*int(e[0]) + 60*int(e[1]) + float(e[2])
-
-    return e - s
+    # Times are in microseconds
+    return (int(end) - int(start)) / 1000000
 
 filepath_pattern = re.compile('convergence/(?P<rate>[0-9]+)/(?P<n>[0-9]+)-(?P<r>[0-9]+)-(?P<w>[0-9]+)-[0-9]+\.txt')
 
-write_commit_pattern = re.compile('(?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2}\.[0-9]{6}) (?P<id>[0-9]+) write commit (?P<key>\[.+\]) (?P<ts>[0-9]+)')
-background_write_pattern = re.compile('(?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2}\.[0-9]{6}) (?P<id>[0-9]+) background write (?P<key>\[.+\]) (?P<ts>[0-9]+)')
+write_commit_pattern = re.compile('(?P<time>[0-9]+) (?P<id>[0-9]+) write commit (?P<key>\[.+\]) (?P<ts>[0-9]+)')
+background_write_pattern = re.compile('(?P<time>[0-9]+) (?P<id>[0-9]+) background write (?P<key>\[.+\]) (?P<ts>[0-9]+)')
 
 filepath = sys.argv[1]
 
@@ -24,7 +19,7 @@ num_background_writes_required = (n - r + 1) - w
 
 background_writes_done = {} # key -> node set
 timestamp = {} # key -> Lamport timestamp
-start_time = {} # key -> UTC timestamp
+start_time = {} # key -> time of the write commit
 
 for line in open(filepath, 'r'):
     m = write_commit_pattern.match(line)
@@ -1,7 +1,9 @@
 #!/usr/bin/env python3
-# A script to parse transaction logs from stdin
+# A script to parse transaction logs from stdin, in either event format
 # eg. go run main.go | python3 parseOutput.py
+# or go run main.go -eventformat json | python3 parseOutput.py
 
+import base64
 import json
 
 import re
@@ -68,6 +70,10 @@ class Transaction:
         return m.group('val')
 
     def __init__(self, line):
+        if isinstance(line, dict):
+            self.from_event(line)
+            return
+
         self.line = line
 
         self.start_time = int(self.parse(int_pattern))
@@ -80,6 +86,25 @@ class Transaction:
 
         self.time_taken = self.end_time - self.start_time
 
+    # A txn_end event from a JSON event log
+    def from_event(self, e):
+        def decode(field):
+            res = 0
+            for byte in base64.b64decode(e.get(field, '')):
+                res *= 256
+                res += byte
+            return res
+
+        self.start_time = e.get('start', 0)
+        self.end_time = e['time']
+        self.type = request_type(e['op'])
+        self.key = decode('key')
+        self.value = decode('value')
+        self.timestamp = str(e.get('timestamp', 0))
+        self.ok = res_type(e['result'])
+
+        self.time_taken = self.end_time - self.start_time
+
     def print(self):
         print(self.start_time, self.end_time, self.type, self.key, self.value, self.timestamp)
 
@@ -107,13 +132,17 @@ for line in sys.stdin:
 
     m = json_pattern.match(line)
 
-    if m == None:
-        m = two_ints_pattern.match(line)
-        if m == None:
-            continue
-
+    t = None
+    if m != None:
+        event = json.loads(line)
+        if event.get('type') == 'txn_end':
+            t = Transaction(event)
+        elif 'type' not in event:
+            jsons.append(line)
+    elif two_ints_pattern.match(line) != None:
         t = Transaction(line)
 
+    if t != None:
         if t.key not in transactions:
             transactions[t.key] = set()
         transactions[t.key].add(t)
@@ -137,9 +166,6 @@ for line in sys.stdin:
             elif t.ok == FAILURE:
                 failed_writes += 1
 
-    else:
-        jsons.append(line)
-
 def div(x, y):
     if x == y == 0:
         return 0